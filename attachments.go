@@ -0,0 +1,60 @@
+package rpc2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+type (
+	outgoingAttachmentsKey struct{}
+	incomingAttachmentsKey struct{}
+)
+
+// WithAttachments returns a copy of ctx adding attachments to calls made with
+// it by CallWithContext. Attachments are binary blobs sent along with the
+// args, which refer to them by index, e.g. a JSON description of an image
+// with the image itself attached:
+//
+//	ctx := rpc2.WithAttachments(ctx, jpeg)
+//	err := client.CallWithContext(ctx, "upload", Upload{Name: "cat.jpg", Image: 0}, &id)
+//
+// Handlers get them with Attachments or OpenAttachment. The gob codec sends
+// them as they are; the jsonrpc codec sends them as base64 strings.
+// Codecs that can not carry attachments ignore them.
+// Attachments added earlier are replaced. They must not be modified until
+// the call returns.
+func WithAttachments(ctx context.Context, attachments ...[]byte) context.Context {
+	return context.WithValue(ctx, outgoingAttachmentsKey{}, attachments)
+}
+
+func outgoingAttachments(ctx context.Context) [][]byte {
+	a, _ := ctx.Value(outgoingAttachmentsKey{}).([][]byte)
+	return a
+}
+
+// Attachments returns the attachments of the call being handled with ctx,
+// the context given to the handler. They must not be modified.
+func Attachments(ctx context.Context) [][]byte {
+	a, _ := ctx.Value(incomingAttachmentsKey{}).([][]byte)
+	return a
+}
+
+// OpenAttachment returns a reader of the attachment with index i of the call
+// being handled with ctx, or an error if the call has no such attachment.
+func OpenAttachment(ctx context.Context, i int) (io.Reader, error) {
+	a := Attachments(ctx)
+	if i < 0 || i >= len(a) {
+		return nil, &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("rpc2: no attachment %d", i)}
+	}
+	return bytes.NewReader(a[i]), nil
+}
+
+// attachmentContext returns parent with the attachments of req.
+func attachmentContext(parent context.Context, req *Request) context.Context {
+	if len(req.Attachments) == 0 {
+		return parent
+	}
+	return context.WithValue(parent, incomingAttachmentsKey{}, req.Attachments)
+}
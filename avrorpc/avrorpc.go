@@ -0,0 +1,280 @@
+// Package avrorpc implements an Avro codec for the rpc2 package.
+//
+// Every message is a header followed by a body, both prefixed with their
+// length as a 4-byte big-endian integer. Headers are encoded with a fixed
+// schema. Bodies use the Confluent wire format: a zero magic byte, the 4-byte
+// big-endian ID of the writer schema in a schema registry and the Avro binary
+// encoding of the value. Readers resolve writer schemas from the registry by ID,
+// so peers only need to share a registry, not compiled-in schemas.
+//
+// Writers need to know which registered schema to use for each method:
+//
+//	reg, _ := registry.NewClient("http://registry:8081")
+//	codec := avrorpc.NewAvroCodec(conn, reg, avrorpc.Methods{
+//		"add": {Args: 1, Reply: 2},
+//	})
+package avrorpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/hamba/avro/v2"
+)
+
+// Registry resolves schemas by their IDs.
+// *registry.Client from github.com/hamba/avro/v2/registry implements it.
+type Registry interface {
+	GetSchema(ctx context.Context, id int) (avro.Schema, error)
+}
+
+// Method holds the registry IDs of the schemas used when writing
+// the args and reply of a method.
+type Method struct {
+	Args  int
+	Reply int
+}
+
+// Methods maps method names to their schemas.
+type Methods map[string]Method
+
+// maxFrameSize limits the size of a single header or body.
+const maxFrameSize = 64 << 20
+
+const magicByte = 0
+
+var headerSchema = avro.MustParse(`{
+	"type": "record",
+	"name": "Header",
+	"namespace": "rpc2",
+	"fields": [
+		{"name": "seq", "type": "long"},
+		{"name": "method", "type": "string"},
+		{"name": "error", "type": "string"},
+		{"name": "code", "type": "int"}
+	]
+}`)
+
+type header struct {
+	Seq    int64  `avro:"seq"`
+	Method string `avro:"method"`
+	Error  string `avro:"error"`
+	Code   int    `avro:"code"`
+}
+
+type avroCodec struct {
+	r        *bufio.Reader
+	w        *bufio.Writer
+	rwc      io.ReadWriteCloser
+	wmutex   sync.Mutex // protects w
+	registry Registry
+	methods  Methods
+
+	// temporary work space
+	body []byte
+
+	// Methods of incoming requests, by sequence number,
+	// to find the reply schema in WriteResponse.
+	mutex   sync.Mutex // protects pending, schemas
+	pending map[uint64]string
+	schemas map[int]avro.Schema // cache of registry lookups
+}
+
+// NewAvroCodec returns a new rpc2.Codec using Avro on conn.
+// Writer schemas of incoming messages are resolved from registry.
+// Schemas of outgoing messages are chosen from methods.
+func NewAvroCodec(conn io.ReadWriteCloser, registry Registry, methods Methods) rpc2.Codec {
+	return &avroCodec{
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		rwc:      conn,
+		registry: registry,
+		methods:  methods,
+		pending:  make(map[uint64]string),
+		schemas:  make(map[int]avro.Schema),
+	}
+}
+
+func (c *avroCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	b, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	var h header
+	if err = avro.Unmarshal(headerSchema, b, &h); err != nil {
+		return err
+	}
+	if c.body, err = c.readFrame(); err != nil {
+		return err
+	}
+
+	if h.Method != "" {
+		req.Seq = uint64(h.Seq)
+		req.Method = h.Method
+		if req.Seq != 0 {
+			c.mutex.Lock()
+			c.pending[req.Seq] = h.Method
+			c.mutex.Unlock()
+		}
+	} else {
+		resp.Seq = uint64(h.Seq)
+		resp.Error = h.Error
+		resp.Code = h.Code
+	}
+	return nil
+}
+
+func (c *avroCodec) readFrame() ([]byte, error) {
+	var size uint32
+	if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("avrorpc: frame too large: %d bytes", size)
+	}
+	b := make([]byte, size)
+	_, err := io.ReadFull(c.r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+func (c *avroCodec) ReadRequestBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+func (c *avroCodec) ReadResponseBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+var errMissingBody = errors.New("avrorpc: message has no body")
+
+func (c *avroCodec) readBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	if len(c.body) == 0 {
+		return errMissingBody
+	}
+	if len(c.body) < 5 || c.body[0] != magicByte {
+		return errors.New("avrorpc: invalid body")
+	}
+	schema, err := c.schema(int(binary.BigEndian.Uint32(c.body[1:5])))
+	if err != nil {
+		return err
+	}
+	return avro.Unmarshal(schema, c.body[5:], x)
+}
+
+// schema returns the schema with id, asking the registry if it is not cached.
+func (c *avroCodec) schema(id int) (avro.Schema, error) {
+	c.mutex.Lock()
+	schema, ok := c.schemas[id]
+	c.mutex.Unlock()
+	if ok {
+		return schema, nil
+	}
+	schema, err := c.registry.GetSchema(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.schemas[id] = schema
+	c.mutex.Unlock()
+	return schema, nil
+}
+
+func (c *avroCodec) WriteRequest(r *rpc2.Request, param interface{}) error {
+	m, ok := c.methods[r.Method]
+	if !ok {
+		return fmt.Errorf("avrorpc: no schema for method %s", r.Method)
+	}
+	body, err := c.encodeBody(m.Args, param)
+	if err != nil {
+		return err
+	}
+	return c.write(header{Seq: int64(r.Seq), Method: r.Method}, body)
+}
+
+func (c *avroCodec) WriteResponse(r *rpc2.Response, x interface{}) error {
+	c.mutex.Lock()
+	method, ok := c.pending[r.Seq]
+	if !ok {
+		c.mutex.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.mutex.Unlock()
+
+	h := header{Seq: int64(r.Seq), Error: r.Error, Code: r.Code}
+	if r.Error != "" {
+		// Error responses have no body.
+		return c.write(h, nil)
+	}
+	m, ok := c.methods[method]
+	if !ok {
+		h.Error = "avrorpc: no schema for reply of method " + method
+		c.write(h, nil)
+		return errors.New(h.Error)
+	}
+	body, err := c.encodeBody(m.Reply, x)
+	if err != nil {
+		return err
+	}
+	return c.write(h, body)
+}
+
+// encodeBody encodes x with the registered schema id in Confluent wire format.
+func (c *avroCodec) encodeBody(id int, x interface{}) ([]byte, error) {
+	schema, err := c.schema(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := avro.Marshal(schema, x)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 5, 5+len(b))
+	body[0] = magicByte
+	binary.BigEndian.PutUint32(body[1:5], uint32(id))
+	return append(body, b...), nil
+}
+
+func (c *avroCodec) write(h header, body []byte) error {
+	b, err := avro.Marshal(headerSchema, h)
+	if err != nil {
+		return err
+	}
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if err = c.writeFrame(b); err != nil {
+		return err
+	}
+	if err = c.writeFrame(body); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *avroCodec) writeFrame(b []byte) error {
+	if err := binary.Write(c.w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := c.w.Write(b)
+	return err
+}
+
+func (c *avroCodec) Conn() io.ReadWriteCloser {
+	return c.rwc
+}
+
+func (c *avroCodec) Close() error {
+	return c.rwc.Close()
+}
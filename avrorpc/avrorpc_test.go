@@ -0,0 +1,82 @@
+package avrorpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/hamba/avro/v2"
+)
+
+type memoryRegistry map[int]avro.Schema
+
+func (r memoryRegistry) GetSchema(ctx context.Context, id int) (avro.Schema, error) {
+	if s, ok := r[id]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("schema %d not found", id)
+}
+
+type Args struct {
+	A int `avro:"a"`
+	B int `avro:"b"`
+}
+
+type Reply struct {
+	Result int `avro:"result"`
+}
+
+func TestAvroRPC(t *testing.T) {
+	reg := memoryRegistry{
+		1: avro.MustParse(`{"type":"record","name":"Args","fields":[{"name":"a","type":"int"},{"name":"b","type":"int"}]}`),
+		2: avro.MustParse(`{"type":"record","name":"Reply","fields":[{"name":"result","type":"int"}]}`),
+		// Newer version of Args with an extra field, used by the client.
+		3: avro.MustParse(`{"type":"record","name":"Args","fields":[{"name":"a","type":"int"},{"name":"b","type":"int"},{"name":"c","type":"string","default":""}]}`),
+	}
+
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *Reply) error {
+		reply.Result = args.A + args.B
+		return nil
+	})
+	srv.Handle("fail", func(client *rpc2.Client, args *Args, reply *Reply) error {
+		return &rpc2.Error{Code: 42, Message: "failed"}
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewAvroCodec(c1, reg, Methods{"add": {Args: 1, Reply: 2}}))
+
+	clt := rpc2.NewClientWithCodec(NewAvroCodec(c2, reg, Methods{
+		"add":  {Args: 3, Reply: 2},
+		"fail": {Args: 1, Reply: 2},
+		"foo":  {Args: 1, Reply: 2},
+	}))
+	go clt.Run()
+	defer clt.Close()
+
+	type ArgsV2 struct {
+		A int    `avro:"a"`
+		B int    `avro:"b"`
+		C string `avro:"c"`
+	}
+	var reply Reply
+	err := clt.Call("add", ArgsV2{1, 2, "x"}, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Result != 3 {
+		t.Fatalf("not expected: %d", reply.Result)
+	}
+
+	err = clt.Call("fail", Args{1, 2}, &reply)
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != 42 || e.Message != "failed" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	err = clt.Call("foo", Args{1, 2}, &reply)
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != rpc2.CodeMethodNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package rpc2
+
+import "context"
+
+// CallInfo describes the call being handled.
+type CallInfo struct {
+	// Method is the name the method was called by.
+	Method string
+	// Handler is the name or pattern the handler was registered with,
+	// which differs from Method for calls made by an alias or a pattern.
+	Handler string
+	// Params are the segments of Method matched by the wildcards of the
+	// pattern of the handler, see Server.HandlePattern.
+	Params []string
+	// Seq is the sequence number of the call, zero for notifications.
+	Seq uint64
+}
+
+type callInfoKey struct{}
+
+// IncomingCall returns the description of the call being handled with ctx,
+// the context given to the handler, so a handler registered under several
+// names can tell which one it is called by:
+//
+//	srv.Handle("user.get", func(ctx context.Context, client *rpc2.Client, id int, reply *User) error {
+//		if info, _ := rpc2.IncomingCall(ctx); info.Method != info.Handler {
+//			log.Printf("deprecated method %s called", info.Method)
+//		}
+//		...
+//	})
+//
+// It returns false if ctx is not the context of a handler.
+func IncomingCall(ctx context.Context) (CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(*CallInfo)
+	if !ok {
+		return CallInfo{}, false
+	}
+	return *info, true
+}
+
+// callInfoContext returns parent with the description of the call r,
+// if its handler takes a context.
+func callInfoContext(parent context.Context, r *incoming) context.Context {
+	if !r.method.withCtx {
+		return parent
+	}
+	info := &CallInfo{Method: r.req.Method, Handler: r.req.Method, Params: r.params, Seq: r.req.Seq}
+	switch {
+	case r.method.pattern != "":
+		info.Handler = r.method.pattern
+	case r.method.aliasOf != "":
+		info.Handler = r.method.aliasOf
+	}
+	return context.WithValue(parent, callInfoKey{}, info)
+}
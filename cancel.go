@@ -0,0 +1,97 @@
+package rpc2
+
+import (
+	"context"
+	"strconv"
+)
+
+// CancelMethod is the name of the built-in notification canceling a call in
+// progress. Its argument is the value of CancelKey in the metadata of the call.
+// CallWithContext sends it when its context is done before the response
+// arrives. The context of the handler of the call is canceled, and so are the
+// calls the handler makes with it, on the same or other clients:
+//
+//	srv.Handle("search", func(ctx context.Context, client *rpc2.Client, q string, reply *[]string) error {
+//		// Canceled when the caller gives up or disconnects.
+//		return client.CallWithContext(ctx, "index.search", q, reply)
+//	})
+const CancelMethod = "rpc.cancel"
+
+// CancelKey is the metadata key identifying calls that the caller may cancel
+// with CancelMethod. It is set on calls made with a cancelable context.
+const CancelKey = "rpc2.cancel"
+
+// requestContext returns the context of the handler of req, which is canceled
+// on disconnect, when the caller cancels the call or when cancel is called.
+func (c *Client) requestContext(req *Request) (ctx context.Context, cancel context.CancelFunc) {
+	ctx, cancel = handlerContext(c.metadataContext(c.ctx, req), req)
+	s, ok := req.Metadata[CancelKey]
+	if !ok || req.Seq == 0 {
+		return ctx, cancel
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		debugln("rpc2: invalid cancel id in call to", req.Method+":", s)
+		return ctx, cancel
+	}
+	c.handlerMutex.Lock()
+	c.inflight[id] = cancel
+	c.handlerMutex.Unlock()
+	cancelCtx := cancel
+	return ctx, func() {
+		c.handlerMutex.Lock()
+		delete(c.inflight, id)
+		c.handlerMutex.Unlock()
+		cancelCtx()
+	}
+}
+
+// readCancel reads the body of a CancelMethod notification
+// and cancels the context of the handler of the call.
+func (c *Client) readCancel() error {
+	var id uint64
+	if err := c.codec.ReadRequestBody(&id); err != nil {
+		debugln("rpc2: invalid cancel notification:", err.Error())
+		return nil
+	}
+	c.handlerMutex.Lock()
+	cancel := c.inflight[id]
+	c.handlerMutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+// forget lets the codec release the state of the request with seq,
+// which is no longer waiting for a response.
+func (c *Client) forget(seq uint64) {
+	if fc, ok := c.codec.(ForgetCodec); ok {
+		fc.Forget(seq)
+	}
+}
+
+// abandon completes call with err as its caller is no longer waiting for the
+// response, and asks the peer to cancel the call if it is in progress.
+func (c *Client) abandon(call *Call, err error) {
+	c.mutex.Lock()
+	pending := call.seq != 0 && c.pending[call.seq] == call
+	if pending {
+		delete(c.pending, call.seq)
+	}
+	c.mutex.Unlock()
+	if !pending {
+		return
+	}
+	c.forget(call.seq)
+	call.Error = err
+	call.done()
+	if !call.cancel {
+		return
+	}
+	go func() {
+		if err := c.notify(CancelMethod, call.seq); err != nil && err != ErrShutdown {
+			debugln("rpc2: error sending cancel:", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+// Package certreload serves rpc2 over TLS with certificates that can be
+// replaced while the server is running.
+//
+// Certificates are loaded from files and used for new handshakes through
+// tls.Config.GetCertificate. Reloading does not affect established
+// connections, so certificates can be rotated without dropping rpc2 clients.
+//
+//	cert, _ := certreload.Load("server.crt", "server.key")
+//	lis, _ := certreload.Listen("tcp", ":5000", cert)
+//	stop := cert.Watch(time.Minute)
+//	defer stop()
+//	srv.Accept(lis)
+package certreload
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificate is a certificate and key pair loaded from files.
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.RWMutex // protects cert, modTime
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the files when loaded
+}
+
+// Load reads a PEM encoded certificate and key pair from files.
+func Load(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again. New handshakes use the new certificate.
+// If the files can not be loaded, the previous certificate is kept and the error is returned.
+func (c *Certificate) Reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mutex.Unlock()
+	return nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key files.
+func (c *Certificate) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate returns the current certificate.
+// It has the signature of tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// Watch checks the files every interval and reloads them when they are modified.
+// Errors are ignored so a partially written pair does not replace a valid certificate;
+// the files are checked again on the next tick. Call the returned function to stop watching.
+func (c *Certificate) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			modTime, err := c.filesModTime()
+			if err != nil {
+				continue
+			}
+			c.mutex.RLock()
+			changed := !modTime.Equal(c.modTime)
+			c.mutex.RUnlock()
+			if changed {
+				c.Reload()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Config returns a TLS server configuration using the current certificate.
+func (c *Certificate) Config() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate}
+}
+
+// Listen announces on the local network address and returns a listener
+// accepting TLS connections with the current certificate of c.
+func Listen(network, address string, c *Certificate) (net.Listener, error) {
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(lis, c.Config()), nil
+}
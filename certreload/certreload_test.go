@@ -0,0 +1,153 @@
+package certreload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// writeCert writes a self-signed certificate with serial to the files.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dial(t *testing.T, addr string) (*rpc2.Client, int64) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	clt := rpc2.NewClient(conn)
+	go clt.Run()
+	return clt, serial
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeCert(t, certFile, keyFile, 1)
+
+	cert, err := Load(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := Listen("tcp", "127.0.0.1:0", cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, args string, reply *string) error {
+		*reply = args
+		return nil
+	})
+	go srv.Accept(lis)
+
+	old, serial := dial(t, lis.Addr().String())
+	defer old.Close()
+	if serial != 1 {
+		t.Fatalf("unexpected serial: %d", serial)
+	}
+
+	writeCert(t, certFile, keyFile, 2)
+	if err = cert.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	clt, serial := dial(t, lis.Addr().String())
+	defer clt.Close()
+	if serial != 2 {
+		t.Fatalf("certificate is not reloaded, serial: %d", serial)
+	}
+
+	// The connection established with the old certificate still works.
+	var reply string
+	if err = old.Call("echo", "hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hello" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+
+	// Invalid files do not replace the certificate.
+	if err = os.WriteFile(keyFile, []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.Reload(); err == nil {
+		t.Fatal("expected error")
+	}
+	clt2, serial := dial(t, lis.Addr().String())
+	defer clt2.Close()
+	if serial != 2 {
+		t.Fatalf("unexpected serial after failed reload: %d", serial)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeCert(t, certFile, keyFile, 1)
+	cert, err := Load(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := cert.Watch(5 * time.Millisecond)
+	defer stop()
+
+	writeCert(t, certFile, keyFile, 2)
+	// Make sure the modification time changes on file systems with coarse timestamps.
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, _ := cert.GetCertificate(nil)
+		x, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x.SerialNumber.Int64() == 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate is not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
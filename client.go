@@ -6,8 +6,14 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net"
 	"reflect"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client represents an RPC Client.
@@ -15,19 +21,77 @@ import (
 // with a single Client, and a Client may be used by
 // multiple goroutines simultaneously.
 type Client struct {
-	mutex      sync.Mutex // protects pending, seq, request
-	sending    sync.Mutex
-	request    Request // temp area used in send()
-	seq        uint64
-	pending    map[uint64]*Call
-	closing    bool
-	shutdown   bool
-	server     bool
-	codec      Codec
-	handlers   map[string]*handler
-	disconnect chan struct{}
-	State      *State // additional information to associate with client
-	blocking   bool   // whether to block request handling
+	mutex       sync.Mutex // protects pending, seq
+	seq         uint64
+	pending     map[uint64]*Call
+	closing     bool
+	shutdown    bool
+	server      bool
+	codec       Codec
+	handlers    map[string]*handler
+	index       methodIndex // of handlers, for matching methods ignoring case
+	routes      []*route
+	disconnect  chan struct{}
+	err         error // terminal error of read loop, set before disconnect is closed
+	created     time.Time
+	closed      time.Time         // set before disconnect is closed
+	watchers    []chan Disconnect // protected by mutex
+	State       *State            // additional information to associate with client
+	blocking    bool              // whether to block request handling
+	handlerSent chan struct{}     // signaled when the running blocking handler sends a call, protected by mutex
+	lastDone    chan struct{}     // closed when the last blocking handler returns, used by read loop only
+	stats       *stats            // counters of the server, nil if not served by a server
+	labels      bool              // whether to set profiler labels in handlers
+	tracing     bool              // whether to create execution trace tasks
+	slow        time.Duration     // log handlers and calls taking longer, zero to disable
+	retry       RetryPolicy
+	failErr     error // reason of disconnection set by fail, protected by mutex
+	limiter     Limiter
+	lazy        *lazyConn          // nil unless created with NewLazyClient
+	ctx         context.Context    // parent of handler contexts, canceled on disconnect
+	cancelCtx   context.CancelFunc // cancels ctx
+	propagate   []string           // metadata keys propagated to calls made by handlers
+	deps        *dependencies      // shared with the server
+	dedup       *dedupCache        // of the server, nil if calls are not deduplicated
+	timeSource  Clock
+	onDrain     func(deadline time.Time) // protected by mutex
+	draining    *atomic.Bool             // of the server, nil if not served by a server
+
+	schemaVersion  int
+	minPeerVersion int
+	peerVersion    atomic.Int64 // plus one, zero if not negotiated
+	foldCase       bool         // whether methods are matched ignoring case
+
+	unknownResponses     atomic.Int64 // responses matching no pending call
+	expiredNotifications atomic.Int64 // queued notifications discarded after notifyTTL
+
+	writes     chan outgoing // messages to be written by the writer goroutine
+	control    chan outgoing // control messages, written ahead of writes
+	writerOnce sync.Once
+	holdWrites bool        // whether writes wait until Run is called
+	runCalled  atomic.Bool // set when Run is called
+
+	lastActivity     atomic.Int64 // unix nanoseconds of the last message read
+	rtt              rttRing
+	skew             skewSamples
+	keepalive        time.Duration
+	keepaliveTimeout time.Duration
+
+	notifySize   int
+	notifyPolicy OverflowPolicy
+	notifyTTL    time.Duration // zero if queued notifications do not expire
+	notifyQueue  chan notification
+	notifyOnce   sync.Once
+
+	handlerMutex sync.Mutex // protects running, queue, inflight
+	maxHandlers  int        // zero for no limit
+	running      int        // number of goroutines running handlers
+	queue        []incoming
+	work         tracker                       // requests being handled or queued
+	serverWork   *tracker                      // of the server, nil if not served by a server
+	inflight     map[uint64]context.CancelFunc // of cancelable requests by their ID
+	maxQueued    int                           // zero for no limit
+	memoryBudget uint64                        // zero for no limit
 }
 
 // NewClient returns a new Client to handle requests to the
@@ -41,26 +105,94 @@ func NewClient(conn io.ReadWriteCloser) *Client {
 // NewClientWithCodec is like NewClient but uses the specified
 // codec to encode requests and decode responses.
 func NewClientWithCodec(codec Codec) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Client{
 		codec:      codec,
 		pending:    make(map[uint64]*Call),
 		handlers:   make(map[string]*handler),
+		index:      make(methodIndex),
 		disconnect: make(chan struct{}),
+		writes:     make(chan outgoing, writeQueueSize),
+		control:    make(chan outgoing, controlQueueSize),
+		created:    RealClock.Now(),
 		seq:        1, // 0 means notification.
+		ctx:        ctx,
+		cancelCtx:  cancel,
+		inflight:   make(map[uint64]context.CancelFunc),
+		deps:       &dependencies{},
+		timeSource: RealClock,
 	}
 }
 
 // SetBlocking puts the client in blocking mode.
 // In blocking mode, received requests are processes synchronously.
 // If you have methods that may take a long time, other subsequent requests may time out.
+// A handler may call back to the peer on the same client: while the call
+// is in progress, the client keeps reading so the response can be received,
+// and subsequent requests wait until the handler returns.
 func (c *Client) SetBlocking(blocking bool) {
 	c.blocking = blocking
 }
 
+// SetProfilerLabels makes the client run handlers with the pprof label
+// "rpc2.method" set to the name of the method, so CPU and goroutine
+// profiles attribute time to methods. Goroutines started by handlers
+// inherit the label.
+func (c *Client) SetProfilerLabels(enabled bool) {
+	c.labels = enabled
+}
+
+// SetTracing makes the client create runtime/trace tasks for handled requests
+// and outgoing calls, named "rpc2.handle <method>" and "rpc2.call <method>".
+// Handlers run in a "rpc2.handler" region of the task and notifications are
+// sent in a "rpc2.notify <method>" region, so execution traces show rpc2
+// activity with method names.
+func (c *Client) SetTracing(enabled bool) {
+	c.tracing = enabled
+}
+
+// SetSlowThreshold makes the client log handlers and outgoing calls that
+// take longer than d, with the method, the remote address and the elapsed time.
+// Logs are written to the logger set with SetLogger. Zero disables logging.
+func (c *Client) SetSlowThreshold(d time.Duration) {
+	c.slow = d
+}
+
+// logSlow logs an operation on method if it took longer than the slow threshold.
+func (c *Client) logSlow(kind, method string, elapsed time.Duration) {
+	if elapsed <= c.slow {
+		return
+	}
+	peer := "unknown"
+	if addr := c.RemoteAddr(); addr != nil {
+		peer = addr.String()
+	}
+	logln("rpc2: slow", kind, method, "peer", peer, "elapsed", elapsed)
+}
+
+// SetMaxConcurrentHandlers limits the number of handlers running concurrently
+// in non-blocking mode. Requests received while n handlers are running are
+// queued and handled in order as handlers return. Zero means no limit.
+// It must be called before Run.
+func (c *Client) SetMaxConcurrentHandlers(n int) {
+	c.maxHandlers = n
+}
+
 // Run the client's read loop.
 // You must run this method before calling any methods on the server.
-func (c *Client) Run() {
+// Run blocks until the connection is gone and returns the reason.
+// It returns nil if the connection is closed with Close.
+func (c *Client) Run() error {
+	if !c.waitConnected() {
+		return nil
+	}
+	c.runCalled.Store(true)
+	c.startWriter()
+	if c.keepalive > 0 {
+		go c.keepaliveLoop()
+	}
 	c.readLoop()
+	return c.err
 }
 
 // DisconnectNotify returns a channel that is closed
@@ -69,9 +201,95 @@ func (c *Client) DisconnectNotify() chan struct{} {
 	return c.disconnect
 }
 
-// Handle registers the handler function for the given method. If a handler already exists for method, Handle panics.
+// Conn returns the underlying connection if the codec implements ConnCodec, nil otherwise.
+func (c *Client) Conn() io.ReadWriteCloser {
+	if !c.isConnected() {
+		return nil
+	}
+	if cc, ok := c.codec.(ConnCodec); ok {
+		return cc.Conn()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote network address if the underlying connection has one, nil otherwise.
+func (c *Client) RemoteAddr() net.Addr {
+	if conn, ok := c.Conn().(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address if the underlying connection has one, nil otherwise.
+func (c *Client) LocalAddr() net.Addr {
+	if conn, ok := c.Conn().(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// Disconnect describes a connection that has gone away.
+type Disconnect struct {
+	Err            error // reason of disconnection, nil if closed with Close
+	ConnectedAt    time.Time
+	DisconnectedAt time.Time
+}
+
+// SubscribeDisconnect returns a new channel that receives a single
+// Disconnect value when the client connection has gone away.
+// Each call returns an independent channel so multiple consumers
+// can watch the same client.
+func (c *Client) SubscribeDisconnect() <-chan Disconnect {
+	ch := make(chan Disconnect, 1)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.disconnect:
+		ch <- c.disconnectInfo()
+		close(ch)
+	default:
+		c.watchers = append(c.watchers, ch)
+	}
+	return ch
+}
+
+func (c *Client) disconnectInfo() Disconnect {
+	return Disconnect{
+		Err:            c.err,
+		ConnectedAt:    c.created,
+		DisconnectedAt: c.closed,
+	}
+}
+
+// Done returns a channel that is closed when the read loop exits.
+func (c *Client) Done() <-chan struct{} {
+	return c.disconnect
+}
+
+// Err returns the error that terminated the read loop.
+// It returns nil if the read loop is still running or
+// the connection is closed with Close.
+func (c *Client) Err() error {
+	select {
+	case <-c.disconnect:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// UnknownResponses returns the number of responses received that match no
+// pending call, such as duplicates or responses with IDs that were never sent.
+// Servers also publish their sum as "unknown_responses", see PublishExpvar.
+func (c *Client) UnknownResponses() int64 {
+	return c.unknownResponses.Load()
+}
+
+// Handle registers the handler function for the given method. If a handler already exists for method,
+// or method starts with "rpc.", which is reserved for built-in methods, Handle panics.
 func (c *Client) Handle(method string, handlerFunc interface{}) {
-	addHandler(c.handlers, method, handlerFunc)
+	checkReserved(method)
+	addHandler(c.handlers, c.index, method, handlerFunc)
 }
 
 // readLoop reads messages from codec.
@@ -88,6 +306,7 @@ func (c *Client) readLoop() {
 		if err = c.codec.ReadHeader(&req, &resp); err != nil {
 			break
 		}
+		c.lastActivity.Store(c.timeSource.Now().UnixNano())
 
 		if req.Method != "" {
 			// request comes to server
@@ -102,10 +321,16 @@ func (c *Client) readLoop() {
 		}
 	}
 	// Terminate pending calls.
-	c.sending.Lock()
 	c.mutex.Lock()
 	c.shutdown = true
 	closing := c.closing
+	if c.failErr != nil {
+		err = c.failErr
+	}
+	if !closing {
+		c.err = err
+	}
+	c.closed = c.timeSource.Now()
 	if err == io.EOF {
 		if closing {
 			err = ErrShutdown
@@ -113,26 +338,64 @@ func (c *Client) readLoop() {
 			err = io.ErrUnexpectedEOF
 		}
 	}
-	for _, call := range c.pending {
+	for seq, call := range c.pending {
+		delete(c.pending, seq)
 		call.Error = err
 		call.done()
 	}
 	c.mutex.Unlock()
-	c.sending.Unlock()
 	if err != io.EOF && !closing && !c.server {
 		debugln("rpc2: client protocol error:", err)
 	}
-	close(c.disconnect)
+	c.closeDisconnect()
 	if !closing {
 		c.codec.Close()
 	}
 }
 
-func (c *Client) handleRequest(req Request, method *handler, argv reflect.Value) {
-	// Invoke the method, providing a new value for the reply.
-	replyv := reflect.New(method.replyType.Elem())
+// closeDisconnect closes the disconnect channel and notifies watchers.
+func (c *Client) closeDisconnect() {
+	c.cancelCtx()
+	c.mutex.Lock()
+	close(c.disconnect)
+	watchers := c.watchers
+	c.watchers = nil
+	c.mutex.Unlock()
+	for _, ch := range watchers {
+		ch <- c.disconnectInfo()
+		close(ch)
+	}
+}
+
+func (c *Client) handleRequest(r incoming) {
+	req, method, ctx := r.req, r.method, r.ctx
+	defer c.untrackRequest(req.Method)
+	defer r.cancel()
+	if c.tracing {
+		var task *trace.Task
+		ctx, task = trace.NewTask(ctx, "rpc2.handle "+req.Method)
+		defer task.End()
+	}
 
-	returnValues := method.fn.Call([]reflect.Value{reflect.ValueOf(c), argv, replyv})
+	var reply interface{}
+	var err error
+	if method.limit.acquire() {
+		var start time.Time
+		if c.slow > 0 {
+			start = c.timeSource.Now()
+		}
+		reply, err = c.invokeOnce(ctx, req.Method, method, r)
+		if c.slow > 0 {
+			c.logSlow("handler", req.Method, c.timeSource.Now().Sub(start))
+		}
+		method.limit.release()
+	} else {
+		reply = reflect.New(method.replyType.Elem()).Interface()
+		err = &Error{Code: CodeRejected, Message: "rpc2: too many concurrent calls to " + req.Method}
+	}
+	if c.stats != nil && err != nil {
+		c.stats.errors.Add(1)
+	}
 
 	// Do not send response if request is a notification.
 	if req.Seq == 0 {
@@ -140,33 +403,150 @@ func (c *Client) handleRequest(req Request, method *handler, argv reflect.Value)
 	}
 
 	// The return value for the method is an error.
-	errInter := returnValues[0].Interface()
-	errmsg := ""
-	if errInter != nil {
-		errmsg = errInter.(error).Error()
+	resp := getResponse()
+	resp.Seq = req.Seq
+	if err == nil {
+		if reply, err = marshalValue(reply); err != nil {
+			reply = resp
+		} else {
+			reply = genericReply(&req, reply)
+		}
 	}
-	resp := &Response{
-		Seq:   req.Seq,
-		Error: errmsg,
+	if err != nil {
+		setResponseError(resp, err)
 	}
-	if err := c.codec.WriteResponse(resp, replyv.Interface()); err != nil {
+	if err = c.write(outgoing{resp: resp, body: reply, control: isControl(req.Method)}); err != nil {
 		debugln("rpc2: error writing response:", err.Error())
 	}
 }
 
+// invoke calls the handler of the named method with the arguments of r and
+// returns a pointer to the reply and the error, setting profiler labels and
+// a trace region if they are enabled.
+func (c *Client) invoke(ctx context.Context, name string, method *handler, r incoming) (reply interface{}, err error) {
+	call := func(ctx context.Context) {
+		run := func() {
+			if method.typed != nil {
+				reply, err = method.typed.call(ctx, c, r.args)
+			} else {
+				reply, err = c.callReflect(ctx, method, r.argv)
+			}
+		}
+		if c.tracing {
+			trace.WithRegion(ctx, "rpc2.handler", run)
+		} else {
+			run()
+		}
+	}
+	if c.labels {
+		pprof.Do(ctx, pprof.Labels("rpc2.method", name), call)
+	} else {
+		call(ctx)
+	}
+	return reply, err
+}
+
+// callReflect calls the handler registered with Handle, providing a new value for the reply.
+func (c *Client) callReflect(ctx context.Context, method *handler, argv reflect.Value) (interface{}, error) {
+	replyv := reflect.New(method.replyType.Elem())
+	in := []reflect.Value{reflect.ValueOf(c), argv, replyv}
+	if method.argType == nil {
+		in = []reflect.Value{reflect.ValueOf(c), replyv}
+	}
+	if method.returned {
+		in = in[:len(in)-1]
+	}
+	if method.withCtx {
+		in = append([]reflect.Value{reflect.ValueOf(ctx)}, in...)
+	}
+	out := method.fn.Call(in)
+	if err := out[len(out)-1].Interface(); err != nil {
+		return replyv.Interface(), err.(error)
+	}
+	if method.returned {
+		if r := out[0]; r.Kind() != reflect.Ptr {
+			replyv.Elem().Set(r)
+		} else if !r.IsNil() {
+			replyv.Elem().Set(r.Elem())
+		}
+	}
+	return replyv.Interface(), nil
+}
+
 func (c *Client) readRequest(req *Request) error {
+	if c.stats != nil {
+		c.stats.calls.Add(1)
+	}
+	if c.foldCase {
+		req.Method = c.canonicalMethod(req.Method)
+	}
+	if req.Method == CancelMethod && req.Seq == 0 {
+		// Handled here so cancellation is not delayed by queued or shed requests.
+		return c.readCancel()
+	}
+	if c.limiter != nil {
+		if err := c.limiter.Allow(c, req.Method); err != nil {
+			if err := c.codec.ReadRequestBody(nil); err != nil {
+				return err
+			}
+			resp := &Response{Seq: req.Seq}
+			setResponseError(resp, err)
+			if resp.Code == 0 {
+				resp.Code = CodeRejected
+			}
+			return c.writeErrorResponse(resp)
+		}
+	}
+	if _, builtin := builtins[req.Method]; !builtin && c.isDraining() {
+		return c.rejectDraining(req)
+	}
+	if c.overloaded() {
+		return c.shed(req)
+	}
 	method, ok := c.handlers[req.Method]
+	if !ok {
+		method, ok = builtins[req.Method]
+	}
+	var params []string
+	if !ok && !strings.HasPrefix(req.Method, builtinPrefix) {
+		method, params, ok = c.route(req.Method)
+	}
+	if ok && method.aliasOf != "" && c.stats != nil {
+		c.stats.countAlias(req.Method)
+	}
 	if !ok {
 		resp := &Response{
 			Seq:   req.Seq,
 			Error: "rpc2: can't find method " + req.Method,
+			Code:  CodeMethodNotFound,
 		}
-		return c.codec.WriteResponse(resp, resp)
+		if err := c.codec.ReadRequestBody(nil); err != nil {
+			return err
+		}
+		return c.writeErrorResponse(resp)
+	}
+
+	if method.typed != nil {
+		args := method.typed.newArgs()
+		setDefaults(args)
+		if err := readBody(c.codec.ReadRequestBody, args); err != nil {
+			return c.invalidParams(req, err)
+		}
+		c.dispatch(incoming{req: *req, method: method, params: params, args: args})
+		return nil
 	}
 
 	// Decode the argument value.
 	var argv reflect.Value
 	argIsValue := false // if true, need to indirect before calling.
+	if method.argType == nil {
+		// Discard the arguments.
+		if err := c.codec.ReadRequestBody(nil); err != nil {
+			return err
+		}
+		c.dispatch(incoming{req: *req, method: method, params: params, argv: argv})
+		return nil
+	}
 	if method.argType.Kind() == reflect.Ptr {
 		argv = reflect.New(method.argType.Elem())
 	} else {
@@ -174,20 +554,125 @@ func (c *Client) readRequest(req *Request) error {
 		argIsValue = true
 	}
 	// argv guaranteed to be a pointer now.
-	if err := c.codec.ReadRequestBody(argv.Interface()); err != nil {
-		return err
+	setDefaults(argv.Interface())
+	if err := readBody(c.codec.ReadRequestBody, argv.Interface()); err != nil {
+		return c.invalidParams(req, err)
 	}
 	if argIsValue {
 		argv = argv.Elem()
 	}
 
-	if c.blocking {
-		c.handleRequest(*req, method, argv)
-	} else {
-		go c.handleRequest(*req, method, argv)
+	c.dispatch(incoming{req: *req, method: method, params: params, argv: argv})
+	return nil
+}
+
+// invalidParams responds to req with an error decoding its arguments.
+func (c *Client) invalidParams(req *Request, err error) error {
+	debugln("rpc2: error reading request body:", err.Error())
+	resp := &Response{
+		Seq:   req.Seq,
+		Error: "rpc2: invalid params: " + err.Error(),
+		Code:  CodeInvalidParams,
 	}
+	return c.writeErrorResponse(resp)
+}
 
-	return nil
+// dispatch runs the handler of req.
+// In blocking mode, handlers run one at a time in the order requests are received.
+// The read loop waits for the handler to return unless a call is sent while
+// it runs; the handler may be waiting for the response, which the read loop
+// must read to avoid a deadlock.
+func (c *Client) dispatch(r incoming) {
+	c.trackRequest(r.req.Method)
+	r.ctx, r.cancel = c.requestContext(&r.req)
+	r.ctx = callInfoContext(attachmentContext(r.ctx, &r.req), &r)
+	if !c.blocking {
+		if c.maxHandlers > 0 {
+			c.enqueue(r)
+		} else {
+			go c.handleRequest(r)
+		}
+		return
+	}
+	prev := c.lastDone
+	done := make(chan struct{})
+	sent := make(chan struct{}, 1)
+	c.lastDone = done
+	go func() {
+		if prev != nil {
+			<-prev
+		}
+		c.mutex.Lock()
+		c.handlerSent = sent
+		c.mutex.Unlock()
+		c.handleRequest(r)
+		c.mutex.Lock()
+		c.handlerSent = nil
+		c.mutex.Unlock()
+		close(done)
+	}()
+	if prev != nil {
+		select {
+		case <-prev:
+		default:
+			// A previous handler is waiting for a response. Keep reading.
+			return
+		}
+	}
+	select {
+	case <-done:
+	case <-sent:
+	}
+}
+
+// incoming is a request read from the connection to be handled.
+type incoming struct {
+	req    Request
+	method *handler
+	params []string        // segments captured by the pattern of the handler
+	argv   reflect.Value   // of handlers registered with Handle
+	args   interface{}     // pointer to the arguments of handlers registered with HandleFunc
+	ctx    context.Context // of the handler
+	cancel context.CancelFunc
+}
+
+// enqueue starts a goroutine handling q unless maxHandlers goroutines are running,
+// in which case q is handled by one of them when it is done.
+func (c *Client) enqueue(q incoming) {
+	c.handlerMutex.Lock()
+	if c.running >= c.maxHandlers {
+		c.queue = append(c.queue, q)
+		c.handlerMutex.Unlock()
+		return
+	}
+	c.running++
+	c.handlerMutex.Unlock()
+	go func() {
+		for {
+			c.handleRequest(q)
+			c.handlerMutex.Lock()
+			if len(c.queue) == 0 {
+				c.running--
+				c.handlerMutex.Unlock()
+				return
+			}
+			q = c.queue[0]
+			c.queue[0] = incoming{}
+			c.queue = c.queue[1:]
+			c.handlerMutex.Unlock()
+		}
+	}()
+}
+
+// writeErrorResponse sends resp unless the request is a notification.
+func (c *Client) writeErrorResponse(resp *Response) error {
+	if c.stats != nil {
+		c.stats.errors.Add(1)
+	}
+	if resp.Seq == 0 {
+		return nil
+	}
+	return c.write(outgoing{resp: resp, body: resp})
 }
 
 func (c *Client) readResponse(resp *Response) error {
@@ -205,6 +690,13 @@ func (c *Client) readResponse(resp *Response) error {
 		// removed; response is a server telling us about an
 		// error reading request body. We should still attempt
 		// to read error body, but there's no one to give it to.
+		// It may also be a duplicate or a response with an ID
+		// we never sent, from a buggy or malicious peer.
+		c.unknownResponses.Add(1)
+		if c.stats != nil {
+			c.stats.unknownResponses.Add(1)
+		}
+		debugln("rpc2: response to unknown call", seq)
 		err = c.codec.ReadResponseBody(nil)
 		if err != nil {
 			err = errors.New("reading error body: " + err.Error())
@@ -213,14 +705,18 @@ func (c *Client) readResponse(resp *Response) error {
 		// We've got an error response. Give this to the request;
 		// any subsequent requests will get the ReadResponseBody
 		// error if there is one.
-		call.Error = ServerError(resp.Error)
-		err = c.codec.ReadResponseBody(nil)
+		call.Error = responseError(resp)
+		var reply interface{}
+		if resp.Partial {
+			reply = call.Reply
+		}
+		err = readReply(c.codec.ReadResponseBody, call, reply)
 		if err != nil {
 			err = errors.New("reading error body: " + err.Error())
 		}
 		call.done()
 	default:
-		err = c.codec.ReadResponseBody(call.Reply)
+		err = readReply(c.codec.ReadResponseBody, call, call.Reply)
 		if err != nil {
 			call.Error = errors.New("reading body " + err.Error())
 		}
@@ -239,6 +735,9 @@ func (c *Client) Close() error {
 	}
 	c.closing = true
 	c.mutex.Unlock()
+	if c.closeLazy() {
+		return nil
+	}
 	return c.codec.Close()
 }
 
@@ -246,8 +745,14 @@ func (c *Client) Close() error {
 // the invocation.  The done channel will signal when the call is complete by returning
 // the same Call object.  If done is nil, Go will allocate a new channel.
 // If non-nil, done must be buffered or Go will deliberately crash.
+// If reply is nil, the result of the call is read and discarded.
 func (c *Client) Go(method string, args interface{}, reply interface{}, done chan *Call) *Call {
-	call := new(Call)
+	return c.goContext(context.Background(), new(Call), method, args, reply, done)
+}
+
+// goContext is like Go but fills the given call.
+// The trace task of the call is a child of the task in ctx.
+func (c *Client) goContext(ctx context.Context, call *Call, method string, args interface{}, reply interface{}, done chan *Call) *Call {
 	call.Method = method
 	call.Args = args
 	call.Reply = reply
@@ -263,29 +768,121 @@ func (c *Client) Go(method string, args interface{}, reply interface{}, done cha
 		}
 	}
 	call.Done = done
+	if deadline, ok := ctx.Deadline(); ok {
+		if !c.timeSource.Now().Before(deadline) {
+			call.Error = context.DeadlineExceeded
+			call.done()
+			return call
+		}
+		call.deadline = deadline
+	}
+	call.cancel = ctx.Done() != nil
+	call.metadata = callMetadata(ctx)
+	call.attach = outgoingAttachments(ctx)
+	codec, err := c.connect()
+	if err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+	// The codec of a lazy client is only known once it is connected.
+	call.dynamic = isDynamic(codec, reply)
+	if c.tracing {
+		_, call.task = trace.NewTask(ctx, "rpc2.call "+method)
+	}
+	if c.slow > 0 {
+		call.client = c
+		call.start = c.timeSource.Now()
+	}
 	c.send(call)
 	return call
 }
 
 // CallWithContext invokes the named function, waits for it to complete, and
 // returns its error status, or an error from Context timeout.
+// If ctx is done before the call completes, the peer is asked to cancel the
+// context of its handler, see CancelMethod.
+// Rejected calls are retried as configured with SetRetryPolicy.
 func (c *Client) CallWithContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
-	call := c.Go(method, args, reply, make(chan *Call, 1))
-	select {
-	case <-call.Done:
-		return call.Error
-	case <-ctx.Done():
-		return ctx.Err()
+	for attempt := 1; ; attempt++ {
+		call := getCall()
+		c.goContext(ctx, call, method, args, reply, call.Done)
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			c.abandon(call, ctx.Err())
+			return ctx.Err()
+		}
+		delay, ok := c.retry.delay(attempt, call.Error)
+		if !ok {
+			err := call.Error
+			if err == nil {
+				putCall(call)
+			}
+			return err
+		}
+		timer := c.timeSource.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
 	}
-	return nil
+}
+
+// RetryPolicy configures retries of calls rejected by the peer.
+// A call is retried if the peer responds with an *Error that has
+// the code CodeRejected or CodeOverloaded or a RetryAfter delay; other errors are returned
+// because the peer may have handled the call.
+type RetryPolicy struct {
+	MaxAttempts int           // including the first attempt, retries are disabled if less than 2
+	Backoff     time.Duration // delay before the first retry if the peer does not suggest one, doubled for each retry
+	MaxDelay    time.Duration // upper bound of delays, zero for no bound
+}
+
+// delay returns the delay before retrying a call that failed with err
+// in the given attempt, or false if the call must not be retried.
+func (p RetryPolicy) delay(attempt int, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	var e *Error
+	if !errors.As(err, &e) || (e.Code != CodeRejected && e.Code != CodeOverloaded && e.RetryAfter == 0) {
+		return 0, false
+	}
+	d := e.RetryAfter
+	if d == 0 {
+		d = p.Backoff << (attempt - 1)
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d, true
+}
+
+// SetRetryPolicy sets the policy for retrying rejected calls made with Call and CallWithContext.
+// Calls made with Go are not retried.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
 }
 
 // Call invokes the named function, waits for it to complete, and returns its error status.
+// Unlike Notify, a call with a nil reply waits for the peer to handle it,
+// discarding the result, for callers only interested in the error:
+//
+//	err := client.Call("delete", id, nil)
 func (c *Client) Call(method string, args interface{}, reply interface{}) error {
 	return c.CallWithContext(context.Background(), method, args, reply)
 }
 
 func (call *Call) done() {
+	if call.task != nil {
+		call.task.End()
+	}
+	if call.client != nil {
+		call.client.logSlow("call", call.Method, call.client.timeSource.Now().Sub(call.start))
+	}
 	select {
 	case call.Done <- call:
 		// ok
@@ -304,22 +901,86 @@ func (e ServerError) Error() string {
 	return string(e)
 }
 
+// Error codes for protocol level failures.
+// They match the codes defined by the JSON-RPC 2.0 specification.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// CodeRejected is the code of errors rejecting calls before they are handled,
+// e.g. by rate limiting or load shedding. Rejected calls may be retried later.
+// It is in the range reserved for implementation-defined server errors by JSON-RPC 2.0.
+const CodeRejected = -32000
+
+// CodeUnauthorized is the code of errors rejecting calls from peers
+// that are not authenticated or not allowed to make the call.
+const CodeUnauthorized = -32002
+
+// Error is an error with a code.
+// Handlers may return an *Error to send the code to the remote side.
+// Calls return an *Error when the remote side responds with a non-zero code.
+type Error struct {
+	Code    int
+	Message string
+
+	// RetryAfter is the delay the peer suggests before retrying the call.
+	// Zero if not given.
+	RetryAfter time.Duration
+
+	// Details are structured details of the error, such as proto messages
+	// with the protorpc codec. Codecs that can not carry them ignore them.
+	Details []interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// setResponseError sets the error message and code of resp from err.
+func setResponseError(resp *Response, err error) {
+	resp.Error = err.Error()
+	var e *Error
+	if errors.As(err, &e) {
+		resp.Code = e.Code
+		resp.RetryAfter = e.RetryAfter
+		resp.Details = e.Details
+	}
+}
+
+// responseError returns the error reported in resp.
+func responseError(resp *Response) error {
+	if resp.Code == 0 && resp.RetryAfter == 0 && len(resp.Details) == 0 {
+		return ServerError(resp.Error)
+	}
+	return &Error{Code: resp.Code, Message: resp.Error, RetryAfter: resp.RetryAfter, Details: resp.Details}
+}
+
 // ErrShutdown is returned when the connection is closing or closed.
 var ErrShutdown = errors.New("connection is shut down")
 
 // Call represents an active RPC.
 type Call struct {
-	Method string      // The name of the service and method to call.
-	Args   interface{} // The argument to the function (*struct).
-	Reply  interface{} // The reply from the function (*struct).
-	Error  error       // After completion, the error status.
-	Done   chan *Call  // Strobes when call is complete.
+	Method   string      // The name of the service and method to call.
+	Args     interface{} // The argument to the function (*struct).
+	Reply    interface{} // The reply from the function (*struct).
+	Error    error       // After completion, the error status.
+	Done     chan *Call  // Strobes when call is complete.
+	task     *trace.Task // nil if tracing is disabled
+	client   *Client     // set if slow calls are logged
+	start    time.Time
+	deadline time.Time // of the context, sent as the remaining time budget
+	cancel   bool      // whether the context can be canceled
+	metadata map[string]string
+	attach   [][]byte // attachments, see WithAttachments
+	seq      uint64   // set when the call is sent
+	dynamic  bool     // whether the reply is sent in generic form, see DynamicKey
 }
 
 func (c *Client) send(call *Call) {
-	c.sending.Lock()
-	defer c.sending.Unlock()
-
 	// Register this call.
 	c.mutex.Lock()
 	if c.shutdown || c.closing {
@@ -329,36 +990,185 @@ func (c *Client) send(call *Call) {
 		return
 	}
 	seq := c.seq
-	c.seq++
+	for seq == 0 || c.pending[seq] != nil {
+		// Do not reuse the sequence number of a pending call after wraparound.
+		seq++
+	}
+	c.seq = seq + 1
+	call.seq = seq
 	c.pending[seq] = call
+	if c.handlerSent != nil {
+		select {
+		case c.handlerSent <- struct{}{}:
+		default:
+		}
+	}
 	c.mutex.Unlock()
 
-	// Encode and send the request.
-	c.request.Seq = seq
-	c.request.Method = call.Method
-	err := c.codec.WriteRequest(&c.request, call.Args)
+	// Queue the request. The writer completes the call if it fails.
+	args, err := marshalValue(call.Args)
 	if err != nil {
-		c.mutex.Lock()
-		call = c.pending[seq]
-		delete(c.pending, seq)
-		c.mutex.Unlock()
-		if call != nil {
-			call.Error = err
-			call.done()
-		}
+		c.failCall(call, err)
+		return
+	}
+	req := getRequest()
+	req.Seq = seq
+	req.Method = call.Method
+	req.Metadata = call.requestMetadata(c.timeSource.Now())
+	req.Attachments = call.attach
+	if err := c.write(outgoing{req: req, body: args, call: call}); err != nil {
+		c.failCall(call, err)
 	}
 }
 
 // Notify sends a request to the receiver but does not wait for a return value.
+// If a notify queue is set with SetNotifyQueue, the notification is queued
+// and sent by a separate goroutine.
 func (c *Client) Notify(method string, args interface{}) error {
-	c.sending.Lock()
-	defer c.sending.Unlock()
+	if _, err := c.connect(); err != nil {
+		return err
+	}
+	if c.notifySize > 0 {
+		return c.queueNotification(notification{method: method, args: args})
+	}
+	return c.notify(method, args)
+}
 
-	if c.shutdown || c.closing {
+// OverflowPolicy decides what happens to notifications when the notify queue is full.
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	BlockOnOverflow OverflowPolicy = iota // wait until there is room in the queue
+	DropOldest                            // remove the oldest queued notification
+	DropNewest                            // discard the new notification and return ErrNotifyQueueFull
+	CloseOnOverflow                       // close the connection and return ErrNotifyQueueFull
+)
+
+// ErrNotifyQueueFull is returned from Notify when the notify queue is full.
+var ErrNotifyQueueFull = errors.New("rpc2: notify queue is full")
+
+type notification struct {
+	method string
+	args   interface{}
+	queued time.Time // set if queued notifications expire
+}
+
+// SetNotifyQueue makes Notify queue up to size notifications to be sent
+// by a separate goroutine, so slow peers do not block the caller. When
+// the queue is full, policy decides what happens. Queued notifications
+// may be sent after calls made later, and they are discarded when the
+// connection is closed. Args must not be modified after they are queued.
+// It must be called before Run.
+func (c *Client) SetNotifyQueue(size int, policy OverflowPolicy) {
+	c.notifySize = size
+	c.notifyPolicy = policy
+}
+
+// SetNotifyTTL makes notifications queued by the notify queue set with
+// SetNotifyQueue expire after ttl, so a slow peer does not get outdated
+// state. Expired notifications are discarded and counted, see
+// ExpiredNotifications. Zero ttl disables expiration.
+// It must be called before Run.
+func (c *Client) SetNotifyTTL(ttl time.Duration) {
+	c.notifyTTL = ttl
+}
+
+// ExpiredNotifications returns the number of queued notifications discarded
+// because they expired, see SetNotifyTTL. Servers also publish their sum as
+// "expired_notifications", see PublishExpvar.
+func (c *Client) ExpiredNotifications() int64 {
+	return c.expiredNotifications.Load()
+}
+
+func (c *Client) queueNotification(n notification) error {
+	if c.notifyTTL > 0 {
+		n.queued = c.timeSource.Now()
+	}
+	c.notifyOnce.Do(func() {
+		c.notifyQueue = make(chan notification, c.notifySize)
+		go c.notifyLoop()
+	})
+	select {
+	case <-c.disconnect:
 		return ErrShutdown
+	default:
 	}
+	for {
+		select {
+		case c.notifyQueue <- n:
+			return nil
+		default:
+		}
+		switch c.notifyPolicy {
+		case BlockOnOverflow:
+			select {
+			case c.notifyQueue <- n:
+				return nil
+			case <-c.disconnect:
+				return ErrShutdown
+			}
+		case DropOldest:
+			select {
+			case <-c.notifyQueue:
+				debugln("rpc2: notify queue is full, dropping oldest notification")
+			default:
+			}
+		case DropNewest:
+			return ErrNotifyQueueFull
+		case CloseOnOverflow:
+			c.Close()
+			return ErrNotifyQueueFull
+		}
+	}
+}
 
-	c.request.Seq = 0
-	c.request.Method = method
-	return c.codec.WriteRequest(&c.request, args)
+func (c *Client) notifyLoop() {
+	for {
+		select {
+		case n := <-c.notifyQueue:
+			if c.notifyTTL > 0 && c.timeSource.Now().Sub(n.queued) >= c.notifyTTL {
+				c.expiredNotifications.Add(1)
+				if c.stats != nil {
+					c.stats.expiredNotifications.Add(1)
+				}
+				debugln("rpc2: dropping expired notification of", n.method)
+				continue
+			}
+			if err := c.notify(n.method, n.args); err != nil {
+				debugln("rpc2: error sending notification:", err.Error())
+			}
+		case <-c.disconnect:
+			return
+		}
+	}
+}
+
+func (c *Client) notify(method string, args interface{}) error {
+	c.mutex.Lock()
+	closed := c.shutdown || c.closing
+	c.mutex.Unlock()
+	if closed {
+		return ErrShutdown
+	}
+
+	args, err := marshalValue(args)
+	if err != nil {
+		return err
+	}
+	req := getRequest()
+	req.Method = method
+	msg := outgoing{req: req, body: args}
+	if !c.writesHeld() {
+		// Held notifications are written after Notify returns.
+		msg.err = make(chan error, 1)
+	}
+	if c.tracing {
+		var err error
+		trace.WithRegion(context.Background(), "rpc2.notify "+method, func() {
+			err = c.write(msg)
+		})
+		return err
+	}
+	return c.write(msg)
 }
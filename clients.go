@@ -0,0 +1,181 @@
+package rpc2
+
+import (
+	"context"
+	"sync"
+)
+
+// registry keeps the connected clients of a server and their tags.
+type registry struct {
+	mutex   sync.Mutex
+	clients map[*Client]*entry
+	idle    chan struct{} // set when draining, closed when there are no clients
+}
+
+// entry is a client in the registry.
+type entry struct {
+	tags    map[string]string
+	weight  int // see SetWeight
+	current int // of smooth weighted round-robin in CallAny
+}
+
+// add adds c unless the registry is draining.
+func (r *registry) add(c *Client) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.idle != nil {
+		return false
+	}
+	if r.clients == nil {
+		r.clients = make(map[*Client]*entry)
+	}
+	r.clients[c] = &entry{weight: 1}
+	return true
+}
+
+func (r *registry) remove(c *Client) {
+	r.mutex.Lock()
+	delete(r.clients, c)
+	if r.idle != nil && len(r.clients) == 0 {
+		select {
+		case <-r.idle:
+		default:
+			close(r.idle)
+		}
+	}
+	r.mutex.Unlock()
+}
+
+// drain stops adding clients. It returns the clients and a channel
+// closed when all of them are removed.
+func (r *registry) drain() ([]*Client, <-chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.idle == nil {
+		r.idle = make(chan struct{})
+		if len(r.clients) == 0 {
+			close(r.idle)
+		}
+	}
+	clients := make([]*Client, 0, len(r.clients))
+	for c := range r.clients {
+		clients = append(clients, c)
+	}
+	return clients, r.idle
+}
+
+// Clients returns the clients connected to the server.
+func (s *Server) Clients() []*Client {
+	return s.Select(nil)
+}
+
+// Tag sets the tag key of client to value, so it can be found with Select.
+// Tags of a client are removed when it disconnects. Tag has no effect if
+// client is not connected to the server.
+func (s *Server) Tag(client *Client, key, value string) {
+	r := &s.clients
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	e, ok := r.clients[client]
+	if !ok {
+		return
+	}
+	if e.tags == nil {
+		e.tags = make(map[string]string)
+	}
+	e.tags[key] = value
+}
+
+// Untag removes the tag key of client.
+func (s *Server) Untag(client *Client, key string) {
+	r := &s.clients
+	r.mutex.Lock()
+	if e, ok := r.clients[client]; ok {
+		delete(e.tags, key)
+	}
+	r.mutex.Unlock()
+}
+
+// Select returns the connected clients having all tags in selector,
+// e.g. for pushing notifications to a group of clients:
+//
+//	for _, client := range srv.Select(map[string]string{"role": "camera", "zone": "3"}) {
+//		client.Notify("capture", nil)
+//	}
+//
+// A nil selector selects all clients.
+func (s *Server) Select(selector map[string]string) []*Client {
+	r := &s.clients
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var clients []*Client
+	for c, e := range r.clients {
+		if matches(e.tags, selector) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+func matches(tags, selector map[string]string) bool {
+	for k, v := range selector {
+		if t, ok := tags[k]; !ok || t != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SetWeight sets the share of calls made with CallAny that client gets,
+// relative to the weights of the other clients, e.g. its capacity advertised
+// when it registers. Clients have a weight of 1 when they connect and get no
+// calls with a weight of 0. The weight may be changed at any time.
+// SetWeight has no effect if client is not connected to the server.
+func (s *Server) SetWeight(client *Client, weight int) {
+	if weight < 0 {
+		weight = 0
+	}
+	r := &s.clients
+	r.mutex.Lock()
+	if e, ok := r.clients[client]; ok {
+		e.weight = weight
+	}
+	r.mutex.Unlock()
+}
+
+// CallAny calls method on one of the connected clients having all tags in
+// selector, or any of them if selector is nil, distributing calls among them
+// in proportion to their weights set with SetWeight, e.g. for dispatching jobs
+// to a fleet of workers. It returns ErrNoClients if no client with a positive
+// weight matches the selector.
+func (s *Server) CallAny(ctx context.Context, selector map[string]string, method string, args interface{}, reply interface{}) error {
+	client := s.clients.pick(selector)
+	if client == nil {
+		return ErrNoClients
+	}
+	return client.CallWithContext(ctx, method, args, reply)
+}
+
+// pick returns the next client matching selector by smooth weighted round-robin,
+// which spreads the calls of each client evenly over time.
+func (r *registry) pick(selector map[string]string) *Client {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var best *Client
+	var bestEntry *entry
+	total := 0
+	for c, e := range r.clients {
+		if e.weight == 0 || !matches(e.tags, selector) {
+			continue
+		}
+		e.current += e.weight
+		total += e.weight
+		if bestEntry == nil || e.current > bestEntry.current {
+			best, bestEntry = c, e
+		}
+	}
+	if best != nil {
+		bestEntry.current -= total
+	}
+	return best
+}
@@ -0,0 +1,88 @@
+package rpc2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TimeMethod is the name of the built-in method replying with the current
+// time of the peer in nanoseconds since the Unix epoch. SyncClock calls it
+// with its own time as the argument, which is ignored.
+const TimeMethod = "rpc.time"
+
+func init() {
+	addHandler(builtins, builtinIndex, TimeMethod, func(client *Client, args int64, reply *int64) error {
+		*reply = client.timeSource.Now().UnixNano()
+		return nil
+	})
+}
+
+// skewWindow is the number of recent samples used for estimating the clock offset.
+const skewWindow = 8
+
+type skewSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+// skewSamples keeps the most recent samples of the clock offset of the peer.
+type skewSamples struct {
+	mutex   sync.Mutex
+	samples [skewWindow]skewSample
+	n       int // total number of samples added
+}
+
+func (s *skewSamples) add(cs skewSample) {
+	s.mutex.Lock()
+	s.samples[s.n%skewWindow] = cs
+	s.n++
+	s.mutex.Unlock()
+}
+
+// best returns the offset of the sample with the lowest round-trip time,
+// which has the smallest error bound.
+func (s *skewSamples) best() (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := s.n
+	if n == 0 {
+		return 0, false
+	}
+	if n > skewWindow {
+		n = skewWindow
+	}
+	best := s.samples[0]
+	for _, cs := range s.samples[1:n] {
+		if cs.rtt < best.rtt {
+			best = cs
+		}
+	}
+	return best.offset, true
+}
+
+// SyncClock asks the peer for its time and returns the difference between
+// the clock of the peer and the local clock, assuming the request and the
+// response take the same time on the network. The error of the estimate is
+// at most half of the round-trip time.
+// Samples are kept for ClockOffset; call SyncClock periodically to follow drift.
+func (c *Client) SyncClock(ctx context.Context) (time.Duration, error) {
+	start := c.timeSource.Now()
+	var peer int64
+	if err := c.CallWithContext(ctx, TimeMethod, start.UnixNano(), &peer); err != nil {
+		return 0, err
+	}
+	rtt := c.timeSource.Now().Sub(start)
+	mid := start.Add(rtt / 2)
+	offset := time.Duration(peer - mid.UnixNano())
+	c.skew.add(skewSample{offset: offset, rtt: rtt})
+	return offset, nil
+}
+
+// ClockOffset returns the estimated difference between the clock of the peer
+// and the local clock, from the sample with the lowest round-trip time among
+// the 8 most recent calls to SyncClock. Add the offset to a local time to get
+// the corresponding peer time. It returns false if SyncClock has not succeeded yet.
+func (c *Client) ClockOffset() (time.Duration, bool) {
+	return c.skew.best()
+}
@@ -0,0 +1,150 @@
+// Command rpc2call calls a method on an rpc2 peer and prints the response.
+//
+//	rpc2call [flags] address method [args]
+//
+// Args are given as JSON. If args is "-", they are read from standard input.
+// If args are omitted, the call is made without arguments. The reply is
+// printed as JSON; with the jsonrpc codec it is printed as received.
+//
+//	$ rpc2call -codec jsonrpc localhost:5000 add '{"A": 1, "B": 2}'
+//	3
+//
+// Codecs that need type information to decode args, such as gob, are not
+// supported.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/cenkalti/rpc2/msgpackrpc"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rpc2call", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	codecName := flags.String("codec", "jsonrpc", "codec to use: jsonrpc or msgpack")
+	network := flags.String("network", "tcp", "network of the address, e.g. tcp or unix")
+	timeout := flags.Duration("timeout", 10*time.Second, "time to wait for the connection and the response")
+	notify := flags.Bool("notify", false, "send a notification instead of a call")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: rpc2call [flags] address method [args]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		flags.Usage()
+		return 2
+	}
+	address, method := flags.Arg(0), flags.Arg(1)
+
+	var params interface{}
+	if flags.NArg() == 3 {
+		b := []byte(flags.Arg(2))
+		if flags.Arg(2) == "-" {
+			var err error
+			if b, err = io.ReadAll(stdin); err != nil {
+				fmt.Fprintln(stderr, "rpc2call:", err)
+				return 1
+			}
+		}
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err := d.Decode(&params); err != nil {
+			fmt.Fprintln(stderr, "rpc2call: invalid args:", err)
+			return 2
+		}
+	}
+
+	var newCodec func(io.ReadWriteCloser) rpc2.Codec
+	switch *codecName {
+	case "jsonrpc":
+		newCodec = func(conn io.ReadWriteCloser) rpc2.Codec { return jsonrpc.NewJSONCodec(conn) }
+	case "msgpack":
+		newCodec = msgpackrpc.NewMsgpackCodec
+		params = fromJSONNumbers(params)
+	default:
+		fmt.Fprintln(stderr, "rpc2call: unknown codec:", *codecName)
+		return 2
+	}
+
+	conn, err := net.DialTimeout(*network, address, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, "rpc2call:", err)
+		return 1
+	}
+	clt := rpc2.NewClientWithCodec(newCodec(conn))
+	defer clt.Close()
+	go clt.Run()
+
+	if *notify {
+		if err = clt.Notify(method, params); err != nil {
+			fmt.Fprintln(stderr, "rpc2call:", err)
+			return 1
+		}
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var out []byte
+	if *codecName == "jsonrpc" {
+		var reply json.RawMessage
+		err = clt.CallWithContext(ctx, method, params, &reply)
+		out = reply
+	} else {
+		var reply interface{}
+		if err = clt.CallWithContext(ctx, method, params, &reply); err == nil {
+			out, err = json.Marshal(reply)
+		}
+	}
+	if err != nil {
+		var e *rpc2.Error
+		if errors.As(err, &e) {
+			fmt.Fprintf(stderr, "rpc2call: error %d: %s\n", e.Code, e.Message)
+		} else {
+			fmt.Fprintln(stderr, "rpc2call:", err)
+		}
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s\n", out)
+	return 0
+}
+
+// fromJSONNumbers converts json.Number values in v to int64 or float64
+// so codecs other than jsonrpc encode them as numbers.
+func fromJSONNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		for i := range x {
+			x[i] = fromJSONNumbers(x[i])
+		}
+	case map[string]interface{}:
+		for k := range x {
+			x[k] = fromJSONNumbers(x[k])
+		}
+	}
+	return v
+}
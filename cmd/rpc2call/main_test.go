@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/cenkalti/rpc2/msgpackrpc"
+)
+
+type Args struct{ A, B int }
+
+func listen(t *testing.T, newCodec func(io.ReadWriteCloser) rpc2.Codec) string {
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeCodec(newCodec(conn))
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	jsonAddr := listen(t, func(conn io.ReadWriteCloser) rpc2.Codec { return jsonrpc.NewJSONCodec(conn) })
+	msgpackAddr := listen(t, msgpackrpc.NewMsgpackCodec)
+
+	cases := []struct {
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{args: []string{jsonAddr, "add", `{"A": 1, "B": 2}`}, stdout: "3\n"},
+		{args: []string{jsonAddr, "add", "-"}, stdin: `{"A": 3, "B": 4}`, stdout: "7\n"},
+		{args: []string{"-codec", "msgpack", msgpackAddr, "add", `{"A": 1, "B": 2}`}, stdout: "3\n"},
+		{args: []string{jsonAddr, "sub", `{}`}, code: 1, stderr: "can't find method sub"},
+		{args: []string{jsonAddr, "add", `{`}, code: 2, stderr: "invalid args"},
+		{args: []string{jsonAddr}, code: 2, stderr: "usage"},
+	}
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		code := run(c.args, strings.NewReader(c.stdin), &stdout, &stderr)
+		if code != c.code || stdout.String() != c.stdout || !strings.Contains(stderr.String(), c.stderr) {
+			t.Errorf("%v: exit code %d, stdout %q, stderr %q", c.args, code, stdout.String(), stderr.String())
+		}
+	}
+}
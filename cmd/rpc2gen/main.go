@@ -0,0 +1,351 @@
+// Command rpc2gen generates a typed client and server glue for a Go interface.
+//
+// Every method of the interface is an RPC method. Methods take an optional
+// context.Context followed by at most one argument and return either a reply
+// and an error, or only an error:
+//
+//	type Calculator interface {
+//		Add(ctx context.Context, args Args) (int, error) // call
+//		Log(msg string) error                            // notification
+//	}
+//
+// Methods returning only an error are sent as notifications, so errors
+// returned by their implementations are not reported to the caller.
+//
+// Running rpc2gen in the directory of the package,
+//
+//	//go:generate rpc2gen -type Calculator
+//
+// writes calculator_rpc2.go with a CalculatorClient type implementing
+// Calculator by making calls on an *rpc2.Client, and a RegisterCalculator
+// function registering an implementation of Calculator as handlers on an
+// *rpc2.Server or *rpc2.Client.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const rpc2Path = "github.com/cenkalti/rpc2"
+
+func main() {
+	typeName := flag.String("type", "", "name of the interface type (required)")
+	output := flag.String("output", "", "output file name (default <type>_rpc2.go)")
+	prefix := flag.String("prefix", "", "prefix of RPC method names, e.g. \"Calculator.\"")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("rpc2gen: ")
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	src, err := generateDir(dir, *typeName, *prefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output == "" {
+		*output = filepath.Join(dir, strings.ToLower(*typeName)+"_rpc2.go")
+	}
+	if err = os.WriteFile(*output, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generateDir generates code for the interface named typeName in the package in dir.
+func generateDir(dir, typeName, prefix string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if it := findInterface(f, typeName); it != nil {
+			return generate(fset, f, typeName, it, prefix)
+		}
+	}
+	return nil, fmt.Errorf("interface %s not found in %s", typeName, dir)
+}
+
+func findInterface(f *ast.File, typeName string) *ast.InterfaceType {
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != typeName {
+				continue
+			}
+			if it, ok := ts.Type.(*ast.InterfaceType); ok {
+				return it
+			}
+		}
+	}
+	return nil
+}
+
+// method is an RPC method parsed from the interface.
+type method struct {
+	Name    string
+	Context bool   // takes a context.Context as the first argument
+	Args    string // type of the argument, empty if there is none
+	Reply   string // type of the reply, empty for notifications
+}
+
+type generator struct {
+	fset    *token.FileSet
+	file    *ast.File
+	imports map[string]string // package name to import path of used imports
+	buf     bytes.Buffer
+}
+
+// generate returns the formatted source of the client and server glue for it.
+func generate(fset *token.FileSet, f *ast.File, typeName string, it *ast.InterfaceType, prefix string) ([]byte, error) {
+	g := &generator{fset: fset, file: f, imports: make(map[string]string)}
+	var methods []method
+	for _, field := range it.Methods.List {
+		ft, ok := field.Type.(*ast.FuncType)
+		if !ok {
+			return nil, errors.New("embedded interfaces are not supported")
+		}
+		m, err := g.parseMethod(field.Names[0].Name, ft)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", typeName, field.Names[0].Name, err)
+		}
+		methods = append(methods, m)
+	}
+	g.writeFile(f.Name.Name, typeName, prefix, methods)
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %w", err)
+	}
+	return src, nil
+}
+
+func (g *generator) parseMethod(name string, ft *ast.FuncType) (method, error) {
+	m := method{Name: name}
+	var params []ast.Expr
+	for _, p := range ft.Params.List {
+		n := len(p.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, p.Type)
+		}
+	}
+	if len(params) > 0 && g.isContext(params[0]) {
+		m.Context = true
+		g.imports["context"] = "context"
+		params = params[1:]
+	}
+	switch len(params) {
+	case 0:
+	case 1:
+		m.Args = g.typeString(params[0])
+	default:
+		return m, errors.New("methods can take at most one argument besides the context")
+	}
+
+	var results []ast.Expr
+	if ft.Results != nil {
+		for _, r := range ft.Results.List {
+			n := len(r.Names)
+			if n == 0 {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				results = append(results, r.Type)
+			}
+		}
+	}
+	switch {
+	case len(results) == 1 && isError(results[0]):
+	case len(results) == 2 && isError(results[1]):
+		m.Reply = g.typeString(results[0])
+	default:
+		return m, errors.New("methods must return (reply, error) or error")
+	}
+	if m.Reply == "" && m.Context {
+		return m, errors.New("notifications can not take a context")
+	}
+	return m, nil
+}
+
+func isError(e ast.Expr) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == "error"
+}
+
+func (g *generator) isContext(e ast.Expr) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Context" {
+		return false
+	}
+	id, ok := sel.X.(*ast.Ident)
+	return ok && g.importPath(id.Name) == "context"
+}
+
+// importPath returns the path of the package imported with name in the file.
+func (g *generator) importPath(name string) string {
+	for _, spec := range g.file.Imports {
+		p, _ := strconv.Unquote(spec.Path.Value)
+		if spec.Name != nil {
+			if spec.Name.Name == name {
+				return p
+			}
+		} else if path.Base(p) == name {
+			return p
+		}
+	}
+	return ""
+}
+
+// typeString returns the source of the type expression e
+// and records the imports it uses.
+func (g *generator) typeString(e ast.Expr) string {
+	ast.Inspect(e, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				if p := g.importPath(id.Name); p != "" {
+					g.imports[id.Name] = p
+				}
+			}
+			return false
+		}
+		return true
+	})
+	var buf bytes.Buffer
+	printer.Fprint(&buf, g.fset, e)
+	return buf.String()
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) writeFile(pkg, typeName, prefix string, methods []method) {
+	g.printf("// Code generated by rpc2gen; DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", pkg)
+
+	names := make([]string, 0, len(g.imports))
+	for name := range g.imports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	g.printf("import (\n")
+	for _, name := range names {
+		p := g.imports[name]
+		if p == rpc2Path {
+			continue
+		}
+		if path.Base(p) == name {
+			g.printf("%q\n", p)
+		} else {
+			g.printf("%s %q\n", name, p)
+		}
+	}
+	g.printf("\n%q\n)\n\n", rpc2Path)
+
+	client := typeName + "Client"
+	g.printf("// %s implements %s by making calls on a *rpc2.Client.\n", client, typeName)
+	g.printf("type %s struct {\nClient *rpc2.Client\n}\n\n", client)
+	g.printf("var _ %s = (*%s)(nil)\n\n", typeName, client)
+	g.printf("// New%s returns a new %s making calls on c.\n", client, client)
+	g.printf("func New%s(c *rpc2.Client) *%s {\nreturn &%s{Client: c}\n}\n\n", client, client, client)
+
+	for _, m := range methods {
+		g.printf("func (c *%s) %s(%s) %s {\n", client, m.Name, m.params(), m.results())
+		args := "nil"
+		if m.Args != "" {
+			args = "args"
+		}
+		switch {
+		case m.Reply == "":
+			g.printf("return c.Client.Notify(%q, %s)\n", prefix+m.Name, args)
+		case m.Context:
+			g.printf("var reply %s\nerr := c.Client.CallWithContext(ctx, %q, %s, &reply)\nreturn reply, err\n", m.Reply, prefix+m.Name, args)
+		default:
+			g.printf("var reply %s\nerr := c.Client.Call(%q, %s, &reply)\nreturn reply, err\n", m.Reply, prefix+m.Name, args)
+		}
+		g.printf("}\n\n")
+	}
+
+	g.printf("// Register%s registers the methods of impl as handlers on h,\n", typeName)
+	g.printf("// which is typically a *rpc2.Server or *rpc2.Client.\n")
+	g.printf("func Register%s(h interface{ Handle(string, interface{}) }, impl %s) {\n", typeName, typeName)
+	for _, m := range methods {
+		reply := m.Reply
+		if reply == "" {
+			reply = "struct{}"
+		}
+		g.printf("h.Handle(%q, func(", prefix+m.Name)
+		if m.Context {
+			g.printf("ctx context.Context, ")
+		}
+		g.printf("client *rpc2.Client, ")
+		if m.Args != "" {
+			g.printf("args %s, ", m.Args)
+		}
+		g.printf("reply *%s) error {\n", reply)
+		var callArgs []string
+		if m.Context {
+			callArgs = append(callArgs, "ctx")
+		}
+		if m.Args != "" {
+			callArgs = append(callArgs, "args")
+		}
+		if m.Reply == "" {
+			g.printf("return impl.%s(%s)\n", m.Name, strings.Join(callArgs, ", "))
+		} else {
+			g.printf("r, err := impl.%s(%s)\nif err != nil {\nreturn err\n}\n*reply = r\nreturn nil\n", m.Name, strings.Join(callArgs, ", "))
+		}
+		g.printf("})\n")
+	}
+	g.printf("}\n")
+}
+
+func (m method) params() string {
+	var params []string
+	if m.Context {
+		params = append(params, "ctx context.Context")
+	}
+	if m.Args != "" {
+		params = append(params, "args "+m.Args)
+	}
+	return strings.Join(params, ", ")
+}
+
+func (m method) results() string {
+	if m.Reply == "" {
+		return "error"
+	}
+	return "(" + m.Reply + ", error)"
+}
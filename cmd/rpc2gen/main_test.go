@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	src, err := generateDir("testdata", "Calculator", "Calculator.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := os.ReadFile("testdata/calc_rpc2.go.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, golden) {
+		t.Fatalf("generated code does not match testdata/calc_rpc2.go.golden:\n%s", src)
+	}
+}
+
+func TestInvalidMethods(t *testing.T) {
+	cases := map[string]string{
+		"two args":         "Foo(a, b int) (int, error)",
+		"no error":         "Foo(a int) int",
+		"two replies":      "Foo(a int) (int, int, error)",
+		"notification ctx": "Foo(ctx context.Context, a int) error",
+	}
+	for name, m := range cases {
+		src := "package p\nimport \"context\"\ntype I interface {\n" + m + "\n}\n"
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "p.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = generate(fset, f, "I", findInterface(f, "I"), "")
+		if err == nil || !strings.HasPrefix(err.Error(), "I.Foo: ") {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package calc
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+type Args struct{ A, B int }
+
+type Calculator interface {
+	Add(ctx context.Context, args Args) (int, error)
+	Sleep(d time.Duration) (time.Time, error)
+	Status() (string, error)
+	Log(msg string) error
+}
+
+// Not used by Calculator, must not be imported by the generated code.
+var _ io.Reader
+var _ *rpc2.Client
@@ -0,0 +1,69 @@
+// Command rpc2inspect prints the messages in a captured rpc2 byte stream.
+//
+//	rpc2inspect [-codec jsonrpc] [file]
+//
+// The stream is read from standard input if file is omitted. It must contain
+// the bytes written in one direction of a connection.
+//
+//	$ rpc2inspect -codec msgpack client.bin
+//	request id=1 method="add" params=[{"A":1,"B":2}]
+//	notification method="log" params=["hello"]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cenkalti/rpc2/inspect"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rpc2inspect", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	codec := flags.String("codec", inspect.JSONRPC, "codec of the stream: "+strings.Join(inspect.Codecs, ", "))
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: rpc2inspect [flags] [file]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	r := stdin
+	if flags.NArg() == 1 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(stderr, "rpc2inspect:", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	d, err := inspect.NewDecoder(*codec, r)
+	if err != nil {
+		fmt.Fprintln(stderr, "rpc2inspect:", err)
+		return 2
+	}
+	for {
+		rec, err := d.Next()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "rpc2inspect:", err)
+			return 1
+		}
+		fmt.Fprintln(stdout, rec)
+	}
+}
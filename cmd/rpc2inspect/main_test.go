@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	in := `{"method":"add","params":[{"A":1}],"id":1}
+{"id":1,"result":1,"error":null}
+{"method":"log","params":["hi"],"id":null}
+`
+	var stdout, stderr bytes.Buffer
+	if code := run(nil, strings.NewReader(in), &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	want := `request id=1 method="add" params=[{"A":1}]
+response id=1 result=1
+notification method="log" params=["hi"]
+`
+	if stdout.String() != want {
+		t.Fatalf("unexpected output:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-codec", "avro"}, strings.NewReader(""), &stdout, &stderr); code != 2 {
+		t.Fatalf("unexpected exit code for unsupported codec: %d", code)
+	}
+}
@@ -0,0 +1,151 @@
+package rpc2
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CoalescingConn buffers writes to a connection and writes them together,
+// which reduces system calls when many small messages are sent, e.g. by
+// high-rate notifications. Buffered data is written when it reaches the size
+// threshold or when the delay has passed since the first buffered write,
+// whichever comes first.
+type CoalescingConn struct {
+	io.ReadWriteCloser
+	delay time.Duration
+	size  int
+	clock Clock
+
+	mutex    sync.Mutex // protects the fields below
+	buf      []byte
+	timer    Timer         // started when buf becomes non-empty
+	stop     chan struct{} // closed when timer is stopped
+	disabled bool
+	err      error // of the last write, returned from subsequent writes
+}
+
+// NewCoalescingConn returns conn with writes coalesced for up to delay
+// or until size bytes are buffered.
+func NewCoalescingConn(conn io.ReadWriteCloser, delay time.Duration, size int) *CoalescingConn {
+	return &CoalescingConn{ReadWriteCloser: conn, delay: delay, size: size, clock: RealClock}
+}
+
+// SetClock sets the source of time of the delay. It must be called before writing.
+func (c *CoalescingConn) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+func (c *CoalescingConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.disabled {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+		n, err := c.ReadWriteCloser.Write(p)
+		c.err = err
+		return n, err
+	}
+	c.buf = append(c.buf, p...)
+	if len(c.buf) >= c.size {
+		return len(p), c.flush()
+	}
+	if len(c.buf) == len(p) {
+		c.timer = c.clock.NewTimer(c.delay)
+		c.stop = make(chan struct{})
+		go c.flushLater(c.timer, c.stop)
+	}
+	return len(p), nil
+}
+
+// Flush writes buffered data to the connection.
+func (c *CoalescingConn) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.flush()
+}
+
+func (c *CoalescingConn) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		close(c.stop)
+		c.timer = nil
+	}
+	if len(c.buf) == 0 || c.err != nil {
+		return c.err
+	}
+	_, c.err = c.ReadWriteCloser.Write(c.buf)
+	c.buf = c.buf[:0]
+	return c.err
+}
+
+// flushLater flushes when timer fires unless stop is closed first. Since no
+// writer is waiting for the result, the connection is closed if the write
+// fails so the reader notices the failure.
+func (c *CoalescingConn) flushLater(timer Timer, stop chan struct{}) {
+	select {
+	case <-timer.C():
+	case <-stop:
+		return
+	}
+	if err := c.Flush(); err != nil {
+		debugln("rpc2: error writing coalesced messages:", err.Error())
+		c.ReadWriteCloser.Close()
+	}
+}
+
+// SetCoalescing turns coalescing on or off. Buffered data is written
+// when it is turned off, so latency-critical connections can opt out.
+func (c *CoalescingConn) SetCoalescing(enabled bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.disabled = !enabled
+	if c.disabled {
+		c.flush()
+	}
+}
+
+// Close writes buffered data and closes the connection.
+func (c *CoalescingConn) Close() error {
+	c.Flush()
+	return c.ReadWriteCloser.Close()
+}
+
+// RemoteAddr returns the remote address of the connection if it has one, nil otherwise.
+func (c *CoalescingConn) RemoteAddr() net.Addr {
+	if conn, ok := c.ReadWriteCloser.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the connection if it has one, nil otherwise.
+func (c *CoalescingConn) LocalAddr() net.Addr {
+	if conn, ok := c.ReadWriteCloser.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// SetWriteCoalescing turns write coalescing on or off for the connection of
+// the client if it is a CoalescingConn, e.g. a connection served by a server
+// with write coalescing. It has no effect on other connections.
+func (c *Client) SetWriteCoalescing(enabled bool) {
+	if cc, ok := c.Conn().(*CoalescingConn); ok {
+		cc.SetCoalescing(enabled)
+	}
+}
+
+// SetWriteCoalescing makes connections served with ServeConn and Accept
+// coalesce writes for up to delay or until size bytes are buffered, see
+// CoalescingConn. Handlers may opt clients out with Client.SetWriteCoalescing.
+// Zero delay disables coalescing. It must be called before serving connections.
+func (s *Server) SetWriteCoalescing(delay time.Duration, size int) {
+	s.coalesceDelay = delay
+	s.coalesceSize = size
+}
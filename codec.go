@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"io"
 	"sync"
+	"time"
 )
 
 // A Codec implements reading and writing of RPC requests and responses.
@@ -13,7 +14,10 @@ import (
 // Depending on which argument is populated, ReadRequestBody or
 // ReadResponseBody is called right after ReadHeader.
 // ReadRequestBody and ReadResponseBody may be called with a nil
-// argument to force the body to be read and then discarded.
+// argument to force the body to be read and then discarded, e.g. for
+// calls made with a nil reply.
+// Requests and responses given to WriteRequest and WriteResponse
+// are reused after they return and must not be retained.
 type Codec interface {
 	// ReadHeader must read a message and populate either the request
 	// or the response by inspecting the incoming message.
@@ -35,16 +39,50 @@ type Codec interface {
 	Close() error
 }
 
+// ConnCodec is implemented by codecs that can report the connection they are reading from and writing to.
+type ConnCodec interface {
+	Conn() io.ReadWriteCloser
+}
+
+// ForgetCodec is implemented by codecs keeping state of outgoing requests
+// until their responses are read. Forget is called with the sequence number
+// of a request whose call completed without a response, because it was
+// canceled, timed out or could not be written, so the codec can release it.
+// A response arriving afterwards may be read with a zero sequence number.
+type ForgetCodec interface {
+	Forget(seq uint64)
+}
+
 // Request is a header written before every RPC call.
 type Request struct {
 	Seq    uint64 // sequence number chosen by client
 	Method string
+
+	// Metadata are key-value pairs sent along with the call, added with
+	// WithMetadata or by the package, such as the remaining time budget of
+	// the caller under TimeoutKey. Codecs that can not carry metadata ignore it.
+	Metadata map[string]string
+
+	// Attachments are binary blobs sent along with the call, added with
+	// WithAttachments. Codecs that can not carry attachments ignore them.
+	Attachments [][]byte
 }
 
 // Response is a header written before every RPC return.
 type Response struct {
 	Seq   uint64 // echoes that of the request
 	Error string // error, if any.
+	Code  int    // error code, if any. Zero means unspecified.
+
+	// RetryAfter is the delay suggested to the caller before retrying, if any.
+	RetryAfter time.Duration
+
+	// Partial is set by codecs when the body of an error response holds
+	// a result, which is then decoded into the reply of the call.
+	Partial bool
+
+	// Details of the error, see Error. Codecs that can not carry them ignore them.
+	Details []interface{}
 }
 
 type gobCodec struct {
@@ -56,9 +94,14 @@ type gobCodec struct {
 }
 
 type message struct {
-	Seq    uint64
-	Method string
-	Error  string
+	Seq        uint64
+	Method     string
+	Error      string
+	Code       int
+	RetryAfter time.Duration
+	Metadata   map[string]string
+
+	Attachments [][]byte
 }
 
 // NewGobCodec returns a new rpc2.Codec using gob encoding/decoding on conn.
@@ -81,9 +124,13 @@ func (c *gobCodec) ReadHeader(req *Request, resp *Response) error {
 	if msg.Method != "" {
 		req.Seq = msg.Seq
 		req.Method = msg.Method
+		req.Metadata = msg.Metadata
+		req.Attachments = msg.Attachments
 	} else {
 		resp.Seq = msg.Seq
 		resp.Error = msg.Error
+		resp.Code = msg.Code
+		resp.RetryAfter = msg.RetryAfter
 	}
 	return nil
 }
@@ -109,6 +156,15 @@ func (c *gobCodec) WriteRequest(r *Request, body interface{}) (err error) {
 }
 
 func (c *gobCodec) WriteResponse(r *Response, body interface{}) (err error) {
+	if r.Details != nil {
+		// Gob can not encode details of unregistered types.
+		stripped := *r
+		stripped.Details = nil
+		if body == interface{}(r) {
+			body = &stripped
+		}
+		r = &stripped
+	}
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	if err = c.enc.Encode(r); err != nil {
@@ -120,6 +176,10 @@ func (c *gobCodec) WriteResponse(r *Response, body interface{}) (err error) {
 	return c.encBuf.Flush()
 }
 
+func (c *gobCodec) Conn() io.ReadWriteCloser {
+	return c.rwc
+}
+
 func (c *gobCodec) Close() error {
 	return c.rwc.Close()
 }
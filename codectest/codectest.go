@@ -0,0 +1,224 @@
+// Package codectest implements a conformance suite for rpc2 codecs.
+//
+// Authors of codecs call Run from a test to verify that their codec works
+// with the dispatcher of rpc2:
+//
+//	func TestConformance(t *testing.T) {
+//		codectest.Run(t, mycodec.NewCodec)
+//	}
+//
+// The suite uses structs with exported int fields, ints and strings as args
+// and replies, so it is meant for codecs that can encode arbitrary Go values.
+package codectest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// Factory returns a new codec on conn.
+type Factory func(conn io.ReadWriteCloser) rpc2.Codec
+
+// Args is the argument type of the methods called by the suite.
+type Args struct {
+	A, B int
+}
+
+// timeout is how long the suite waits for a single operation.
+const timeout = 5 * time.Second
+
+// largeSize is the size of the payload in the large payload test.
+const largeSize = 1 << 20
+
+// Run runs the conformance suite against codecs returned by newCodec.
+func Run(t *testing.T, newCodec Factory) {
+	t.Run("Call", func(t *testing.T) { testCall(t, newCodec) })
+	t.Run("Notification", func(t *testing.T) { testNotification(t, newCodec) })
+	t.Run("ReverseCall", func(t *testing.T) { testReverseCall(t, newCodec) })
+	t.Run("ConcurrentCalls", func(t *testing.T) { testConcurrentCalls(t, newCodec) })
+	t.Run("NilReply", func(t *testing.T) { testNilReply(t, newCodec) })
+	t.Run("Errors", func(t *testing.T) { testErrors(t, newCodec) })
+	t.Run("LargePayload", func(t *testing.T) { testLargePayload(t, newCodec) })
+}
+
+// pair returns a client connected to a new server with handlers registered.
+// If setup is not nil, it is called to register more handlers on the server.
+func pair(t *testing.T, newCodec Factory, setup func(*rpc2.Server)) *rpc2.Client {
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+	srv.Handle("fail", func(client *rpc2.Client, args *Args, reply *int) error {
+		return errors.New("failed")
+	})
+	srv.Handle("reverse", func(client *rpc2.Client, args *Args, reply *int) error {
+		return client.Call("mult", args, reply)
+	})
+	if setup != nil {
+		setup(srv)
+	}
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(newCodec(c1))
+	clt := rpc2.NewClientWithCodec(newCodec(c2))
+	clt.Handle("mult", func(client *rpc2.Client, args *Args, reply *int) error {
+		*reply = args.A * args.B
+		return nil
+	})
+	go clt.Run()
+	t.Cleanup(func() { clt.Close() })
+	return clt
+}
+
+// call makes a call and fails the test if it does not return in time.
+func call(t *testing.T, clt *rpc2.Client, method string, args, reply interface{}) error {
+	c := clt.Go(method, args, reply, nil)
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-time.After(timeout):
+		t.Fatalf("call to %s timed out", method)
+		return nil
+	}
+}
+
+func testCall(t *testing.T, newCodec Factory) {
+	clt := pair(t, newCodec, nil)
+	var reply int
+	if err := call(t, clt, "add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 3 {
+		t.Fatalf("add returned %d, want 3", reply)
+	}
+}
+
+func testNotification(t *testing.T, newCodec Factory) {
+	received := make(chan Args, 1)
+	clt := pair(t, newCodec, func(srv *rpc2.Server) {
+		srv.Handle("notify", func(client *rpc2.Client, args *Args, reply *struct{}) error {
+			received <- *args
+			return nil
+		})
+	})
+	if err := clt.Notify("notify", Args{4, 5}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case args := <-received:
+		if args != (Args{4, 5}) {
+			t.Fatalf("notification received with args %+v", args)
+		}
+	case <-time.After(timeout):
+		t.Fatal("notification is not received")
+	}
+	// The connection must still work after a notification.
+	var reply int
+	if err := call(t, clt, "add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testReverseCall(t *testing.T, newCodec Factory) {
+	clt := pair(t, newCodec, nil)
+	var reply int
+	if err := call(t, clt, "reverse", Args{3, 4}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 12 {
+		t.Fatalf("reverse returned %d, want 12", reply)
+	}
+}
+
+func testConcurrentCalls(t *testing.T, newCodec Factory) {
+	clt := pair(t, newCodec, nil)
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			c := clt.Go("add", Args{i, i}, &reply, nil)
+			select {
+			case <-c.Done:
+			case <-time.After(timeout):
+				errs <- fmt.Errorf("call %d timed out", i)
+				return
+			}
+			if c.Error != nil {
+				errs <- c.Error
+			} else if reply != 2*i {
+				errs <- fmt.Errorf("call %d returned %d", i, reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testNilReply(t *testing.T, newCodec Factory) {
+	clt := pair(t, newCodec, nil)
+	if err := call(t, clt, "add", Args{1, 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(t, clt, "fail", Args{}, nil); err == nil {
+		t.Fatal("fail returned no error")
+	}
+	// The discarded results must not leave the connection out of sync.
+	var reply int
+	if err := call(t, clt, "add", Args{3, 4}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 7 {
+		t.Fatalf("add returned %d, want 7", reply)
+	}
+}
+
+func testErrors(t *testing.T, newCodec Factory) {
+	clt := pair(t, newCodec, nil)
+	var reply int
+	err := call(t, clt, "fail", Args{}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("fail returned error %v", err)
+	}
+	if err = call(t, clt, "undefined", Args{}, &reply); err == nil {
+		t.Fatal("undefined method returned no error")
+	}
+	// The connection must still work after errors.
+	if err = call(t, clt, "add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 3 {
+		t.Fatalf("add returned %d, want 3", reply)
+	}
+}
+
+func testLargePayload(t *testing.T, newCodec Factory) {
+	clt := pair(t, newCodec, nil)
+	s := strings.Repeat("x", largeSize)
+	var reply string
+	if err := call(t, clt, "echo", s, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != s {
+		t.Fatalf("echo returned %d bytes, want %d", len(reply), len(s))
+	}
+}
@@ -0,0 +1,11 @@
+package codectest
+
+import (
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+func TestGob(t *testing.T) {
+	Run(t, rpc2.NewGobCodec)
+}
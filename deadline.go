@@ -0,0 +1,64 @@
+package rpc2
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// TimeoutKey is the metadata key of the remaining time budget of a call,
+// in milliseconds. It is set on calls made with a context having a deadline.
+// Handlers taking a context.Context get one with the same deadline, so calls
+// they make with it to other peers carry what is left of the budget.
+const TimeoutKey = "rpc2.timeout"
+
+// encodeTimeout formats d in milliseconds, rounded down so the budget
+// never grows on the way. Expired budgets are zero.
+func encodeTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0"
+	}
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+// decodeTimeout parses a budget formatted by encodeTimeout.
+func decodeTimeout(s string) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms < 0 || ms > int64(1<<63-1)/int64(time.Millisecond) {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// handlerContext returns the context for handling req, derived from parent.
+// It has a deadline if the caller sent its remaining time budget.
+func handlerContext(parent context.Context, req *Request) (context.Context, context.CancelFunc) {
+	if s, ok := req.Metadata[TimeoutKey]; ok {
+		if d, ok := decodeTimeout(s); ok {
+			return context.WithTimeout(parent, d)
+		}
+		debugln("rpc2: invalid timeout in call to", req.Method+":", s)
+	}
+	return context.WithCancel(parent)
+}
+
+// requestMetadata returns the metadata to send with call at now.
+func (call *Call) requestMetadata(now time.Time) map[string]string {
+	if call.deadline.IsZero() && !call.cancel && !call.dynamic {
+		return call.metadata
+	}
+	md := make(map[string]string, len(call.metadata)+3)
+	for k, v := range call.metadata {
+		md[k] = v
+	}
+	if !call.deadline.IsZero() {
+		md[TimeoutKey] = encodeTimeout(call.deadline.Sub(now))
+	}
+	if call.cancel {
+		md[CancelKey] = strconv.FormatUint(call.seq, 10)
+	}
+	if call.dynamic {
+		md[DynamicKey] = "1"
+	}
+	return md
+}
@@ -1,12 +1,39 @@
 package rpc2
 
-import "log"
+import (
+	"log"
+	"sync/atomic"
+)
 
 // DebugLog controls the printing of internal and I/O errors.
 var DebugLog = false
 
+// Logger receives the log output of rpc2. *log.Logger implements it.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+// loggerHolder keeps atomic.Value storing a single concrete type.
+type loggerHolder struct{ Logger }
+
+var logger atomic.Value
+
+func init() {
+	logger.Store(loggerHolder{log.Default()})
+}
+
+// SetLogger sets the logger used for debug and slow call logs.
+// The default logger is the standard logger of the log package.
+func SetLogger(l Logger) {
+	logger.Store(loggerHolder{l})
+}
+
+func logln(v ...interface{}) {
+	logger.Load().(loggerHolder).Println(v...)
+}
+
 func debugln(v ...interface{}) {
 	if DebugLog {
-		log.Println(v...)
+		logln(v...)
 	}
 }
@@ -0,0 +1,146 @@
+package rpc2
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// IdempotencyKey is the metadata key identifying a call for deduplication,
+// see Server.SetDeduplication. Callers set it with WithIdempotencyKey.
+const IdempotencyKey = "idempotency-key"
+
+// WithIdempotencyKey returns a copy of ctx adding key to the metadata of calls
+// made with it, so retries of a call with the same key are handled once by
+// servers deduplicating calls. Keys must be unique, e.g. random UUIDs.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return WithMetadata(ctx, map[string]string{IdempotencyKey: key})
+}
+
+// SetDeduplication makes the server remember the responses of calls having an
+// IdempotencyKey for window after they are handled. Calls with the same key
+// get the remembered response without running the handler again, which
+// protects non-idempotent handlers from retries of calls whose responses were
+// lost. Calls arriving while the first one is handled wait for its response.
+//
+// If identify is not nil, keys are scoped to the identity it returns for the
+// client, e.g. an authenticated user, so clients can not see responses to
+// each other. Otherwise keys are shared by all clients.
+// Zero window disables deduplication. It must be called before serving connections.
+func (s *Server) SetDeduplication(window time.Duration, identify func(*Client) string) {
+	if window <= 0 {
+		s.dedup = nil
+		return
+	}
+	s.dedup = &dedupCache{
+		window:   window,
+		identify: identify,
+		entries:  make(map[dedupKey]*dedupEntry),
+	}
+}
+
+type dedupKey struct {
+	identity string
+	method   string
+	key      string
+}
+
+// dedupEntry is the response of a call, available when done is closed.
+type dedupEntry struct {
+	done      chan struct{}
+	reply     interface{}
+	err       error
+	expires   time.Time
+	forgotten bool // the call is abandoned and must be handled again
+}
+
+// dedupCache remembers responses of calls by their idempotency keys.
+type dedupCache struct {
+	window   time.Duration
+	identify func(*Client) string
+
+	mutex   sync.Mutex // protects entries, expiry
+	entries map[dedupKey]*dedupEntry
+	expiry  []dedupKey // of finished entries, in order of expiration
+}
+
+// begin returns the entry of the call and whether it is the first one with
+// its key, in which case the caller must handle it and call finish.
+func (d *dedupCache) begin(c *Client, method, key string) (dedupKey, *dedupEntry, bool) {
+	k := dedupKey{method: method, key: key}
+	if d.identify != nil {
+		k.identity = d.identify(c)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.expire(c.timeSource.Now())
+	if e, ok := d.entries[k]; ok {
+		return k, e, false
+	}
+	e := &dedupEntry{done: make(chan struct{})}
+	d.entries[k] = e
+	return k, e, true
+}
+
+// finish remembers the response of the call, unless it is abandoned by the
+// caller or the connection, so the caller can retry it with the same key.
+func (d *dedupCache) finish(now time.Time, k dedupKey, e *dedupEntry, reply interface{}, err error) {
+	d.mutex.Lock()
+	e.reply, e.err = reply, err
+	if abandoned(err) {
+		e.forgotten = true
+		delete(d.entries, k)
+	} else {
+		e.expires = now.Add(d.window)
+		d.expiry = append(d.expiry, k)
+	}
+	d.mutex.Unlock()
+	close(e.done)
+}
+
+// abandoned returns true if err is returned from a handler because the call
+// is canceled, its deadline is exceeded or the connection is closed.
+func abandoned(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrShutdown)
+}
+
+// expire removes entries expired at now.
+func (d *dedupCache) expire(now time.Time) {
+	for len(d.expiry) > 0 {
+		k := d.expiry[0]
+		if e := d.entries[k]; e != nil && now.Before(e.expires) {
+			return
+		}
+		delete(d.entries, k)
+		d.expiry[0] = dedupKey{}
+		d.expiry = d.expiry[1:]
+	}
+}
+
+// invokeOnce is like invoke but returns the remembered response
+// if the call is a duplicate of one handled recently.
+func (c *Client) invokeOnce(ctx context.Context, name string, method *handler, r incoming) (interface{}, error) {
+	key, ok := r.req.Metadata[IdempotencyKey]
+	if c.dedup == nil || !ok || r.req.Seq == 0 {
+		return c.invoke(ctx, name, method, r)
+	}
+	for {
+		k, e, first := c.dedup.begin(c, name, key)
+		if first {
+			reply, err := c.invoke(ctx, name, method, r)
+			c.dedup.finish(c.timeSource.Now(), k, e, reply, err)
+			return reply, err
+		}
+		select {
+		case <-e.done:
+			if !e.forgotten {
+				return e.reply, e.err
+			}
+			// The first call is abandoned, handle this one instead.
+		case <-ctx.Done():
+			return reflect.New(method.replyType.Elem()).Interface(), ctx.Err()
+		}
+	}
+}
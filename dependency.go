@@ -0,0 +1,54 @@
+package rpc2
+
+import "sync"
+
+// dependencies are values shared with handlers, such as databases and services.
+type dependencies struct {
+	m      sync.RWMutex
+	values map[string]interface{}
+}
+
+func (d *dependencies) get(key string) (value interface{}, ok bool) {
+	d.m.RLock()
+	value, ok = d.values[key]
+	d.m.RUnlock()
+	return
+}
+
+func (d *dependencies) set(key string, value interface{}) {
+	d.m.Lock()
+	if d.values == nil {
+		d.values = make(map[string]interface{})
+	}
+	d.values[key] = value
+	d.m.Unlock()
+}
+
+// SetDependency makes value available to handlers under key through
+// Client.Dependency, so handlers can reach databases and services without
+// global variables, and tests can serve handlers with fakes:
+//
+//	srv.SetDependency("db", db)
+//	srv.Handle("user.get", func(client *rpc2.Client, id int, reply *User) error {
+//		db := client.Dependency("db").(*sql.DB)
+//		...
+//	})
+//
+// It may be called while serving connections.
+func (s *Server) SetDependency(key string, value interface{}) {
+	s.deps.set(key, value)
+}
+
+// SetDependency makes value available to handlers of the client under key.
+// Clients served by a server share the dependencies of the server, so
+// setting them on such a client sets them for all clients of the server.
+func (c *Client) SetDependency(key string, value interface{}) {
+	c.deps.set(key, value)
+}
+
+// Dependency returns the value set under key with SetDependency
+// on the client or its server, nil if there is none.
+func (c *Client) Dependency(key string) interface{} {
+	value, _ := c.deps.get(key)
+	return value
+}
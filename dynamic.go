@@ -0,0 +1,151 @@
+package rpc2
+
+import (
+	"encoding"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// DynamicKey is the metadata key set on calls whose replies are decoded into
+// a *interface{} or a *map[string]interface{}, by codecs that can not decode
+// arbitrary values into them, i.e. gob and loopback codecs. Handlers of such
+// calls send their replies in a generic form, which these codecs can decode:
+// structs and maps become map[string]interface{}, slices and arrays become
+// []interface{} and values of named basic types become values of their basic
+// types. Structs are mapped by the names of their exported fields.
+//
+// Values of time.Time and of types implementing gob.GobEncoder or
+// encoding.BinaryMarshaler are sent as they are, so types other than
+// time.Time must be registered with gob.Register on both peers.
+const DynamicKey = "rpc2.dynamic"
+
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+}
+
+// dynamicValue carries a reply in generic form. The value is in an interface
+// so gob sends its type along with it.
+type dynamicValue struct {
+	Value interface{}
+}
+
+var (
+	typeOfInterface       = reflect.TypeOf((*interface{})(nil)).Elem()
+	typeOfGenericMap      = reflect.TypeOf(map[string]interface{}(nil))
+	typeOfTime            = reflect.TypeOf(time.Time{})
+	typeOfGobEncoder      = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	typeOfBinaryMarshaler = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// isDynamic returns true if the reply of a call made with codec must be sent in
+// generic form, see DynamicKey.
+func isDynamic(codec Codec, reply interface{}) bool {
+	switch codec.(type) {
+	case *gobCodec, *loopbackCodec:
+	default:
+		return false
+	}
+	t := reflect.TypeOf(reply)
+	return t != nil && t.Kind() == reflect.Ptr && (t.Elem() == typeOfInterface || t.Elem() == typeOfGenericMap)
+}
+
+// readReply reads the body of a response into the reply of call.
+func readReply(read func(interface{}) error, call *Call, reply interface{}) error {
+	if reply == nil || !call.dynamic {
+		return readBody(read, reply)
+	}
+	var v dynamicValue
+	if err := read(&v); err != nil {
+		return err
+	}
+	return assign(reply, v.Value)
+}
+
+// genericReply returns reply, a pointer, in generic form if the caller asked for it.
+func genericReply(req *Request, reply interface{}) interface{} {
+	if _, ok := req.Metadata[DynamicKey]; !ok {
+		return reply
+	}
+	return &dynamicValue{Value: generic(reflect.ValueOf(reply))}
+}
+
+// generic returns the generic form of v, see DynamicKey.
+func generic(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	if t == typeOfTime || t.Implements(typeOfGobEncoder) || t.Implements(typeOfBinaryMarshaler) {
+		return v.Interface()
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return generic(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{}, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() {
+				m[f.Name] = generic(v.Field(i))
+			}
+		}
+		return m
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k := iter.Key()
+			if k.Kind() == reflect.String {
+				m[k.String()] = generic(iter.Value())
+			} else {
+				m[fmt.Sprint(k.Interface())] = generic(iter.Value())
+			}
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return v.Bytes()
+		}
+		a := make([]interface{}, v.Len())
+		for i := range a {
+			a[i] = generic(v.Index(i))
+		}
+		return a
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return nil
+	}
+	// Basic kinds, converted to the unnamed type so gob knows it.
+	return v.Convert(basicTypes[t.Kind()]).Interface()
+}
+
+var basicTypes = map[reflect.Kind]reflect.Type{
+	reflect.Bool:       reflect.TypeOf(false),
+	reflect.Int:        reflect.TypeOf(int(0)),
+	reflect.Int8:       reflect.TypeOf(int8(0)),
+	reflect.Int16:      reflect.TypeOf(int16(0)),
+	reflect.Int32:      reflect.TypeOf(int32(0)),
+	reflect.Int64:      reflect.TypeOf(int64(0)),
+	reflect.Uint:       reflect.TypeOf(uint(0)),
+	reflect.Uint8:      reflect.TypeOf(uint8(0)),
+	reflect.Uint16:     reflect.TypeOf(uint16(0)),
+	reflect.Uint32:     reflect.TypeOf(uint32(0)),
+	reflect.Uint64:     reflect.TypeOf(uint64(0)),
+	reflect.Uintptr:    reflect.TypeOf(uintptr(0)),
+	reflect.Float32:    reflect.TypeOf(float32(0)),
+	reflect.Float64:    reflect.TypeOf(float64(0)),
+	reflect.Complex64:  reflect.TypeOf(complex64(0)),
+	reflect.Complex128: reflect.TypeOf(complex128(0)),
+	reflect.String:     reflect.TypeOf(""),
+}
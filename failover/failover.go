@@ -0,0 +1,212 @@
+// Package failover connects rpc2 clients to one of several server endpoints
+// and reconnects to another one when the connection fails.
+//
+// Endpoints come from a static list or DNS SRV records. They are tried in
+// order of priority, and by weight among endpoints with the same priority,
+// as described in RFC 2782:
+//
+//	d := &failover.Dialer{Resolve: failover.SRV("rpc", "tcp", "example.com")}
+//	go d.Run(ctx, func(conn net.Conn) *rpc2.Client {
+//		clt := rpc2.NewClient(conn)
+//		clt.Handle("event", handleEvent)
+//		setClient(clt)
+//		return clt
+//	})
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// DefaultRetryDelay is the default delay before trying the endpoints again
+// after all of them failed.
+const DefaultRetryDelay = time.Second
+
+// Endpoint is an address of a server.
+type Endpoint struct {
+	Address  string
+	Priority uint16 // lower values are tried first
+	Weight   uint16 // relative chance of being tried first among endpoints with the same priority
+}
+
+// Resolver returns the endpoints of the servers.
+type Resolver func(ctx context.Context) ([]Endpoint, error)
+
+// Static returns a Resolver returning addresses in the given order.
+func Static(addresses ...string) Resolver {
+	endpoints := make([]Endpoint, len(addresses))
+	for i, addr := range addresses {
+		endpoints[i] = Endpoint{Address: addr, Priority: uint16(i)}
+	}
+	return func(context.Context) ([]Endpoint, error) {
+		return endpoints, nil
+	}
+}
+
+// SRV returns a Resolver looking up the SRV records of _service._proto.name.
+// Records are resolved again for every connection attempt, so changes in DNS
+// are picked up on failover.
+func SRV(service, proto, name string) Resolver {
+	return func(ctx context.Context) ([]Endpoint, error) {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+		endpoints := make([]Endpoint, len(records))
+		for i, r := range records {
+			endpoints[i] = Endpoint{
+				Address:  net.JoinHostPort(r.Target, strconv.Itoa(int(r.Port))),
+				Priority: r.Priority,
+				Weight:   r.Weight,
+			}
+		}
+		return endpoints, nil
+	}
+}
+
+// Dialer connects to the first reachable endpoint.
+type Dialer struct {
+	// Resolve returns the endpoints. It must be set.
+	Resolve Resolver
+
+	// Dial connects to an address. A net.Dialer with the "tcp" network is used if it is nil.
+	Dial func(ctx context.Context, address string) (net.Conn, error)
+
+	// RetryDelay is the delay in Run before trying again when all endpoints
+	// fail. DefaultRetryDelay is used if it is zero.
+	RetryDelay time.Duration
+}
+
+// order sorts endpoints by priority and shuffles endpoints with the same
+// priority so that endpoints with more weight are more likely to be first.
+func order(endpoints []Endpoint) []Endpoint {
+	sorted := append([]Endpoint(nil), endpoints...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		shuffleByWeight(sorted[start:end])
+		start = end
+	}
+	return sorted
+}
+
+// shuffleByWeight orders endpoints by repeatedly picking one with a
+// probability proportional to its weight, giving zero weights a small chance.
+func shuffleByWeight(endpoints []Endpoint) {
+	for i := range endpoints {
+		total := 0
+		for _, e := range endpoints[i:] {
+			total += int(e.Weight) + 1
+		}
+		n := rand.Intn(total)
+		for j := i; j < len(endpoints); j++ {
+			n -= int(endpoints[j].Weight) + 1
+			if n < 0 {
+				endpoints[i], endpoints[j] = endpoints[j], endpoints[i]
+				break
+			}
+		}
+	}
+}
+
+// DialContext connects to the endpoints in order and returns the first connection.
+func (d *Dialer) DialContext(ctx context.Context) (net.Conn, error) {
+	conn, _, err := d.dial(ctx, "")
+	return conn, err
+}
+
+// dial connects to the endpoints in order, trying the address avoid last, and returns
+// the connection and its address.
+func (d *Dialer) dial(ctx context.Context, avoid string) (net.Conn, string, error) {
+	endpoints, err := d.Resolve(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(endpoints) == 0 {
+		return nil, "", errors.New("failover: no endpoints")
+	}
+	endpoints = order(endpoints)
+	if avoid != "" {
+		for i, e := range endpoints {
+			if e.Address == avoid {
+				endpoints = append(append(endpoints[:i:i], endpoints[i+1:]...), e)
+				break
+			}
+		}
+	}
+	var errs []error
+	for _, e := range endpoints {
+		conn, err := d.dialAddress(ctx, e.Address)
+		if err == nil {
+			return conn, e.Address, nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e.Address, err))
+	}
+	return nil, "", fmt.Errorf("failover: all endpoints failed: %w", errors.Join(errs...))
+}
+
+func (d *Dialer) dialAddress(ctx context.Context, address string) (net.Conn, error) {
+	if d.Dial != nil {
+		return d.Dial(ctx, address)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, "tcp", address)
+}
+
+// Run keeps a client connected until ctx is done. For every connection,
+// newClient is called to create the client, register its handlers and make it
+// available to the application, then the client is run. When the connection
+// fails, the next endpoint is tried first, so the client fails over to another
+// server. Run closes the client and returns ctx.Err() when ctx is done.
+func (d *Dialer) Run(ctx context.Context, newClient func(net.Conn) *rpc2.Client) error {
+	delay := d.RetryDelay
+	if delay == 0 {
+		delay = DefaultRetryDelay
+	}
+	var last string
+	for {
+		conn, addr, err := d.dial(ctx, last)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			last = ""
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		last = addr
+		clt := newClient(conn)
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				clt.Close()
+			case <-done:
+			}
+		}()
+		clt.Run()
+		close(done)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
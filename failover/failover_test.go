@@ -0,0 +1,126 @@
+package failover
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+type server struct {
+	lis   net.Listener
+	conns chan net.Conn
+}
+
+func startServer(t *testing.T, name string) *server {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	s := &server{lis: lis, conns: make(chan net.Conn, 10)}
+	srv := rpc2.NewServer()
+	srv.Handle("name", func(client *rpc2.Client, reply *string) error {
+		*reply = name
+		return nil
+	})
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+			go srv.ServeConn(conn)
+		}
+	}()
+	return s
+}
+
+func TestRun(t *testing.T) {
+	// Nothing listens on the first address.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := lis.Addr().String()
+	lis.Close()
+	a := startServer(t, "a")
+	b := startServer(t, "b")
+
+	d := &Dialer{
+		Resolve:    Static(down, a.lis.Addr().String(), b.lis.Addr().String()),
+		RetryDelay: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	clients := make(chan *rpc2.Client, 10)
+	result := make(chan error, 1)
+	go func() {
+		result <- d.Run(ctx, func(conn net.Conn) *rpc2.Client {
+			clt := rpc2.NewClient(conn)
+			clients <- clt
+			return clt
+		})
+	}()
+
+	name := func(clt *rpc2.Client) string {
+		var reply string
+		if err := clt.Call("name", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if n := name(<-clients); n != "a" {
+		t.Fatalf("connected to %s", n)
+	}
+
+	// Fail the connection to a while it is still up; the client must move to b.
+	(<-a.conns).Close()
+	select {
+	case clt := <-clients:
+		if n := name(clt); n != "b" {
+			t.Fatalf("failed over to %s", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not reconnect")
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+func TestDialAllFailed(t *testing.T) {
+	d := &Dialer{Resolve: Static()}
+	if _, err := d.DialContext(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestOrder(t *testing.T) {
+	endpoints := []Endpoint{
+		{Address: "c", Priority: 2},
+		{Address: "a1", Priority: 1, Weight: 10},
+		{Address: "b", Priority: 1, Weight: 0},
+		{Address: "a0", Priority: 0},
+	}
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		sorted := order(endpoints)
+		if sorted[0].Address != "a0" || sorted[3].Address != "c" {
+			t.Fatalf("not sorted by priority: %v", sorted)
+		}
+		first[sorted[1].Address]++
+	}
+	if first["a1"] < first["b"] {
+		t.Fatalf("weights are not honored: %v", first)
+	}
+}
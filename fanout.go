@@ -0,0 +1,54 @@
+package rpc2
+
+import (
+	"context"
+	"sync"
+)
+
+// Result is the outcome of a call made to one of several clients.
+type Result struct {
+	Client *Client
+	Reply  interface{} // pointer to a new value of the type of the reply, nil if the reply is nil
+	Err    error
+}
+
+// Fanout calls method on all clients concurrently and returns the results in
+// the order of clients, e.g. for orchestrators querying many agents:
+//
+//	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+//	defer cancel()
+//	for _, r := range rpc2.Fanout(ctx, agents, "status", nil, new(Status)) {
+//		if r.Err == nil {
+//			fmt.Println(r.Client.RemoteAddr(), *r.Reply.(*Status))
+//		}
+//	}
+//
+// Replies are decoded into new values of the type of reply, which must be a
+// pointer or nil. Calls not completed when ctx is done fail with its error.
+func Fanout(ctx context.Context, clients []*Client, method string, args interface{}, reply interface{}) []Result {
+	results := make([]Result, len(clients))
+	var wg sync.WaitGroup
+	for i, clt := range clients {
+		results[i].Client = clt
+		results[i].Reply = newReply(reply)
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			r.Err = r.Client.CallWithContext(ctx, method, args, r.Reply)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// CallAll calls method on the connected clients having all tags in selector,
+// or on all of them if selector is nil, and returns the results by client,
+// like Fanout. Calls not completed when ctx is done fail with its error.
+func (s *Server) CallAll(ctx context.Context, selector map[string]string, method string, args interface{}, reply interface{}) map[*Client]Result {
+	results := Fanout(ctx, s.Select(selector), method, args, reply)
+	m := make(map[*Client]Result, len(results))
+	for _, r := range results {
+		m[r.Client] = r
+	}
+	return m
+}
@@ -0,0 +1,160 @@
+// Package faultconn wraps connections to inject faults on a deterministic schedule,
+// so applications can test their reconnect and retry logic against rpc2.
+//
+//	conn = faultconn.New(conn,
+//		faultconn.Fault{Op: faultconn.Write, Delay: 10 * time.Millisecond}, // every write
+//		faultconn.Fault{Op: faultconn.Write, N: 3, Corrupt: true},          // third write
+//		faultconn.Fault{Op: faultconn.Read, N: 5, Drop: true},              // fifth read
+//	)
+//	clt := rpc2.NewClient(conn)
+package faultconn
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Op is the kind of operation a fault applies to.
+type Op int
+
+// Operations
+const (
+	Read Op = iota
+	Write
+)
+
+// ErrDropped is returned from the operation that dropped the connection and all after it.
+var ErrDropped = errors.New("faultconn: connection dropped")
+
+// Fault describes a fault and when it is injected.
+type Fault struct {
+	Op Op // operation the fault applies to
+
+	// N is the 1-based index of the operation the fault is injected on.
+	// Zero means every operation.
+	N int
+
+	Delay   time.Duration // sleep this long before the operation
+	Drop    bool          // close the connection and fail the operation
+	Corrupt bool          // flip the bits of a byte in the data
+	Partial int           // write only this many bytes, then fail with io.ErrShortWrite
+	Chunk   int           // split the write into chunks of this size
+}
+
+// Conn is a connection injecting faults into reads and writes.
+type Conn struct {
+	conn   io.ReadWriteCloser
+	faults []Fault
+
+	mutex   sync.Mutex // protects reads, writes, dropped
+	reads   int
+	writes  int
+	dropped bool
+}
+
+// New returns a Conn wrapping conn and injecting faults.
+func New(conn io.ReadWriteCloser, faults ...Fault) *Conn {
+	return &Conn{conn: conn, faults: faults}
+}
+
+// match returns the combined fault for the next operation of kind op.
+func (c *Conn) match(op Op) (f Fault, dropped bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.dropped {
+		return f, true
+	}
+	n := &c.reads
+	if op == Write {
+		n = &c.writes
+	}
+	*n++
+	for _, fault := range c.faults {
+		if fault.Op != op || (fault.N != 0 && fault.N != *n) {
+			continue
+		}
+		f.Delay += fault.Delay
+		f.Drop = f.Drop || fault.Drop
+		f.Corrupt = f.Corrupt || fault.Corrupt
+		if fault.Partial != 0 {
+			f.Partial = fault.Partial
+		}
+		if fault.Chunk != 0 {
+			f.Chunk = fault.Chunk
+		}
+	}
+	if f.Drop {
+		c.dropped = true
+	}
+	return f, false
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	f, dropped := c.match(Read)
+	if dropped {
+		return 0, ErrDropped
+	}
+	time.Sleep(f.Delay)
+	if f.Drop {
+		c.conn.Close()
+		return 0, ErrDropped
+	}
+	n, err := c.conn.Read(p)
+	if f.Corrupt && n > 0 {
+		p[n/2] ^= 0xff
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	f, dropped := c.match(Write)
+	if dropped {
+		return 0, ErrDropped
+	}
+	time.Sleep(f.Delay)
+	if f.Drop {
+		c.conn.Close()
+		return 0, ErrDropped
+	}
+	if f.Corrupt && len(p) > 0 {
+		p = append([]byte(nil), p...)
+		p[len(p)/2] ^= 0xff
+	}
+	var short bool
+	if f.Partial > 0 && f.Partial < len(p) {
+		p = p[:f.Partial]
+		short = true
+	}
+	chunk := len(p)
+	if f.Chunk > 0 {
+		chunk = f.Chunk
+	}
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := c.conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	if short {
+		return written, io.ErrShortWrite
+	}
+	return written, nil
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Conn returns the underlying connection.
+func (c *Conn) Conn() io.ReadWriteCloser {
+	return c.conn
+}
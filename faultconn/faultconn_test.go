@@ -0,0 +1,87 @@
+package faultconn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+func newServer() *rpc2.Server {
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+	return srv
+}
+
+func TestChunkAndDelay(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go newServer().ServeConn(c1)
+
+	delay := 20 * time.Millisecond
+	clt := rpc2.NewClient(New(c2, Fault{Op: Write, Chunk: 1}, Fault{Op: Write, N: 1, Delay: delay}))
+	go clt.Run()
+	defer clt.Close()
+
+	start := time.Now()
+	var reply string
+	if err := clt.Call("echo", "hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hello" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	if time.Since(start) < delay {
+		t.Fatal("write is not delayed")
+	}
+}
+
+func TestDrop(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go newServer().ServeConn(c1)
+
+	clt := rpc2.NewClient(New(c2, Fault{Op: Write, N: 2, Drop: true}))
+	done := make(chan error, 1)
+	go func() { done <- clt.Run() }()
+
+	var reply string
+	if err := clt.Call("echo", "first", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := clt.Call("echo", "second", &reply); err != ErrDropped {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client did not disconnect")
+	}
+}
+
+type buffer struct{ bytes.Buffer }
+
+func (b *buffer) Close() error { return nil }
+
+func TestCorruptAndPartial(t *testing.T) {
+	var b buffer
+	c := New(&b, Fault{Op: Write, N: 2, Corrupt: true}, Fault{Op: Write, N: 3, Partial: 2})
+
+	data := []byte("abc")
+	c.Write(data)
+	c.Write(data)
+	n, err := c.Write(data)
+	if n != 2 || err != io.ErrShortWrite {
+		t.Fatalf("unexpected result of partial write: %d, %v", n, err)
+	}
+	if string(data) != "abc" {
+		t.Fatal("caller's buffer is modified")
+	}
+	if got, want := b.String(), "abc"+"a\x9dc"+"ab"; got != want {
+		t.Fatalf("unexpected data: %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package rpc2
+
+import "strings"
+
+// SetCaseInsensitiveMethods makes the client match the methods of incoming
+// requests with the names of handlers ignoring case, for peers that disagree
+// about the casing of method names, e.g. "getUser" and "GetUser". Exact
+// matches are preferred; among names differing only in case, the first in
+// lexical order is used. Requests are handled, logged and counted under the
+// name of the handler. Methods of handlers registered with HandlePattern are
+// matched as usual. It must be called before Run.
+func (c *Client) SetCaseInsensitiveMethods(enabled bool) {
+	c.foldCase = enabled
+}
+
+// SetCaseInsensitiveMethods makes clients of the server match methods ignoring case.
+// See Client.SetCaseInsensitiveMethods. It must be called before serving connections.
+func (s *Server) SetCaseInsensitiveMethods(enabled bool) {
+	s.foldCase = enabled
+}
+
+// methodIndex maps lowercase names of handlers to the first of the names in
+// lexical order, so methods are matched ignoring case without a scan.
+type methodIndex map[string]string
+
+func (idx methodIndex) add(name string) {
+	key := strings.ToLower(name)
+	if cur, ok := idx[key]; !ok || name < cur {
+		idx[key] = name
+	}
+}
+
+// canonicalMethod returns the name of the handler of method, matched
+// ignoring case, or method if there is no such handler.
+func (c *Client) canonicalMethod(method string) string {
+	if _, ok := c.handlers[method]; ok {
+		return method
+	}
+	if _, ok := builtins[method]; ok {
+		return method
+	}
+	key := strings.ToLower(method)
+	canonical, found := c.index[key]
+	if name, ok := builtinIndex[key]; ok && (!found || name < canonical) {
+		canonical, found = name, true
+	}
+	if !found {
+		return method
+	}
+	return canonical
+}
@@ -0,0 +1,169 @@
+// Package gateway exposes the handlers of an rpc2.Server as HTTP endpoints.
+//
+// Every method is served at POST <prefix><method>. The request body is the
+// JSON encoded argument and the response body is the JSON encoded reply:
+//
+//	http.Handle("/api/", gateway.New(srv, "/api/"))
+//
+//	$ curl -d '{"A": 1, "B": 2}' http://localhost:8080/api/add
+//	3
+//
+// Each HTTP request is served by srv like a connection carrying a single call,
+// so handlers and anything wrapping them on srv run unchanged. OnConnect and
+// OnDisconnect callbacks of srv run for every HTTP request as well. The
+// *http.Request is stored in the client state under RequestKey.
+// Handlers cannot call back to HTTP clients.
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// RequestKey is the key of the *http.Request in the state of clients served by the gateway.
+const RequestKey = "gateway.request"
+
+// MaxBodySize is the maximum size of request bodies.
+const MaxBodySize = 10 << 20
+
+// ErrCallback is returned from calls handlers make to HTTP clients.
+var ErrCallback = errors.New("gateway: calls to HTTP clients are not supported")
+
+// Gateway is an http.Handler calling methods of a server.
+type Gateway struct {
+	srv    *rpc2.Server
+	prefix string
+}
+
+// New returns a Gateway serving methods of srv at paths starting with prefix.
+func New(srv *rpc2.Server, prefix string) *Gateway {
+	return &Gateway{srv: srv, prefix: prefix}
+}
+
+// errorBody is the response body of failed calls.
+type errorBody struct {
+	Error string `json:"error"`
+	Code  int    `json:"code,omitempty"`
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, g.prefix)
+	if (method == r.URL.Path && g.prefix != "") || method == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, errorBody{Error: err.Error()})
+		return
+	}
+
+	c := &callCodec{method: method, body: body, done: make(chan struct{})}
+	state := rpc2.NewState()
+	state.Set(RequestKey, r)
+	go g.srv.ServeCodecWithState(c, state)
+
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		c.Close()
+		return
+	}
+	if c.resp.Error != "" {
+		writeJSON(w, statusCode(c.resp.Code), errorBody{Error: c.resp.Error, Code: c.resp.Code})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(c.reply)
+}
+
+// statusCode returns the HTTP status code of responses with the rpc2 error code.
+func statusCode(code int) int {
+	switch code {
+	case rpc2.CodeMethodNotFound:
+		return http.StatusNotFound
+	case rpc2.CodeInvalidParams, rpc2.CodeParseError, rpc2.CodeInvalidRequest:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// callCodec is an rpc2.Codec carrying a single call from an HTTP request.
+type callCodec struct {
+	method string
+	body   []byte
+	read   bool // request header is read
+
+	resp  rpc2.Response
+	reply []byte
+	done  chan struct{} // closed when the response is written or the codec is closed
+	once  sync.Once
+}
+
+func (c *callCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	if !c.read {
+		c.read = true
+		req.Method = c.method
+		req.Seq = 1
+		return nil
+	}
+	// Wait for the handler before ending the connection.
+	<-c.done
+	return io.EOF
+}
+
+func (c *callCodec) ReadRequestBody(x interface{}) error {
+	if x == nil || len(c.body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(c.body, x)
+}
+
+func (c *callCodec) ReadResponseBody(x interface{}) error {
+	return nil
+}
+
+func (c *callCodec) WriteRequest(*rpc2.Request, interface{}) error {
+	return ErrCallback
+}
+
+func (c *callCodec) WriteResponse(r *rpc2.Response, x interface{}) error {
+	var err error
+	c.once.Do(func() {
+		c.resp = *r
+		if r.Error == "" {
+			if c.reply, err = json.Marshal(x); err != nil {
+				c.resp.Error = "gateway: cannot encode reply: " + err.Error()
+				c.resp.Code = rpc2.CodeInternalError
+			}
+		}
+		close(c.done)
+	})
+	return err
+}
+
+func (c *callCodec) Close() error {
+	c.once.Do(func() {
+		c.resp.Error = "gateway: connection closed"
+		close(c.done)
+	})
+	return nil
+}
@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+type Args struct{ A, B int }
+
+func newGateway() *Gateway {
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	srv.Handle("fail", func(client *rpc2.Client, args *Args, reply *int) error {
+		return errors.New("failed")
+	})
+	srv.Handle("agent", func(client *rpc2.Client, args *Args, reply *string) error {
+		r, _ := client.State.Get(RequestKey)
+		*reply = r.(*http.Request).UserAgent()
+		return nil
+	})
+	return New(srv, "/api/")
+}
+
+func post(t *testing.T, g *Gateway, path, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("User-Agent", "test")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	var v map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &v)
+	return w, v
+}
+
+func TestGateway(t *testing.T) {
+	g := newGateway()
+
+	w, _ := post(t, g, "/api/add", `{"A": 1, "B": 2}`)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "3" {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body)
+	}
+	w, _ = post(t, g, "/api/agent", "")
+	if w.Code != http.StatusOK || w.Body.String() != `"test"` {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body)
+	}
+
+	cases := []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/fail", `{}`, http.StatusInternalServerError},
+		{"/api/undefined", `{}`, http.StatusNotFound},
+		{"/api/add", `{"A": "x"}`, http.StatusBadRequest},
+		{"/other/add", `{}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w, v := post(t, g, c.path, c.body)
+		if w.Code != c.status {
+			t.Errorf("%s: unexpected status %d", c.path, w.Code)
+		}
+		if c.path != "/other/add" && v["error"] == nil {
+			t.Errorf("%s: missing error in body: %s", c.path, w.Body)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/add", nil)
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status for GET: %d", w.Code)
+	}
+}
@@ -2,4 +2,34 @@ module github.com/cenkalti/rpc2
 
 go 1.20
 
-require github.com/cenkalti/hub v1.0.2
+require (
+	github.com/apache/thrift v0.19.0
+	github.com/cenkalti/hub v1.0.2
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/hamba/avro/v2 v2.20.1
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	github.com/xtaci/kcp-go/v5 v5.6.2
+	go.bug.st/serial v1.6.4
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/crypto v0.22.0
+	golang.org/x/net v0.24.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/creack/goselect v0.1.2 // indirect
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.14 // indirect
+	github.com/klauspost/reedsolomon v1.10.0 // indirect
+	github.com/mitchellh/mapstructure v1.5.0 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/templexxx/cpu v0.0.9 // indirect
+	github.com/templexxx/xorsimd v0.4.1 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
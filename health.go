@@ -0,0 +1,79 @@
+package rpc2
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Health is a snapshot of the state of a server, see Server.Health.
+type Health struct {
+	// Ready is true if the server accepts connections: Accept is running
+	// on at least one listener and Shutdown is not called.
+	Ready bool `json:"ready"`
+	// Draining is true after Shutdown is called.
+	Draining bool `json:"draining"`
+	// Listeners is the number of listeners being accepted on by Accept.
+	Listeners int64 `json:"listeners"`
+
+	ActiveConnections int64 `json:"active_connections"`
+
+	// Counters since the server is created, as published with PublishExpvar.
+	Calls  int64 `json:"calls"`  // incoming requests and notifications
+	Errors int64 `json:"errors"` // failed requests, including shed ones
+	Shed   int64 `json:"shed"`   // requests rejected because of overload
+
+	// ErrorRate is Errors divided by Calls, zero if there are no calls.
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// Health returns the current state of the server.
+func (s *Server) Health() Health {
+	h := Health{
+		Draining:          s.draining.Load(),
+		Listeners:         s.listeners.Load(),
+		ActiveConnections: s.stats.activeConnections.Load(),
+		Calls:             s.stats.calls.Load(),
+		Errors:            s.stats.errors.Load(),
+		Shed:              s.stats.shed.Load(),
+	}
+	h.Ready = h.Listeners > 0 && !h.Draining
+	if h.Calls > 0 {
+		h.ErrorRate = float64(h.Errors) / float64(h.Calls)
+	}
+	return h
+}
+
+// LivenessHandler returns an http.Handler responding with the Health of the
+// server in JSON and status 200 OK, for liveness probes and monitoring.
+func (s *Server) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, s.Health())
+	})
+}
+
+// ReadinessHandler returns an http.Handler responding with the Health of the
+// server in JSON, with status 200 OK while it is ready and 503 Service
+// Unavailable before Accept is called, after its listeners are closed and
+// once Shutdown is called, for readiness probes and load balancer health
+// checks, so traffic moves to other servers while it drains. Servers serving
+// connections only with ServeConn or ServeCodec are never ready:
+//
+//	mux.Handle("/healthz", srv.LivenessHandler())
+//	mux.Handle("/readyz", srv.ReadinessHandler())
+func (s *Server) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.Health()
+		status := http.StatusOK
+		if !h.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, status, h)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status int, h Health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h)
+}
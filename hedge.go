@@ -0,0 +1,91 @@
+package rpc2
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// ErrNoClients is returned by functions calling one of several clients when none is given.
+var ErrNoClients = errors.New("rpc2: no clients")
+
+// CallHedged calls method on the first of clients, connected to redundant
+// servers, and on the next one if it has not responded within delay, and so
+// on, until one of the calls succeeds, which cuts the tail latency of calls
+// to slow servers. Calls failing with an error are hedged right away.
+// The reply of the first successful call is stored in reply and the other
+// calls are canceled. If all calls fail, the error of the last one is returned.
+//
+// The method must be idempotent, because more than one server may handle the call.
+// Replies of calls are decoded into new values of the type of reply, so
+// reply must be a pointer or nil.
+func CallHedged(ctx context.Context, clients []*Client, delay time.Duration, method string, args interface{}, reply interface{}) error {
+	if len(clients) == 0 {
+		return ErrNoClients
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	results := make(chan result, len(clients))
+	clock := clients[0].timeSource
+	var timer Timer
+	next, running := 0, 0
+	// start calls the next client, and hedges it after delay.
+	start := func() {
+		clt := clients[next]
+		next++
+		running++
+		r := newReply(reply)
+		go func() {
+			err := clt.CallWithContext(ctx, method, args, r)
+			results <- result{r, err}
+		}()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = clock.NewTimer(delay)
+	}
+
+	start()
+	defer func() { timer.Stop() }()
+	var err error
+	for running > 0 {
+		var hedge <-chan time.Time
+		if next < len(clients) {
+			hedge = timer.C()
+		}
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+				}
+				return nil
+			}
+			err = r.err
+			if next < len(clients) {
+				start()
+			}
+		case <-hedge:
+			start()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// newReply returns a pointer to a new value of the type reply points to,
+// or nil if reply is nil.
+func newReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+}
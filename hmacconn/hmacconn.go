@@ -0,0 +1,249 @@
+// Package hmacconn signs rpc2 connections with HMAC-SHA256 and rejects
+// replayed frames.
+//
+// Peers share a secret key. Written data is sent in frames carrying a sequence
+// number, a timestamp and a MAC. Each connection starts by exchanging random
+// nonces, and the MAC keys are derived from the secret and both nonces, so
+// frames captured from one connection are rejected on any other. Within a
+// connection, sequence numbers must increase by one, so frames can not be
+// replayed, dropped or reordered, and frames with timestamps outside of the
+// MaxSkew window, e.g. held back by an attacker, are rejected too.
+//
+// Frames are signed but not encrypted; see the naclconn package for confidentiality.
+//
+//	conn, _ := net.Dial("tcp", addr)
+//	sc, err := hmacconn.Client(conn, &hmacconn.Config{Key: secret})
+//	clt := rpc2.NewClient(sc)
+package hmacconn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSkew is the default MaxSkew.
+const DefaultMaxSkew = time.Minute
+
+const (
+	nonceSize  = 16
+	headerSize = 4 + 8 + 8 // payload length, sequence number, timestamp
+	macSize    = sha256.Size
+	maxPayload = 64 << 10
+)
+
+// Errors returned from Read when a frame is rejected. The connection can not
+// be used after an error because the stream is out of sync.
+var (
+	ErrMAC    = errors.New("hmacconn: invalid message authentication code")
+	ErrReplay = errors.New("hmacconn: replayed or reordered frame")
+	ErrStale  = errors.New("hmacconn: frame timestamp is outside of the allowed window")
+)
+
+// Config is the configuration of one side of a connection.
+type Config struct {
+	// Key is the shared secret. It must be set.
+	Key []byte
+
+	// MaxSkew is the maximum difference between the timestamp of a received
+	// frame and the local time, allowing for clock differences and delays.
+	// DefaultMaxSkew is used if it is zero. Negative disables the check.
+	MaxSkew time.Duration
+
+	// Now returns the current time. time.Now is used if it is nil.
+	Now func() time.Time
+}
+
+func (c *Config) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// Conn is a signed connection.
+type Conn struct {
+	conn   io.ReadWriteCloser
+	config *Config
+
+	rmutex sync.Mutex // protects r*
+	rkey   []byte
+	rseq   uint64 // sequence number of the last received frame
+	rbuf   []byte // payload not read yet
+	rerr   error
+
+	wmutex sync.Mutex // protects w*
+	wkey   []byte
+	wseq   uint64
+	wframe []byte
+}
+
+// Client starts a signed connection on conn as the dialing side.
+func Client(conn io.ReadWriteCloser, config *Config) (*Conn, error) {
+	return handshake(conn, config, true)
+}
+
+// Server starts a signed connection on conn as the accepting side.
+func Server(conn io.ReadWriteCloser, config *Config) (*Conn, error) {
+	return handshake(conn, config, false)
+}
+
+func handshake(conn io.ReadWriteCloser, config *Config, client bool) (*Conn, error) {
+	if len(config.Key) == 0 {
+		return nil, errors.New("hmacconn: missing key")
+	}
+	var local, remote [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, local[:]); err != nil {
+		return nil, err
+	}
+	werr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(local[:])
+		werr <- err
+	}()
+	if _, err := io.ReadFull(conn, remote[:]); err != nil {
+		return nil, fmt.Errorf("hmacconn: handshake: %w", err)
+	}
+	if err := <-werr; err != nil {
+		return nil, fmt.Errorf("hmacconn: handshake: %w", err)
+	}
+
+	clientNonce, serverNonce := local[:], remote[:]
+	if !client {
+		clientNonce, serverNonce = remote[:], local[:]
+	}
+	clientKey := deriveKey(config.Key, "client", clientNonce, serverNonce)
+	serverKey := deriveKey(config.Key, "server", clientNonce, serverNonce)
+	c := &Conn{conn: conn, config: config, rkey: serverKey, wkey: clientKey}
+	if !client {
+		c.rkey, c.wkey = clientKey, serverKey
+	}
+	return c, nil
+}
+
+// deriveKey returns the key signing frames written by the named side of a connection.
+func deriveKey(secret []byte, side string, clientNonce, serverNonce []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("rpc2 hmacconn v1 " + side))
+	h.Write(clientNonce)
+	h.Write(serverNonce)
+	return h.Sum(nil)
+}
+
+// sign appends the MAC of data to dst.
+func sign(key, dst, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(dst)
+}
+
+// Read reads data from verified frames.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		c.rerr = c.readFrame()
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *Conn) readFrame() error {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxPayload {
+		return fmt.Errorf("hmacconn: invalid frame size %d", size)
+	}
+	frame := make([]byte, headerSize+int(size)+macSize)
+	copy(frame, header[:])
+	if _, err := io.ReadFull(c.conn, frame[headerSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	body, mac := frame[:len(frame)-macSize], frame[len(frame)-macSize:]
+	if !hmac.Equal(mac, sign(c.rkey, nil, body)) {
+		return ErrMAC
+	}
+	if seq := binary.BigEndian.Uint64(header[4:12]); seq != c.rseq+1 {
+		return ErrReplay
+	}
+	c.rseq++
+	if skew := c.maxSkew(); skew > 0 {
+		ts := time.Unix(0, int64(binary.BigEndian.Uint64(header[12:20])))
+		if d := c.config.now().Sub(ts); d > skew || d < -skew {
+			return ErrStale
+		}
+	}
+	c.rbuf = body[headerSize:]
+	return nil
+}
+
+func (c *Conn) maxSkew() time.Duration {
+	if c.config.MaxSkew == 0 {
+		return DefaultMaxSkew
+	}
+	return c.config.MaxSkew
+}
+
+// Write writes b in one or more signed frames.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		c.wseq++
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(n))
+		binary.BigEndian.PutUint64(header[4:12], c.wseq)
+		binary.BigEndian.PutUint64(header[12:20], uint64(c.config.now().UnixNano()))
+		c.wframe = append(append(c.wframe[:0], header[:]...), b[:n]...)
+		c.wframe = sign(c.wkey, c.wframe, c.wframe)
+		if _, err := c.conn.Write(c.wframe); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// RemoteAddr returns the remote address of the underlying connection, if it has one.
+func (c *Conn) RemoteAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the underlying connection, if it has one.
+func (c *Conn) LocalAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package hmacconn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+var key = []byte("secret")
+
+// recorder records writes to the connection.
+type recorder struct {
+	io.ReadWriteCloser
+	writes [][]byte
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	return r.ReadWriteCloser.Write(p)
+}
+
+func connect(t *testing.T, c1, c2 io.ReadWriteCloser, clientConfig, serverConfig *Config) (*Conn, *Conn) {
+	var server *Conn
+	var serverErr error
+	done := make(chan struct{})
+	go func() {
+		server, serverErr = Server(c2, serverConfig)
+		close(done)
+	}()
+	client, err := Client(c1, clientConfig)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverErr != nil {
+		t.Fatal(serverErr)
+	}
+	return client, server
+}
+
+func TestRPC(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := connect(t, c1, c2, &Config{Key: key}, &Config{Key: key})
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, args []byte, reply *[]byte) error {
+		*reply = args
+		return nil
+	})
+	go srv.ServeConn(server)
+	clt := rpc2.NewClient(client)
+	go clt.Run()
+	defer clt.Close()
+
+	large := bytes.Repeat([]byte("x"), 2*maxPayload+1)
+	for _, args := range [][]byte{[]byte("hello"), large} {
+		var reply []byte
+		if err := clt.Call("echo", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, args) {
+			t.Fatalf("unexpected reply of %d bytes", len(reply))
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	c1, c2 := net.Pipe()
+	rec := &recorder{ReadWriteCloser: c1}
+	client, server := connect(t, rec, c2, &Config{Key: key}, &Config{Key: key})
+	go client.Write([]byte("pay"))
+	buf := make([]byte, 16)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "pay" {
+		t.Fatalf("unexpected read: %q %v", buf[:n], err)
+	}
+	// The first write is the nonce.
+	frame := rec.writes[1]
+	go c1.Write(frame)
+	if _, err := server.Read(buf); err != ErrReplay {
+		t.Fatalf("unexpected error on replay: %v", err)
+	}
+
+	// Frames of another connection are rejected.
+	c3, c4 := net.Pipe()
+	_, server = connect(t, c3, c4, &Config{Key: key}, &Config{Key: key})
+	go c3.Write(frame)
+	if _, err := server.Read(buf); err != ErrMAC {
+		t.Fatalf("unexpected error on replay to another connection: %v", err)
+	}
+}
+
+func TestStale(t *testing.T) {
+	c1, c2 := net.Pipe()
+	past := func() time.Time { return time.Now().Add(-2 * time.Minute) }
+	client, server := connect(t, c1, c2, &Config{Key: key, Now: past}, &Config{Key: key})
+	go client.Write([]byte("late"))
+	if _, err := server.Read(make([]byte, 16)); err != ErrStale {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := connect(t, c1, c2, &Config{Key: []byte("other")}, &Config{Key: key})
+	go client.Write([]byte("hello"))
+	if _, err := server.Read(make([]byte, 16)); err != ErrMAC {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
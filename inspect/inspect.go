@@ -0,0 +1,343 @@
+// Package inspect decodes captured rpc2 byte streams into readable records.
+//
+// It reads one direction of a connection, as captured from a file or a proxy,
+// without knowing the Go types of args and replies, which helps debugging
+// interoperability problems with peers written in other languages:
+//
+//	d, _ := inspect.NewDecoder(inspect.JSONRPC, f)
+//	for {
+//		rec, err := d.Next()
+//		if err != nil {
+//			break
+//		}
+//		fmt.Println(rec)
+//	}
+//
+// Bodies are decoded into generic values, except for gob, where the types of
+// bodies are not known and bodies are skipped. The avro codec is not supported
+// because it needs access to the schema registry.
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec names
+const (
+	Gob     = "gob"
+	JSONRPC = "jsonrpc"
+	Msgpack = "msgpack"
+	Thrift  = "thrift"
+)
+
+// Codecs lists the names of supported codecs.
+var Codecs = []string{Gob, JSONRPC, Msgpack, Thrift}
+
+// Kind is the kind of a message.
+type Kind string
+
+// Kinds of messages
+const (
+	Request      Kind = "request"
+	Response     Kind = "response"
+	Notification Kind = "notification"
+)
+
+// Record is a decoded message.
+type Record struct {
+	Kind   Kind
+	ID     interface{} // request ID as on the wire, nil for notifications
+	Method string      // empty for responses
+	Body   interface{} // params or result, nil if missing or unknown
+	Error  interface{} // error member of responses, nil if none
+}
+
+func (r Record) String() string {
+	var b strings.Builder
+	b.WriteString(string(r.Kind))
+	if r.ID != nil {
+		b.WriteString(" id=" + format(r.ID))
+	}
+	if r.Method != "" {
+		fmt.Fprintf(&b, " method=%q", r.Method)
+	}
+	if r.Error != nil {
+		b.WriteString(" error=" + format(r.Error))
+	}
+	if r.Body != nil {
+		name := " params="
+		if r.Kind == Response {
+			name = " result="
+		}
+		b.WriteString(name + format(r.Body))
+	}
+	return b.String()
+}
+
+// format returns v in JSON if possible.
+func format(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// Decoder reads records from a stream.
+type Decoder interface {
+	// Next returns the next record in the stream.
+	// It returns io.EOF at the end of the stream.
+	Next() (Record, error)
+}
+
+// NewDecoder returns a decoder reading messages of the named codec from r.
+func NewDecoder(codec string, r io.Reader) (Decoder, error) {
+	switch codec {
+	case Gob:
+		return &gobDecoder{dec: gob.NewDecoder(r)}, nil
+	case JSONRPC:
+		d := json.NewDecoder(r)
+		d.UseNumber()
+		return &jsonDecoder{dec: d}, nil
+	case Msgpack:
+		return &msgpackDecoder{dec: msgpack.NewDecoder(r)}, nil
+	case Thrift:
+		return &thriftDecoder{in: thrift.NewTCompactProtocol(thrift.NewStreamTransportR(r))}, nil
+	}
+	return nil, fmt.Errorf("inspect: unsupported codec %q", codec)
+}
+
+// gobHeader has the fields of both rpc2.Request and rpc2.Response.
+type gobHeader struct {
+	Seq    uint64
+	Method string
+	Error  string
+	Code   int
+}
+
+type gobDecoder struct {
+	dec *gob.Decoder
+}
+
+func (d *gobDecoder) Next() (Record, error) {
+	var h gobHeader
+	if err := d.dec.Decode(&h); err != nil {
+		return Record{}, err
+	}
+	// Types of bodies are not known. Skip them.
+	if err := d.dec.DecodeValue(reflect.Value{}); err != nil {
+		return Record{}, err
+	}
+	rec := Record{ID: h.Seq, Method: h.Method}
+	switch {
+	case h.Method == "":
+		rec.Kind = Response
+		if h.Error != "" {
+			rec.Error = h.Error
+			if h.Code != 0 {
+				rec.Error = map[string]interface{}{"code": h.Code, "message": h.Error}
+			}
+		}
+	case h.Seq == 0:
+		rec.Kind = Notification
+		rec.ID = nil
+	default:
+		rec.Kind = Request
+	}
+	return rec, nil
+}
+
+type jsonMessage struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || bytes.Equal(raw, []byte("null"))
+}
+
+// rawValue returns raw as a value of Record or nil if it is null.
+func rawValue(raw json.RawMessage) interface{} {
+	if isNull(raw) {
+		return nil
+	}
+	return raw
+}
+
+func (d *jsonDecoder) Next() (Record, error) {
+	var m jsonMessage
+	if err := d.dec.Decode(&m); err != nil {
+		return Record{}, err
+	}
+	if m.Method == "" {
+		return Record{Kind: Response, ID: rawValue(m.ID), Body: rawValue(m.Result), Error: rawValue(m.Error)}, nil
+	}
+	rec := Record{Kind: Request, ID: rawValue(m.ID), Method: m.Method, Body: rawValue(m.Params)}
+	if rec.ID == nil {
+		rec.Kind = Notification
+	}
+	return rec, nil
+}
+
+type msgpackDecoder struct {
+	dec *msgpack.Decoder
+}
+
+func (d *msgpackDecoder) Next() (Record, error) {
+	var m []interface{}
+	if err := d.dec.Decode(&m); err != nil {
+		return Record{}, err
+	}
+	if len(m) == 0 {
+		return Record{}, fmt.Errorf("inspect: invalid msgpack message %v", m)
+	}
+	typ := toInt(m[0])
+	switch {
+	case len(m) == 4 && typ == 0:
+		method, _ := m[2].(string)
+		return Record{Kind: Request, ID: m[1], Method: method, Body: m[3]}, nil
+	case len(m) == 4 && typ == 1:
+		return Record{Kind: Response, ID: m[1], Error: m[2], Body: m[3]}, nil
+	case len(m) == 3 && typ == 2:
+		method, _ := m[1].(string)
+		return Record{Kind: Notification, Method: method, Body: m[2]}, nil
+	}
+	return Record{}, fmt.Errorf("inspect: invalid msgpack message %v", m)
+}
+
+func toInt(v interface{}) int {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint())
+	}
+	return -1
+}
+
+type thriftDecoder struct {
+	in *thrift.TCompactProtocol
+}
+
+func (d *thriftDecoder) Next() (Record, error) {
+	ctx := context.Background()
+	name, typ, seqID, err := d.in.ReadMessageBegin(ctx)
+	if err != nil {
+		return Record{}, thriftError(err)
+	}
+	body, err := d.readValue(ctx, thrift.STRUCT)
+	if err != nil {
+		return Record{}, thriftError(err)
+	}
+	if err = d.in.ReadMessageEnd(ctx); err != nil {
+		return Record{}, thriftError(err)
+	}
+	switch typ {
+	case thrift.CALL:
+		return Record{Kind: Request, ID: seqID, Method: name, Body: body}, nil
+	case thrift.ONEWAY:
+		return Record{Kind: Notification, Method: name, Body: body}, nil
+	case thrift.REPLY:
+		return Record{Kind: Response, ID: seqID, Body: body}, nil
+	case thrift.EXCEPTION:
+		return Record{Kind: Response, ID: seqID, Error: body}, nil
+	}
+	return Record{}, fmt.Errorf("inspect: invalid thrift message type %d", typ)
+}
+
+// thriftError returns io.EOF if err is caused by the end of the stream.
+func thriftError(err error) error {
+	if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == thrift.END_OF_FILE {
+		return io.EOF
+	}
+	return err
+}
+
+// readValue reads a value of typ without knowing its IDL.
+// Structs are returned as maps of field IDs to values.
+func (d *thriftDecoder) readValue(ctx context.Context, typ thrift.TType) (interface{}, error) {
+	switch typ {
+	case thrift.BOOL:
+		return d.in.ReadBool(ctx)
+	case thrift.BYTE:
+		return d.in.ReadByte(ctx)
+	case thrift.I16:
+		return d.in.ReadI16(ctx)
+	case thrift.I32:
+		return d.in.ReadI32(ctx)
+	case thrift.I64:
+		return d.in.ReadI64(ctx)
+	case thrift.DOUBLE:
+		return d.in.ReadDouble(ctx)
+	case thrift.STRING:
+		return d.in.ReadString(ctx)
+	case thrift.STRUCT:
+		if _, err := d.in.ReadStructBegin(ctx); err != nil {
+			return nil, err
+		}
+		fields := make(map[int16]interface{})
+		for {
+			_, ftyp, id, err := d.in.ReadFieldBegin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if ftyp == thrift.STOP {
+				break
+			}
+			if fields[id], err = d.readValue(ctx, ftyp); err != nil {
+				return nil, err
+			}
+			if err = d.in.ReadFieldEnd(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return fields, d.in.ReadStructEnd(ctx)
+	case thrift.LIST, thrift.SET:
+		etyp, n, err := d.in.ReadListBegin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = d.readValue(ctx, etyp); err != nil {
+				return nil, err
+			}
+		}
+		return list, d.in.ReadListEnd(ctx)
+	case thrift.MAP:
+		ktyp, vtyp, n, err := d.in.ReadMapBegin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := d.readValue(ctx, ktyp)
+			if err != nil {
+				return nil, err
+			}
+			if m[fmt.Sprint(k)], err = d.readValue(ctx, vtyp); err != nil {
+				return nil, err
+			}
+		}
+		return m, d.in.ReadMapEnd(ctx)
+	}
+	return nil, fmt.Errorf("inspect: unknown thrift type %d", typ)
+}
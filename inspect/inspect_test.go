@@ -0,0 +1,157 @@
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/cenkalti/rpc2/msgpackrpc"
+	"github.com/cenkalti/rpc2/thriftrpc"
+)
+
+type Args struct{ A, B int }
+
+// capture is a connection copying written bytes to buf.
+type capture struct {
+	net.Conn
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	c.buf.Write(p)
+	c.mutex.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *capture) bytes() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buf.Bytes()
+}
+
+// session runs calls over newCodec and returns the streams written by the client and the server.
+func session(t *testing.T, newCodec func(io.ReadWriteCloser) rpc2.Codec) (client, server []byte) {
+	srv := rpc2.NewServer()
+	notified := make(chan struct{})
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	srv.Handle("fail", func(client *rpc2.Client, args *Args, reply *int) error {
+		return errors.New("failed")
+	})
+	srv.Handle("log", func(client *rpc2.Client, args *Args, reply *struct{}) error {
+		close(notified)
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	sc, cc := &capture{Conn: c1}, &capture{Conn: c2}
+	go srv.ServeCodec(newCodec(sc))
+	clt := rpc2.NewClientWithCodec(newCodec(cc))
+	go clt.Run()
+	defer clt.Close()
+
+	var reply int
+	if err := clt.Call("add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	clt.Call("fail", Args{}, &reply)
+	clt.Notify("log", Args{})
+	<-notified
+	return cc.bytes(), sc.bytes()
+}
+
+func decodeAll(t *testing.T, codec string, b []byte) []string {
+	d, err := NewDecoder(codec, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	for {
+		rec, err := d.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		records = append(records, rec.String())
+	}
+}
+
+func check(t *testing.T, codec string, got []string, want ...string) {
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s: unexpected records:\n%s\nwant:\n%s", codec, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDecoders(t *testing.T) {
+	clt, srv := session(t, rpc2.NewGobCodec)
+	check(t, Gob, decodeAll(t, Gob, clt),
+		`request id=1 method="add"`,
+		`request id=2 method="fail"`,
+		`notification method="log"`)
+	check(t, Gob, decodeAll(t, Gob, srv),
+		`response id=1`,
+		`response id=2 error="failed"`)
+
+	clt, srv = session(t, func(conn io.ReadWriteCloser) rpc2.Codec { return jsonrpc.NewJSONCodec(conn) })
+	check(t, JSONRPC, decodeAll(t, JSONRPC, clt),
+		`request id=1 method="add" params=[{"A":1,"B":2}]`,
+		`request id=2 method="fail" params=[{"A":0,"B":0}]`,
+		`notification method="log" params=[{"A":0,"B":0}]`)
+	check(t, JSONRPC, decodeAll(t, JSONRPC, srv),
+		`response id=1 result=3`,
+		`response id=2 error="failed"`)
+
+	clt, srv = session(t, msgpackrpc.NewMsgpackCodec)
+	check(t, Msgpack, decodeAll(t, Msgpack, clt),
+		`request id=1 method="add" params=[{"A":1,"B":2}]`,
+		`request id=2 method="fail" params=[{"A":0,"B":0}]`,
+		`notification method="log" params=[{"A":0,"B":0}]`)
+	check(t, Msgpack, decodeAll(t, Msgpack, srv),
+		`response id=1 result=3`,
+		`response id=2 error="failed"`)
+}
+
+type thriftArgs struct{ A int32 }
+
+func (a *thriftArgs) Write(ctx context.Context, p thrift.TProtocol) error {
+	p.WriteStructBegin(ctx, "args")
+	p.WriteFieldBegin(ctx, "a", thrift.I32, 1)
+	p.WriteI32(ctx, a.A)
+	p.WriteFieldEnd(ctx)
+	p.WriteFieldStop(ctx)
+	return p.WriteStructEnd(ctx)
+}
+
+func (a *thriftArgs) Read(ctx context.Context, p thrift.TProtocol) error { return nil }
+
+func TestThrift(t *testing.T) {
+	c1, c2 := net.Pipe()
+	cc := &capture{Conn: c1}
+	go io.Copy(io.Discard, c2)
+	codec := thriftrpc.NewThriftCodec(cc)
+	codec.WriteRequest(&rpc2.Request{Seq: 1, Method: "add"}, &thriftArgs{A: 5})
+	codec.WriteRequest(&rpc2.Request{Method: "log"}, &thriftArgs{A: 6})
+	codec.Close()
+	check(t, Thrift, decodeAll(t, Thrift, cc.bytes()),
+		`request id=1 method="add" params={"1":5}`,
+		`notification method="log" params={"1":6}`)
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := NewDecoder("avro", nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
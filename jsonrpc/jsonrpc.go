@@ -15,12 +15,16 @@
 package jsonrpc
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/cenkalti/rpc2"
 )
@@ -28,7 +32,8 @@ import (
 type jsonCodec struct {
 	dec *json.Decoder // for reading JSON values
 	enc *json.Encoder // for writing JSON values
-	c   io.Closer
+	c   io.ReadWriteCloser
+	r   io.Reader // read by dec, with bytes dec read ahead of body parts
 
 	// temporary work space
 	msg            message
@@ -41,28 +46,182 @@ type jsonCodec struct {
 	// but save the original request ID in the pending map.
 	// When rpc responds, we use the sequence number in
 	// the response to find the original request ID.
-	mutex   sync.Mutex // protects seq, pending
+	mutex   sync.Mutex // protects seq, pending, ids, idKeys
 	pending map[uint64]*json.RawMessage
 	seq     uint64
+
+	// When idGen is set, outgoing requests use generated IDs.
+	// We map the JSON encoding of each generated ID back to the
+	// sequence number of the request to match the response, and
+	// the sequence number to the key for forgetting the request.
+	idGen  func(seq uint64) interface{}
+	ids    map[string]uint64
+	idKeys map[uint64]string
+
+	errDecoder func(raw json.RawMessage) error
+
+	validateParams func(method string, params json.RawMessage) error
+
+	positional bool // map struct arguments to positional params
+	named      bool // send struct and map arguments as params objects
+	partial    bool // decode results of error responses
+
+	values       valueFormat // encoding of times and integers
+	strictParams bool        // reject unknown fields in params
+	maxDepth     int         // of params, zero for no limit
+	maxElements  int         // of arrays and objects in params, zero for no limit
+
+	// Methods with params and results in binary body parts, see WithBodyEncoding.
+	// Encodings are remembered by sequence number for outgoing requests, whose
+	// responses are read with them, and for incoming requests, whose responses
+	// are written with them, under mutex.
+	encodings      map[string]Encoding
+	replyEncodings map[uint64]Encoding
+	respEncodings  map[uint64]Encoding
+	part           []byte   // of the message just read, reused
+	partEnc        Encoding // of the message just read, nil if it has no part
+
+	// When lines is set, messages are read line by line instead of using dec.
+	lines         *bufio.Reader
+	lineFraming   bool
+	onDecodeError func(line []byte, err error)
+	badLines      int // consecutive lines that could not be decoded
+
+	// Responses to rpc2 are written by its writer goroutine, but parse errors
+	// are written from the reading goroutine, so writes are serialized.
+	wmutex sync.Mutex
+}
+
+// maxBadLines is the number of consecutive lines that can not be decoded
+// before a codec with line framing gives up on the connection.
+const maxBadLines = 10
+
+// Option configures the codec returned by NewJSONCodec.
+type Option func(*jsonCodec)
+
+// WithIDGenerator sets the function generating IDs of outgoing requests.
+// The function is called with the sequence number chosen by rpc2 and
+// may return any value that encodes as a JSON string or number.
+// Generated IDs must be unique among pending requests.
+func WithIDGenerator(f func(seq uint64) interface{}) Option {
+	return func(c *jsonCodec) {
+		c.idGen = f
+	}
+}
+
+// WithErrorDecoder sets the function translating the error member of responses.
+// It is called with the raw JSON of every non-null error member, which allows
+// handling peers that encode errors in non-standard shapes.
+// The message of the returned error is given to the caller, along with the code
+// if it is an *rpc2.Error. The function may return nil if raw does not indicate an error.
+// Raw must not be retained after the function returns.
+func WithErrorDecoder(f func(raw json.RawMessage) error) Option {
+	return func(c *jsonCodec) {
+		c.errDecoder = f
+	}
+}
+
+// WithLineFraming makes the codec read one message per line.
+// A line that cannot be decoded is skipped instead of closing the connection,
+// which is useful on noisy transports such as serial or radio links.
+// Skipped lines are reported to onDecodeError if it is not nil.
+// The connection is closed after 10 consecutive lines that cannot be decoded.
+// Messages are always written one per line so the peer does not need this option.
+func WithLineFraming(onDecodeError func(line []byte, err error)) Option {
+	return func(c *jsonCodec) {
+		c.lineFraming = true
+		c.onDecodeError = onDecodeError
+	}
+}
+
+// WithParamsValidator sets the function validating params of incoming requests
+// before they are decoded into handler arguments. It is called with the method name
+// and the raw JSON of params, which is nil if params are omitted.
+// Params must not be retained after the function returns.
+// If it returns an error, the request is answered with an invalid params error.
+func WithParamsValidator(f func(method string, params json.RawMessage) error) Option {
+	return func(c *jsonCodec) {
+		c.validateParams = f
+	}
+}
+
+// WithNamedParams makes the codec send struct and map arguments as a params
+// object instead of wrapping them in an array, for peers expecting named params.
+// Structs mapped by WithPositionalStructs are still sent as arrays.
+// Params objects of incoming requests are decoded into the argument
+// with or without this option.
+func WithNamedParams() Option {
+	return func(c *jsonCodec) {
+		c.named = true
+	}
+}
+
+// WithPartialResults makes the codec decode the result of responses having both
+// a result and an error into the reply of the call, for non-compliant peers
+// returning partial results along with errors. The call still returns the error.
+// Without this option, such results are discarded.
+func WithPartialResults() Option {
+	return func(c *jsonCodec) {
+		c.partial = true
+	}
+}
+
+// WithDisallowUnknownFields makes the codec reject params of incoming requests
+// having object members that do not match any field of the struct they are
+// decoded into, like json.Decoder.DisallowUnknownFields. Such requests are
+// answered with an invalid params error naming the field, so schema drift and
+// misspelled fields are detected instead of being ignored. Results are
+// decoded as usual.
+func WithDisallowUnknownFields() Option {
+	return func(c *jsonCodec) {
+		c.strictParams = true
+	}
 }
 
 // NewJSONCodec returns a new rpc2.Codec using JSON-RPC on conn.
-func NewJSONCodec(conn io.ReadWriteCloser) rpc2.Codec {
-	return &jsonCodec{
+func NewJSONCodec(conn io.ReadWriteCloser, opts ...Option) rpc2.Codec {
+	c := &jsonCodec{
 		dec:     json.NewDecoder(conn),
 		enc:     json.NewEncoder(conn),
 		c:       conn,
+		r:       conn,
 		pending: make(map[uint64]*json.RawMessage),
+		ids:     make(map[string]uint64),
+		idKeys:  make(map[uint64]string),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if c.lineFraming {
+		c.lines = bufio.NewReader(conn)
+	}
+	return c
 }
 
 // serverRequest and clientResponse combined
+//
+// Buffers of Params, Result and Error are reused for every message, so they
+// are only valid until the next message is read. They are empty if missing.
+// Id, Meta and Attachments are retained by the codec and rpc2, and allocated
+// for every message.
 type message struct {
 	Method string           `json:"method"`
-	Params *json.RawMessage `json:"params"`
+	Params json.RawMessage  `json:"params"`
 	Id     *json.RawMessage `json:"id"`
-	Result *json.RawMessage `json:"result"`
-	Error  interface{}      `json:"error"`
+	Result json.RawMessage  `json:"result"` // "null" for null
+	Error  json.RawMessage  `json:"error"`
+
+	// Meta is not part of JSON-RPC. It carries rpc2.Request.Metadata
+	// and is ignored by other implementations.
+	Meta map[string]string `json:"meta"`
+
+	// Attachments are not part of JSON-RPC. They carry
+	// rpc2.Request.Attachments as base64 strings.
+	Attachments [][]byte `json:"attachments"`
+
+	// Body is not part of JSON-RPC. It is the length of the binary part
+	// following the message, see WithBodyEncoding.
+	Body *int `json:"body"`
 }
 
 // Unmarshal to
@@ -74,7 +233,7 @@ type serverRequest struct {
 type clientResponse struct {
 	Id     uint64           `json:"id"`
 	Result *json.RawMessage `json:"result"`
-	Error  interface{}      `json:"error"`
+	Error  *json.RawMessage `json:"error"`
 }
 
 // to Marshal
@@ -82,26 +241,54 @@ type serverResponse struct {
 	Id     *json.RawMessage `json:"id"`
 	Result interface{}      `json:"result"`
 	Error  interface{}      `json:"error"`
+	Body   *int             `json:"body,omitempty"`
 }
+
+// errorObject is the error member of a response that has an error code.
+type errorObject struct {
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *errorData `json:"data,omitempty"`
+}
+
+// errorData is the data member of error objects.
+type errorData struct {
+	RetryAfter float64 `json:"retryAfter"` // in milliseconds
+}
+
 type clientRequest struct {
-	Method string      `json:"method"`
-	Params interface{} `json:"params"`
-	Id     *uint64     `json:"id"`
+	Method string            `json:"method"`
+	Params interface{}       `json:"params"`
+	Id     interface{}       `json:"id"`
+	Meta   map[string]string `json:"meta,omitempty"`
+
+	Attachments [][]byte `json:"attachments,omitempty"`
+	Body        *int     `json:"body,omitempty"`
 }
 
 func (c *jsonCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
-	c.msg = message{}
-	if err := c.dec.Decode(&c.msg); err != nil {
+	if err := c.readMessage(); err != nil {
 		return err
 	}
+	c.partEnc = nil
+	if c.msg.Body != nil {
+		if err := c.readPart(*c.msg.Body); err != nil {
+			return err
+		}
+	}
 
 	if c.msg.Method != "" {
 		// request comes to server
 		c.serverRequest.Id = c.msg.Id
 		c.serverRequest.Method = c.msg.Method
-		c.serverRequest.Params = c.msg.Params
+		c.serverRequest.Params = nil
+		if len(c.msg.Params) > 0 && !isNull(c.msg.Params) {
+			c.serverRequest.Params = &c.msg.Params
+		}
 
 		req.Method = c.serverRequest.Method
+		req.Metadata = c.msg.Meta
+		req.Attachments = c.msg.Attachments
 
 		// JSON request id can be any JSON value;
 		// RPC package expects uint64.  Translate to
@@ -114,68 +301,320 @@ func (c *jsonCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
 			c.pending[c.seq] = c.serverRequest.Id
 			c.serverRequest.Id = nil
 			req.Seq = c.seq
+			if enc := c.encodings[req.Method]; enc != nil {
+				c.respEncodings[c.seq] = enc
+			}
 			c.mutex.Unlock()
 		}
+		if c.msg.Body != nil {
+			c.partEnc = c.encodings[req.Method]
+		}
 	} else {
 		// response comes to client
-		err := json.Unmarshal(*c.msg.Id, &c.clientResponse.Id)
+		err := c.readResponseId()
 		if err != nil {
 			return err
 		}
-		c.clientResponse.Result = c.msg.Result
-		c.clientResponse.Error = c.msg.Error
+		c.clientResponse.Result = nil
+		if len(c.msg.Result) > 0 {
+			// A null result with a null error is a successful void response.
+			c.clientResponse.Result = &c.msg.Result
+		}
+		c.clientResponse.Error = nil
+		if len(c.msg.Error) > 0 && !isNull(c.msg.Error) {
+			c.clientResponse.Error = &c.msg.Error
+		}
 
 		resp.Error = ""
 		resp.Seq = c.clientResponse.Id
-		if c.clientResponse.Error != nil || c.clientResponse.Result == nil {
-			x, ok := c.clientResponse.Error.(string)
-			if !ok {
-				return fmt.Errorf("invalid error %v", c.clientResponse.Error)
+		resp.Code = 0
+		if c.replyEncodings != nil {
+			c.mutex.Lock()
+			enc := c.replyEncodings[resp.Seq]
+			delete(c.replyEncodings, resp.Seq)
+			c.mutex.Unlock()
+			if c.msg.Body != nil {
+				c.partEnc = enc
+				if enc == nil {
+					return errUnexpectedPart
+				}
 			}
-			if x == "" {
-				x = "unspecified error"
+		}
+		if c.clientResponse.Error != nil || (c.clientResponse.Result == nil && c.msg.Body == nil) {
+			if err := c.readError(resp); err != nil {
+				return err
 			}
-			resp.Error = x
 		}
+		resp.Partial = c.partial && resp.Error != "" && c.clientResponse.Result != nil && string(*c.clientResponse.Result) != "null"
 	}
 	return nil
 }
 
+// readMessage reads the next message into c.msg.
+func (c *jsonCodec) readMessage() error {
+	c.msg.reset()
+	if c.lines == nil {
+		err := c.dec.Decode(&c.msg)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// The stream cannot be resynchronized after a syntax error.
+			// Tell the peer before the connection is closed.
+			c.writeParseError(err)
+		}
+		return err
+	}
+	for {
+		line, err := c.lines.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		decodeErr := json.Unmarshal(line, &c.msg)
+		if decodeErr == nil {
+			c.badLines = 0
+			return nil
+		}
+		if err != nil {
+			// Partial line at the end of stream.
+			return err
+		}
+		// Skip the corrupted line and continue with the next one.
+		c.msg.reset()
+		if c.onDecodeError != nil {
+			c.onDecodeError(line, decodeErr)
+		}
+		c.writeParseError(decodeErr)
+		if c.badLines++; c.badLines >= maxBadLines {
+			return fmt.Errorf("jsonrpc: %d consecutive lines cannot be decoded: %w", c.badLines, decodeErr)
+		}
+	}
+}
+
+// reset clears m, keeping the buffers of raw members.
+func (m *message) reset() {
+	*m = message{
+		Params: m.Params[:0],
+		Result: m.Result[:0],
+		Error:  m.Error[:0],
+	}
+}
+
+func isNull(raw json.RawMessage) bool {
+	return string(raw) == "null"
+}
+
+func (c *jsonCodec) writeParseError(err error) {
+	c.encode(serverResponse{
+		Id:    &null,
+		Error: errorObject{Code: rpc2.CodeParseError, Message: "parse error: " + err.Error()},
+	})
+}
+
+// encode writes v as a single line.
+func (c *jsonCodec) encode(v interface{}) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	return c.enc.Encode(v)
+}
+
+// readError populates the error message and code of resp from the error member of the response.
+func (c *jsonCodec) readError(resp *rpc2.Response) error {
+	raw := c.clientResponse.Error
+	if raw == nil {
+		return errors.New("jsonrpc: response has neither result nor error")
+	}
+	var x string
+	if c.errDecoder != nil {
+		err := c.errDecoder(*raw)
+		if err == nil {
+			// Decoder says the response is not an error.
+			c.clientResponse.Error = nil
+			return nil
+		}
+		x = err.Error()
+		var e *rpc2.Error
+		if errors.As(err, &e) {
+			resp.Code = e.Code
+		}
+	} else if p := bytes.TrimSpace(*raw); len(p) > 0 && p[0] == '"' {
+		if err := json.Unmarshal(p, &x); err != nil {
+			x = string(*raw)
+		}
+	} else {
+		// Error object as defined by JSON-RPC 2.0
+		var obj struct {
+			Code    int     `json:"code"`
+			Message *string `json:"message"`
+			Data    struct {
+				RetryAfter float64 `json:"retryAfter"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(*raw, &obj); err == nil && obj.Message != nil {
+			x = *obj.Message
+			resp.Code = obj.Code
+			resp.RetryAfter = time.Duration(obj.Data.RetryAfter * float64(time.Millisecond))
+		} else {
+			// Unknown shape; report it as is.
+			x = string(*raw)
+		}
+	}
+	if x == "" {
+		x = "unspecified error"
+	}
+	resp.Error = x
+	return nil
+}
+
+// readResponseId translates the ID of a response to the sequence number of the request.
+// Responses with unknown or null IDs get a zero sequence number and are discarded by rpc2.
+func (c *jsonCodec) readResponseId() error {
+	c.clientResponse.Id = 0
+	if c.msg.Id == nil {
+		return nil
+	}
+	if c.idGen != nil {
+		key, err := idKey(*c.msg.Id)
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		c.clientResponse.Id = c.ids[key]
+		delete(c.ids, key)
+		delete(c.idKeys, c.clientResponse.Id)
+		c.mutex.Unlock()
+		return nil
+	}
+	if err := json.Unmarshal(*c.msg.Id, &c.clientResponse.Id); err == nil {
+		return nil
+	}
+	// Some peers echo numeric IDs as strings.
+	var str string
+	if err := json.Unmarshal(*c.msg.Id, &str); err != nil {
+		return err
+	}
+	seq, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid response id %q", str)
+	}
+	c.clientResponse.Id = seq
+	return nil
+}
+
+// idKey returns the compact JSON encoding of id.
+func idKey(id json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 var errMissingParams = errors.New("jsonrpc: request body missing params")
 
 func (c *jsonCodec) ReadRequestBody(x interface{}) error {
 	if x == nil {
 		return nil
 	}
+	if c.msg.Body != nil {
+		if c.partEnc == nil {
+			return errUnexpectedPart
+		}
+		return c.partEnc.Unmarshal(c.part, x)
+	}
+	values := c.values
+	values.strict = c.strictParams
+	if c.serverRequest.Params != nil {
+		if err := c.checkLimits(*c.serverRequest.Params); err != nil {
+			return err
+		}
+	}
+	if c.validateParams != nil {
+		var params json.RawMessage
+		if c.serverRequest.Params != nil {
+			params = *c.serverRequest.Params
+		}
+		if err := c.validateParams(c.serverRequest.Method, params); err != nil {
+			return err
+		}
+	}
 	if c.serverRequest.Params == nil {
+		// Params may be omitted for methods taking no arguments.
+		if takesNoParams(x) {
+			return nil
+		}
 		return errMissingParams
 	}
 
+	if p := bytes.TrimSpace(*c.serverRequest.Params); len(p) > 0 && p[0] == '{' {
+		// Named params
+		return values.unmarshal(p, x)
+	}
+	if c.positional {
+		if ok, err := decodePositional(*c.serverRequest.Params, x, values.unmarshal); ok {
+			return err
+		}
+	}
+
 	var err error
 
 	// Check if x points to a slice of any kind
 	rt := reflect.TypeOf(x)
 	if rt.Kind() == reflect.Ptr && rt.Elem().Kind() == reflect.Slice {
 		// If it's a slice, unmarshal as is
-		err = json.Unmarshal(*c.serverRequest.Params, x)
+		err = values.unmarshal(*c.serverRequest.Params, x)
 	} else {
 		// Anything else unmarshal into a slice containing x
 		params := &[]interface{}{x}
-		err = json.Unmarshal(*c.serverRequest.Params, params)
+		err = values.unmarshal(*c.serverRequest.Params, params)
 	}
 
 	return err
 }
 
+// isObject returns true if x is a struct or a map, or a pointer to one.
+func isObject(x interface{}) bool {
+	rt := reflect.TypeOf(x)
+	if rt == nil {
+		return false
+	}
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	return rt.Kind() == reflect.Struct || rt.Kind() == reflect.Map
+}
+
+// takesNoParams returns true if x can be left as zero value when params are omitted.
+func takesNoParams(x interface{}) bool {
+	rt := reflect.TypeOf(x)
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	switch rt.Kind() {
+	case reflect.Struct:
+		return rt.NumField() == 0
+	case reflect.Slice, reflect.Interface:
+		return true
+	}
+	return false
+}
+
 func (c *jsonCodec) ReadResponseBody(x interface{}) error {
-	if x == nil {
+	if x != nil && c.partEnc != nil {
+		return c.partEnc.Unmarshal(c.part, x)
+	}
+	if x == nil || c.clientResponse.Result == nil {
 		return nil
 	}
-	return json.Unmarshal(*c.clientResponse.Result, x)
+	return c.values.unmarshal(*c.clientResponse.Result, x)
 }
 
 func (c *jsonCodec) WriteRequest(r *rpc2.Request, param interface{}) error {
-	req := &clientRequest{Method: r.Method}
+	req := &clientRequest{Method: r.Method, Meta: r.Metadata, Attachments: r.Attachments}
+	if enc := c.encodings[r.Method]; enc != nil {
+		return c.writeRequestPart(req, r.Seq, enc, param)
+	}
 
 	// Check if param is a slice of any kind
 	if param != nil && reflect.TypeOf(param).Kind() == reflect.Slice {
@@ -185,15 +624,80 @@ func (c *jsonCodec) WriteRequest(r *rpc2.Request, param interface{}) error {
 		// Put anything else into a slice
 		req.Params = []interface{}{param}
 	}
+	if c.named && isObject(param) {
+		req.Params = param
+	}
+	if c.positional {
+		if params, ok := positionalParams(param); ok {
+			req.Params = params
+		}
+	}
+	params, err := c.values.marshal(req.Params)
+	if err != nil {
+		return err
+	}
+	req.Params = params
 
-	if r.Seq == 0 {
+	if err := c.setRequestId(req, r.Seq); err != nil {
+		return err
+	}
+	return c.encode(req)
+}
+
+// writeRequestPart writes req with param encoded with enc in a body part.
+func (c *jsonCodec) writeRequestPart(req *clientRequest, seq uint64, enc Encoding, param interface{}) error {
+	part, err := enc.Marshal(param)
+	if err != nil {
+		return err
+	}
+	n := len(part)
+	req.Body = &n
+	if err = c.setRequestId(req, seq); err != nil {
+		return err
+	}
+	if seq != 0 {
+		c.mutex.Lock()
+		c.replyEncodings[seq] = enc
+		c.mutex.Unlock()
+	}
+	return c.writePart(req, part)
+}
+
+// setRequestId sets the id of req, the request with sequence number seq.
+func (c *jsonCodec) setRequestId(req *clientRequest, seq uint64) error {
+	if seq == 0 {
 		// Notification
 		req.Id = nil
+	} else if c.idGen != nil {
+		b, err := json.Marshal(c.idGen(seq))
+		if err != nil {
+			return err
+		}
+		key, err := idKey(b)
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		c.ids[key] = seq
+		c.idKeys[seq] = key
+		c.mutex.Unlock()
+		req.Id = json.RawMessage(b)
 	} else {
-		seq := r.Seq
-		req.Id = &seq
+		req.Id = seq
 	}
-	return c.enc.Encode(req)
+	return nil
+}
+
+// Forget removes the generated ID and the encoding of the request with seq,
+// whose call completed without a response.
+func (c *jsonCodec) Forget(seq uint64) {
+	c.mutex.Lock()
+	delete(c.replyEncodings, seq)
+	if key, ok := c.idKeys[seq]; ok {
+		delete(c.ids, key)
+		delete(c.idKeys, seq)
+	}
+	c.mutex.Unlock()
 }
 
 var null = json.RawMessage([]byte("null"))
@@ -206,6 +710,8 @@ func (c *jsonCodec) WriteResponse(r *rpc2.Response, x interface{}) error {
 		return errors.New("invalid sequence number in response")
 	}
 	delete(c.pending, r.Seq)
+	enc := c.respEncodings[r.Seq]
+	delete(c.respEncodings, r.Seq)
 	c.mutex.Unlock()
 
 	if b == nil {
@@ -213,12 +719,40 @@ func (c *jsonCodec) WriteResponse(r *rpc2.Response, x interface{}) error {
 		b = &null
 	}
 	resp := serverResponse{Id: b}
+	if enc != nil && r.Error == "" {
+		return c.writeResponsePart(&resp, enc, x)
+	}
 	if r.Error == "" {
-		resp.Result = x
+		result, err := c.values.marshal(x)
+		if err != nil {
+			return err
+		}
+		resp.Result = result
+	} else if r.Code != 0 || r.RetryAfter != 0 {
+		obj := errorObject{Code: r.Code, Message: r.Error}
+		if r.RetryAfter != 0 {
+			obj.Data = &errorData{RetryAfter: float64(r.RetryAfter) / float64(time.Millisecond)}
+		}
+		resp.Error = obj
 	} else {
 		resp.Error = r.Error
 	}
-	return c.enc.Encode(resp)
+	return c.encode(resp)
+}
+
+// writeResponsePart writes resp with x encoded with enc in a body part.
+func (c *jsonCodec) writeResponsePart(resp *serverResponse, enc Encoding, x interface{}) error {
+	part, err := enc.Marshal(x)
+	if err != nil {
+		return err
+	}
+	n := len(part)
+	resp.Body = &n
+	return c.writePart(resp, part)
+}
+
+func (c *jsonCodec) Conn() io.ReadWriteCloser {
+	return c.c
 }
 
 func (c *jsonCodec) Close() error {
@@ -1,13 +1,20 @@
 package jsonrpc
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/codectest"
 )
 
 const (
@@ -75,7 +82,8 @@ func TestJSONRPC(t *testing.T) {
 	go func() {
 		conn, err := lis.Accept()
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		srv.ServeCodec(NewJSONCodec(conn))
 	}()
@@ -180,3 +188,890 @@ func TestJSONRPC(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIDGenerator(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+
+	gen := func(seq uint64) interface{} { return fmt.Sprintf("req-%d", seq) }
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2, WithIDGenerator(gen)))
+	go clt.Run()
+	defer clt.Close()
+
+	for _, s := range []string{"a", "b"} {
+		var reply string
+		if err := clt.Call("echo", s, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != s {
+			t.Fatalf("unexpected reply: %s", reply)
+		}
+	}
+}
+
+func TestIDGeneratorForget(t *testing.T) {
+	// Responses are sent after the calls are abandoned.
+	release := make(chan struct{})
+	defer close(release)
+	srv := rpc2.NewServer()
+	srv.Handle("wait", func(client *rpc2.Client, args int, reply *int) error {
+		<-release
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+
+	gen := func(seq uint64) interface{} { return fmt.Sprintf("req-%d", seq) }
+	codec := NewJSONCodec(c2, WithIDGenerator(gen)).(*jsonCodec)
+	clt := rpc2.NewClientWithCodec(codec)
+	go clt.Run()
+	defer clt.Close()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := clt.CallWithContext(ctx, "wait", 0, new(int))
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	codec.mutex.Lock()
+	n := len(codec.ids) + len(codec.idKeys)
+	codec.mutex.Unlock()
+	if n != 0 {
+		t.Fatalf("IDs of abandoned calls are kept: %v", codec.ids)
+	}
+}
+
+func TestStringResponseID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		dec := json.NewDecoder(c1)
+		var req map[string]interface{}
+		if err := dec.Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprintf(c1, `{"id":"%v","result":"ok","error":null}`, req["id"])
+	}()
+
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2))
+	go clt.Run()
+	defer clt.Close()
+
+	var reply string
+	if err := clt.Call("foo", nil, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "ok" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("set", func(client *rpc2.Client, i int, _ *struct{}) error {
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+	defer c2.Close()
+
+	dec := json.NewDecoder(c2)
+	expectCode := func(req string, code int) {
+		t.Helper()
+		if _, err := io.WriteString(c2, req); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Error struct {
+				Code int `json:"code"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error.Code != code {
+			t.Fatalf("unexpected code: %d", resp.Error.Code)
+		}
+	}
+	expectCode(`{"id":1,"method":"foo","params":[]}`, rpc2.CodeMethodNotFound)
+	expectCode(`{"id":2,"method":"set","params":["x"]}`, rpc2.CodeInvalidParams)
+	expectCode(`{"id":3,"method":"set",}`, rpc2.CodeParseError)
+}
+
+func TestOmittedParams(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("ping", func(client *rpc2.Client, reply *string) error {
+		*reply = "pong"
+		return nil
+	})
+	srv.Handle("empty", func(client *rpc2.Client, args struct{}, reply *string) error {
+		*reply = "ok"
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+	defer c2.Close()
+
+	dec := json.NewDecoder(c2)
+	for req, expected := range map[string]string{
+		`{"id":1,"method":"ping"}`:              "pong",
+		`{"id":2,"method":"ping","params":[]}`:  "pong",
+		`{"id":3,"method":"empty"}`:             "ok",
+		`{"id":4,"method":"empty","params":[]}`: "ok",
+	} {
+		if _, err := io.WriteString(c2, req); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Result string      `json:"result"`
+			Error  interface{} `json:"error"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != nil || resp.Result != expected {
+			t.Fatalf("unexpected response to %s: %+v", req, resp)
+		}
+	}
+}
+
+func TestErrorDecoder(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		dec := json.NewDecoder(c1)
+		for _, e := range []string{`{"reason":"busy","errno":7}`, `["weird"]`} {
+			var req map[string]interface{}
+			if err := dec.Decode(&req); err != nil {
+				t.Error(err)
+				return
+			}
+			fmt.Fprintf(c1, `{"id":%v,"result":null,"error":%s}`, req["id"], e)
+		}
+	}()
+
+	decodeError := func(raw json.RawMessage) error {
+		var e struct {
+			Reason string `json:"reason"`
+			Errno  int    `json:"errno"`
+		}
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return fmt.Errorf("undecodable error: %s", raw)
+		}
+		return &rpc2.Error{Code: e.Errno, Message: e.Reason}
+	}
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2, WithErrorDecoder(decodeError)))
+	go clt.Run()
+	defer clt.Close()
+
+	err := clt.Call("foo", nil, nil)
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != 7 || e.Message != "busy" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	err = clt.Call("foo", nil, nil)
+	if err == nil || err.Error() != `undecodable error: ["weird"]` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLineFraming(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+
+	decodeErrors := make(chan string, 1)
+	onDecodeError := func(line []byte, err error) {
+		decodeErrors <- string(line)
+	}
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1, WithLineFraming(onDecodeError)))
+	defer c2.Close()
+
+	go io.WriteString(c2, "{\"id\":1,\"met\x00hod\":\"echo\"\n{\"id\":2,\"method\":\"echo\",\"params\":[\"hi\"]}\n")
+
+	dec := json.NewDecoder(c2)
+	var resp struct {
+		Id     interface{} `json:"id"`
+		Result string      `json:"result"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != nil || resp.Error == nil || resp.Error.Code != rpc2.CodeParseError {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if line := <-decodeErrors; line != "{\"id\":1,\"met\x00hod\":\"echo\"\n" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+
+	resp.Error = nil
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil || resp.Result != "hi" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestLineFramingBadLines(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeCodec(NewJSONCodec(c1, WithLineFraming(nil)))
+		close(done)
+	}()
+	defer c2.Close()
+
+	type response struct {
+		Id     interface{} `json:"id"`
+		Result string      `json:"result"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	dec := json.NewDecoder(c2)
+	readParseErrors := func(n int) {
+		for i := 0; i < n; i++ {
+			var resp response
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error == nil || resp.Error.Code != rpc2.CodeParseError {
+				t.Fatalf("unexpected response: %+v", resp)
+			}
+		}
+	}
+
+	// A valid line resets the count of bad lines.
+	// Its response is written while parse errors are written.
+	go io.WriteString(c2, strings.Repeat("bad\n", maxBadLines-1)+"{\"id\":1,\"method\":\"echo\",\"params\":[\"hi\"]}\nbad\n")
+	readParseErrors(maxBadLines - 1)
+	var resp response
+	var parseErrors int
+	for resp.Result != "hi" {
+		resp = response{}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != nil {
+			parseErrors++
+		}
+	}
+	readParseErrors(1 - parseErrors)
+
+	go io.WriteString(c2, strings.Repeat("bad\n", maxBadLines-1))
+	readParseErrors(maxBadLines - 1)
+	if err := dec.Decode(&resp); err != io.EOF {
+		t.Fatalf("connection is not closed: %v", err)
+	}
+	<-done
+}
+
+func TestConformance(t *testing.T) {
+	codectest.Run(t, func(conn io.ReadWriteCloser) rpc2.Codec { return NewJSONCodec(conn) })
+}
+
+func TestRetryAfter(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("busy", func(client *rpc2.Client, i int, _ *struct{}) error {
+		return &rpc2.Error{Code: rpc2.CodeRejected, Message: "busy", RetryAfter: 1500 * time.Millisecond}
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2))
+	go clt.Run()
+	defer clt.Close()
+
+	err := clt.Call("busy", 1, nil)
+	e, ok := err.(*rpc2.Error)
+	if !ok || e.Code != rpc2.CodeRejected || e.RetryAfter != 1500*time.Millisecond {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestRetryAfterWire(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("busy", func(client *rpc2.Client, i int, _ *struct{}) error {
+		return &rpc2.Error{Code: rpc2.CodeRejected, Message: "busy", RetryAfter: 2 * time.Second}
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+	defer c2.Close()
+
+	if _, err := io.WriteString(c2, `{"id":1,"method":"busy","params":[1]}`); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.NewDecoder(c2).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if s := string(resp.Error); s != `{"code":-32000,"message":"busy","data":{"retryAfter":2000}}` {
+		t.Fatalf("unexpected error: %s", s)
+	}
+}
+
+func TestPositionalStructs(t *testing.T) {
+	type AddArgs struct {
+		A, B    int
+		Ignored string `json:"-"`
+	}
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *AddArgs, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1, WithPositionalStructs()))
+	defer c2.Close()
+
+	// Positional, wrapped and partial params are all accepted.
+	dec := json.NewDecoder(c2)
+	for params, want := range map[string]string{`[1, 2]`: "3", `[{"A": 3, "B": 4}]`: "7", `[5]`: "5"} {
+		if _, err := fmt.Fprintf(c2, `{"id":1,"method":"add","params":%s}`, params); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  interface{}     `json:"error"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Result) != want || resp.Error != nil {
+			t.Fatalf("unexpected response to %s: %s, %v", params, resp.Result, resp.Error)
+		}
+	}
+
+	// Structs are sent as positional params.
+	c3, c4 := net.Pipe()
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c3, WithPositionalStructs()))
+	go clt.Run()
+	defer clt.Close()
+	go clt.Call("add", AddArgs{A: 1, B: 2, Ignored: "x"}, new(int))
+	var req struct {
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(c4).Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Params) != `[1,2]` {
+		t.Fatalf("unexpected params: %s", req.Params)
+	}
+}
+
+func TestNamedParams(t *testing.T) {
+	type AddArgs struct{ A, B int }
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args AddArgs, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	srv.Handle("sum", func(client *rpc2.Client, args map[string]int, reply *int) error {
+		for _, v := range args {
+			*reply += v
+		}
+		return nil
+	})
+
+	// Objects are decoded without the option.
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+	defer c2.Close()
+	if _, err := io.WriteString(c2, `{"id":1,"method":"add","params":{"A":1,"B":2}}`); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(c2).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Result) != "3" {
+		t.Fatalf("unexpected result: %s", resp.Result)
+	}
+
+	// Structs and maps are sent as objects with the option.
+	c3, c4 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c3))
+	var params json.RawMessage
+	rec := &recorder{ReadWriteCloser: c4, params: &params}
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(rec, WithNamedParams()))
+	go clt.Run()
+	defer clt.Close()
+	var reply int
+	if err := clt.Call("add", &AddArgs{3, 4}, &reply); err != nil || reply != 7 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	if string(params) != `{"A":3,"B":4}` {
+		t.Fatalf("unexpected params: %s", params)
+	}
+	reply = 0
+	if err := clt.Call("sum", map[string]int{"x": 1, "y": 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+}
+
+// recorder saves the params of the last request written to the connection.
+type recorder struct {
+	io.ReadWriteCloser
+	params *json.RawMessage
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	var req struct {
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(p, &req) == nil && req.Params != nil {
+		*r.params = req.Params
+	}
+	return r.ReadWriteCloser.Write(p)
+}
+
+func TestNullResult(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		dec := json.NewDecoder(c1)
+		for _, resp := range []string{`"result":null,"error":null`, `"error":null`} {
+			var req map[string]interface{}
+			if err := dec.Decode(&req); err != nil {
+				t.Error(err)
+				return
+			}
+			fmt.Fprintf(c1, `{"id":%v,%s}`, req["id"], resp)
+		}
+	}()
+
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2))
+	go clt.Run()
+	defer clt.Close()
+
+	reply := "unchanged"
+	if err := clt.Call("void", nil, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "unchanged" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	if err := clt.Call("void", nil, &reply); err == nil {
+		t.Fatal("response without result is accepted")
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		dec := json.NewDecoder(c1)
+		for {
+			var req map[string]interface{}
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			fmt.Fprintf(c1, `{"id":%v,"result":[1,2],"error":{"code":1,"message":"partial"}}`, req["id"])
+		}
+	}()
+
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2, WithPartialResults()))
+	go clt.Run()
+	defer clt.Close()
+
+	var reply []int
+	err := clt.Call("list", nil, &reply)
+	if err == nil || err.Error() != "partial" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reply) != 2 || reply[0] != 1 || reply[1] != 2 {
+		t.Fatalf("unexpected reply: %v", reply)
+	}
+}
+
+func TestReusedBuffers(t *testing.T) {
+	c1, c2 := net.Pipe()
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, args []string, reply *[]string) error {
+		*reply = args
+		return nil
+	})
+	go srv.ServeCodec(NewJSONCodec(c1))
+	defer c2.Close()
+
+	// A message must not see the members of the previous message.
+	dec := json.NewDecoder(c2)
+	for _, tc := range []struct{ req, resp string }{
+		{`{"method":"echo","params":["a long parameter"],"id":1}`, `{"id":1,"result":["a long parameter"],"error":null}`},
+		{`{"method":"echo","id":2}`, `{"id":2,"result":null,"error":null}`},
+		{`{"method":"echo","params":null,"id":3}`, `{"id":3,"result":null,"error":null}`},
+		{`{"method":"echo","params":["b"],"id":4}`, `{"id":4,"result":["b"],"error":null}`},
+	} {
+		if _, err := io.WriteString(c2, tc.req+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		var resp json.RawMessage
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if string(resp) != tc.resp {
+			t.Fatalf("unexpected response to %s: %s", tc.req, resp)
+		}
+	}
+}
+
+func TestValueFormats(t *testing.T) {
+	type Event struct {
+		ID     int64     `json:"id"`
+		At     time.Time `json:"at"`
+		Total  *big.Int  `json:"total"`
+		Count  int32     `json:"count"`
+		Quoted uint64    `json:"quoted,string"`
+	}
+	c1, c2 := net.Pipe()
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, args Event, reply *Event) error {
+		if args.ID != 9007199254740993 || args.At.UnixMilli() != 1700000000123 || args.Total.String() != "123456789012345678901234567890" {
+			t.Errorf("unexpected args: %+v", args)
+		}
+		*reply = args
+		return nil
+	})
+	go srv.ServeCodec(NewJSONCodec(c1, WithStringInts(), WithTimeFormat(TimeUnixMilli)))
+	defer c2.Close()
+
+	dec := json.NewDecoder(c2)
+	for _, tc := range []struct{ req, resp string }{
+		{
+			`{"method":"echo","params":[{"id":"9007199254740993","at":1700000000123,"total":"123456789012345678901234567890","count":1,"quoted":"2"}],"id":1}`,
+			`{"id":1,"result":{"at":1700000000123,"count":1,"id":"9007199254740993","quoted":"2","total":"123456789012345678901234567890"},"error":null}`,
+		},
+		{
+			`{"method":"echo","params":[{"id":9007199254740993,"at":"2023-11-14T22:13:20.123Z","total":123456789012345678901234567890}],"id":2}`,
+			`{"id":2,"result":{"at":1700000000123,"count":0,"id":"9007199254740993","quoted":"0","total":"123456789012345678901234567890"},"error":null}`,
+		},
+	} {
+		if _, err := io.WriteString(c2, tc.req+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		var resp json.RawMessage
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if string(resp) != tc.resp {
+			t.Fatalf("unexpected response to %s: %s", tc.req, resp)
+		}
+	}
+}
+
+func TestUnixTimes(t *testing.T) {
+	for _, s := range []string{"0", "1700000000", "1700000000.5", "-1.25", "-0.000000001"} {
+		tm, ok := parseUnix(s, false)
+		if !ok {
+			t.Fatalf("can't parse %s", s)
+		}
+		if got := formatUnix(tm); got != s {
+			t.Fatalf("unexpected format of %s: %s", s, got)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	core := rpc2.NewServer()
+	core.Handle("add", func(ctx context.Context, client *rpc2.Client, args []int, reply *int) error {
+		if rpc2.IncomingMetadata(ctx)["tenant"] != "a" {
+			t.Error("metadata is not forwarded")
+		}
+		*reply = args[0] + args[1]
+		return nil
+	})
+	core.Handle("fail", func(client *rpc2.Client, args []int, reply *int) error {
+		return &rpc2.Error{Code: 42, Message: "failed"}
+	})
+	c1, c2 := net.Pipe()
+	go core.ServeCodec(NewJSONCodec(c1))
+	upstream := rpc2.NewClientWithCodec(NewJSONCodec(c2))
+	go upstream.Run()
+	defer upstream.Close()
+
+	edge := rpc2.NewServer()
+	edge.Handle("local", func(client *rpc2.Client, args []int, reply *int) error {
+		*reply = -1
+		return nil
+	})
+	edge.HandlePattern("**", rpc2.Proxy[json.RawMessage](upstream))
+	c3, c4 := net.Pipe()
+	go edge.ServeCodec(NewJSONCodec(c3))
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c4))
+	go clt.Run()
+	defer clt.Close()
+
+	ctx := rpc2.WithMetadata(context.Background(), map[string]string{"tenant": "a"})
+	var reply int
+	if err := clt.CallWithContext(ctx, "add", []int{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	if err := clt.Call("local", []int{}, &reply); err != nil || reply != -1 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	err := clt.CallWithContext(ctx, "fail", []int{}, &reply)
+	var e *rpc2.Error
+	if !errors.As(err, &e) || e.Code != 42 || e.Message != "failed" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("concat", func(ctx context.Context, client *rpc2.Client, indexes []int, reply *string) error {
+		a := rpc2.Attachments(ctx)
+		for _, i := range indexes {
+			*reply += string(a[i])
+		}
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1))
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2))
+	go clt.Run()
+	defer clt.Close()
+
+	ctx := rpc2.WithAttachments(context.Background(), []byte("foo"), []byte{0, 1, 2})
+	var reply string
+	if err := clt.CallWithContext(ctx, "concat", []int{1, 0}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "\x00\x01\x02foo" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+}
+
+func TestBodyEncoding(t *testing.T) {
+	for _, lines := range []bool{false, true} {
+		opts := []Option{WithBodyEncoding("reverse", RawEncoding), WithBodyEncoding("store", RawEncoding)}
+		if lines {
+			opts = append(opts, WithLineFraming(nil))
+		}
+		srv := rpc2.NewServer()
+		srv.Handle("reverse", func(client *rpc2.Client, b []byte) ([]byte, error) {
+			r := make([]byte, len(b))
+			for i := range b {
+				r[len(b)-1-i] = b[i]
+			}
+			return r, nil
+		})
+		stored := make(chan []byte, 1)
+		srv.Handle("store", func(client *rpc2.Client, b []byte, _ *struct{}) error {
+			stored <- b
+			return nil
+		})
+		srv.Handle("add", func(client *rpc2.Client, args []int, reply *int) error {
+			*reply = args[0] + args[1]
+			return nil
+		})
+		c1, c2 := net.Pipe()
+		go srv.ServeCodec(NewJSONCodec(c1, opts...))
+		clt := rpc2.NewClientWithCodec(NewJSONCodec(c2, opts...))
+		go clt.Run()
+
+		// Parts may contain newlines and bytes that are not valid JSON.
+		blob := []byte("a\n\x00\xff{")
+		var reversed []byte
+		if err := clt.Call("reverse", blob, &reversed); err != nil {
+			t.Fatal(err)
+		}
+		if string(reversed) != "{\xff\x00\na" {
+			t.Fatalf("unexpected reply: %q", reversed)
+		}
+		var sum int
+		if err := clt.Call("add", []int{1, 2}, &sum); err != nil || sum != 3 {
+			t.Fatalf("unexpected reply: %d, %v", sum, err)
+		}
+		if err := clt.Notify("store", blob); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case b := <-stored:
+			if string(b) != string(blob) {
+				t.Fatalf("unexpected notification: %q", b)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("notification is not handled")
+		}
+		clt.Close()
+	}
+}
+
+// bufferConn is a connection reading what is written to it.
+type bufferConn struct{ bytes.Buffer }
+
+func (*bufferConn) Close() error { return nil }
+
+func TestPipelinedBodyParts(t *testing.T) {
+	for _, lines := range []bool{false, true} {
+		opts := []Option{WithBodyEncoding("frame", RawEncoding)}
+		if lines {
+			opts = append(opts, WithLineFraming(nil))
+		}
+		// Write all messages before reading any, so the decoder reads ahead
+		// across messages and parts.
+		conn := new(bufferConn)
+		w := NewJSONCodec(conn, opts...)
+		const n = 50
+		for i := 0; i < n; i++ {
+			req := &rpc2.Request{Seq: uint64(i), Method: "frame"}
+			if i == 0 {
+				req.Metadata = map[string]string{"large": strings.Repeat("x", 3000)}
+			}
+			part := bytes.Repeat([]byte{byte('0' + i%10)}, 100+i)
+			if err := w.WriteRequest(req, part); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r := NewJSONCodec(conn, opts...)
+		for i := 0; i < n; i++ {
+			var req rpc2.Request
+			if err := r.ReadHeader(&req, new(rpc2.Response)); err != nil {
+				t.Fatal(err)
+			}
+			var part []byte
+			if err := r.ReadRequestBody(&part); err != nil {
+				t.Fatal(err)
+			}
+			if want := bytes.Repeat([]byte{byte('0' + i%10)}, 100+i); !bytes.Equal(part, want) {
+				t.Fatalf("unexpected part of message %d (lines: %v): %q", i, lines, part)
+			}
+		}
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("describe", func(client *rpc2.Client, args []interface{}, reply *string) error {
+		*reply = fmt.Sprintf("%T %v", args[0], args[0])
+		return nil
+	})
+	srv.Handle("big", func(client *rpc2.Client, args []interface{}, reply *uint64) error {
+		*reply = 1<<60 + 1
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1, WithUseNumber()))
+	clt := rpc2.NewClientWithCodec(NewJSONCodec(c2, WithUseNumber()))
+	go clt.Run()
+	defer clt.Close()
+
+	var reply string
+	if err := clt.Call("describe", []interface{}{uint64(1<<60 + 1)}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "json.Number 1152921504606846977" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	var result interface{}
+	if err := clt.Call("big", nil, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result != json.Number("1152921504606846977") {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	type AddArgs struct{ A, B int }
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args AddArgs, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1, WithDisallowUnknownFields()))
+	defer c2.Close()
+
+	dec := json.NewDecoder(c2)
+	for params, want := range map[string]string{
+		`{"A":1,"B":2}`:   `3`,
+		`[{"A":1,"B":2}]`: `3`,
+		`{"A":1,"C":2}`:   `{"code":-32602,"message":"rpc2: invalid params: json: unknown field \"C\""}`,
+		`[{"A":1,"C":2}]`: `{"code":-32602,"message":"rpc2: invalid params: json: unknown field \"C\""}`,
+	} {
+		if _, err := fmt.Fprintf(c2, `{"id":1,"method":"add","params":%s}`, params); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  json.RawMessage `json:"error"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		got := string(resp.Result)
+		if string(resp.Error) != "null" {
+			got = string(resp.Error)
+		}
+		if got != want {
+			t.Fatalf("unexpected response to %s: %s", params, got)
+		}
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("count", func(client *rpc2.Client, args []interface{}, reply *int) error {
+		*reply = len(args)
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewJSONCodec(c1, WithDecodeLimits(3, 4)))
+	defer c2.Close()
+
+	dec := json.NewDecoder(c2)
+	for params, want := range map[string]string{
+		`[1, 2, 3, 4]`:             `4`,
+		`[[[1]], "[[[,,,,"]`:       `2`,
+		`[{"a": [1, 2], "b": {}}]`: `1`,
+		`[1, 2, 3, 4, 5]`:          `{"code":-32602,"message":"rpc2: invalid params: jsonrpc: more than 4 elements in params"}`,
+		`[[[[1]]]]`:                `{"code":-32602,"message":"rpc2: invalid params: jsonrpc: params nested deeper than 3"}`,
+		`[[1, 2, 3, 4, "\",\""]]`:  `{"code":-32602,"message":"rpc2: invalid params: jsonrpc: more than 4 elements in params"}`,
+	} {
+		if _, err := fmt.Fprintf(c2, `{"id":1,"method":"count","params":%s}`, params); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  json.RawMessage `json:"error"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		got := string(resp.Result)
+		if string(resp.Error) != "null" {
+			got = string(resp.Error)
+		}
+		if got != want {
+			t.Fatalf("unexpected response to %s: %s", params, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Package jsonschema validates params of incoming JSON-RPC requests against
+// per-method JSON Schemas before handlers run.
+//
+//	v, err := jsonschema.New(map[string]string{
+//		"add": `{"type": "array", "items": {"type": "number"}, "minItems": 2}`,
+//	})
+//	codec := jsonrpc.NewJSONCodec(conn, jsonrpc.WithParamsValidator(v.Validate))
+//
+// Schemas describe the params member as sent. Peers using the jsonrpc codec
+// send a single argument wrapped in an array, so a struct argument is described
+// by an array schema with one object item.
+//
+// Requests with invalid params are answered with an invalid params error
+// describing every violation; their handlers are not called.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Validator holds compiled schemas of methods.
+type Validator struct {
+	schemas map[string]*jsonschema.Schema
+}
+
+// New compiles schemas, which map method names to JSON Schema documents
+// describing the params member of requests. Params of methods without
+// a schema are not validated.
+func New(schemas map[string]string) (*Validator, error) {
+	v := &Validator{schemas: make(map[string]*jsonschema.Schema, len(schemas))}
+	c := jsonschema.NewCompiler()
+	for method, src := range schemas {
+		u := "mem:///methods/" + url.PathEscape(method) + ".json"
+		if err := c.AddResource(u, strings.NewReader(src)); err != nil {
+			return nil, fmt.Errorf("jsonschema: method %s: %w", method, err)
+		}
+		s, err := c.Compile(u)
+		if err != nil {
+			return nil, fmt.Errorf("jsonschema: method %s: %w", method, err)
+		}
+		v.schemas[method] = s
+	}
+	return v, nil
+}
+
+// Validate validates params of a request to method. Omitted params are validated as null.
+// It can be passed to jsonrpc.WithParamsValidator.
+func (v *Validator) Validate(method string, params json.RawMessage) error {
+	s, ok := v.schemas[method]
+	if !ok {
+		return nil
+	}
+	var doc interface{}
+	if len(params) > 0 {
+		d := json.NewDecoder(bytes.NewReader(params))
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			return err
+		}
+	}
+	err := s.Validate(doc)
+	if ve, ok := err.(*jsonschema.ValidationError); ok {
+		var details []string
+		collect(ve, &details)
+		return fmt.Errorf("%s", strings.Join(details, "; "))
+	}
+	return err
+}
+
+// collect appends the messages of the leaf errors of ve to details.
+func collect(ve *jsonschema.ValidationError, details *[]string) {
+	if len(ve.Causes) == 0 {
+		loc := ve.InstanceLocation
+		if loc == "" {
+			loc = "/"
+		}
+		*details = append(*details, loc+": "+ve.Message)
+		return
+	}
+	for _, c := range ve.Causes {
+		collect(c, details)
+	}
+}
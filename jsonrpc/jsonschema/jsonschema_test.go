@@ -0,0 +1,72 @@
+package jsonschema
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+)
+
+type Args struct {
+	A, B int
+}
+
+func TestValidate(t *testing.T) {
+	v, err := New(map[string]string{
+		"add": `{
+			"type": "array",
+			"minItems": 1,
+			"maxItems": 1,
+			"items": {
+				"type": "object",
+				"properties": {"A": {"type": "integer"}, "B": {"type": "integer", "minimum": 0}},
+				"required": ["A", "B"]
+			}
+		}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := 0
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *int) error {
+		called++
+		*reply = args.A + args.B
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(jsonrpc.NewJSONCodec(c1, jsonrpc.WithParamsValidator(v.Validate)))
+	clt := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(c2))
+	go clt.Run()
+	defer clt.Close()
+
+	var reply int
+	if err = clt.Call("add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 3 {
+		t.Fatalf("unexpected reply: %d", reply)
+	}
+
+	err = clt.Call("add", map[string]interface{}{"A": "x", "B": -1}, &reply)
+	var e *rpc2.Error
+	if !errors.As(err, &e) || e.Code != rpc2.CodeInvalidParams {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if !strings.Contains(e.Message, "/0/A: ") || !strings.Contains(e.Message, "/0/B: ") {
+		t.Fatalf("error does not describe violations: %s", e.Message)
+	}
+	if called != 1 {
+		t.Fatalf("handler is called %d times", called)
+	}
+}
+
+func TestInvalidSchema(t *testing.T) {
+	if _, err := New(map[string]string{"add": `{"type": 1}`}); err == nil {
+		t.Fatal("invalid schema is compiled")
+	}
+}
@@ -0,0 +1,59 @@
+package jsonrpc
+
+import "fmt"
+
+// WithDecodeLimits limits the nesting depth of arrays and objects in params
+// of incoming requests to maxDepth, and the number of elements of each array
+// and members of each object to maxElements, so a peer can not make the
+// server spend memory and time on pathological payloads. The outermost
+// params array or object has depth one. Requests exceeding a limit are
+// answered with an invalid params error before params are decoded.
+// Zero means no limit.
+func WithDecodeLimits(maxDepth, maxElements int) Option {
+	return func(c *jsonCodec) {
+		c.maxDepth = maxDepth
+		c.maxElements = maxElements
+	}
+}
+
+// checkLimits returns an error if the JSON value in data exceeds the limits
+// set with WithDecodeLimits. Data must be valid JSON.
+func (c *jsonCodec) checkLimits(data []byte) error {
+	if c.maxDepth <= 0 && c.maxElements <= 0 {
+		return nil
+	}
+	var commas []int // of each open array and object
+	inString := false
+	escaped := false
+	for _, b := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+		switch b {
+		case '"':
+			inString = true
+		case '[', '{':
+			if c.maxDepth > 0 && len(commas) >= c.maxDepth {
+				return fmt.Errorf("jsonrpc: params nested deeper than %d", c.maxDepth)
+			}
+			commas = append(commas, 0)
+		case ']', '}':
+			commas = commas[:len(commas)-1]
+		case ',':
+			n := &commas[len(commas)-1]
+			*n++
+			if c.maxElements > 0 && *n >= c.maxElements {
+				return fmt.Errorf("jsonrpc: more than %d elements in params", c.maxElements)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encoding encodes params and results of a method in a binary body part
+// instead of JSON, see WithBodyEncoding. Data given to Unmarshal must not be
+// retained after it returns.
+type Encoding interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// WithBodyEncoding makes the codec encode the params of requests of method,
+// and the results of successful responses to them, with enc in a binary part
+// following the JSON message, so high-volume payloads bypass JSON, e.g. with
+// protobuf:
+//
+//	type protoEncoding struct{}
+//
+//	func (protoEncoding) Marshal(v interface{}) ([]byte, error) {
+//		return proto.Marshal(v.(proto.Message))
+//	}
+//
+//	func (protoEncoding) Unmarshal(data []byte, v interface{}) error {
+//		return proto.Unmarshal(data, v.(proto.Message))
+//	}
+//
+//	codec := jsonrpc.NewJSONCodec(conn, jsonrpc.WithBodyEncoding("frame", protoEncoding{}))
+//
+// The JSON message has a "body" member, which is not part of JSON-RPC, with
+// the length of the part written right after the newline ending the message.
+// Error responses have no part. Both peers must set the same encodings, other
+// implementations can not read such messages.
+func WithBodyEncoding(method string, enc Encoding) Option {
+	return func(c *jsonCodec) {
+		if c.encodings == nil {
+			c.encodings = make(map[string]Encoding)
+			c.replyEncodings = make(map[uint64]Encoding)
+			c.respEncodings = make(map[uint64]Encoding)
+		}
+		c.encodings[method] = enc
+	}
+}
+
+// RawEncoding is an Encoding sending []byte params and results as they are.
+// Values must be of type []byte or *[]byte.
+var RawEncoding Encoding = rawEncoding{}
+
+type rawEncoding struct{}
+
+func (rawEncoding) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case *[]byte:
+		return *b, nil
+	}
+	return nil, fmt.Errorf("jsonrpc: raw encoding of %T", v)
+}
+
+func (rawEncoding) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("jsonrpc: raw decoding into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+var errUnexpectedPart = errors.New("jsonrpc: unexpected body part")
+
+// readPart reads the body part of the message just read.
+func (c *jsonCodec) readPart(n int) error {
+	if c.encodings == nil || n < 0 {
+		return errUnexpectedPart
+	}
+	r := io.Reader(c.lines)
+	if c.lines == nil {
+		// The decoder may have read ahead of the message, and bytes it has
+		// not read yet may be left from the previous part, so continue with
+		// them before the rest of the connection.
+		r = io.MultiReader(c.dec.Buffered(), c.r)
+		var nl [1]byte
+		if _, err := io.ReadFull(r, nl[:]); err != nil {
+			return err
+		}
+		if nl[0] != '\n' {
+			return errUnexpectedPart
+		}
+		defer func() {
+			c.r = r
+			c.dec = json.NewDecoder(r)
+		}()
+	}
+	if cap(c.part) < n {
+		c.part = make([]byte, n)
+	}
+	c.part = c.part[:n]
+	_, err := io.ReadFull(r, c.part)
+	return err
+}
+
+// writePart writes msg, a message having its body set, followed by part.
+// They are written at once so concurrent writes do not interleave.
+func (c *jsonCodec) writePart(msg interface{}, part []byte) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	b = append(b, part...)
+	c.wmutex.Lock()
+	_, err = c.c.Write(b)
+	c.wmutex.Unlock()
+	return err
+}
@@ -0,0 +1,103 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// WithPositionalStructs makes the codec map struct arguments to positional
+// params, as many JSON-RPC services expect. Params arrays of incoming requests
+// are decoded into the exported fields of struct arguments in declaration
+// order, and struct arguments of outgoing requests are encoded as an array of
+// their field values:
+//
+//	type AddArgs struct{ A, B int }
+//
+//	// Called with {"method": "add", "params": [1, 2], "id": 1}
+//	srv.Handle("add", func(client *rpc2.Client, args AddArgs, reply *int) error {
+//		*reply = args.A + args.B
+//		return nil
+//	})
+//
+// Fields tagged with `json:"-"` are skipped. Missing params leave fields with
+// their zero values. An array with a single object is decoded as the struct
+// itself, like without this option, so peers wrapping structs in an array keep
+// working. Types implementing json.Marshaler or json.Unmarshaler are not mapped.
+func WithPositionalStructs() Option {
+	return func(c *jsonCodec) {
+		c.positional = true
+	}
+}
+
+var (
+	typeOfMarshaler   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// positionalFields returns the indexes of the fields of struct type t mapped to params.
+func positionalFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields = append(fields, i)
+	}
+	return fields
+}
+
+// positionalParams returns the field values of param as an array
+// if it is a struct or a pointer to a struct.
+func positionalParams(param interface{}) ([]interface{}, bool) {
+	v := reflect.ValueOf(param)
+	for v.Kind() == reflect.Ptr && !v.IsNil() && !v.Type().Implements(typeOfMarshaler) {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct || v.Type().Implements(typeOfMarshaler) || reflect.PtrTo(v.Type()).Implements(typeOfMarshaler) {
+		return nil, false
+	}
+	fields := positionalFields(v.Type())
+	params := make([]interface{}, len(fields))
+	for i, f := range fields {
+		params[i] = v.Field(f).Interface()
+	}
+	return params, true
+}
+
+// decodePositional decodes the params array raw into the struct pointed by x,
+// decoding each param with unmarshal.
+// It returns false if x is not a struct or raw is not a positional array,
+// in which case params are decoded as usual.
+func decodePositional(raw json.RawMessage, x interface{}, unmarshal func([]byte, interface{}) error) (bool, error) {
+	v := reflect.ValueOf(x)
+	for v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Ptr {
+		if v.Elem().IsNil() {
+			v.Elem().Set(reflect.New(v.Elem().Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct || v.Type().Implements(typeOfUnmarshaler) {
+		return false, nil
+	}
+	var params []json.RawMessage
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return false, nil
+	}
+	if len(params) == 1 && bytes.HasPrefix(bytes.TrimSpace(params[0]), []byte("{")) {
+		return false, nil
+	}
+	s := v.Elem()
+	fields := positionalFields(s.Type())
+	if len(params) > len(fields) {
+		return true, fmt.Errorf("jsonrpc: too many params: %d, %s has %d fields", len(params), s.Type(), len(fields))
+	}
+	for i, p := range params {
+		if err := unmarshal(p, s.Field(fields[i]).Addr().Interface()); err != nil {
+			return true, fmt.Errorf("jsonrpc: param %d: %w", i, err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,407 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeFormat is the encoding of time.Time values, see WithTimeFormat.
+type TimeFormat int
+
+const (
+	// TimeRFC3339 encodes times as strings in RFC 3339 format with
+	// nanoseconds, like encoding/json.
+	TimeRFC3339 TimeFormat = iota
+	// TimeUnix encodes times as numbers of seconds since the Unix epoch,
+	// with a fraction for sub-second times.
+	TimeUnix
+	// TimeUnixMilli encodes times as integer numbers of milliseconds since the
+	// Unix epoch, as JavaScript does.
+	TimeUnixMilli
+)
+
+// WithTimeFormat sets the encoding of time.Time values in params and results.
+// Times are decoded from RFC 3339 strings and from numbers, which are read as
+// milliseconds with TimeUnixMilli and seconds otherwise. Times decoded from
+// numbers are in UTC.
+func WithTimeFormat(f TimeFormat) Option {
+	return func(c *jsonCodec) {
+		c.values.enabled = true
+		c.values.time = f
+	}
+}
+
+// WithStringInts makes the codec encode 64-bit integers (int, int64, uint,
+// uint64) and big.Int values in params and results as JSON strings, so peers
+// decoding numbers as float64, e.g. JavaScript, do not lose precision above
+// 2^53. Integers and big.Int values are decoded from both strings and numbers.
+//
+// Fields tagged with the ",string" option and values of types implementing
+// json.Marshaler, json.Unmarshaler or encoding.TextMarshaler, other than
+// time.Time and big.Int, are encoded and decoded as usual.
+// Values in interface{} are only converted when encoding.
+func WithStringInts() Option {
+	return func(c *jsonCodec) {
+		c.values.enabled = true
+		c.values.stringInts = true
+	}
+}
+
+// WithUseNumber makes the codec decode numbers in params and results into
+// interface{} values as json.Number instead of float64, like
+// json.Decoder.UseNumber, so integers above 2^53 keep their precision in
+// []interface{} params, positional struct fields of type interface{} and
+// maps of interface{} values.
+func WithUseNumber() Option {
+	return func(c *jsonCodec) {
+		c.values.useNumber = true
+	}
+}
+
+// valueFormat converts times and integers between their encodings.
+// Values are marshaled as usual, then the resulting JSON is rewritten by
+// walking it along with the Go value it was marshaled from or is unmarshaled into.
+type valueFormat struct {
+	enabled    bool
+	time       TimeFormat
+	stringInts bool
+	useNumber  bool // decode numbers as json.Number, independent of enabled
+	strict     bool // reject unknown fields, independent of enabled
+}
+
+var (
+	typeOfTime            = reflect.TypeOf(time.Time{})
+	typeOfBigInt          = reflect.TypeOf(big.Int{})
+	typeOfTextMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeOfTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// marshal returns x, or its JSON with values converted if the format is enabled.
+func (f *valueFormat) marshal(x interface{}) (interface{}, error) {
+	if !f.enabled || x == nil {
+		return x, nil
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	node, err := decodeTree(b)
+	if err != nil {
+		return nil, err
+	}
+	b, err = json.Marshal(f.convert(reflect.ValueOf(x), node, true))
+	return json.RawMessage(b), err
+}
+
+// unmarshal decodes data into x, converting values if the format is enabled.
+func (f *valueFormat) unmarshal(data []byte, x interface{}) error {
+	if !f.enabled || x == nil {
+		return f.decode(data, x)
+	}
+	node, err := decodeTree(data)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(f.convert(reflect.ValueOf(x), node, false))
+	if err != nil {
+		return err
+	}
+	return f.decode(b, x)
+}
+
+// decode is json.Unmarshal, keeping numbers as json.Number if useNumber is
+// set and rejecting unknown fields if strict is set.
+func (f *valueFormat) decode(data []byte, x interface{}) error {
+	if !f.useNumber && !f.strict {
+		return json.Unmarshal(data, x)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if f.useNumber {
+		dec.UseNumber()
+	}
+	if f.strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(x); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("jsonrpc: invalid data after top-level value")
+	}
+	return nil
+}
+
+// decodeTree decodes data keeping numbers as they are written.
+func decodeTree(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var node interface{}
+	err := dec.Decode(&node)
+	return node, err
+}
+
+// convert returns node, the JSON of v, with the values in it converted to the
+// wire encoding if encode is true, and from it otherwise. When decoding,
+// v may be a zero value, which gives the type of the value to decode.
+func (f *valueFormat) convert(v reflect.Value, node interface{}, encode bool) interface{} {
+	if !v.IsValid() || node == nil {
+		return node
+	}
+	t := v.Type()
+	switch {
+	case t.Kind() == reflect.Interface:
+		if v.IsNil() {
+			return node
+		}
+		return f.convert(v.Elem(), node, encode)
+	case t.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return f.convert(reflect.Zero(t.Elem()), node, encode)
+		}
+		return f.convert(v.Elem(), node, encode)
+	case t == typeOfTime:
+		return f.convertTime(node, encode)
+	case t == typeOfBigInt:
+		return f.convertInt(node, encode)
+	case hasCustomEncoding(t):
+		return node
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		if t.Size() == 8 {
+			return f.convertInt(node, encode)
+		}
+	case reflect.Struct:
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return node
+		}
+		fields := jsonFields(t)
+		for key, val := range m {
+			field, ok := fields.lookup(key)
+			if !ok || field.quoted {
+				continue
+			}
+			m[key] = f.convert(fieldByIndex(v, field.index), val, encode)
+		}
+	case reflect.Map:
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return node
+		}
+		for key, val := range m {
+			elem := reflect.Zero(t.Elem())
+			if t.Key().Kind() == reflect.String && !v.IsNil() {
+				if e := v.MapIndex(reflect.ValueOf(key).Convert(t.Key())); e.IsValid() {
+					elem = e
+				}
+			}
+			m[key] = f.convert(elem, val, encode)
+		}
+	case reflect.Slice, reflect.Array:
+		a, ok := node.([]interface{})
+		if !ok || t.Elem().Kind() == reflect.Uint8 {
+			return node
+		}
+		for i, val := range a {
+			elem := reflect.Zero(t.Elem())
+			if i < v.Len() {
+				elem = v.Index(i)
+			}
+			a[i] = f.convert(elem, val, encode)
+		}
+	}
+	return node
+}
+
+// hasCustomEncoding returns true if values of t encode themselves.
+func hasCustomEncoding(t reflect.Type) bool {
+	p := reflect.PtrTo(t)
+	return t.Implements(typeOfMarshaler) || p.Implements(typeOfMarshaler) ||
+		p.Implements(typeOfUnmarshaler) ||
+		t.Implements(typeOfTextMarshaler) || p.Implements(typeOfTextMarshaler) ||
+		p.Implements(typeOfTextUnmarshaler)
+}
+
+func (f *valueFormat) convertInt(node interface{}, encode bool) interface{} {
+	switch n := node.(type) {
+	case json.Number:
+		if encode && f.stringInts {
+			return string(n)
+		}
+	case string:
+		if !encode {
+			if _, ok := new(big.Int).SetString(n, 10); ok {
+				return json.Number(n)
+			}
+		}
+	}
+	return node
+}
+
+func (f *valueFormat) convertTime(node interface{}, encode bool) interface{} {
+	switch n := node.(type) {
+	case string:
+		if !encode || f.time == TimeRFC3339 {
+			return node
+		}
+		t, err := time.Parse(time.RFC3339Nano, n)
+		if err != nil {
+			return node
+		}
+		if f.time == TimeUnixMilli {
+			return json.Number(strconv.FormatInt(t.UnixMilli(), 10))
+		}
+		return json.Number(formatUnix(t))
+	case json.Number:
+		if encode {
+			return node
+		}
+		t, ok := parseUnix(string(n), f.time == TimeUnixMilli)
+		if !ok {
+			return node
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return node
+}
+
+// formatUnix returns the number of seconds since the Unix epoch to t,
+// with as many decimals as needed.
+func formatUnix(t time.Time) string {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	sign := ""
+	if sec < 0 {
+		// Unix rounds down, so the fraction counts up from sec.
+		sign, sec, nsec = "-", -(sec + 1), 1e9-nsec
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%09d", nsec), "0")
+	return fmt.Sprintf("%s%d.%s", sign, sec, frac)
+}
+
+// parseUnix parses a number of seconds, or milliseconds, since the Unix epoch.
+func parseUnix(s string, milli bool) (time.Time, bool) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return time.Time{}, false
+	}
+	unit := int64(time.Second)
+	if milli {
+		unit = int64(time.Millisecond)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(unit))
+	ns := new(big.Int).Quo(r.Num(), r.Denom())
+	sec, nsec := new(big.Int).QuoRem(ns, big.NewInt(1e9), new(big.Int))
+	if !sec.IsInt64() {
+		return time.Time{}, false
+	}
+	return time.Unix(sec.Int64(), nsec.Int64()), true
+}
+
+// jsonField is a field of a struct as seen by encoding/json.
+type jsonField struct {
+	index  []int
+	quoted bool // has the ",string" option
+}
+
+type fieldMap map[string]jsonField
+
+// lookup returns the field of key, matching names case-insensitively
+// if there is no exact match, like encoding/json.
+func (m fieldMap) lookup(key string) (jsonField, bool) {
+	if f, ok := m[key]; ok {
+		return f, true
+	}
+	for name, f := range m {
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return jsonField{}, false
+}
+
+var fieldCache sync.Map // reflect.Type -> fieldMap
+
+// jsonFields returns the fields of struct type t by their JSON names,
+// including the promoted fields of embedded structs.
+func jsonFields(t reflect.Type) fieldMap {
+	if m, ok := fieldCache.Load(t); ok {
+		return m.(fieldMap)
+	}
+	m := make(fieldMap)
+	addFields(m, t, nil, make(map[reflect.Type]bool))
+	fieldCache.Store(t, m)
+	return m
+}
+
+func addFields(m fieldMap, t reflect.Type, index []int, visited map[reflect.Type]bool) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			embedded = append(embedded, sf)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if _, ok := m[name]; ok {
+			continue
+		}
+		m[name] = jsonField{
+			index:  append(append([]int(nil), index...), i),
+			quoted: strings.Contains(","+opts+",", ",string,"),
+		}
+	}
+	// Fields of embedded structs are shadowed by the fields of t.
+	for _, sf := range embedded {
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		addFields(m, ft, append(append([]int(nil), index...), sf.Index...), visited)
+	}
+}
+
+// fieldByIndex returns the field of struct v with index, or a zero value of
+// its type if an embedded pointer on the way is nil.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Zero(v.Type().Elem().FieldByIndex(index[i:]).Type)
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
@@ -0,0 +1,132 @@
+// Package jwtauth authenticates rpc2 peers with JSON Web Tokens.
+//
+// After connecting, the peer calls LoginMethod with a bearer token. The token
+// is verified and its claims are stored in the State of the connection.
+// Until then, and after the token expires, every other call is rejected with
+// an *rpc2.Error with the code rpc2.CodeUnauthorized.
+//
+//	auth := jwtauth.New(func(*jwt.Token) (interface{}, error) { return key, nil }, []string{"HS256"})
+//	auth.Register(srv)
+//	srv.SetLimiter(auth) // or rpc2.ChainLimiters(auth, rateLimiter)
+//
+//	srv.Handle("whoami", func(client *rpc2.Client, reply *string) error {
+//		claims, _ := jwtauth.Claims(client)
+//		*reply, _ = claims.GetSubject()
+//		return nil
+//	})
+//
+// On the other side:
+//
+//	err := jwtauth.Login(ctx, client, token)
+package jwtauth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// LoginMethod is the name of the method called with the token.
+const LoginMethod = "auth.login"
+
+// ClaimsKey is the key of the verified jwt.MapClaims in the State of the connection.
+const ClaimsKey = "jwtauth.claims"
+
+// ErrUnauthorized is the error sent for calls before a successful login.
+var ErrUnauthorized = &rpc2.Error{Code: rpc2.CodeUnauthorized, Message: "jwtauth: unauthorized"}
+
+// Auth verifies tokens and admits calls from peers that presented a valid token.
+// It implements rpc2.Limiter.
+type Auth struct {
+	parser  *jwt.Parser
+	keyFunc jwt.Keyfunc
+
+	// Now returns the current time for checking expiration.
+	// time.Now is used if it is nil.
+	Now func() time.Time
+}
+
+// New returns an Auth verifying tokens with keys returned by keyFunc.
+// Only tokens signed with one of methods, e.g. "RS256", are accepted, so peers
+// can not choose a weaker algorithm. Options are passed to jwt.NewParser,
+// e.g. jwt.WithAudience and jwt.WithIssuer to check more claims.
+func New(keyFunc jwt.Keyfunc, methods []string, opts ...jwt.ParserOption) *Auth {
+	a := &Auth{keyFunc: keyFunc}
+	opts = append(opts, jwt.WithValidMethods(methods), jwt.WithTimeFunc(a.now))
+	a.parser = jwt.NewParser(opts...)
+	return a
+}
+
+// Register registers LoginMethod on srv.
+func (a *Auth) Register(srv *rpc2.Server) {
+	srv.Handle(LoginMethod, a.login)
+}
+
+func (a *Auth) login(client *rpc2.Client, token string, reply *struct{}) error {
+	claims, err := a.Verify(token)
+	if err != nil {
+		return &rpc2.Error{Code: rpc2.CodeUnauthorized, Message: "jwtauth: invalid token: " + err.Error()}
+	}
+	if client.State == nil {
+		return errors.New("jwtauth: connection has no state")
+	}
+	client.State.Set(ClaimsKey, claims)
+	return nil
+}
+
+// Verify parses token, checks its signature and claims and returns the claims.
+func (a *Auth) Verify(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keyFunc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Allow admits calls to LoginMethod and calls from clients that logged in
+// with a token that has not expired.
+func (a *Auth) Allow(client *rpc2.Client, method string) error {
+	if method == LoginMethod {
+		return nil
+	}
+	claims, ok := Claims(client)
+	if !ok {
+		return ErrUnauthorized
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return ErrUnauthorized
+	}
+	if exp != nil && !a.now().Before(exp.Time) {
+		return &rpc2.Error{Code: rpc2.CodeUnauthorized, Message: "jwtauth: token is expired"}
+	}
+	return nil
+}
+
+func (a *Auth) now() time.Time {
+	if a.Now != nil {
+		return a.Now()
+	}
+	return time.Now()
+}
+
+// Claims returns the verified claims of the peer of client.
+func Claims(client *rpc2.Client) (jwt.MapClaims, bool) {
+	if client.State == nil {
+		return nil, false
+	}
+	v, ok := client.State.Get(ClaimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(jwt.MapClaims)
+	return claims, ok
+}
+
+// Login presents token to the peer of client.
+func Login(ctx context.Context, client *rpc2.Client, token string) error {
+	return client.CallWithContext(ctx, LoginMethod, token, new(struct{}))
+}
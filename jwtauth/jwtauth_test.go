@@ -0,0 +1,76 @@
+package jwtauth
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var key = []byte("secret")
+
+func sign(t *testing.T, method jwt.SigningMethod, claims jwt.MapClaims) string {
+	s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func isUnauthorized(err error) bool {
+	e, ok := err.(*rpc2.Error)
+	return ok && e.Code == rpc2.CodeUnauthorized
+}
+
+func TestAuth(t *testing.T) {
+	now := time.Now()
+	auth := New(func(*jwt.Token) (interface{}, error) { return key, nil }, []string{"HS256"})
+	auth.Now = func() time.Time { return now }
+
+	srv := rpc2.NewServer()
+	auth.Register(srv)
+	srv.SetLimiter(auth)
+	srv.Handle("whoami", func(client *rpc2.Client, reply *string) error {
+		claims, _ := Claims(client)
+		*reply, _ = claims.GetSubject()
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := rpc2.NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+	ctx := context.Background()
+
+	var sub string
+	if err := clt.Call("whoami", 0, &sub); !isUnauthorized(err) {
+		t.Fatalf("call before login: %#v", err)
+	}
+	if err := Login(ctx, clt, "invalid"); !isUnauthorized(err) {
+		t.Fatalf("login with invalid token: %#v", err)
+	}
+	claims := jwt.MapClaims{"sub": "alice", "exp": now.Add(time.Minute).Unix()}
+	if err := Login(ctx, clt, sign(t, jwt.SigningMethodHS384, claims)); !isUnauthorized(err) {
+		t.Fatalf("login with unexpected algorithm: %#v", err)
+	}
+	if err := Login(ctx, clt, sign(t, jwt.SigningMethodHS256, claims)); err != nil {
+		t.Fatal(err)
+	}
+	if err := clt.Call("whoami", 0, &sub); err != nil {
+		t.Fatal(err)
+	}
+	if sub != "alice" {
+		t.Fatalf("unexpected subject: %q", sub)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := clt.Call("whoami", 0, &sub); !isUnauthorized(err) {
+		t.Fatalf("call after expiration: %#v", err)
+	}
+	if err := Login(ctx, clt, sign(t, jwt.SigningMethodHS256, claims)); !isUnauthorized(err) {
+		t.Fatalf("login with expired token: %#v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Package kcp runs rpc2 connections over KCP (github.com/xtaci/kcp-go),
+// a reliable protocol on top of UDP that keeps throughput on high-latency,
+// lossy WAN links where TCP collapses.
+//
+// Dial and Listen mirror net.Dial and net.Listen for TCP:
+//
+//	lis, _ := kcp.Listen("0.0.0.0:5000", nil)
+//	go srv.Accept(lis)
+//
+//	conn, _ := kcp.Dial("203.0.113.7:5000", nil)
+//	clt := rpc2.NewClient(conn)
+package kcp
+
+import (
+	"net"
+
+	kcpgo "github.com/xtaci/kcp-go/v5"
+)
+
+// Config tunes KCP sessions. Both peers must use the same
+// Block, DataShards and ParityShards.
+type Config struct {
+	// Block encrypts packets if not nil.
+	Block kcpgo.BlockCrypt
+
+	// Forward error correction shards, disabled if zero.
+	DataShards   int
+	ParityShards int
+
+	// Fast enables the low-latency ("turbo") mode of KCP
+	// at the cost of extra bandwidth.
+	Fast bool
+
+	// Send and receive window sizes in packets. Defaults are used if zero.
+	SendWindow    int
+	ReceiveWindow int
+}
+
+var defaultConfig Config
+
+// Dial connects to the KCP server at address.
+func Dial(address string, cfg *Config) (net.Conn, error) {
+	if cfg == nil {
+		cfg = &defaultConfig
+	}
+	sess, err := kcpgo.DialWithOptions(address, cfg.Block, cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	cfg.apply(sess)
+	return sess, nil
+}
+
+// Listen announces on the local address for KCP connections.
+func Listen(address string, cfg *Config) (net.Listener, error) {
+	if cfg == nil {
+		cfg = &defaultConfig
+	}
+	lis, err := kcpgo.ListenWithOptions(address, cfg.Block, cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{lis, cfg}, nil
+}
+
+type listener struct {
+	*kcpgo.Listener
+	cfg *Config
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	sess, err := l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	l.cfg.apply(sess)
+	return sess, nil
+}
+
+func (cfg *Config) apply(sess *kcpgo.UDPSession) {
+	// Codecs write a message with several small writes.
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	if cfg.Fast {
+		sess.SetNoDelay(1, 10, 2, 1)
+		sess.SetACKNoDelay(true)
+	}
+	if cfg.SendWindow != 0 || cfg.ReceiveWindow != 0 {
+		sess.SetWindowSize(cfg.SendWindow, cfg.ReceiveWindow)
+	}
+}
@@ -0,0 +1,51 @@
+package kcp
+
+import (
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+func TestKCP(t *testing.T) {
+	cfg := &Config{DataShards: 10, ParityShards: 3, Fast: true}
+	lis, err := Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		var rev string
+		if err := client.Call("reverse", s, &rev); err != nil {
+			return err
+		}
+		*reply = rev
+		return nil
+	})
+	go srv.Accept(lis)
+
+	conn, err := Dial(lis.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt := rpc2.NewClient(conn)
+	clt.Handle("reverse", func(client *rpc2.Client, s string, reply *string) error {
+		b := []byte(s)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		*reply = string(b)
+		return nil
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	var reply string
+	if err = clt.Call("echo", "abc", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "cba" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+}
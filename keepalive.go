@@ -0,0 +1,227 @@
+package rpc2
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EchoMethod is the name of the built-in method replying with its argument,
+// an integer. Every client handles it. Ping and keepalives call it to measure round-trip times.
+const EchoMethod = "rpc.echo"
+
+// builtins are handled by every client after its registered handlers.
+// builtinIndex matches them ignoring case.
+var (
+	builtins     = make(map[string]*handler)
+	builtinIndex = make(methodIndex)
+)
+
+func init() {
+	addHandler(builtins, builtinIndex, EchoMethod, func(client *Client, args int64, reply *int64) error {
+		*reply = args
+		return nil
+	})
+}
+
+// ErrKeepaliveTimeout is the reason of disconnection when the peer does not
+// respond to a keepalive in time.
+var ErrKeepaliveTimeout = errors.New("rpc2: keepalive timeout")
+
+// rttWindow is the number of recent round-trip times kept for RTTStats.
+const rttWindow = 16
+
+// RTTStats are statistics of recent round-trip times to the peer.
+type RTTStats struct {
+	Samples int           // number of measurements, at most the 16 most recent are used
+	Last    time.Duration // round-trip time of the last measurement
+	Min     time.Duration
+	Max     time.Duration
+	Mean    time.Duration
+}
+
+// rttRing keeps the most recent round-trip times.
+type rttRing struct {
+	mutex   sync.Mutex
+	samples [rttWindow]time.Duration
+	n       int // total number of samples added
+}
+
+func (r *rttRing) add(d time.Duration) {
+	r.mutex.Lock()
+	r.samples[r.n%rttWindow] = d
+	r.n++
+	r.mutex.Unlock()
+}
+
+func (r *rttRing) stats() RTTStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := RTTStats{Samples: r.n}
+	if r.n == 0 {
+		return s
+	}
+	s.Last = r.samples[(r.n-1)%rttWindow]
+	n := r.n
+	if n > rttWindow {
+		n = rttWindow
+	}
+	var sum time.Duration
+	s.Min = r.samples[0]
+	for _, d := range r.samples[:n] {
+		sum += d
+		if d < s.Min {
+			s.Min = d
+		}
+		if d > s.Max {
+			s.Max = d
+		}
+	}
+	s.Mean = sum / time.Duration(n)
+	return s
+}
+
+// Ping calls EchoMethod on the peer and returns the round-trip time,
+// which is also recorded in the statistics returned by RTT.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := c.timeSource.Now()
+	var reply int64
+	if err := c.CallWithContext(ctx, EchoMethod, start.UnixNano(), &reply); err != nil {
+		return 0, err
+	}
+	return c.echoed(start, reply)
+}
+
+// echoed records the round-trip time of an echo call started at start.
+func (c *Client) echoed(start time.Time, reply int64) (time.Duration, error) {
+	rtt := c.timeSource.Now().Sub(start)
+	if reply != start.UnixNano() {
+		return rtt, errors.New("rpc2: invalid echo reply")
+	}
+	c.rtt.add(rtt)
+	return rtt, nil
+}
+
+// pingTimeout is like Ping but fails with context.DeadlineExceeded
+// if the peer does not respond within timeout on the clock of the client.
+func (c *Client) pingTimeout(timeout time.Duration) error {
+	start := c.timeSource.Now()
+	var reply int64
+	call := c.Go(EchoMethod, start.UnixNano(), &reply, make(chan *Call, 1))
+	timer := c.timeSource.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+	case <-timer.C():
+		c.abandon(call, context.DeadlineExceeded)
+		return context.DeadlineExceeded
+	}
+	if call.Error != nil {
+		return call.Error
+	}
+	_, err := c.echoed(start, reply)
+	return err
+}
+
+// RTT returns statistics of recent round-trip times measured by Ping
+// and keepalives.
+func (c *Client) RTT() RTTStats {
+	return c.rtt.stats()
+}
+
+// SetKeepalive makes the client ping the peer every interval while it runs.
+// If the peer does not respond within timeout, the connection is closed and
+// Err returns ErrKeepaliveTimeout. Keepalives stop if the peer does not
+// implement EchoMethod. Zero interval disables keepalives.
+// It must be called before Run.
+func (c *Client) SetKeepalive(interval, timeout time.Duration) {
+	c.keepalive = interval
+	c.keepaliveTimeout = timeout
+}
+
+// LastActivity returns the time the last message was received from the peer,
+// or the zero time if none is received yet.
+func (c *Client) LastActivity() time.Time {
+	ns := c.lastActivity.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// IsAlive reports whether the connection is up. If keepalives are enabled
+// with SetKeepalive, it also requires a message from the peer within the last
+// keepalive interval plus timeout, so a peer that stopped responding is
+// reported before the keepalive fails. It is cheap enough to call before
+// queuing every piece of work for the peer.
+func (c *Client) IsAlive() bool {
+	select {
+	case <-c.disconnect:
+		return false
+	default:
+	}
+	if !c.isConnected() {
+		return false
+	}
+	if c.keepalive <= 0 {
+		return true
+	}
+	last := c.lastActivity.Load()
+	if last == 0 {
+		// Keepalives fail if the peer never responds.
+		return true
+	}
+	return c.timeSource.Now().Sub(time.Unix(0, last)) <= c.keepalive+c.keepaliveTimeout
+}
+
+func (c *Client) keepaliveLoop() {
+	ticker := c.timeSource.NewTicker(c.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-c.disconnect:
+			return
+		}
+		err := c.pingTimeout(c.keepaliveTimeout)
+		switch {
+		case err == nil:
+		case errors.Is(err, context.DeadlineExceeded):
+			c.fail(ErrKeepaliveTimeout)
+			return
+		case isMethodNotFound(err):
+			debugln("rpc2: peer does not support keepalives:", err.Error())
+			return
+		case err == ErrShutdown:
+			return
+		default:
+			debugln("rpc2: keepalive error:", err.Error())
+		}
+	}
+}
+
+// isMethodNotFound reports whether err is returned because the peer does not
+// have the method called. Peers without error codes, such as older versions
+// of this package, are recognized by their error messages.
+func isMethodNotFound(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code == CodeMethodNotFound
+	}
+	var se ServerError
+	return errors.As(err, &se) && strings.Contains(string(se), "can't find method")
+}
+
+// fail closes the connection and makes err the reason of disconnection.
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	if c.shutdown || c.closing || c.failErr != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.failErr = err
+	c.mutex.Unlock()
+	c.codec.Close()
+}
@@ -0,0 +1,132 @@
+package rpc2
+
+import "sync"
+
+// lazyConn establishes the connection of a lazy client.
+type lazyConn struct {
+	dial      func() (Codec, error)
+	mutex     sync.Mutex   // protects attempt, closed
+	attempt   *dialAttempt // in-flight dial, nil if not dialing
+	closed    bool
+	connected chan struct{} // closed after codec of the client is set
+	done      chan struct{} // closed when the client is closed before connecting
+}
+
+type dialAttempt struct {
+	done  chan struct{}
+	codec Codec // set if the dial succeeded
+	err   error
+}
+
+// NewLazyClient returns a client that calls dial to connect on the first
+// call or notification instead of at construction, so it can be created
+// before the server is up. Concurrent callers wait for the same dial. If dial
+// fails, the callers get its error and the next call dials again.
+// Run must be called as usual; it waits until the client is connected.
+func NewLazyClient(dial func() (Codec, error)) *Client {
+	c := NewClientWithCodec(nil)
+	c.lazy = &lazyConn{
+		dial:      dial,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	return c
+}
+
+// connect dials unless the client is connected or it is not lazy,
+// and returns the codec of the client.
+func (c *Client) connect() (Codec, error) {
+	l := c.lazy
+	if l == nil {
+		return c.codec, nil
+	}
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil, ErrShutdown
+	}
+	select {
+	case <-l.connected:
+		codec := c.codec
+		l.mutex.Unlock()
+		return codec, nil
+	default:
+	}
+	if a := l.attempt; a != nil {
+		l.mutex.Unlock()
+		<-a.done
+		return a.codec, a.err
+	}
+	a := &dialAttempt{done: make(chan struct{})}
+	l.attempt = a
+	l.mutex.Unlock()
+
+	codec, err := l.dial()
+
+	l.mutex.Lock()
+	l.attempt = nil
+	if err == nil && l.closed {
+		codec.Close()
+		err = ErrShutdown
+	}
+	if err == nil {
+		c.codec = codec
+		a.codec = codec
+		close(l.connected)
+	}
+	l.mutex.Unlock()
+	a.err = err
+	close(a.done)
+	return a.codec, err
+}
+
+// isConnected reports whether the codec of the client is set.
+func (c *Client) isConnected() bool {
+	if c.lazy == nil {
+		return true
+	}
+	select {
+	case <-c.lazy.connected:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitConnected waits until the client is connected and reports
+// whether it is, or closed before connecting.
+func (c *Client) waitConnected() bool {
+	if c.lazy == nil {
+		return true
+	}
+	select {
+	case <-c.lazy.connected:
+		return true
+	case <-c.lazy.done:
+		return false
+	}
+}
+
+// closeLazy closes the client if it is not connected yet
+// and reports whether it did.
+func (c *Client) closeLazy() bool {
+	l := c.lazy
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	if c.isConnected() {
+		l.mutex.Unlock()
+		return false
+	}
+	l.closed = true
+	close(l.done)
+	l.mutex.Unlock()
+
+	c.mutex.Lock()
+	c.shutdown = true
+	c.closed = c.timeSource.Now()
+	c.mutex.Unlock()
+	c.closeDisconnect()
+	return true
+}
@@ -0,0 +1,79 @@
+package rpc2
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter decides whether a request is admitted before it is dispatched.
+// Allow is called from the read loop for every incoming request and
+// notification, before the arguments are decoded and before a goroutine is
+// started for the handler, so it must not block. If it returns an error, the
+// request is not handled and the error is sent to the caller; errors that are
+// not an *Error with a code are sent with CodeRejected.
+type Limiter interface {
+	Allow(client *Client, method string) error
+}
+
+// ChainLimiters returns a Limiter admitting requests admitted by all limiters,
+// in order. The first error is returned and the remaining limiters are not called.
+func ChainLimiters(limiters ...Limiter) Limiter {
+	return chain(limiters)
+}
+
+type chain []Limiter
+
+func (c chain) Allow(client *Client, method string) error {
+	for _, l := range c {
+		if err := l.Allow(client, method); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLimiter sets the limiter admitting requests received by the client.
+// It must be called before Run.
+func (c *Client) SetLimiter(l Limiter) {
+	c.limiter = l
+}
+
+// TokenBucket is a Limiter admitting requests at a fixed rate with bursts.
+// The same TokenBucket may be shared by many clients to limit their total rate.
+type TokenBucket struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mutex  sync.Mutex // protects tokens, last
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a TokenBucket admitting rate requests per second
+// on average and up to burst requests at once. Time is measured with the
+// clocks of the clients, see SetClock.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Allow takes a token from the bucket. If the bucket is empty, it returns
+// a CodeRejected error with the time until the next token as RetryAfter.
+func (b *TokenBucket) Allow(client *Client, method string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := client.timeSource.Now()
+	if b.last.IsZero() {
+		b.last = now // the bucket is full until the first request
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return nil
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return &Error{Code: CodeRejected, Message: "rpc2: rate limit exceeded", RetryAfter: wait}
+}
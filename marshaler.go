@@ -0,0 +1,117 @@
+package rpc2
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// marshaler converts values of a registered type to and from their wire type.
+type marshaler struct {
+	wire reflect.Type
+	to   func(v interface{}) (interface{}, error)
+	from func(w interface{}) (interface{}, error)
+}
+
+var marshalers struct {
+	sync.RWMutex
+	types map[reflect.Type]*marshaler
+	any   atomic.Bool // whether any type is registered
+}
+
+// RegisterMarshaler registers functions converting values of type T to and
+// from type W, which the codecs can encode, such as a string or a struct with
+// exported fields. Args and replies of type T or *T are sent as W by every
+// codec, so types that can not be encoded, e.g. third-party types with
+// unexported fields, can be used without implementing encoding interfaces:
+//
+//	rpc2.RegisterMarshaler(
+//		func(d decimal.Decimal) (string, error) { return d.String(), nil },
+//		decimal.NewFromString,
+//	)
+//
+// Only args and replies are converted, not values nested in them.
+// Both peers must register the same conversions. Registering a type again
+// replaces its conversions. It must be called before making or serving calls.
+func RegisterMarshaler[T, W any](to func(T) (W, error), from func(W) (T, error)) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	m := &marshaler{
+		wire: reflect.TypeOf((*W)(nil)).Elem(),
+		to: func(v interface{}) (interface{}, error) {
+			return to(v.(T))
+		},
+		from: func(w interface{}) (interface{}, error) {
+			return from(w.(W))
+		},
+	}
+	marshalers.Lock()
+	if marshalers.types == nil {
+		marshalers.types = make(map[reflect.Type]*marshaler)
+	}
+	marshalers.types[t] = m
+	marshalers.Unlock()
+	marshalers.any.Store(true)
+}
+
+func marshalerOf(t reflect.Type) *marshaler {
+	marshalers.RLock()
+	defer marshalers.RUnlock()
+	return marshalers.types[t]
+}
+
+// marshalValue returns the wire value of v if its type, or the type it
+// points to, is registered with RegisterMarshaler, and v otherwise.
+func marshalValue(v interface{}) (interface{}, error) {
+	if !marshalers.any.Load() || v == nil {
+		return v, nil
+	}
+	rv := reflect.ValueOf(v)
+	m := marshalerOf(rv.Type())
+	if m == nil && rv.Kind() == reflect.Ptr {
+		if m = marshalerOf(rv.Type().Elem()); m != nil {
+			if rv.IsNil() {
+				return v, nil
+			}
+			v = rv.Elem().Interface()
+		}
+	}
+	if m == nil {
+		return v, nil
+	}
+	return m.to(v)
+}
+
+// readBody reads a body with read into x, a pointer, decoding the wire value
+// if the type x points to, or the type pointed by it, is registered with
+// RegisterMarshaler.
+func readBody(read func(interface{}) error, x interface{}) error {
+	if !marshalers.any.Load() || x == nil {
+		return read(x)
+	}
+	xv := reflect.ValueOf(x)
+	if xv.Kind() != reflect.Ptr {
+		return read(x)
+	}
+	m := marshalerOf(xv.Type().Elem())
+	if m == nil && xv.Type().Elem().Kind() == reflect.Ptr && !xv.IsNil() {
+		if m = marshalerOf(xv.Type().Elem().Elem()); m != nil {
+			if xv.Elem().IsNil() {
+				xv.Elem().Set(reflect.New(xv.Type().Elem().Elem()))
+			}
+			xv = xv.Elem()
+		}
+	}
+	if m == nil {
+		return read(x)
+	}
+	w := reflect.New(m.wire)
+	if err := read(w.Interface()); err != nil {
+		return err
+	}
+	v, err := m.from(w.Elem().Interface())
+	if err != nil {
+		return err
+	}
+	xv.Elem().Set(reflect.ValueOf(v))
+	return nil
+}
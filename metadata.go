@@ -0,0 +1,105 @@
+package rpc2
+
+import (
+	"context"
+	"strings"
+)
+
+// reservedPrefix is the prefix of metadata keys set by the package,
+// such as TimeoutKey and CancelKey.
+const reservedPrefix = "rpc2."
+
+type (
+	incomingKey   struct{}
+	outgoingKey   struct{}
+	propagatedKey struct{}
+)
+
+// WithMetadata returns a copy of ctx with md added to the metadata of calls
+// made with it by CallWithContext. Values in md override those of the same
+// keys added earlier or propagated from the call being handled.
+// Keys prefixed with "rpc2." are reserved and ignored.
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+	merged := make(map[string]string)
+	for k, v := range outgoingMetadata(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		if !strings.HasPrefix(k, reservedPrefix) {
+			merged[k] = v
+		}
+	}
+	return context.WithValue(ctx, outgoingKey{}, merged)
+}
+
+func outgoingMetadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(outgoingKey{}).(map[string]string)
+	return md
+}
+
+// IncomingMetadata returns the metadata of the call being handled
+// with ctx, the context given to the handler. It must not be modified.
+func IncomingMetadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(incomingKey{}).(map[string]string)
+	return md
+}
+
+// SetPropagatedMetadata sets the keys of metadata copied from calls handled
+// by the client to calls made with the context of their handlers, on this or
+// other clients, so values like trace IDs, tenants or auth subjects follow
+// chains of calls without handlers passing them on:
+//
+//	srv.SetPropagatedMetadata("trace-id", "tenant")
+//	srv.Handle("order", func(ctx context.Context, client *rpc2.Client, args Order, reply *int) error {
+//		// Carries "trace-id" and "tenant" of the order call.
+//		return client.CallWithContext(ctx, "confirm", args.ID, reply)
+//	})
+//
+// Metadata added to the context with WithMetadata overrides propagated values.
+// It must be called before Run.
+func (c *Client) SetPropagatedMetadata(keys ...string) {
+	c.propagate = keys
+}
+
+// metadataContext returns parent with the incoming metadata of req
+// and the part of it propagated to outgoing calls.
+func (c *Client) metadataContext(parent context.Context, req *Request) context.Context {
+	if len(req.Metadata) == 0 {
+		return parent
+	}
+	ctx := context.WithValue(parent, incomingKey{}, req.Metadata)
+	var propagated map[string]string
+	for _, k := range c.propagate {
+		if v, ok := req.Metadata[k]; ok && !strings.HasPrefix(k, reservedPrefix) {
+			if propagated == nil {
+				propagated = make(map[string]string, len(c.propagate))
+			}
+			propagated[k] = v
+		}
+	}
+	if propagated != nil {
+		ctx = context.WithValue(ctx, propagatedKey{}, propagated)
+	}
+	return ctx
+}
+
+// callMetadata returns the metadata of calls made with ctx,
+// excluding the keys set by the package.
+func callMetadata(ctx context.Context) map[string]string {
+	propagated, _ := ctx.Value(propagatedKey{}).(map[string]string)
+	outgoing := outgoingMetadata(ctx)
+	if len(propagated) == 0 {
+		return outgoing
+	}
+	if len(outgoing) == 0 {
+		return propagated
+	}
+	md := make(map[string]string, len(propagated)+len(outgoing))
+	for k, v := range propagated {
+		md[k] = v
+	}
+	for k, v := range outgoing {
+		md[k] = v
+	}
+	return md
+}
@@ -0,0 +1,291 @@
+// Package msgpackrpc implements a MessagePack-RPC codec for the rpc2 package.
+//
+// Messages are encoded as described in the MessagePack-RPC specification
+// so rpc2 peers can interoperate with other MessagePack-RPC implementations:
+//
+//	request:      [0, msgid, method, params]
+//	response:     [1, msgid, error, result]
+//	notification: [2, method, params]
+//
+// Params are always an array. Like the jsonrpc codec, slices are sent as
+// positional params; any other argument is sent as the only element.
+package msgpackrpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Message types
+const (
+	typeRequest      = 0
+	typeResponse     = 1
+	typeNotification = 2
+)
+
+type msgpackCodec struct {
+	dec    *msgpack.Decoder
+	enc    *msgpack.Encoder
+	encBuf *bufio.Writer
+	rwc    io.ReadWriteCloser
+	wmutex sync.Mutex // protects enc, encBuf
+
+	// temporary work space
+	params msgpack.RawMessage
+	result msgpack.RawMessage
+
+	// Message IDs of incoming requests are 32-bit and chosen by the peer.
+	// We assign our own sequence numbers to incoming requests
+	// and save the original message ID in the pending map.
+	mutex   sync.Mutex // protects seq, pending, msgid, calls, msgids
+	pending map[uint64]uint32
+	seq     uint64
+
+	// Sequence numbers of outgoing requests are 64-bit and would be
+	// truncated, so we assign our own message IDs to outgoing requests
+	// and map them back to sequence numbers when responses are read.
+	msgid  uint32            // last message ID of outgoing requests
+	calls  map[uint32]uint64 // sequence numbers by message ID
+	msgids map[uint64]uint32 // message IDs by sequence number
+}
+
+// NewMsgpackCodec returns a new rpc2.Codec using MessagePack-RPC on conn.
+func NewMsgpackCodec(conn io.ReadWriteCloser) rpc2.Codec {
+	buf := bufio.NewWriter(conn)
+	return &msgpackCodec{
+		dec:     msgpack.NewDecoder(conn),
+		enc:     msgpack.NewEncoder(buf),
+		encBuf:  buf,
+		rwc:     conn,
+		pending: make(map[uint64]uint32),
+		calls:   make(map[uint32]uint64),
+		msgids:  make(map[uint64]uint32),
+	}
+}
+
+func (c *msgpackCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	c.params = nil
+	c.result = nil
+
+	n, err := c.dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	typ, err := c.dec.DecodeInt()
+	if err != nil {
+		return err
+	}
+	switch {
+	case typ == typeRequest && n == 4:
+		msgid, err := c.dec.DecodeUint32()
+		if err != nil {
+			return err
+		}
+		if req.Method, err = c.dec.DecodeString(); err != nil {
+			return err
+		}
+		if c.params, err = c.dec.DecodeRaw(); err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		c.seq++
+		c.pending[c.seq] = msgid
+		req.Seq = c.seq
+		c.mutex.Unlock()
+	case typ == typeNotification && n == 3:
+		if req.Method, err = c.dec.DecodeString(); err != nil {
+			return err
+		}
+		if c.params, err = c.dec.DecodeRaw(); err != nil {
+			return err
+		}
+	case typ == typeResponse && n == 4:
+		msgid, err := c.dec.DecodeUint32()
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		resp.Seq = c.calls[msgid] // zero for unknown IDs, discarded by rpc2
+		delete(c.calls, msgid)
+		delete(c.msgids, resp.Seq)
+		c.mutex.Unlock()
+		var e interface{}
+		if err = c.dec.Decode(&e); err != nil {
+			return err
+		}
+		if c.result, err = c.dec.DecodeRaw(); err != nil {
+			return err
+		}
+		if e != nil {
+			resp.Error, resp.Code = readError(e)
+		}
+	default:
+		return fmt.Errorf("msgpackrpc: invalid message type %d with %d elements", typ, n)
+	}
+	return nil
+}
+
+// readError converts the error member of a response to an error message and code.
+// The specification does not define the shape of errors. Strings, [code, message]
+// arrays and maps with "code" and "message" keys are recognized.
+func readError(e interface{}) (msg string, code int) {
+	switch v := e.(type) {
+	case string:
+		msg = v
+	case []interface{}:
+		if len(v) == 2 {
+			if s, ok := v[1].(string); ok {
+				return s, toInt(v[0])
+			}
+		}
+		msg = fmt.Sprint(v)
+	case map[string]interface{}:
+		if s, ok := v["message"].(string); ok {
+			return s, toInt(v["code"])
+		}
+		msg = fmt.Sprint(v)
+	default:
+		msg = fmt.Sprint(v)
+	}
+	if msg == "" {
+		msg = "unspecified error"
+	}
+	return msg, 0
+}
+
+func toInt(v interface{}) int {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint())
+	}
+	return 0
+}
+
+var errMissingParams = errors.New("msgpackrpc: request body missing params")
+
+func (c *msgpackCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+
+	// Check if x points to a slice of any kind
+	rt := reflect.TypeOf(x)
+	if rt.Kind() == reflect.Ptr && rt.Elem().Kind() == reflect.Slice {
+		// If it's a slice, unmarshal as is
+		return msgpack.Unmarshal(c.params, x)
+	}
+
+	// Anything else is the first element of params
+	dec := msgpack.NewDecoder(bytes.NewReader(c.params))
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return errMissingParams
+	}
+	return dec.Decode(x)
+}
+
+func (c *msgpackCodec) ReadResponseBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	return msgpack.Unmarshal(c.result, x)
+}
+
+func (c *msgpackCodec) WriteRequest(r *rpc2.Request, param interface{}) error {
+	// Check if param is a slice of any kind
+	var params interface{}
+	if param != nil && reflect.TypeOf(param).Kind() == reflect.Slice {
+		// If it's a slice, leave as is
+		params = param
+	} else if param == nil {
+		params = []interface{}{}
+	} else {
+		// Put anything else into a slice
+		params = []interface{}{param}
+	}
+
+	if r.Seq == 0 {
+		return c.write(typeNotification, r.Method, params)
+	}
+	c.mutex.Lock()
+	msgid := c.msgid + 1
+	for {
+		// Skip IDs of pending requests after wraparound.
+		if _, ok := c.calls[msgid]; !ok {
+			break
+		}
+		msgid++
+	}
+	c.msgid = msgid
+	c.calls[msgid] = r.Seq
+	c.msgids[r.Seq] = msgid
+	c.mutex.Unlock()
+	return c.write(typeRequest, msgid, r.Method, params)
+}
+
+// Forget removes the message ID of the request with seq,
+// whose call completed without a response.
+func (c *msgpackCodec) Forget(seq uint64) {
+	c.mutex.Lock()
+	if msgid, ok := c.msgids[seq]; ok {
+		delete(c.calls, msgid)
+		delete(c.msgids, seq)
+	}
+	c.mutex.Unlock()
+}
+
+func (c *msgpackCodec) WriteResponse(r *rpc2.Response, x interface{}) error {
+	c.mutex.Lock()
+	msgid, ok := c.pending[r.Seq]
+	if !ok {
+		c.mutex.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.mutex.Unlock()
+
+	if r.Error == "" {
+		return c.write(typeResponse, msgid, nil, x)
+	}
+	if r.Code != 0 {
+		return c.write(typeResponse, msgid, []interface{}{r.Code, r.Error}, nil)
+	}
+	return c.write(typeResponse, msgid, r.Error, nil)
+}
+
+// write encodes values as a message array and flushes the connection.
+func (c *msgpackCodec) write(values ...interface{}) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if err := c.enc.EncodeArrayLen(len(values)); err != nil {
+		return err
+	}
+	for _, v := range values {
+		if err := c.enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *msgpackCodec) Conn() io.ReadWriteCloser {
+	return c.rwc
+}
+
+func (c *msgpackCodec) Close() error {
+	return c.rwc.Close()
+}
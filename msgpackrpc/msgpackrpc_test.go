@@ -0,0 +1,165 @@
+package msgpackrpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/codectest"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestMsgpackRPC(t *testing.T) {
+	type Args struct{ A, B int }
+	type Reply int
+
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *Reply) error {
+		*reply = Reply(args.A + args.B)
+
+		var rep Reply
+		err := client.Call("mult", Args{2, 3}, &rep)
+		if err != nil {
+			t.Error(err)
+		}
+		if rep != 6 {
+			t.Errorf("not expected: %d", rep)
+		}
+		return nil
+	})
+	srv.Handle("addPos", func(client *rpc2.Client, args []int, reply *int) error {
+		*reply = args[0] + args[1]
+		return nil
+	})
+	number := make(chan int, 1)
+	srv.Handle("set", func(client *rpc2.Client, i int, _ *struct{}) error {
+		number <- i
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewMsgpackCodec(c1))
+
+	clt := rpc2.NewClientWithCodec(NewMsgpackCodec(c2))
+	clt.Handle("mult", func(client *rpc2.Client, args *Args, reply *Reply) error {
+		*reply = Reply(args.A * args.B)
+		return nil
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	// Test Call.
+	var rep Reply
+	err := clt.Call("add", Args{1, 2}, &rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep != 3 {
+		t.Fatalf("not expected: %d", rep)
+	}
+
+	// Test positional arguments.
+	var sum int
+	err = clt.Call("addPos", []int{3, 4}, &sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 7 {
+		t.Fatalf("not expected: %d", sum)
+	}
+
+	// Test notification.
+	err = clt.Notify("set", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case i := <-number:
+		if i != 6 {
+			t.Fatalf("unexpected number: %d", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not get notification")
+	}
+
+	// Test undefined method.
+	err = clt.Call("foo", 1, &rep)
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != rpc2.CodeMethodNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewMsgpackCodec(c1))
+	defer c2.Close()
+
+	b, err := msgpack.Marshal([]interface{}{0, 42, "echo", []interface{}{"hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c2.Write(b)
+
+	var resp []interface{}
+	if err = msgpack.NewDecoder(c2).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 4 || toInt(resp[0]) != 1 || toInt(resp[1]) != 42 || resp[2] != nil || resp[3] != "hello" {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+}
+
+func TestLargeSeq(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	codec := NewMsgpackCodec(c1)
+	defer codec.Close()
+
+	// Sequence numbers that do not fit in message IDs are mapped to them.
+	seqs := []uint64{1 << 32, 1<<32 + 1}
+	dec := msgpack.NewDecoder(c2)
+	var msgids []uint32
+	for _, seq := range seqs {
+		go codec.WriteRequest(&rpc2.Request{Seq: seq, Method: "m"}, nil)
+		var req []interface{}
+		if err := dec.Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if len(req) != 4 || toInt(req[0]) != typeRequest {
+			t.Fatalf("unexpected request: %v", req)
+		}
+		msgids = append(msgids, uint32(toInt(req[1])))
+	}
+	if msgids[0] == msgids[1] {
+		t.Fatalf("message IDs are reused: %v", msgids)
+	}
+
+	for i := len(seqs) - 1; i >= 0; i-- {
+		b, err := msgpack.Marshal([]interface{}{typeResponse, msgids[i], nil, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c2.Write(b)
+		var resp rpc2.Response
+		if err = codec.ReadHeader(new(rpc2.Request), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Seq != seqs[i] {
+			t.Fatalf("unexpected sequence number: %d", resp.Seq)
+		}
+		if err = codec.ReadResponseBody(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	codectest.Run(t, NewMsgpackCodec)
+}
@@ -0,0 +1,286 @@
+// Package naclconn encrypts rpc2 connections with NaCl secretbox after an
+// X25519 key exchange, for links where TLS and a PKI are impractical.
+//
+// Both sides have a static key pair. The handshake exchanges static and
+// ephemeral public keys and derives the session keys from three Diffie-Hellman
+// results, so only holders of the static private keys can complete it and
+// recorded sessions can not be decrypted later with the static keys. The dialing
+// side calls Client and the accepting side calls Server. Pin the public key of
+// the peer to reject anybody else:
+//
+//	conn, _ := net.Dial("tcp", addr)
+//	sc, err := naclconn.Client(conn, &naclconn.Config{PrivateKey: myKey, PeerKey: serverKey})
+//	clt := rpc2.NewClient(sc)
+//
+// Any codec can be used on the returned connection. Frames are authenticated
+// with implicit sequence numbers, so dropped, reordered and replayed frames
+// are detected and fail the connection.
+package naclconn
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// KeySize is the size of public and private keys.
+const KeySize = 32
+
+// maxPayload is the largest plaintext size of a frame.
+const maxPayload = 64 << 10
+
+// ErrPeerKey is returned when the peer presents a different static key than the pinned one.
+var ErrPeerKey = errors.New("naclconn: unexpected peer key")
+
+// ErrDecrypt is returned when a frame can not be authenticated.
+var ErrDecrypt = errors.New("naclconn: message authentication failed")
+
+// Config is the configuration of one side of a connection.
+type Config struct {
+	// PrivateKey is the static private key. It must be set.
+	PrivateKey *[KeySize]byte
+
+	// PeerKey is the expected static public key of the peer.
+	// If nil, any peer is accepted and VerifyPeerKey may be used to check it.
+	PeerKey *[KeySize]byte
+
+	// VerifyPeerKey, if not nil, is called with the static public key of the
+	// peer during the handshake. The handshake fails if it returns an error.
+	VerifyPeerKey func(key *[KeySize]byte) error
+}
+
+// GenerateKey returns a new static key pair.
+func GenerateKey() (publicKey, privateKey *[KeySize]byte, err error) {
+	privateKey = new([KeySize]byte)
+	if _, err = io.ReadFull(rand.Reader, privateKey[:]); err != nil {
+		return nil, nil, err
+	}
+	if publicKey, err = PublicKey(privateKey); err != nil {
+		return nil, nil, err
+	}
+	return publicKey, privateKey, nil
+}
+
+// PublicKey returns the public key of privateKey.
+func PublicKey(privateKey *[KeySize]byte) (*[KeySize]byte, error) {
+	pub, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := new([KeySize]byte)
+	copy(publicKey[:], pub)
+	return publicKey, nil
+}
+
+// Conn is an encrypted connection.
+type Conn struct {
+	conn    io.ReadWriteCloser
+	peerKey [KeySize]byte
+
+	rmutex sync.Mutex // protects r*
+	rkey   [32]byte
+	rnonce [24]byte
+	rbuf   []byte // decrypted bytes not read yet
+	rframe []byte
+	rerr   error
+
+	wmutex sync.Mutex // protects w*
+	wkey   [32]byte
+	wnonce [24]byte
+	wframe []byte
+}
+
+// Client performs the handshake as the dialing side of conn.
+func Client(conn io.ReadWriteCloser, config *Config) (*Conn, error) {
+	return handshake(conn, config, true)
+}
+
+// Server performs the handshake as the accepting side of conn.
+func Server(conn io.ReadWriteCloser, config *Config) (*Conn, error) {
+	return handshake(conn, config, false)
+}
+
+func handshake(conn io.ReadWriteCloser, config *Config, client bool) (*Conn, error) {
+	if config.PrivateKey == nil {
+		return nil, errors.New("naclconn: missing private key")
+	}
+	staticPub, err := PublicKey(config.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	ephPub, ephPriv, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Both sides send their static and ephemeral public keys at once.
+	var local, remote [2 * KeySize]byte
+	copy(local[:KeySize], staticPub[:])
+	copy(local[KeySize:], ephPub[:])
+	werr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(local[:])
+		werr <- err
+	}()
+	if _, err = io.ReadFull(conn, remote[:]); err != nil {
+		return nil, fmt.Errorf("naclconn: handshake: %w", err)
+	}
+	if err = <-werr; err != nil {
+		return nil, fmt.Errorf("naclconn: handshake: %w", err)
+	}
+
+	c := &Conn{conn: conn}
+	copy(c.peerKey[:], remote[:KeySize])
+	if config.PeerKey != nil && *config.PeerKey != c.peerKey {
+		return nil, ErrPeerKey
+	}
+	if config.VerifyPeerKey != nil {
+		if err = config.VerifyPeerKey(&c.peerKey); err != nil {
+			return nil, err
+		}
+	}
+
+	peerStatic, peerEph := remote[:KeySize], remote[KeySize:]
+	ee, err := curve25519.X25519(ephPriv[:], peerEph)
+	if err != nil {
+		return nil, err
+	}
+	// es is the client's ephemeral key with the server's static key, se is the reverse.
+	// Each side computes one of them with its static key.
+	withStatic, err := curve25519.X25519(config.PrivateKey[:], peerEph)
+	if err != nil {
+		return nil, err
+	}
+	withPeerStatic, err := curve25519.X25519(ephPriv[:], peerStatic)
+	if err != nil {
+		return nil, err
+	}
+	clientKeys, serverKeys := local[:], remote[:]
+	es, se := withPeerStatic, withStatic
+	if !client {
+		clientKeys, serverKeys = remote[:], local[:]
+		es, se = withStatic, withPeerStatic
+	}
+	h := sha512.New()
+	h.Write([]byte("rpc2 naclconn v1"))
+	h.Write(clientKeys)
+	h.Write(serverKeys)
+	h.Write(ee)
+	h.Write(es)
+	h.Write(se)
+	sum := h.Sum(nil)
+	if client {
+		copy(c.wkey[:], sum[:32])
+		copy(c.rkey[:], sum[32:])
+	} else {
+		copy(c.rkey[:], sum[:32])
+		copy(c.wkey[:], sum[32:])
+	}
+	return c, nil
+}
+
+// PeerKey returns the static public key of the peer.
+func (c *Conn) PeerKey() *[KeySize]byte {
+	k := c.peerKey
+	return &k
+}
+
+func increment(nonce *[24]byte) {
+	n := binary.BigEndian.Uint64(nonce[16:]) + 1
+	binary.BigEndian.PutUint64(nonce[16:], n)
+}
+
+// Read reads decrypted data.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		c.rerr = c.readFrame()
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *Conn) readFrame() error {
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < secretbox.Overhead || n > maxPayload+secretbox.Overhead {
+		return fmt.Errorf("naclconn: invalid frame size %d", n)
+	}
+	if cap(c.rframe) < int(n) {
+		c.rframe = make([]byte, n)
+	}
+	frame := c.rframe[:n]
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	out, ok := secretbox.Open(c.rbuf[:0], frame, &c.rnonce, &c.rkey)
+	if !ok {
+		return ErrDecrypt
+	}
+	increment(&c.rnonce)
+	c.rbuf = out
+	return nil
+}
+
+// Write encrypts and writes b in one or more frames.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		c.wframe = append(c.wframe[:0], 0, 0, 0, 0)
+		c.wframe = secretbox.Seal(c.wframe, b[:n], &c.wnonce, &c.wkey)
+		binary.BigEndian.PutUint32(c.wframe, uint32(len(c.wframe)-4))
+		if _, err := c.conn.Write(c.wframe); err != nil {
+			return written, err
+		}
+		increment(&c.wnonce)
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// RemoteAddr returns the remote address of the underlying connection, if it has one.
+func (c *Conn) RemoteAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the underlying connection, if it has one.
+func (c *Conn) LocalAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package naclconn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/faultconn"
+)
+
+type pair struct {
+	client, server *Conn
+	clientErr      error
+	serverErr      error
+}
+
+func connect(c1, c2 io.ReadWriteCloser, clientConfig, serverConfig *Config) pair {
+	var p pair
+	done := make(chan struct{})
+	go func() {
+		p.server, p.serverErr = Server(c2, serverConfig)
+		if p.serverErr != nil {
+			c2.Close()
+		}
+		close(done)
+	}()
+	p.client, p.clientErr = Client(c1, clientConfig)
+	if p.clientErr != nil {
+		c1.Close()
+	}
+	<-done
+	return p
+}
+
+func keys(t *testing.T) (pub, priv *[KeySize]byte) {
+	pub, priv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestRPC(t *testing.T) {
+	clientPub, clientPriv := keys(t)
+	serverPub, serverPriv := keys(t)
+	c1, c2 := net.Pipe()
+	p := connect(c1, c2,
+		&Config{PrivateKey: clientPriv, PeerKey: serverPub},
+		&Config{PrivateKey: serverPriv, PeerKey: clientPub})
+	if p.clientErr != nil || p.serverErr != nil {
+		t.Fatal(p.clientErr, p.serverErr)
+	}
+	if *p.server.PeerKey() != *clientPub {
+		t.Fatal("unexpected peer key")
+	}
+
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, args []byte, reply *[]byte) error {
+		*reply = args
+		return nil
+	})
+	go srv.ServeConn(p.server)
+	clt := rpc2.NewClient(p.client)
+	go clt.Run()
+	defer clt.Close()
+
+	large := bytes.Repeat([]byte("x"), 3*maxPayload+1)
+	for _, args := range [][]byte{[]byte("hello"), large} {
+		var reply []byte
+		if err := clt.Call("echo", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, args) {
+			t.Fatalf("unexpected reply of %d bytes", len(reply))
+		}
+	}
+}
+
+func TestPeerKeyMismatch(t *testing.T) {
+	_, clientPriv := keys(t)
+	_, serverPriv := keys(t)
+	otherPub, _ := keys(t)
+	c1, c2 := net.Pipe()
+	p := connect(c1, c2,
+		&Config{PrivateKey: clientPriv, PeerKey: otherPub},
+		&Config{PrivateKey: serverPriv})
+	if p.clientErr != ErrPeerKey {
+		t.Fatalf("unexpected error: %v", p.clientErr)
+	}
+}
+
+// An attacker sending the static public key of the server without
+// its private key can not derive the session keys, so the client rejects its frames.
+func TestImpersonation(t *testing.T) {
+	serverPub, _ := keys(t)
+	_, clientPriv := keys(t)
+
+	c1, c2 := net.Pipe()
+	go func() {
+		ephPub, _, _ := GenerateKey()
+		var remote [2 * KeySize]byte
+		go io.ReadFull(c2, remote[:])
+		c2.Write(append(serverPub[:], ephPub[:]...))
+		forged := &Conn{conn: c2}
+		copy(forged.wkey[:], bytes.Repeat([]byte{1}, 32))
+		forged.Write([]byte("forged"))
+	}()
+	clt, err := Client(c1, &Config{PrivateKey: clientPriv, PeerKey: serverPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clt.Read(make([]byte, 16)); err != ErrDecrypt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	_, clientPriv := keys(t)
+	_, serverPriv := keys(t)
+	c1, c2 := net.Pipe()
+	// The first write is the handshake.
+	corrupt := faultconn.New(c1, faultconn.Fault{Op: faultconn.Write, N: 2, Corrupt: true})
+	p := connect(corrupt, c2, &Config{PrivateKey: clientPriv}, &Config{PrivateKey: serverPriv})
+	if p.clientErr != nil || p.serverErr != nil {
+		t.Fatal(p.clientErr, p.serverErr)
+	}
+	go p.client.Write([]byte("hello world"))
+	if _, err := p.server.Read(make([]byte, 16)); err != ErrDecrypt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package outbox
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a Store that keeps entries in a bbolt database.
+// Each Append is committed in its own transaction, which bbolt syncs to disk,
+// so entries survive crashes and restarts. IDs come from the sequence of the
+// bucket and are not reused after entries are acknowledged.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var boltBucket = []byte("outbox")
+
+// NewBoltStore opens the bbolt database at path, creating it if it does not
+// exist, and returns a BoltStore saving entries in it. Close the store to
+// release the database.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Append(method string, params json.RawMessage) (uint64, error) {
+	var id uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		var err error
+		if id, err = b.NextSequence(); err != nil {
+			return err
+		}
+		v, err := json.Marshal(Entry{ID: id, Method: method, Params: params})
+		if err != nil {
+			return err
+		}
+		return b.Put(boltKey(id), v)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *BoltStore) Pending() ([]Entry, error) {
+	var entries []Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Keys are big endian so the cursor iterates in order of IDs.
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *BoltStore) Ack(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(boltKey(id))
+	})
+}
+
+func boltKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
@@ -0,0 +1,120 @@
+// Package outbox implements a durable queue of outbound notifications for rpc2.
+//
+// Notifications added to an Outbox are persisted in a Store and delivered to
+// the peer as calls. An entry is removed from the store only after the peer
+// acknowledges it with a successful response, so undelivered notifications
+// survive connection loss and process restarts.
+//
+// Params are persisted as JSON and decoded into generic values before
+// delivery, so the outbox is meant to be used with the jsonrpc codec.
+//
+//	box := outbox.New(store)
+//	box.Notify("temperature", Reading{Sensor: "s1", Value: 21.5})
+//
+//	// For every established connection:
+//	err := box.Deliver(ctx, client)
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// Entry is a notification waiting to be delivered.
+type Entry struct {
+	ID     uint64          // assigned by the Store, increasing
+	Method string          // method to call on the peer
+	Params json.RawMessage // JSON encoded arguments
+}
+
+// Store persists entries until they are acknowledged.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Append saves a new entry and returns its ID.
+	Append(method string, params json.RawMessage) (uint64, error)
+
+	// Pending returns unacknowledged entries ordered by ID.
+	Pending() ([]Entry, error)
+
+	// Ack removes the entry with the given ID.
+	Ack(id uint64) error
+}
+
+// Outbox delivers entries from a Store to the peer.
+type Outbox struct {
+	store Store
+	mutex sync.Mutex // serializes deliveries
+	wake  chan struct{}
+}
+
+// New returns a new Outbox backed by store.
+func New(store Store) *Outbox {
+	return &Outbox{
+		store: store,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Notify persists a notification to be delivered by Deliver.
+func (o *Outbox) Notify(method string, args interface{}) error {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	if _, err = o.store.Append(method, b); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Deliver sends pending entries to the peer on client in order and acks each
+// one after the peer responds successfully. It keeps delivering new entries
+// until the context is done, the client disconnects or a call fails.
+// Only one Deliver runs at a time; the caller typically invokes it again
+// after establishing a new connection.
+func (o *Outbox) Deliver(ctx context.Context, client *rpc2.Client) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for {
+		entries, err := o.store.Pending()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err = o.deliver(ctx, client, e); err != nil {
+				return err
+			}
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		select {
+		case <-o.wake:
+		case <-client.DisconnectNotify():
+			return rpc2.ErrShutdown
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (o *Outbox) deliver(ctx context.Context, client *rpc2.Client, e Entry) error {
+	var args interface{}
+	d := json.NewDecoder(bytes.NewReader(e.Params))
+	d.UseNumber()
+	if err := d.Decode(&args); err != nil {
+		return err
+	}
+	if err := client.CallWithContext(ctx, e.Method, args, nil); err != nil {
+		return err
+	}
+	return o.store.Ack(e.ID)
+}
@@ -0,0 +1,149 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+)
+
+func TestOutbox(t *testing.T) {
+	type Reading struct {
+		Sensor string
+		Value  int
+	}
+
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := New(store)
+	if err = box.Notify("reading", Reading{"s1", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = box.Notify("reading", Reading{"s2", 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries must survive reopening the store.
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box = New(store)
+
+	received := make(chan Reading, 2)
+	srv := rpc2.NewServer()
+	srv.Handle("reading", func(client *rpc2.Client, r *Reading, _ *struct{}) error {
+		received <- *r
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(jsonrpc.NewJSONCodec(c1))
+	clt := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(c2))
+	go clt.Run()
+	defer clt.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- box.Deliver(ctx, clt) }()
+
+	for _, expected := range []Reading{{"s1", 1}, {"s2", 2}} {
+		select {
+		case r := <-received:
+			if r != expected {
+				t.Fatalf("unexpected reading: %+v", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("did not receive notification")
+		}
+	}
+
+	// Acks happen after the handler returns.
+	deadline := time.Now().Add(time.Second)
+	for {
+		entries, err := store.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected pending entries: %d", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err = <-done; err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+// testStore checks that entries and IDs survive reopening a store with open.
+func testStore(t *testing.T, open func() Store) {
+	store := open()
+	for _, method := range []string{"a", "b"} {
+		if _, err := store.Append(method, json.RawMessage(`[1]`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = open()
+	entries, err := store.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Method != "a" || entries[1].Method != "b" || string(entries[1].Params) != `[1]` {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	for _, e := range entries {
+		if err = store.Ack(e.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// IDs are not reused after the store is drained.
+	store = open()
+	id, err := store.Append("c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= entries[1].ID {
+		t.Fatalf("ID is reused: %d", id)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	testStore(t, func() Store {
+		store, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	var store *BoltStore
+	testStore(t, func() Store {
+		if store != nil {
+			store.Close()
+		}
+		var err error
+		if store, err = NewBoltStore(path); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+	store.Close()
+}
@@ -0,0 +1,229 @@
+package outbox
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a Store that keeps entries in memory.
+// Entries do not survive a process restart.
+type MemoryStore struct {
+	mutex   sync.Mutex
+	seq     uint64
+	entries []Entry
+}
+
+// NewMemoryStore returns a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Append(method string, params json.RawMessage) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seq++
+	s.entries = append(s.entries, Entry{ID: s.seq, Method: method, Params: params})
+	return s.seq, nil
+}
+
+func (s *MemoryStore) Pending() ([]Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStore) Ack(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, e := range s.entries {
+		if e.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// FileStore is a Store that keeps each entry in its own file in a directory.
+// Files are synced to disk and renamed into place atomically before Append
+// returns, so entries survive crashes and restarts. The highest assigned ID
+// is saved before entries are removed, so IDs are not reused after the
+// directory is drained and the store is reopened.
+type FileStore struct {
+	dir   string
+	mutex sync.Mutex
+	seq   uint64
+	mark  uint64 // highest ID saved in seqFile
+}
+
+const (
+	fileExt = ".json"
+	seqFile = "seq"
+)
+
+// NewFileStore returns a FileStore saving entries in dir.
+// The directory is created if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileStore{dir: dir}
+	b, err := os.ReadFile(filepath.Join(dir, seqFile))
+	if err == nil {
+		if s.mark, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.seq = s.mark
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 && ids[len(ids)-1] > s.seq {
+		s.seq = ids[len(ids)-1]
+	}
+	return s, nil
+}
+
+func (s *FileStore) Append(method string, params json.RawMessage) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.seq + 1
+	b, err := json.Marshal(Entry{ID: id, Method: method, Params: params})
+	if err != nil {
+		return 0, err
+	}
+	tmp := filepath.Join(s.dir, "."+s.name(id)+".tmp")
+	if err = writeFileSync(tmp, b); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err = os.Rename(tmp, filepath.Join(s.dir, s.name(id))); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	// Sync the directory so the rename is durable too.
+	if err = syncDir(s.dir); err != nil {
+		return 0, err
+	}
+	s.seq = id
+	return id, nil
+}
+
+// writeFileSync writes b to a new file at path and syncs it to disk.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *FileStore) Pending() ([]Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		b, err := os.ReadFile(filepath.Join(s.dir, s.name(id)))
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err = json.Unmarshal(b, &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *FileStore) Ack(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Entries may be the only record of the highest ID.
+	if s.mark < s.seq {
+		if err := s.saveMark(); err != nil {
+			return err
+		}
+	}
+	err := os.Remove(filepath.Join(s.dir, s.name(id)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// saveMark saves the highest assigned ID in seqFile.
+func (s *FileStore) saveMark() error {
+	tmp := filepath.Join(s.dir, "."+seqFile+".tmp")
+	if err := writeFileSync(tmp, []byte(strconv.FormatUint(s.seq, 10))); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, seqFile)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	s.mark = s.seq
+	return nil
+}
+
+func (s *FileStore) name(id uint64) string {
+	return strconv.FormatUint(id, 10) + fileExt
+}
+
+// ids returns IDs of entries in the directory in increasing order.
+func (s *FileStore) ids() ([]uint64, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, fileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
@@ -0,0 +1,79 @@
+package rpc2
+
+import (
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// CodeOverloaded is the code of errors shedding calls because the peer is
+// overloaded. Like CodeRejected, the call is not handled and may be retried later.
+const CodeOverloaded = -32001
+
+// SetMaxQueuedRequests makes the client shed requests when n requests are
+// waiting for a handler goroutine, see SetMaxConcurrentHandlers. Shed requests
+// are not decoded and the caller gets an *Error with CodeOverloaded.
+// Zero means no limit. It must be called before Run.
+func (c *Client) SetMaxQueuedRequests(n int) {
+	c.maxQueued = n
+}
+
+// SetMemoryBudget makes the client shed requests while the heap of the
+// process is larger than bytes. The caller gets an *Error with CodeOverloaded.
+// The heap size is sampled at most every 10ms. Zero disables the check.
+// It must be called before Run.
+func (c *Client) SetMemoryBudget(bytes uint64) {
+	c.memoryBudget = bytes
+}
+
+// overloaded reports whether a new request must be shed.
+func (c *Client) overloaded() bool {
+	if c.maxQueued > 0 {
+		c.handlerMutex.Lock()
+		full := len(c.queue) >= c.maxQueued
+		c.handlerMutex.Unlock()
+		if full {
+			return true
+		}
+	}
+	return c.memoryBudget > 0 && heapSize(c.timeSource.Now()) > c.memoryBudget
+}
+
+// shed discards the body of req and responds with an overloaded error.
+func (c *Client) shed(req *Request) error {
+	if c.stats != nil {
+		c.stats.shed.Add(1)
+	}
+	if err := c.codec.ReadRequestBody(nil); err != nil {
+		return err
+	}
+	return c.writeErrorResponse(&Response{
+		Seq:   req.Seq,
+		Error: "rpc2: server overloaded",
+		Code:  CodeOverloaded,
+	})
+}
+
+const heapSampleInterval = 10 * time.Millisecond
+
+var heap struct {
+	sync.Mutex
+	sample  []metrics.Sample
+	size    uint64
+	sampled time.Time
+}
+
+// heapSize returns the size of heap objects in bytes, sampled recently at now.
+func heapSize(now time.Time) uint64 {
+	heap.Lock()
+	defer heap.Unlock()
+	if now.Sub(heap.sampled) >= heapSampleInterval || now.Before(heap.sampled) {
+		if heap.sample == nil {
+			heap.sample = []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		}
+		metrics.Read(heap.sample)
+		heap.size = heap.sample[0].Value.Uint64()
+		heap.sampled = now
+	}
+	return heap.size
+}
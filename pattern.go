@@ -0,0 +1,93 @@
+package rpc2
+
+import "strings"
+
+// route is a handler registered for a pattern of method names.
+type route struct {
+	segments []string
+	handler  *handler
+}
+
+// HandlePattern registers the handler function for methods matching pattern,
+// whose segments are separated by dots. A "*" segment matches any single
+// segment and a final "**" segment matches the rest of the name, one or more
+// segments. The matched segments are available to handlers taking a context
+// as the Params of IncomingCall:
+//
+//	srv.HandlePattern("device.*.status", func(ctx context.Context, client *rpc2.Client, args struct{}, reply *Status) error {
+//		info, _ := rpc2.IncomingCall(ctx)
+//		return getStatus(info.Params[0], reply) // "42" for "device.42.status"
+//	})
+//
+// Patterns are tried in the order they are registered, after handlers
+// registered with Handle for exact names. Methods starting with "rpc." are
+// reserved for built-in methods and never match patterns. If the pattern is
+// invalid, already registered or starts with "rpc.", HandlePattern panics.
+func (s *Server) HandlePattern(pattern string, handlerFunc interface{}) {
+	s.routes = addRoute(s.routes, pattern, handlerFunc)
+}
+
+// HandlePattern registers the handler function for methods matching pattern, like Server.HandlePattern.
+func (c *Client) HandlePattern(pattern string, handlerFunc interface{}) {
+	c.routes = addRoute(c.routes, pattern, handlerFunc)
+}
+
+func addRoute(routes []*route, pattern string, handlerFunc interface{}) []*route {
+	checkReserved(pattern)
+	segments := strings.Split(pattern, ".")
+	for i, s := range segments {
+		if s == "" || (s == "**" && i != len(segments)-1) ||
+			(s != "*" && s != "**" && strings.Contains(s, "*")) {
+			panic("rpc2: invalid method pattern " + pattern)
+		}
+	}
+	for _, r := range routes {
+		if r.handler.pattern == pattern {
+			panic("rpc2: multiple registrations for " + pattern)
+		}
+	}
+	h := newHandler(pattern, handlerFunc)
+	h.pattern = pattern
+	return append(routes, &route{segments: segments, handler: h})
+}
+
+// route returns the handler of the first pattern matching method
+// and the segments matched by its wildcards.
+func (c *Client) route(method string) (*handler, []string, bool) {
+	if len(c.routes) == 0 {
+		return nil, nil, false
+	}
+	segments := strings.Split(method, ".")
+	for _, r := range c.routes {
+		if params, ok := r.match(segments); ok {
+			return r.handler, params, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (r *route) match(segments []string) ([]string, bool) {
+	var params []string
+	for i, p := range r.segments {
+		if p == "**" {
+			if i >= len(segments) {
+				return nil, false
+			}
+			return append(params, strings.Join(segments[i:], ".")), true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		switch p {
+		case "*":
+			if segments[i] == "" {
+				return nil, false
+			}
+			params = append(params, segments[i])
+		case segments[i]:
+		default:
+			return nil, false
+		}
+	}
+	return params, len(segments) == len(r.segments)
+}
@@ -0,0 +1,40 @@
+package rpc2
+
+import "sync"
+
+// Pools of per-message structures on hot paths. Requests and responses are
+// recycled by the writer goroutine after they are written; codecs must not
+// retain them. Calls are recycled by CallWithContext when they succeed,
+// because the caller never sees them and nothing else refers to them.
+var (
+	requestPool  = sync.Pool{New: func() interface{} { return new(Request) }}
+	responsePool = sync.Pool{New: func() interface{} { return new(Response) }}
+	callPool     = sync.Pool{New: func() interface{} { return &Call{Done: make(chan *Call, 1)} }}
+)
+
+func getRequest() *Request {
+	return requestPool.Get().(*Request)
+}
+
+func putRequest(req *Request) {
+	*req = Request{}
+	requestPool.Put(req)
+}
+
+func getResponse() *Response {
+	return responsePool.Get().(*Response)
+}
+
+func putResponse(resp *Response) {
+	*resp = Response{}
+	responsePool.Put(resp)
+}
+
+func getCall() *Call {
+	return callPool.Get().(*Call)
+}
+
+func putCall(call *Call) {
+	*call = Call{Done: call.Done}
+	callPool.Put(call)
+}
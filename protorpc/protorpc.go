@@ -0,0 +1,491 @@
+// Package protorpc implements a Protocol Buffers codec for the rpc2 package.
+//
+// Each message is a frame preceded by its length as a varint. The frame is
+// encoded as the following message, so peers in other languages can
+// implement the codec with generated code:
+//
+//	message Frame {
+//	  uint64 seq = 1;                            // zero for notifications
+//	  string method = 2;                         // set in requests only
+//	  string error = 3;                          // set in error responses only
+//	  sint64 code = 4;                           // of the error, zero if unspecified
+//	  map<string, string> metadata = 5;          // of requests
+//	  repeated bytes attachments = 6;            // of requests
+//	  google.protobuf.Duration retry_after = 7;  // of error responses
+//	  google.protobuf.Any body = 8;              // params or result
+//	  repeated google.protobuf.Any details = 9;  // of error responses
+//	}
+//
+// Params and results are sent as google.protobuf.Any, so handlers and callers
+// taking *anypb.Any get them with their type URL as they are, e.g. for
+// forwarding or generic tooling, and others get them unpacked into their own
+// message type, which must match. Args and replies must be proto messages;
+// Go integers, floats, strings, booleans and byte slices are also accepted
+// and sent as wrapper messages such as google.protobuf.Int64Value, so the
+// built-in methods of rpc2 work.
+//
+// Error details are carried losslessly, like the details of gRPC statuses:
+// handlers return an *rpc2.Error with proto messages in Details, and callers
+// get them back in the Details of the *rpc2.Error returned from the call,
+// unpacked if their types are linked into the program and as *anypb.Any
+// otherwise. Details that are not proto messages are not sent.
+package protorpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// MaxFrameSize is the maximum size of a frame read by the codec in bytes.
+// Larger frames are reported as errors and close the connection.
+const MaxFrameSize = 64 << 20
+
+// Field numbers of Frame.
+const (
+	fieldSeq         = 1
+	fieldMethod      = 2
+	fieldError       = 3
+	fieldCode        = 4
+	fieldMetadata    = 5
+	fieldAttachments = 6
+	fieldRetryAfter  = 7
+	fieldBody        = 8
+	fieldDetails     = 9
+)
+
+type protoCodec struct {
+	r      *bufio.Reader
+	w      *bufio.Writer
+	rwc    io.ReadWriteCloser
+	wmutex sync.Mutex // protects w, wbuf
+
+	// temporary work space
+	rbuf []byte
+	wbuf []byte
+	body anypb.Any // of the message just read
+	has  bool      // whether the message just read has a body
+}
+
+// NewProtoCodec returns a new rpc2.Codec using Protocol Buffers on conn.
+func NewProtoCodec(conn io.ReadWriteCloser) rpc2.Codec {
+	return &protoCodec{
+		r:   bufio.NewReader(conn),
+		w:   bufio.NewWriter(conn),
+		rwc: conn,
+	}
+}
+
+func (c *protoCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if n > MaxFrameSize {
+		return fmt.Errorf("protorpc: frame of %d bytes is too large", n)
+	}
+	if uint64(cap(c.rbuf)) < n {
+		c.rbuf = make([]byte, n)
+	}
+	c.rbuf = c.rbuf[:n]
+	if _, err = io.ReadFull(c.r, c.rbuf); err != nil {
+		return err
+	}
+	var f frame
+	if err = f.unmarshal(c.rbuf); err != nil {
+		return err
+	}
+	proto.Reset(&c.body)
+	c.has = f.body != nil
+	if c.has {
+		if err = proto.Unmarshal(f.body, &c.body); err != nil {
+			return err
+		}
+	}
+	if f.method != "" {
+		req.Seq = f.seq
+		req.Method = f.method
+		req.Metadata = f.metadata
+		req.Attachments = f.attachments
+		return nil
+	}
+	resp.Seq = f.seq
+	resp.Error = f.error
+	resp.Code = int(f.code)
+	resp.RetryAfter = f.retryAfter
+	for _, b := range f.details {
+		d, err := unmarshalDetail(b)
+		if err != nil {
+			return err
+		}
+		resp.Details = append(resp.Details, d)
+	}
+	return nil
+}
+
+// unmarshalDetail returns the detail encoded in b as google.protobuf.Any,
+// unpacked if its type is known.
+func unmarshalDetail(b []byte) (interface{}, error) {
+	a := new(anypb.Any)
+	if err := proto.Unmarshal(b, a); err != nil {
+		return nil, err
+	}
+	if m, err := a.UnmarshalNew(); err == nil {
+		return m, nil
+	}
+	return a, nil
+}
+
+func (c *protoCodec) ReadRequestBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+func (c *protoCodec) ReadResponseBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+// readBody decodes the body of the message just read into x.
+func (c *protoCodec) readBody(x interface{}) error {
+	if x == nil || !c.has {
+		return nil
+	}
+	if a, ok := x.(*anypb.Any); ok {
+		a.TypeUrl = c.body.TypeUrl
+		a.Value = append(a.Value[:0], c.body.Value...)
+		return nil
+	}
+	if m, ok := x.(proto.Message); ok {
+		return c.body.UnmarshalTo(m)
+	}
+	v := reflect.ValueOf(x)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("protorpc: can not decode into %T", x)
+	}
+	m, err := c.body.UnmarshalNew()
+	if err != nil {
+		return err
+	}
+	return setScalar(v.Elem(), m)
+}
+
+func (c *protoCodec) WriteRequest(r *rpc2.Request, param interface{}) error {
+	f := frame{seq: r.Seq, method: r.Method, metadata: r.Metadata, attachments: r.Attachments}
+	var err error
+	if f.body, err = marshalBody(param); err != nil {
+		return err
+	}
+	return c.write(&f)
+}
+
+func (c *protoCodec) WriteResponse(r *rpc2.Response, x interface{}) error {
+	f := frame{seq: r.Seq}
+	if r.Error != "" {
+		// Bodies of error responses are not sent.
+		f.error = r.Error
+		f.code = int64(r.Code)
+		f.retryAfter = r.RetryAfter
+		for _, d := range r.Details {
+			m, ok := d.(proto.Message)
+			if !ok {
+				continue
+			}
+			b, err := marshalAny(m)
+			if err != nil {
+				return err
+			}
+			f.details = append(f.details, b)
+		}
+		return c.write(&f)
+	}
+	var err error
+	if f.body, err = marshalBody(x); err != nil {
+		return err
+	}
+	return c.write(&f)
+}
+
+// marshalBody returns v encoded as google.protobuf.Any, or nil if v is nil.
+func marshalBody(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		var err error
+		if m, err = scalarMessage(reflect.ValueOf(v)); err != nil {
+			return nil, err
+		}
+	}
+	return marshalAny(m)
+}
+
+// marshalAny returns m encoded as google.protobuf.Any.
+// Messages of type *anypb.Any are encoded as they are.
+func marshalAny(m proto.Message) ([]byte, error) {
+	a, ok := m.(*anypb.Any)
+	if !ok {
+		var err error
+		if a, err = anypb.New(m); err != nil {
+			return nil, err
+		}
+	}
+	return proto.Marshal(a)
+}
+
+// write encodes f with its length and flushes the connection.
+func (c *protoCodec) write(f *frame) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.wbuf = f.marshal(c.wbuf[:0])
+	var n [binary.MaxVarintLen64]byte
+	if _, err := c.w.Write(n[:binary.PutUvarint(n[:], uint64(len(c.wbuf)))]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(c.wbuf); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *protoCodec) Conn() io.ReadWriteCloser {
+	return c.rwc
+}
+
+func (c *protoCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// scalarMessage returns the wrapper message of the Go scalar in v,
+// which may be a pointer.
+func scalarMessage(v reflect.Value) (proto.Message, error) {
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		if m, ok := v.Interface().(proto.Message); ok {
+			return m, nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return wrapperspb.Int64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return wrapperspb.UInt64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return wrapperspb.Double(v.Float()), nil
+	case reflect.String:
+		return wrapperspb.String(v.String()), nil
+	case reflect.Bool:
+		return wrapperspb.Bool(v.Bool()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return wrapperspb.Bytes(v.Bytes()), nil
+		}
+	}
+	return nil, fmt.Errorf("protorpc: %s is not a proto.Message", v.Type())
+}
+
+var errScalarType = errors.New("protorpc: mismatched scalar type")
+
+// setScalar sets v, a Go scalar, to the value of the wrapper message m.
+func setScalar(v reflect.Value, m proto.Message) error {
+	switch w := m.(type) {
+	case *wrapperspb.Int64Value:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(w.Value)
+			return nil
+		}
+	case *wrapperspb.UInt64Value:
+		switch v.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(w.Value)
+			return nil
+		}
+	case *wrapperspb.DoubleValue:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(w.Value)
+			return nil
+		}
+	case *wrapperspb.StringValue:
+		if v.Kind() == reflect.String {
+			v.SetString(w.Value)
+			return nil
+		}
+	case *wrapperspb.BoolValue:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(w.Value)
+			return nil
+		}
+	case *wrapperspb.BytesValue:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(w.Value)
+			return nil
+		}
+	}
+	return errScalarType
+}
+
+// frame is a decoded Frame. Bytes fields refer to the buffer it is decoded from.
+type frame struct {
+	seq         uint64
+	method      string
+	error       string
+	code        int64
+	metadata    map[string]string
+	attachments [][]byte
+	retryAfter  time.Duration
+	body        []byte   // google.protobuf.Any, nil if missing
+	details     [][]byte // google.protobuf.Any
+}
+
+func (f *frame) marshal(b []byte) []byte {
+	if f.seq != 0 {
+		b = protowire.AppendTag(b, fieldSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, f.seq)
+	}
+	if f.method != "" {
+		b = protowire.AppendTag(b, fieldMethod, protowire.BytesType)
+		b = protowire.AppendString(b, f.method)
+	}
+	if f.error != "" {
+		b = protowire.AppendTag(b, fieldError, protowire.BytesType)
+		b = protowire.AppendString(b, f.error)
+	}
+	if f.code != 0 {
+		b = protowire.AppendTag(b, fieldCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(f.code))
+	}
+	for k, v := range f.metadata {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, fieldMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	for _, a := range f.attachments {
+		b = protowire.AppendTag(b, fieldAttachments, protowire.BytesType)
+		b = protowire.AppendBytes(b, a)
+	}
+	if f.retryAfter != 0 {
+		d, _ := proto.Marshal(durationpb.New(f.retryAfter))
+		b = protowire.AppendTag(b, fieldRetryAfter, protowire.BytesType)
+		b = protowire.AppendBytes(b, d)
+	}
+	if f.body != nil {
+		b = protowire.AppendTag(b, fieldBody, protowire.BytesType)
+		b = protowire.AppendBytes(b, f.body)
+	}
+	for _, d := range f.details {
+		b = protowire.AppendTag(b, fieldDetails, protowire.BytesType)
+		b = protowire.AppendBytes(b, d)
+	}
+	return b
+}
+
+func (f *frame) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldSeq && typ == protowire.VarintType:
+			f.seq, n = protowire.ConsumeVarint(b)
+		case num == fieldCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			f.code = protowire.DecodeZigZag(v)
+		case typ == protowire.BytesType && num >= fieldMethod && num <= fieldDetails:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				if err := f.set(num, v); err != nil {
+					return err
+				}
+			}
+		default:
+			// Unknown fields are skipped for forward compatibility.
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// set sets the length-delimited field num of f to v.
+func (f *frame) set(num protowire.Number, v []byte) error {
+	switch num {
+	case fieldMethod:
+		f.method = string(v)
+	case fieldError:
+		f.error = string(v)
+	case fieldMetadata:
+		k, val, err := unmarshalEntry(v)
+		if err != nil {
+			return err
+		}
+		if f.metadata == nil {
+			f.metadata = make(map[string]string)
+		}
+		f.metadata[k] = val
+	case fieldAttachments:
+		// Attachments are retained by rpc2, so they are copied.
+		f.attachments = append(f.attachments, append([]byte{}, v...))
+	case fieldRetryAfter:
+		var d durationpb.Duration
+		if err := proto.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		f.retryAfter = d.AsDuration()
+	case fieldBody:
+		f.body = v
+	case fieldDetails:
+		f.details = append(f.details, v)
+	}
+	return nil
+}
+
+// unmarshalEntry decodes an entry of a map<string, string> field.
+func unmarshalEntry(b []byte) (k, v string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.BytesType && (num == 1 || num == 2) {
+			var s string
+			s, n = protowire.ConsumeString(b)
+			if num == 1 {
+				k = s
+			} else {
+				v = s
+			}
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return k, v, nil
+}
@@ -0,0 +1,152 @@
+package protorpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// pair returns a client connected to srv with the codec.
+func pair(t *testing.T, srv *rpc2.Server) *rpc2.Client {
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewProtoCodec(c1))
+	clt := rpc2.NewClientWithCodec(NewProtoCodec(c2))
+	go clt.Run()
+	t.Cleanup(func() { clt.Close() })
+	return clt
+}
+
+func TestProtoRPC(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("greet", func(client *rpc2.Client, name *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+		reply.Value = "hello " + name.Value
+		return nil
+	})
+	received := make(chan *structpb.Struct, 1)
+	srv.Handle("record", func(client *rpc2.Client, s *structpb.Struct, _ *wrapperspb.BoolValue) error {
+		received <- s
+		return nil
+	})
+	srv.Handle("fail", func(client *rpc2.Client, args *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+		return errors.New("failed")
+	})
+	clt := pair(t, srv)
+
+	var reply wrapperspb.StringValue
+	if err := clt.Call("greet", wrapperspb.String("world"), &reply); err != nil || reply.Value != "hello world" {
+		t.Fatalf("unexpected reply: %q, %v", reply.Value, err)
+	}
+	s, _ := structpb.NewStruct(map[string]interface{}{"a": 1.0})
+	if err := clt.Notify("record", s); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !proto.Equal(got, s) {
+			t.Fatalf("unexpected notification: %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notification is not handled")
+	}
+	err := clt.Call("fail", wrapperspb.String(""), &reply)
+	if _, ok := err.(rpc2.ServerError); !ok || err.Error() != "failed" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if err = clt.Call("greet", wrapperspb.Int64(1), &reply); err == nil {
+		t.Fatal("mismatched params are decoded")
+	}
+	// Built-in methods take Go scalars.
+	if _, err = clt.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAny(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("forward", func(client *rpc2.Client, args *anypb.Any, reply *anypb.Any) error {
+		if args.MessageIs(&wrapperspb.Int64Value{}) {
+			var v wrapperspb.Int64Value
+			if err := args.UnmarshalTo(&v); err != nil {
+				return err
+			}
+			return reply.MarshalFrom(wrapperspb.Int64(v.Value + 1))
+		}
+		proto.Merge(reply, args)
+		return nil
+	})
+	clt := pair(t, srv)
+
+	// Concrete messages are packed and unpacked.
+	var n wrapperspb.Int64Value
+	if err := clt.Call("forward", wrapperspb.Int64(1), &n); err != nil || n.Value != 2 {
+		t.Fatalf("unexpected reply: %v, %v", n.Value, err)
+	}
+	// Any is sent as it is.
+	d, _ := anypb.New(durationpb.New(time.Second))
+	var reply anypb.Any
+	if err := clt.Call("forward", d, &reply); err != nil || !proto.Equal(&reply, d) {
+		t.Fatalf("unexpected reply: %v, %v", &reply, err)
+	}
+	var s wrapperspb.StringValue
+	if err := clt.Call("forward", d, &s); err == nil {
+		t.Fatal("reply of mismatched type is decoded")
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	unknown := &anypb.Any{TypeUrl: "type.googleapis.com/example.Unknown", Value: []byte{8, 1}}
+	srv := rpc2.NewServer()
+	srv.Handle("validate", func(client *rpc2.Client, args *wrapperspb.StringValue, reply *wrapperspb.BoolValue) error {
+		return &rpc2.Error{
+			Code:       -32602,
+			Message:    "invalid name",
+			RetryAfter: time.Second,
+			Details:    []interface{}{wrapperspb.String("name"), unknown, "not a proto message"},
+		}
+	})
+	clt := pair(t, srv)
+
+	err := clt.Call("validate", wrapperspb.String(""), new(wrapperspb.BoolValue))
+	var e *rpc2.Error
+	if !errors.As(err, &e) || e.Code != -32602 || e.Message != "invalid name" || e.RetryAfter != time.Second {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if len(e.Details) != 2 {
+		t.Fatalf("unexpected details: %v", e.Details)
+	}
+	if d, ok := e.Details[0].(*wrapperspb.StringValue); !ok || d.Value != "name" {
+		t.Fatalf("unexpected detail: %#v", e.Details[0])
+	}
+	if d, ok := e.Details[1].(*anypb.Any); !ok || !proto.Equal(d, unknown) {
+		t.Fatalf("unexpected detail: %#v", e.Details[1])
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("describe", func(ctx context.Context, client *rpc2.Client, args *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+		a := rpc2.Attachments(ctx)
+		if len(a) != 1 {
+			return errors.New("missing attachment")
+		}
+		reply.Value = rpc2.IncomingMetadata(ctx)["key"] + " " + string(a[0])
+		return nil
+	})
+	clt := pair(t, srv)
+
+	ctx := rpc2.WithMetadata(context.Background(), map[string]string{"key": "value"})
+	ctx = rpc2.WithAttachments(ctx, []byte("attached"))
+	var reply wrapperspb.StringValue
+	if err := clt.CallWithContext(ctx, "describe", wrapperspb.String(""), &reply); err != nil || reply.Value != "value attached" {
+		t.Fatalf("unexpected reply: %q, %v", reply.Value, err)
+	}
+}
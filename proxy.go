@@ -0,0 +1,37 @@
+package rpc2
+
+import "context"
+
+// Proxy returns a handler forwarding calls and notifications to upstream by
+// the name they are called with, relaying responses and errors, with their
+// codes, back to the caller. Registered for the "**" pattern, it forwards
+// every call not handled by the server itself, e.g. from an edge node to a
+// core service:
+//
+//	srv.HandlePattern("**", rpc2.Proxy[json.RawMessage](core))
+//
+// Raw is a type that the codecs of both connections decode any params and
+// results into and encode as they are, such as json.RawMessage for jsonrpc
+// codecs, so values are forwarded without knowing their types. Gob codecs
+// have no such type.
+//
+// The metadata of calls is forwarded, except for keys reserved by the
+// package, and so are the attachments of calls; the deadline and the cancellation of calls are forwarded as
+// well because upstream calls are made with the context of the handler.
+func Proxy[Raw any](upstream *Client) func(ctx context.Context, client *Client, args Raw) (Raw, error) {
+	return func(ctx context.Context, client *Client, args Raw) (Raw, error) {
+		var reply Raw
+		info, _ := IncomingCall(ctx)
+		if md := IncomingMetadata(ctx); len(md) > 0 {
+			ctx = WithMetadata(ctx, md)
+		}
+		if a := Attachments(ctx); len(a) > 0 {
+			ctx = WithAttachments(ctx, a...)
+		}
+		if info.Seq == 0 {
+			return reply, upstream.Notify(info.Method, args)
+		}
+		err := upstream.CallWithContext(ctx, info.Method, args, &reply)
+		return reply, err
+	}
+}
@@ -0,0 +1,195 @@
+package proxydial
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// startServer returns the address of an rpc2 server.
+func startServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args []int, reply *int) error {
+		*reply = args[0] + args[1]
+		return nil
+	})
+	go srv.Accept(lis)
+	return lis.Addr().String()
+}
+
+// serve runs handle for every connection accepted on a new listener and returns its address.
+func serve(t *testing.T, handle func(net.Conn)) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func tunnel(conn net.Conn, address string) {
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// httpProxy handles CONNECT requests authenticated as user:pass.
+func httpProxy(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if user, pass, ok := parseProxyAuth(req); !ok || user != "user" || pass != "pass" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	tunnel(conn, req.Host)
+}
+
+func parseProxyAuth(req *http.Request) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+// socksProxy implements the parts of SOCKS5 used by the client, with user:pass authentication.
+func socksProxy(conn net.Conn) {
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return
+	}
+	methods := make([]byte, b[1])
+	io.ReadFull(conn, methods)
+	conn.Write([]byte{5, 2}) // username/password
+	io.ReadFull(conn, b[:])
+	user := make([]byte, b[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, b[:1])
+	pass := make([]byte, b[0])
+	io.ReadFull(conn, pass)
+	if string(user) != "user" || string(pass) != "pass" {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	var h [4]byte
+	io.ReadFull(conn, h[:])
+	var host string
+	switch h[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		io.ReadFull(conn, b[:1])
+		name := make([]byte, b[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(conn, b[:])
+	port := binary.BigEndian.Uint16(b[:])
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	tunnel(conn, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+func call(t *testing.T, d *Dialer, address string) error {
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	clt := rpc2.NewClient(conn)
+	go clt.Run()
+	defer clt.Close()
+	var reply int
+	if err = clt.Call("add", []int{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 3 {
+		t.Fatalf("unexpected reply: %d", reply)
+	}
+	return nil
+}
+
+func TestProxies(t *testing.T) {
+	server := startServer(t)
+	httpAddr := serve(t, httpProxy)
+	socksAddr := serve(t, socksProxy)
+
+	for _, u := range []string{"http://user:pass@" + httpAddr, "socks5://user:pass@" + socksAddr} {
+		t.Run(u, func(t *testing.T) {
+			if err := call(t, &Dialer{Proxy: FixedProxy(u)}, server); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	for _, u := range []string{"http://user:wrong@" + httpAddr, "socks5://user:wrong@" + socksAddr} {
+		t.Run(u, func(t *testing.T) {
+			if err := call(t, &Dialer{Proxy: FixedProxy(u)}, server); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	server := startServer(t)
+	httpAddr := serve(t, httpProxy)
+
+	t.Setenv("HTTPS_PROXY", "http://user:pass@"+httpAddr)
+	t.Setenv("NO_PROXY", "")
+	u, err := ProxyFromEnvironment("rpc.example.com:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.Host != httpAddr {
+		t.Fatalf("unexpected proxy: %v", u)
+	}
+	// Loopback addresses are connected directly.
+	if u, _ = ProxyFromEnvironment(server); u != nil {
+		t.Fatalf("unexpected proxy for loopback: %v", u)
+	}
+	if err = call(t, defaultDialer, server); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ALL_PROXY", "socks5://127.0.0.1:1")
+	if u, _ = ProxyFromEnvironment("rpc.example.com:5000"); u == nil || u.Scheme != "socks5" {
+		t.Fatalf("ALL_PROXY is not used: %v", u)
+	}
+
+	t.Setenv("NO_PROXY", "rpc.example.com")
+	if u, _ = ProxyFromEnvironment("rpc.example.com:5000"); u != nil {
+		t.Fatalf("NO_PROXY is not honored: %v", u)
+	}
+}
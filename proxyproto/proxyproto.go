@@ -0,0 +1,267 @@
+// Package proxyproto implements the HAProxy PROXY protocol, versions 1 and 2,
+// on accepted connections.
+//
+// When rpc2 runs behind a TCP load balancer, the remote address of accepted
+// connections is the address of the balancer. A balancer configured to send
+// the PROXY protocol header sends the address of the real client first.
+// Connections accepted by a Listener read the header and report the real
+// address from RemoteAddr, so Client.RemoteAddr returns it in handlers:
+//
+//	lis, _ := net.Listen("tcp", ":5000")
+//	srv.OnConnect(func(client *rpc2.Client) {
+//		client.State.Set("addr", client.RemoteAddr().String())
+//	})
+//	srv.Accept(proxyproto.NewListener(lis))
+//
+// Every connection must start with a header; connections without one fail on
+// the first read, since accepting them would let clients connecting directly
+// spoof their address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReadHeaderTimeout is the default time allowed for reading the header.
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// ErrNoHeader is returned when a connection does not start with a PROXY protocol header.
+var ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+
+// signature starts version 2 headers.
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener wraps a listener so accepted connections read the PROXY protocol header.
+type Listener struct {
+	net.Listener
+
+	// ReadHeaderTimeout limits the time for reading the header.
+	// Zero means no limit.
+	ReadHeaderTimeout time.Duration
+}
+
+// NewListener returns a Listener accepting connections from lis
+// with DefaultReadHeaderTimeout.
+func NewListener(lis net.Listener) *Listener {
+	return &Listener{Listener: lis, ReadHeaderTimeout: DefaultReadHeaderTimeout}
+}
+
+// Accept returns the next connection as a *Conn.
+// The header is read on the first call to Read, RemoteAddr or LocalAddr,
+// so a slow client does not block accepting others.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, l.ReadHeaderTimeout), nil
+}
+
+// Conn is a connection starting with a PROXY protocol header.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once     sync.Once
+	err      error
+	src, dst net.Addr // nil if the header does not carry addresses
+}
+
+// NewConn returns a Conn reading the header from conn within timeout.
+// Zero timeout means no limit.
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{Conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.src, c.dst, c.err = readHeader(c.r)
+	})
+}
+
+// Read reads data following the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address in the header. If the header does not
+// carry addresses, e.g. health checks of the balancer, or it can not be read,
+// it returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address in the header, like RemoteAddr.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// HeaderError returns the error reading the header, if any.
+func (c *Conn) HeaderError() error {
+	c.readHeader()
+	return c.err
+}
+
+func readHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(b) == v1Prefix {
+		return readV1(r)
+	}
+	if bytes.HasPrefix(signature, b) {
+		if b, err = r.Peek(len(signature)); err != nil {
+			return nil, nil, err
+		}
+		if bytes.Equal(b, signature) {
+			return readV2(r)
+		}
+	}
+	return nil, nil, ErrNoHeader
+}
+
+// v1Prefix starts version 1 headers.
+const v1Prefix = "PROXY "
+
+// maxV1Length is the maximum length of a version 1 header including CRLF.
+const maxV1Length = 107
+
+func readV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxyproto: invalid version 1 header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("proxyproto: invalid version 1 header: %q", line)
+	}
+	if src, err = tcpAddr(fields[2], fields[4]); err != nil {
+		return nil, nil, err
+	}
+	if dst, err = tcpAddr(fields[3], fields[5]); err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func tcpAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("proxyproto: invalid address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// Version 2 commands and address families
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famTCP4 = 0x11
+	famUDP4 = 0x12
+	famTCP6 = 0x21
+	famUDP6 = 0x22
+	famUnix = 0x31
+)
+
+func readV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var h [16]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return nil, nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxyproto: unsupported version %d", h[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:16]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch h[12] & 0xf {
+	case cmdLocal:
+		return nil, nil, nil
+	case cmdProxy:
+	default:
+		return nil, nil, fmt.Errorf("proxyproto: unsupported command %d", h[12]&0xf)
+	}
+	// Additional TLVs after the addresses are ignored.
+	switch fam := h[13]; fam {
+	case famTCP4, famUDP4:
+		if len(body) < 12 {
+			return nil, nil, errors.New("proxyproto: short address block")
+		}
+		return inetAddr(fam, body[0:4], body[8:10]), inetAddr(fam, body[4:8], body[10:12]), nil
+	case famTCP6, famUDP6:
+		if len(body) < 36 {
+			return nil, nil, errors.New("proxyproto: short address block")
+		}
+		return inetAddr(fam, body[0:16], body[32:34]), inetAddr(fam, body[16:32], body[34:36]), nil
+	case famUnix:
+		if len(body) < 216 {
+			return nil, nil, errors.New("proxyproto: short address block")
+		}
+		return unixAddr(body[0:108]), unixAddr(body[108:216]), nil
+	}
+	// Unspecified or unknown family, use the real addresses.
+	return nil, nil, nil
+}
+
+func inetAddr(fam byte, ip, port []byte) net.Addr {
+	ip = append(net.IP(nil), ip...)
+	p := int(binary.BigEndian.Uint16(port))
+	if fam == famUDP4 || fam == famUDP6 {
+		return &net.UDPAddr{IP: ip, Port: p}
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+func unixAddr(b []byte) net.Addr {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return &net.UnixAddr{Name: string(b), Net: "unix"}
+}
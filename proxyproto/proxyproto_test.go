@@ -0,0 +1,95 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	var b bytes.Buffer
+	b.Write(signature)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(fam)
+	binary.Write(&b, binary.BigEndian, uint16(len(addrs)))
+	b.Write(addrs)
+	return b.Bytes()
+}
+
+func TestListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	srv := rpc2.NewServer()
+	srv.Handle("addr", func(client *rpc2.Client, args int, reply *string) error {
+		*reply = client.RemoteAddr().String()
+		return nil
+	})
+	go srv.Accept(NewListener(lis))
+
+	tcp4 := []byte{192, 168, 1, 2, 10, 0, 0, 1, 0x30, 0x39, 0x13, 0x88}
+	tcp6 := make([]byte, 36)
+	copy(tcp6, net.ParseIP("2001:db8::1"))
+	copy(tcp6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(tcp6[32:], 443)
+	binary.BigEndian.PutUint16(tcp6[34:], 5000)
+
+	cases := []struct {
+		name   string
+		header []byte
+		addr   string // empty for the address of the connection
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.168.1.2 10.0.0.1 12345 5000\r\n"), "192.168.1.2:12345"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 5000\r\n"), "[2001:db8::1]:443"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", v2Header(cmdProxy, famTCP4, tcp4), "192.168.1.2:12345"},
+		{"v2 tcp6 with tlv", v2Header(cmdProxy, famTCP6, append(tcp6, 0x04, 0x00, 0x01, 0xff)), "[2001:db8::1]:443"},
+		{"v2 local", v2Header(cmdLocal, 0, nil), ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = conn.Write(c.header); err != nil {
+				t.Fatal(err)
+			}
+			clt := rpc2.NewClient(conn)
+			go clt.Run()
+			defer clt.Close()
+			var addr string
+			if err = clt.Call("addr", 0, &addr); err != nil {
+				t.Fatal(err)
+			}
+			want := c.addr
+			if want == "" {
+				want = conn.LocalAddr().String()
+			}
+			if addr != want {
+				t.Fatalf("remote address is %s, want %s", addr, want)
+			}
+		})
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := NewConn(c1, 0)
+	go c2.Write([]byte("GET / HTTP/1.1\r\n"))
+	if err := conn.HeaderError(); err != ErrNoHeader {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != ErrNoHeader {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn.RemoteAddr() != c1.RemoteAddr() {
+		t.Fatal("unexpected remote address")
+	}
+}
@@ -0,0 +1,261 @@
+// Package replay records the messages of an rpc2 connection and plays a
+// recorded peer back, for regression tests against captured traffic and
+// offline debugging.
+//
+// A recording is a stream of JSON encoded frames, one per line. Each frame
+// holds a message header, its body encoded as JSON and the time it was seen:
+//
+//	f, _ := os.Create("session.rec")
+//	clt := rpc2.NewClientWithCodec(replay.NewRecorder(rpc2.NewGobCodec(conn), f))
+//
+// The replayer returns the messages the recorded side received, in order,
+// and discards the messages written to it. An incoming message is not
+// returned before as many messages are written as were written before it in
+// the recording, so a client or server that behaves like the recorded one
+// sees the same conversation:
+//
+//	f, _ := os.Open("session.rec")
+//	codec, _ := replay.NewReplayer(f, false)
+//	clt := rpc2.NewClientWithCodec(codec)
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// Directions of frames
+const (
+	In  = "in"  // read by the recorded side
+	Out = "out" // written by the recorded side
+)
+
+// Frame is a recorded message.
+type Frame struct {
+	Time   time.Duration   `json:"time"` // since the recording started
+	Dir    string          `json:"dir"`  // In or Out
+	Seq    uint64          `json:"seq"`
+	Method string          `json:"method,omitempty"` // empty for responses
+	Error  string          `json:"error,omitempty"`
+	Code   int             `json:"code,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// IsRequest reports whether the frame is a request or notification.
+func (f *Frame) IsRequest() bool {
+	return f.Method != ""
+}
+
+type recorder struct {
+	codec rpc2.Codec
+	start time.Time
+
+	mutex sync.Mutex // protects enc
+	enc   *json.Encoder
+
+	// header of the last message read, recorded with its body
+	in Frame
+}
+
+// NewRecorder returns a codec that records all messages read from and written to codec into w.
+func NewRecorder(codec rpc2.Codec, w io.Writer) rpc2.Codec {
+	return &recorder{
+		codec: codec,
+		start: time.Now(),
+		enc:   json.NewEncoder(w),
+	}
+}
+
+func (r *recorder) record(f *Frame, body interface{}) {
+	if body != nil {
+		// Bodies that can not be encoded are recorded without body.
+		f.Body, _ = json.Marshal(body)
+	}
+	r.mutex.Lock()
+	f.Time = time.Since(r.start)
+	r.enc.Encode(f)
+	r.mutex.Unlock()
+}
+
+func (r *recorder) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	if err := r.codec.ReadHeader(req, resp); err != nil {
+		return err
+	}
+	if req.Method != "" {
+		r.in = Frame{Dir: In, Seq: req.Seq, Method: req.Method}
+	} else {
+		r.in = Frame{Dir: In, Seq: resp.Seq, Error: resp.Error, Code: resp.Code}
+	}
+	return nil
+}
+
+func (r *recorder) ReadRequestBody(x interface{}) error {
+	err := r.codec.ReadRequestBody(x)
+	r.recordIn(x, err)
+	return err
+}
+
+func (r *recorder) ReadResponseBody(x interface{}) error {
+	err := r.codec.ReadResponseBody(x)
+	r.recordIn(x, err)
+	return err
+}
+
+func (r *recorder) recordIn(x interface{}, err error) {
+	if err != nil {
+		x = nil
+	}
+	f := r.in
+	r.record(&f, x)
+}
+
+// Outgoing messages are recorded before they are written,
+// so that they precede the responses they cause in the recording.
+
+func (r *recorder) WriteRequest(req *rpc2.Request, x interface{}) error {
+	r.record(&Frame{Dir: Out, Seq: req.Seq, Method: req.Method}, x)
+	return r.codec.WriteRequest(req, x)
+}
+
+func (r *recorder) WriteResponse(resp *rpc2.Response, x interface{}) error {
+	f := &Frame{Dir: Out, Seq: resp.Seq, Error: resp.Error, Code: resp.Code}
+	body := x
+	if resp.Error != "" {
+		body = nil
+	}
+	r.record(f, body)
+	return r.codec.WriteResponse(resp, x)
+}
+
+func (r *recorder) Close() error {
+	return r.codec.Close()
+}
+
+// ReadFrames reads all frames of a recording.
+func ReadFrames(rd io.Reader) ([]Frame, error) {
+	var frames []Frame
+	dec := json.NewDecoder(bufio.NewReader(rd))
+	for {
+		var f Frame
+		err := dec.Decode(&f)
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+type replayer struct {
+	frames   []Frame // incoming frames
+	writes   []int   // number of writes before each incoming frame
+	realtime bool
+	start    time.Time
+
+	mutex   sync.Mutex
+	cond    *sync.Cond // signaled when written or closed changes
+	written int
+	closed  bool
+
+	// body of the last message read
+	body json.RawMessage
+}
+
+// NewReplayer returns a codec playing back the peer recorded in rd.
+// If realtime is true, incoming messages are also delayed to match the timing of the recording.
+func NewReplayer(rd io.Reader, realtime bool) (rpc2.Codec, error) {
+	frames, err := ReadFrames(rd)
+	if err != nil {
+		return nil, err
+	}
+	r := &replayer{realtime: realtime, start: time.Now()}
+	r.cond = sync.NewCond(&r.mutex)
+	writes := 0
+	for _, f := range frames {
+		if f.Dir == Out {
+			writes++
+			continue
+		}
+		r.frames = append(r.frames, f)
+		r.writes = append(r.writes, writes)
+	}
+	return r, nil
+}
+
+func (r *replayer) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	r.mutex.Lock()
+	for len(r.frames) > 0 && r.written < r.writes[0] && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed || len(r.frames) == 0 {
+		r.mutex.Unlock()
+		return io.EOF
+	}
+	f := r.frames[0]
+	r.frames = r.frames[1:]
+	r.writes = r.writes[1:]
+	r.mutex.Unlock()
+
+	if r.realtime {
+		time.Sleep(time.Until(r.start.Add(f.Time)))
+	}
+	if f.IsRequest() {
+		req.Seq = f.Seq
+		req.Method = f.Method
+	} else {
+		resp.Seq = f.Seq
+		resp.Error = f.Error
+		resp.Code = f.Code
+	}
+	r.body = f.Body
+	return nil
+}
+
+func (r *replayer) ReadRequestBody(x interface{}) error {
+	return r.readBody(x)
+}
+
+func (r *replayer) ReadResponseBody(x interface{}) error {
+	return r.readBody(x)
+}
+
+func (r *replayer) readBody(x interface{}) error {
+	if x == nil || len(r.body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.body, x)
+}
+
+func (r *replayer) WriteRequest(*rpc2.Request, interface{}) error {
+	return r.write()
+}
+
+func (r *replayer) WriteResponse(*rpc2.Response, interface{}) error {
+	return r.write()
+}
+
+func (r *replayer) write() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+	r.written++
+	r.cond.Broadcast()
+	return nil
+}
+
+func (r *replayer) Close() error {
+	r.mutex.Lock()
+	r.closed = true
+	r.cond.Broadcast()
+	r.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,73 @@
+package replay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+type Args struct{ A, B int }
+type Reply int
+
+func TestRecordReplay(t *testing.T) {
+	c1, c2 := net.Pipe()
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *Args, reply *Reply) error {
+		*reply = Reply(args.A + args.B)
+		return nil
+	})
+	go srv.ServeConn(c1)
+
+	var rec bytes.Buffer
+	clt := rpc2.NewClientWithCodec(NewRecorder(rpc2.NewGobCodec(c2), &rec))
+	go clt.Run()
+	var reply Reply
+	if err := clt.Call("add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := clt.Call("add", Args{3, 4}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := clt.Call("sub", Args{3, 4}, &reply); err == nil {
+		t.Fatal("expected error for undefined method")
+	}
+	clt.Close()
+
+	frames, err := ReadFrames(bytes.NewReader(rec.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 6 {
+		t.Fatalf("unexpected number of frames: %d", len(frames))
+	}
+	if f := frames[0]; f.Dir != Out || f.Method != "add" || string(f.Body) != `{"A":1,"B":2}` {
+		t.Fatalf("unexpected frame: %+v", f)
+	}
+
+	// Replay the server against a new client without a connection.
+	codec, err := NewReplayer(bytes.NewReader(rec.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt = rpc2.NewClientWithCodec(codec)
+	go clt.Run()
+	defer clt.Close()
+	if err := clt.Call("add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 3 {
+		t.Fatalf("unexpected reply: %d", reply)
+	}
+	if err := clt.Call("add", Args{3, 4}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 7 {
+		t.Fatalf("unexpected reply: %d", reply)
+	}
+	err = clt.Call("sub", Args{3, 4}, &reply)
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != rpc2.CodeMethodNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
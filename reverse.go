@@ -0,0 +1,58 @@
+package rpc2
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DialAndServe serves connections the server dials itself, for servers that
+// can not accept connections, e.g. devices behind NAT driven by a central
+// service. It dials, serves the connection like ServeConn until it is closed,
+// and dials again after retryDelay, until ctx is done. Dial errors are also
+// retried after retryDelay. DialAndServe closes the connection and returns
+// ctx.Err() when ctx is done.
+//
+// The peer accepting the connections calls the handlers of the server with a
+// client, as if it had dialed:
+//
+//	// On the device
+//	go srv.DialAndServe(ctx, func(ctx context.Context) (net.Conn, error) {
+//		var d net.Dialer
+//		return d.DialContext(ctx, "tcp", "central.example.com:5000")
+//	}, 5*time.Second)
+//
+//	// On the central service
+//	conn, _ := lis.Accept()
+//	clt := rpc2.NewClient(conn)
+//	go clt.Run()
+//	clt.Call("status", nil, &status)
+func (s *Server) DialAndServe(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), retryDelay time.Duration) error {
+	for {
+		conn, err := dial(ctx)
+		if err == nil {
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			s.ServeConn(conn)
+			close(done)
+		} else {
+			debugln("rpc2: dial failed:", err.Error())
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		timer := s.timeSource.NewTimer(retryDelay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -1,7 +1,24 @@
 package rpc2
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -95,4 +112,2454 @@ func TestTCPGOB(t *testing.T) {
 	if err.Error() != "rpc2: can't find method foo" {
 		t.Fatal(err)
 	}
+	if e, ok := err.(*Error); !ok || e.Code != CodeMethodNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	// Test invalid params.
+	err = clt.Call("set", "not a number", &rep)
+	if e, ok := err.(*Error); !ok || e.Code != CodeInvalidParams {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	// Connection must be usable after errors.
+	err = clt.Call("add", Args{1, 2}, &rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test connection addresses.
+	if clt.Conn() != conn {
+		t.Fatal("unexpected conn")
+	}
+	if clt.RemoteAddr().String() != addr {
+		t.Fatalf("unexpected remote addr: %s", clt.RemoteAddr())
+	}
+	if clt.LocalAddr().String() != conn.LocalAddr().String() {
+		t.Fatalf("unexpected local addr: %s", clt.LocalAddr())
+	}
+}
+
+func TestRunError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clt := NewClient(c1)
+	done := make(chan error, 1)
+	go func() { done <- clt.Run() }()
+
+	if err := clt.Err(); err != nil {
+		t.Fatalf("unexpected error before exit: %v", err)
+	}
+	c2.Close()
+	select {
+	case <-clt.Done():
+	case <-time.After(time.Second):
+		t.Fatal("read loop did not exit")
+	}
+	if err := <-done; err != io.EOF {
+		t.Fatalf("unexpected Run error: %v", err)
+	}
+	if err := clt.Err(); err != io.EOF {
+		t.Fatalf("unexpected Err: %v", err)
+	}
+
+	// Closing locally is not an error.
+	c1, c2 = net.Pipe()
+	defer c2.Close()
+	clt = NewClient(c1)
+	go func() { done <- clt.Run() }()
+	clt.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected Run error after Close: %v", err)
+	}
+}
+
+func TestSubscribeDisconnect(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clt := NewClient(c1)
+	w1 := clt.SubscribeDisconnect()
+	w2 := clt.SubscribeDisconnect()
+	go clt.Run()
+	c2.Close()
+
+	for _, w := range []<-chan Disconnect{w1, w2, clt.SubscribeDisconnect()} {
+		select {
+		case d := <-w:
+			if d.Err != io.EOF {
+				t.Fatalf("unexpected error: %v", d.Err)
+			}
+			if d.DisconnectedAt.Before(d.ConnectedAt) {
+				t.Fatal("disconnected before connected")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("did not get disconnect")
+		}
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	type Args struct{ A, B int }
+	type Reply int
+
+	srv := NewServer()
+	srv.Handle("add", func(client *Client, args *Args, reply *Reply) error {
+		var rep Reply
+		if err := client.Call("mult", Args{2, 3}, &rep); err != nil {
+			return err
+		}
+		*reply = Reply(args.A+args.B) + rep
+		return nil
+	})
+	srv.Handle("ping", func(client *Client, reply *string) error {
+		*reply = "pong"
+		return nil
+	})
+
+	clt := NewLoopbackClient(srv)
+	clt.Handle("mult", func(client *Client, args Args, reply *Reply) error {
+		*reply = Reply(args.A * args.B)
+		return nil
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	var rep Reply
+	if err := clt.Call("add", &Args{1, 2}, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep != 9 {
+		t.Fatalf("not expected: %d", rep)
+	}
+
+	var pong string
+	if err := clt.Call("ping", nil, &pong); err != nil {
+		t.Fatal(err)
+	}
+	if pong != "pong" {
+		t.Fatalf("not expected: %s", pong)
+	}
+
+	err := clt.Call("add", "wrong type", &rep)
+	if e, ok := err.(*Error); !ok || e.Code != CodeInvalidParams {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+// expvarRuns makes expvar names unique when tests run more than once.
+var expvarRuns int32
+
+func TestPublishExpvar(t *testing.T) {
+	type Args struct{ A, B int }
+	name := fmt.Sprintf("rpc2test%d", atomic.AddInt32(&expvarRuns, 1))
+
+	srv := NewServer()
+	srv.Handle("add", func(client *Client, args *Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	srv.Alias("sum", "add")
+	srv.PublishExpvar(name)
+
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(c1)
+		close(done)
+	}()
+	clt := NewClient(c2)
+	go clt.Run()
+
+	var reply int
+	if err := clt.Call("add", Args{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := clt.Call("sub", Args{1, 2}, &reply); err == nil {
+		t.Fatal("expected error for undefined method")
+	}
+	reply = 0
+	if err := clt.Call("sum", Args{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("unexpected result of alias: %d, %v", reply, err)
+	}
+	clt.Close()
+	<-done
+
+	var v map[string]int64
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["connections"] != 1 || v["active_connections"] != 0 || v["calls"] != 3 || v["errors"] != 1 || v["alias_calls.sum"] != 1 {
+		t.Fatalf("unexpected counters: %v", v)
+	}
+	if v["bytes_read"] == 0 || v["bytes_written"] == 0 {
+		t.Fatalf("bytes are not counted: %v", v)
+	}
+}
+
+func TestProfilerLabels(t *testing.T) {
+	called := make(chan struct{})
+	release := make(chan struct{})
+	srv := NewServer()
+	srv.SetProfilerLabels(true)
+	srv.Handle("wait", func(client *Client, args int, reply *int) error {
+		close(called)
+		<-release
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	call := clt.Go("wait", 0, new(int), nil)
+	<-called
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	close(release)
+	<-call.Done
+	if !strings.Contains(buf.String(), `"rpc2.method":"wait"`) {
+		t.Fatal("handler goroutine has no method label")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Skip("tracing is already enabled:", err)
+	}
+
+	srv := NewServer()
+	srv.SetTracing(true)
+	srv.Handle("traced", func(client *Client, args int, reply *int) error {
+		*reply = args
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	clt.SetTracing(true)
+	go clt.Run()
+	defer clt.Close()
+
+	err := clt.Call("traced", 1, new(int))
+	trace.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rpc2.handle traced", "rpc2.call traced", "rpc2.handler"} {
+		if !bytes.Contains(buf.Bytes(), []byte(name)) {
+			t.Errorf("trace does not contain %q", name)
+		}
+	}
+}
+
+type testLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Println(v ...interface{}) {
+	l.mutex.Lock()
+	l.lines = append(l.lines, fmt.Sprintln(v...))
+	l.mutex.Unlock()
+}
+
+func (l *testLogger) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return strings.Join(l.lines, "")
+}
+
+func TestSlowThreshold(t *testing.T) {
+	l := &testLogger{}
+	SetLogger(l)
+	defer SetLogger(log.Default())
+
+	srv := NewServer()
+	srv.SetSlowThreshold(10 * time.Millisecond)
+	srv.Handle("sleep", func(client *Client, d time.Duration, reply *int) error {
+		time.Sleep(d)
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	clt.SetSlowThreshold(10 * time.Millisecond)
+	go clt.Run()
+	defer clt.Close()
+
+	if err := clt.Call("sleep", time.Duration(0), new(int)); err != nil {
+		t.Fatal(err)
+	}
+	if s := l.String(); s != "" {
+		t.Fatalf("fast call is logged: %s", s)
+	}
+	if err := clt.Call("sleep", 20*time.Millisecond, new(int)); err != nil {
+		t.Fatal(err)
+	}
+	s := l.String()
+	if !strings.Contains(s, "rpc2: slow handler sleep peer pipe elapsed") || !strings.Contains(s, "rpc2: slow call sleep peer pipe elapsed") {
+		t.Fatalf("unexpected log: %s", s)
+	}
+}
+
+func TestBlockingReentrantCall(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("double", func(client *Client, i int, reply *int) error {
+		*reply = 2 * i
+		return nil
+	})
+	srv.Handle("trigger", func(client *Client, i int, reply *int) error {
+		return client.Call("quadruple", i, reply)
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+
+	var running, overlaps int32
+	clt := NewClient(c2)
+	clt.SetBlocking(true)
+	clt.Handle("quadruple", func(client *Client, i int, reply *int) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		// Calls back to the server while the read loop would be blocked.
+		var r int
+		if err := client.Call("double", i, &r); err != nil {
+			return err
+		}
+		return client.Call("double", r, reply)
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	calls := make([]*Call, 3)
+	for i := range calls {
+		calls[i] = clt.Go("trigger", i+1, new(int), nil)
+	}
+	for i, call := range calls {
+		select {
+		case <-call.Done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlock")
+		}
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		if r := *call.Reply.(*int); r != 4*(i+1) {
+			t.Fatalf("unexpected reply: %d", r)
+		}
+	}
+	if overlaps != 0 {
+		t.Fatal("blocking handlers ran concurrently")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var calls int32
+	srv := NewServer()
+	srv.Handle("limited", func(client *Client, i int, reply *int) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return &Error{Code: CodeRejected, Message: "rate limited", RetryAfter: 10 * time.Millisecond}
+		}
+		*reply = i
+		return nil
+	})
+	srv.Handle("fail", func(client *Client, i int, reply *int) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("failed")
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	// Without a policy, the rejection is returned.
+	err := clt.Call("limited", 1, new(int))
+	if e, ok := err.(*Error); !ok || e.Code != CodeRejected || e.RetryAfter != 10*time.Millisecond {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	clt.SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+	start := time.Now()
+	var reply int
+	if err = clt.Call("limited", 5, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 5 || calls != 3 {
+		t.Fatalf("unexpected reply %d after %d calls", reply, calls)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("retry after delay is not honored")
+	}
+
+	// Other errors are not retried.
+	atomic.StoreInt32(&calls, 0)
+	if err = clt.Call("fail", 1, &reply); err == nil || calls != 1 {
+		t.Fatalf("unexpected result: %v after %d calls", err, calls)
+	}
+}
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	var running, max int32
+	release := make(chan struct{})
+	srv := NewServer()
+	srv.Handle("push", func(client *Client, n int, reply *int) error {
+		calls := make([]*Call, n)
+		for i := range calls {
+			calls[i] = client.Go("work", i, new(int), nil)
+		}
+		close(release)
+		for _, call := range calls {
+			<-call.Done
+			if call.Error != nil {
+				return call.Error
+			}
+		}
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+
+	clt := NewClient(c2)
+	clt.SetMaxConcurrentHandlers(2)
+	clt.Handle("work", func(client *Client, i int, reply *int) error {
+		<-release
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	if err := clt.Call("push", 20, new(int)); err != nil {
+		t.Fatal(err)
+	}
+	if max > 2 {
+		t.Fatalf("%d handlers ran concurrently", max)
+	}
+}
+
+func TestMethodConcurrency(t *testing.T) {
+	var running, max int32
+	work := func(client *Client, i int, reply *int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	hold := make(chan struct{})
+	srv := NewServer()
+	srv.Handle("reindex", work)
+	srv.Handle("refresh", func(client *Client, i int, reply *int) error {
+		atomic.AddInt32(&running, 1)
+		<-hold
+		return nil
+	})
+	srv.SetMethodConcurrency("reindex", 1, QueueExcess)
+	srv.SetMethodConcurrency("refresh", 1, RejectExcess)
+
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		clt := NewClient(c2)
+		go clt.Run()
+		defer clt.Close()
+		clients = append(clients, clt)
+	}
+
+	var calls []*Call
+	for _, clt := range clients {
+		calls = append(calls, clt.Go("reindex", 0, new(int), nil), clt.Go("reindex", 0, new(int), nil))
+	}
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+	if max != 1 {
+		t.Fatalf("%d calls ran concurrently", max)
+	}
+
+	// The first call holds the only slot, so the others are rejected.
+	atomic.StoreInt32(&running, 0)
+	first := clients[0].Go("refresh", 0, new(int), nil)
+	for atomic.LoadInt32(&running) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, clt := range clients[1:] {
+		err := clt.Call("refresh", 0, new(int))
+		if e, ok := err.(*Error); !ok || e.Code != CodeRejected {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	}
+	close(hold)
+	<-first.Done
+	if first.Error != nil {
+		t.Fatal(first.Error)
+	}
+}
+
+func TestNotifyQueue(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clt := NewClient(c1)
+	clt.SetNotifyQueue(2, DropNewest)
+	go clt.Run()
+	defer clt.Close()
+
+	// Nobody reads c2 yet, so the queue fills up.
+	sent := 0
+	for ; sent < 10; sent++ {
+		err := clt.Notify("tick", sent)
+		if err == ErrNotifyQueueFull {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent < 2 || sent > 3 {
+		t.Fatalf("queue full after %d notifications", sent)
+	}
+
+	peer := NewClient(c2)
+	received := make(chan int, 10)
+	peer.Handle("tick", func(client *Client, i int, reply *struct{}) error {
+		received <- i
+		return nil
+	})
+	go peer.Run()
+	defer peer.Close()
+	// Handlers run concurrently, so notifications may be handled in any order.
+	seen := make(map[int]bool)
+	for i := 0; i < sent; i++ {
+		select {
+		case n := <-received:
+			seen[n] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d notifications", i, sent)
+		}
+	}
+	for i := 0; i < sent; i++ {
+		if !seen[i] {
+			t.Fatalf("notification %d is not received", i)
+		}
+	}
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	clt = NewClient(c3)
+	clt.SetNotifyQueue(1, CloseOnOverflow)
+	go clt.Run()
+	for i := 0; i < 10; i++ {
+		if err := clt.Notify("tick", i); err != nil {
+			break
+		}
+	}
+	select {
+	case <-clt.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed on overflow")
+	}
+	if err := clt.Notify("tick", 0); err != ErrShutdown {
+		t.Fatalf("unexpected error after close: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	srv := NewServer()
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	for i := 0; i < 3; i++ {
+		rtt, err := clt.Ping(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Fatalf("invalid rtt: %v", rtt)
+		}
+	}
+	s := clt.RTT()
+	if s.Samples != 3 || s.Last <= 0 || s.Min > s.Mean || s.Mean > s.Max {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	srv := NewServer()
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	clt.SetKeepalive(10*time.Millisecond, time.Second)
+	go clt.Run()
+	defer clt.Close()
+	deadline := time.Now().Add(time.Second)
+	for clt.RTT().Samples < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("keepalives are not sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The peer reads but never responds.
+	c3, c4 := net.Pipe()
+	go io.Copy(io.Discard, c4)
+	defer c4.Close()
+	clt = NewClient(c3)
+	clt.SetKeepalive(10*time.Millisecond, 20*time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- clt.Run() }()
+	select {
+	case err := <-done:
+		if err != ErrKeepaliveTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestSyncClock(t *testing.T) {
+	srv := NewServer()
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	if _, ok := clt.ClockOffset(); ok {
+		t.Fatal("offset is available before sync")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := clt.SyncClock(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both ends share the same clock.
+	offset, ok := clt.ClockOffset()
+	if !ok {
+		t.Fatal("offset is not available")
+	}
+	if offset < -100*time.Millisecond || offset > 100*time.Millisecond {
+		t.Fatalf("unexpected offset: %v", offset)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	type Args struct{ A, B int }
+	type Reply int
+	srv := NewServer()
+	srv.Handle("add", func(client *Client, args *Args, reply *Reply) error {
+		*reply = Reply(args.A + args.B)
+		return nil
+	})
+	srv.SetLimiter(NewTokenBucket(1, 2))
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	var reply Reply
+	for i := 0; i < 2; i++ {
+		if err := clt.Call("add", Args{1, 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := clt.Call("add", Args{1, 2}, &reply)
+	if e, ok := err.(*Error); !ok || e.Code != CodeRejected || e.RetryAfter <= 0 || e.RetryAfter > time.Second {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if err = clt.Call("unknown", 0, &reply); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*Error); !ok || e.Code != CodeRejected {
+		t.Fatalf("unknown methods are not limited: %#v", err)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(1)
+	srv := NewServer()
+	srv.Handle("work", func(client *Client, i int, reply *int) error {
+		if i == 0 {
+			started.Done()
+		}
+		<-release
+		*reply = i
+		return nil
+	})
+	srv.SetMaxConcurrentHandlers(1)
+	srv.SetMaxQueuedRequests(1)
+	var server *Client
+	connected := make(chan struct{})
+	srv.OnConnect(func(c *Client) {
+		server = c
+		close(connected)
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+	<-connected
+
+	first := clt.Go("work", 0, new(int), nil)
+	started.Wait()
+	second := clt.Go("work", 1, new(int), nil)
+	deadline := time.Now().Add(time.Second)
+	for {
+		server.handlerMutex.Lock()
+		queued := len(server.queue)
+		server.handlerMutex.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request is not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err := clt.Call("work", 2, new(int))
+	if e, ok := err.(*Error); !ok || e.Code != CodeOverloaded {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if n := srv.stats.shed.Load(); n != 1 {
+		t.Fatalf("shed count: %d", n)
+	}
+	close(release)
+	for _, call := range []*Call{first, second} {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+
+	srv = NewServer()
+	srv.Handle("noop", func(client *Client, i int, reply *int) error { return nil })
+	srv.SetMemoryBudget(1)
+	c3, c4 := net.Pipe()
+	go srv.ServeConn(c3)
+	clt = NewClient(c4)
+	go clt.Run()
+	defer clt.Close()
+	err = clt.Call("noop", 0, new(int))
+	if e, ok := err.(*Error); !ok || e.Code != CodeOverloaded {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestAcceptAll(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("add", func(client *Client, args []int, reply *int) error {
+		*reply = args[0] + args[1]
+		return nil
+	})
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix, err := net.Listen("unix", t.TempDir()+"/rpc2.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.AcceptAll(tcp, unix)
+		close(done)
+	}()
+
+	for _, lis := range []net.Listener{tcp, unix} {
+		conn, err := net.Dial(lis.Addr().Network(), lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clt := NewClient(conn)
+		go clt.Run()
+		var reply int
+		if err = clt.Call("add", []int{1, 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != 3 {
+			t.Fatalf("unexpected reply: %d", reply)
+		}
+		clt.Close()
+	}
+
+	tcp.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("AcceptAll did not return")
+	}
+	if _, err = net.Dial("unix", unix.Addr().String()); err == nil {
+		t.Fatal("unix listener is not closed")
+	}
+}
+
+func TestConnFilter(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("add", func(client *Client, args []int, reply *int) error {
+		*reply = args[0] + args[1]
+		return nil
+	})
+	var filtered int32
+	srv.SetConnFilter(func(conn net.Conn) error {
+		if atomic.AddInt32(&filtered, 1) > 1 {
+			return errors.New("only one connection is allowed")
+		}
+		return nil
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go srv.Accept(lis)
+
+	dial := func() *Client {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clt := NewClient(conn)
+		go clt.Run()
+		return clt
+	}
+	clt := dial()
+	defer clt.Close()
+	var reply int
+	if err = clt.Call("add", []int{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := dial()
+	defer rejected.Close()
+	if err = rejected.Call("add", []int{1, 2}, &reply); err == nil {
+		t.Fatal("call on rejected connection succeeded")
+	}
+}
+
+func TestLazyClient(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("add", func(client *Client, args []int, reply *int) error {
+		*reply = args[0] + args[1]
+		return nil
+	})
+	var dials int32
+	up := make(chan struct{})
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	clt := NewLazyClient(func() (Codec, error) {
+		atomic.AddInt32(&dials, 1)
+		select {
+		case <-up:
+		default:
+			return nil, errors.New("server is not up")
+		}
+		close(dialing)
+		<-release
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		return NewGobCodec(c2), nil
+	})
+	done := make(chan error, 1)
+	go func() { done <- clt.Run() }()
+
+	if err := clt.Call("add", []int{1, 2}, new(int)); err == nil || err.Error() != "server is not up" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	close(up)
+	var wg, started sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			var reply int
+			if err := clt.Call("add", []int{1, 2}, &reply); err != nil {
+				t.Error(err)
+			} else if reply != 3 {
+				t.Errorf("unexpected reply: %d", reply)
+			}
+		}()
+	}
+	// Callers arriving during the dial wait for it, and later ones find
+	// the client connected, so there is a single successful dial.
+	<-dialing
+	started.Wait()
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("dialed %d times", n)
+	}
+
+	clt.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing before connecting stops Run.
+	clt = NewLazyClient(func() (Codec, error) { return nil, errors.New("unreachable") })
+	go func() { done <- clt.Run() }()
+	clt.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	<-clt.Done()
+	if err := clt.Notify("add", []int{1, 2}); err != ErrShutdown {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The reply of the first call is decoded dynamically,
+	// although the codec is not known before it connects.
+	srv.Handle("info", func(client *Client, args int, reply *map[string]interface{}) error {
+		*reply = map[string]interface{}{"version": 2}
+		return nil
+	})
+	clt = NewLazyClient(func() (Codec, error) {
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		return NewGobCodec(c2), nil
+	})
+	go clt.Run()
+	defer clt.Close()
+	var info interface{}
+	if err := clt.Call("info", 0, &info); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := info.(map[string]interface{}); !ok || m["version"] != 2 {
+		t.Fatalf("unexpected reply: %#v", info)
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("forward", func(ctx context.Context, client *Client, args int, reply *[2]time.Duration) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("no deadline")
+		}
+		reply[0] = time.Until(deadline)
+		return client.CallWithContext(ctx, "remaining", 0, &reply[1])
+	})
+	srv.Handle("noDeadline", func(ctx context.Context, client *Client, reply *bool) error {
+		_, *reply = ctx.Deadline()
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	clt.Handle("remaining", func(ctx context.Context, client *Client, args int, reply *time.Duration) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("no deadline")
+		}
+		*reply = time.Until(deadline)
+		return nil
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var budgets [2]time.Duration
+	if err := clt.CallWithContext(ctx, "forward", 0, &budgets); err != nil {
+		t.Fatal(err)
+	}
+	if budgets[0] <= 500*time.Millisecond || budgets[0] > time.Second {
+		t.Fatalf("unexpected budget in handler: %v", budgets[0])
+	}
+	if budgets[1] <= 0 || budgets[1] > budgets[0] {
+		t.Fatalf("unexpected budget in reverse call: %v (handler had %v)", budgets[1], budgets[0])
+	}
+
+	var hasDeadline bool
+	if err := clt.Call("noDeadline", 0, &hasDeadline); err != nil {
+		t.Fatal(err)
+	}
+	if hasDeadline {
+		t.Fatal("handler has a deadline without one in the call")
+	}
+}
+
+func TestCancelPropagation(t *testing.T) {
+	outerDone := make(chan error, 1)
+	srv := NewServer()
+	srv.Handle("outer", func(ctx context.Context, client *Client, args int, reply *int) error {
+		err := client.CallWithContext(ctx, "inner", 0, reply)
+		outerDone <- err
+		return err
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	innerStarted := make(chan struct{})
+	innerDone := make(chan error, 1)
+	clt.Handle("inner", func(ctx context.Context, client *Client, args int, reply *int) error {
+		close(innerStarted)
+		<-ctx.Done()
+		innerDone <- ctx.Err()
+		return ctx.Err()
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		var reply int
+		errc <- clt.CallWithContext(ctx, "outer", 0, &reply)
+	}()
+	select {
+	case <-innerStarted:
+	case <-time.After(time.Second):
+		t.Fatal("inner handler is not called")
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	for name, ch := range map[string]chan error{"outer": outerDone, "inner": innerDone} {
+		select {
+		case err := <-ch:
+			if err != context.Canceled {
+				t.Fatalf("unexpected error in %s handler: %v", name, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s handler is not canceled", name)
+		}
+	}
+}
+
+func TestRequestContextCancel(t *testing.T) {
+	clt := NewLoopbackClient(NewServer())
+	defer clt.Close()
+	ctx, cancel := clt.requestContext(&Request{Seq: 1, Method: "m", Metadata: map[string]string{CancelKey: "7"}})
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("unexpected error: %v", ctx.Err())
+	}
+	if len(clt.inflight) != 0 {
+		t.Fatal("canceled call is still in flight")
+	}
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	srv := NewServer()
+	srv.Handle("wait", func(ctx context.Context, client *Client, args int, reply *int) error {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	clt.Go("wait", 0, new(int), nil)
+	<-started
+	clt.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context is not canceled on disconnect")
+	}
+}
+
+func TestMetadataPropagation(t *testing.T) {
+	srv := NewServer()
+	srv.SetPropagatedMetadata("trace-id", "tenant")
+	srv.Handle("outer", func(ctx context.Context, client *Client, args int, reply *map[string]string) error {
+		if IncomingMetadata(ctx)["user"] != "alice" {
+			return errors.New("missing incoming metadata")
+		}
+		ctx = WithMetadata(ctx, map[string]string{"tenant": "override"})
+		return client.CallWithContext(ctx, "inner", 0, reply)
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	clt.Handle("inner", func(ctx context.Context, client *Client, args int, reply *map[string]string) error {
+		*reply = make(map[string]string)
+		for k, v := range IncomingMetadata(ctx) {
+			if !strings.HasPrefix(k, "rpc2.") {
+				(*reply)[k] = v
+			}
+		}
+		return nil
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	ctx := WithMetadata(context.Background(), map[string]string{"trace-id": "abc", "tenant": "acme", "user": "alice", TimeoutKey: "1"})
+	var md map[string]string
+	if err := clt.CallWithContext(ctx, "outer", 0, &md); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"trace-id": "abc", "tenant": "override"}
+	if !reflect.DeepEqual(md, want) {
+		t.Fatalf("unexpected metadata in reverse call: %v", md)
+	}
+}
+
+func TestReturnedReply(t *testing.T) {
+	type Reply struct{ Sum int }
+	srv := NewServer()
+	srv.Handle("add", func(client *Client, args [2]int) (Reply, error) {
+		return Reply{args[0] + args[1]}, nil
+	})
+	srv.Handle("ptr", func(ctx context.Context, client *Client, args int) (*Reply, error) {
+		if args == 0 {
+			return nil, nil
+		}
+		return &Reply{args}, nil
+	})
+	srv.Handle("fail", func(client *Client) (int, error) {
+		return 1, errors.New("failed")
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	var r Reply
+	if err := clt.Call("add", [2]int{1, 2}, &r); err != nil || r.Sum != 3 {
+		t.Fatalf("unexpected reply: %v, %v", r, err)
+	}
+	if err := clt.Call("ptr", 4, &r); err != nil || r.Sum != 4 {
+		t.Fatalf("unexpected reply: %v, %v", r, err)
+	}
+	r = Reply{}
+	if err := clt.Call("ptr", 0, &r); err != nil || r.Sum != 0 {
+		t.Fatalf("unexpected reply to nil: %v, %v", r, err)
+	}
+	var n int
+	if err := clt.Call("fail", 0, &n); err == nil || err.Error() != "failed" || n != 0 {
+		t.Fatalf("unexpected result: %v, %v", n, err)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	c1, c2 := net.Pipe()
+	peer := NewGobCodec(c1)
+	go func() {
+		for first := true; ; first = false {
+			var req Request
+			var resp Response
+			if err := peer.ReadHeader(&req, &resp); err != nil {
+				return
+			}
+			var args int
+			peer.ReadRequestBody(&args)
+			if first {
+				// Unknown and duplicate responses are discarded.
+				peer.WriteResponse(&Response{Seq: req.Seq + 100}, -1)
+				peer.WriteResponse(&Response{Seq: req.Seq}, args)
+				peer.WriteResponse(&Response{Seq: req.Seq}, -1)
+			} else {
+				peer.WriteResponse(&Response{Seq: req.Seq}, args)
+			}
+		}
+	}()
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	var reply int
+	if err := clt.Call("echo", 1, &reply); err != nil || reply != 1 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for clt.UnknownResponses() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected number of unknown responses: %d", clt.UnknownResponses())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Sequence numbers of pending calls are skipped after wraparound.
+	clt.mutex.Lock()
+	clt.seq = 1<<64 - 1
+	clt.pending[1] = &Call{Done: make(chan *Call, 1)}
+	clt.mutex.Unlock()
+	for i, want := range []uint64{1<<64 - 1, 2} {
+		call := <-clt.Go("echo", i+2, new(int), nil).Done
+		if call.Error != nil || call.seq != want || *call.Reply.(*int) != i+2 {
+			t.Fatalf("unexpected call: seq %d, reply %d, %v", call.seq, *call.Reply.(*int), call.Error)
+		}
+	}
+}
+
+func TestConcurrentResponses(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("double", func(client *Client, args int) (int, error) {
+		return args * 2, nil
+	})
+	clt := NewLoopbackClient(srv)
+	go clt.Run()
+	defer clt.Close()
+
+	calls := make([]*Call, 500)
+	for i := range calls {
+		calls[i] = clt.Go("double", i, new(int), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil || *call.Reply.(*int) != i*2 {
+			t.Fatalf("unexpected reply to %d: %d, %v", i, *call.Reply.(*int), call.Error)
+		}
+	}
+
+	clt.Close()
+	<-clt.Done()
+	if err := clt.Notify("double", 1); err != ErrShutdown {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// writeCounter counts writes to a connection.
+type writeCounter struct {
+	io.ReadWriteCloser
+	writes atomic.Int64
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	counter := &writeCounter{ReadWriteCloser: c1}
+	clt := NewClient(NewCoalescingConn(counter, 500*time.Millisecond, 1<<20))
+	defer clt.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := clt.Notify("set", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := counter.writes.Load(); n != 0 {
+		t.Fatalf("unexpected number of writes before delay: %d", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for counter.writes.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := counter.writes.Load(); n != 1 {
+		t.Fatalf("unexpected number of writes after delay: %d", n)
+	}
+
+	clt.SetWriteCoalescing(false)
+	if err := clt.Notify("set", 10); err != nil {
+		t.Fatal(err)
+	}
+	if n := counter.writes.Load(); n != 2 {
+		t.Fatalf("unexpected number of writes without coalescing: %d", n)
+	}
+}
+
+func TestCallPooling(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("double", func(client *Client, args int) (int, error) {
+		return args * 2, nil
+	})
+	clt := NewLoopbackClient(srv)
+	go clt.Run()
+	defer clt.Close()
+
+	// Calls returned by Go are not recycled by later calls.
+	call := <-clt.Go("double", 1, new(int), nil).Done
+	for i := 0; i < 100; i++ {
+		var reply int
+		if err := clt.Call("double", i, &reply); err != nil || reply != i*2 {
+			t.Fatalf("unexpected reply to %d: %d, %v", i, reply, err)
+		}
+	}
+	if call.Method != "double" || call.Args != 1 || *call.Reply.(*int) != 2 {
+		t.Fatalf("unexpected call: %+v", call)
+	}
+}
+
+func TestHandleFunc(t *testing.T) {
+	type Args struct{ A, B int }
+
+	srv := NewServer()
+	HandleFunc(srv, "add", func(ctx context.Context, client *Client, args Args) (int, error) {
+		if ctx == nil {
+			return 0, errors.New("no context")
+		}
+		return args.A + args.B, nil
+	})
+	HandleFunc(srv, "fail", func(ctx context.Context, client *Client, args Args) (int, error) {
+		// Gob can not carry details, so they are not sent.
+		return 0, &Error{Code: 7, Message: "failed", Details: []interface{}{struct{ Field string }{"a"}}}
+	})
+	srv.Alias("sum", "add")
+
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	for _, method := range []string{"add", "sum"} {
+		var reply int
+		if err := clt.Call(method, Args{1, 2}, &reply); err != nil || reply != 3 {
+			t.Fatalf("unexpected reply to %s: %d, %v", method, reply, err)
+		}
+	}
+	var reply int
+	if err := clt.Call("fail", Args{}, &reply); err == nil || err.(*Error).Code != 7 || err.(*Error).Details != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := clt.Call("add", "not args", &reply); err == nil || err.(*Error).Code != CodeInvalidParams {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestHoldUntilRun(t *testing.T) {
+	srv := NewServer()
+	number := make(chan int, 1)
+	srv.Handle("set", func(client *Client, i int, _ *struct{}) error {
+		number <- i
+		return nil
+	})
+	srv.Handle("add", func(client *Client, args []int) (int, error) {
+		return args[0] + args[1], nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	counter := &writeCounter{ReadWriteCloser: c2}
+	clt := NewClient(counter)
+	clt.SetHoldUntilRun(true)
+	defer clt.Close()
+
+	if err := clt.Notify("set", 1); err != nil {
+		t.Fatal(err)
+	}
+	call := clt.Go("add", []int{1, 2}, new(int), nil)
+	// Both are queued before Go returns, and nothing writes them.
+	if n := len(clt.writes); n != 2 {
+		t.Fatalf("unexpected number of queued messages: %d", n)
+	}
+	if n := counter.writes.Load(); n != 0 {
+		t.Fatalf("unexpected number of writes before Run: %d", n)
+	}
+
+	go clt.Run()
+	<-call.Done
+	if call.Error != nil || *call.Reply.(*int) != 3 {
+		t.Fatalf("unexpected reply: %d, %v", *call.Reply.(*int), call.Error)
+	}
+	select {
+	case i := <-number:
+		if i != 1 {
+			t.Fatalf("unexpected number: %d", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not get notification")
+	}
+}
+
+// handshakeConn records whether its handshake is done.
+type handshakeConn struct {
+	net.Conn
+	user string
+	done bool
+}
+
+func (c *handshakeConn) Handshake() error {
+	c.done = true
+	return nil
+}
+
+func TestConnectCheck(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("whoami", func(client *Client) (string, error) {
+		user, _ := client.State.Get("user")
+		return user.(string), nil
+	})
+	srv.SetConnectCheck(func(client *Client) error {
+		conn := client.Conn().(*handshakeConn)
+		if !conn.done {
+			return errors.New("handshake is not done")
+		}
+		if conn.user != "alice" {
+			return errors.New("unknown user " + conn.user)
+		}
+		client.State.Set("user", conn.user)
+		return nil
+	})
+	connected := make(chan *Client, 2)
+	srv.OnConnect(func(client *Client) { connected <- client })
+
+	dial := func(user string) *Client {
+		c1, c2 := net.Pipe()
+		go srv.ServeCodec(NewGobCodec(&handshakeConn{Conn: c1, user: user}))
+		clt := NewClient(c2)
+		go clt.Run()
+		return clt
+	}
+	clt := dial("alice")
+	defer clt.Close()
+	var reply string
+	if err := clt.Call("whoami", 0, &reply); err != nil || reply != "alice" {
+		t.Fatalf("unexpected reply: %q, %v", reply, err)
+	}
+
+	rejected := dial("mallory")
+	defer rejected.Close()
+	if err := rejected.Call("whoami", 0, &reply); err == nil {
+		t.Fatal("call on rejected connection succeeded")
+	}
+	if len(connected) != 1 {
+		t.Fatalf("unexpected number of connect events: %d", len(connected))
+	}
+}
+
+func TestDependency(t *testing.T) {
+	type store map[string]int
+
+	srv := NewServer()
+	srv.Handle("get", func(client *Client, key string) (int, error) {
+		s, ok := client.Dependency("store").(store)
+		if !ok {
+			return 0, errors.New("no store")
+		}
+		return s[key], nil
+	})
+	clt := NewLoopbackClient(srv)
+	go clt.Run()
+	defer clt.Close()
+
+	var reply int
+	if err := clt.Call("get", "a", &reply); err == nil || err.Error() != "no store" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv.SetDependency("store", store{"a": 1})
+	if err := clt.Call("get", "a", &reply); err != nil || reply != 1 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	if clt.Dependency("store") != nil {
+		t.Fatal("dependencies of the server are visible to its peer")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("register", func(client *Client, tags map[string]string, _ *struct{}) error {
+		for k, v := range tags {
+			srv.Tag(client, k, v)
+		}
+		return nil
+	})
+	var clients []*Client
+	for _, tags := range []map[string]string{
+		{"role": "camera", "zone": "3"},
+		{"role": "camera", "zone": "4"},
+		{"role": "sensor", "zone": "3"},
+	} {
+		clt := NewLoopbackClient(srv)
+		go clt.Run()
+		defer clt.Close()
+		if err := clt.Call("register", tags, nil); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, clt)
+	}
+
+	if n := len(srv.Clients()); n != 3 {
+		t.Fatalf("unexpected number of clients: %d", n)
+	}
+	selected := srv.Select(map[string]string{"role": "camera", "zone": "3"})
+	if len(selected) != 1 {
+		t.Fatalf("unexpected number of selected clients: %d", len(selected))
+	}
+	srv.Untag(selected[0], "zone")
+	if n := len(srv.Select(map[string]string{"zone": "3"})); n != 1 {
+		t.Fatalf("unexpected number of selected clients after untag: %d", n)
+	}
+
+	// Disconnected clients are not selected.
+	clients[2].Close()
+	deadline := time.Now().Add(time.Second)
+	for len(srv.Select(map[string]string{"zone": "3"})) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("disconnected client is selected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIsAlive(t *testing.T) {
+	srv := NewServer()
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	clt.SetKeepalive(10*time.Millisecond, time.Second)
+	if !clt.LastActivity().IsZero() {
+		t.Fatal("unexpected activity before Run")
+	}
+	go clt.Run()
+	deadline := time.Now().Add(time.Second)
+	for clt.LastActivity().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("no activity")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !clt.IsAlive() {
+		t.Fatal("client is not alive")
+	}
+	clt.Close()
+	<-clt.Done()
+	if clt.IsAlive() {
+		t.Fatal("closed client is alive")
+	}
+}
+
+func TestDeduplicationRetryAfterCancel(t *testing.T) {
+	srv := NewServer()
+	var count int32
+	started := make(chan struct{}, 1)
+	srv.Handle("increment", func(ctx context.Context, client *Client, args bool, reply *int32) error {
+		n := atomic.AddInt32(&count, 1)
+		if args {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		*reply = n
+		return nil
+	})
+	srv.SetDeduplication(time.Minute, nil)
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	ctx := WithIdempotencyKey(context.Background(), "a")
+	cctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- clt.CallWithContext(cctx, "increment", true, new(int32)) }()
+	<-started
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The retry is handled although the first call has the same key.
+	var reply int32
+	if err := clt.CallWithContext(ctx, "increment", false, &reply); err != nil || reply != 2 {
+		t.Fatalf("unexpected reply to retry: %d, %v", reply, err)
+	}
+}
+
+// UUID has no exported fields, so gob can not encode it.
+type UUID struct{ hi, lo uint64 }
+
+func TestRegisterMarshaler(t *testing.T) {
+	RegisterMarshaler(
+		func(u UUID) (string, error) { return fmt.Sprintf("%016x%016x", u.hi, u.lo), nil },
+		func(s string) (u UUID, err error) {
+			_, err = fmt.Sscanf(s, "%016x%016x", &u.hi, &u.lo)
+			return
+		},
+	)
+
+	srv := NewServer()
+	srv.Handle("next", func(client *Client, id UUID, reply *UUID) error {
+		*reply = UUID{id.hi, id.lo + 1}
+		return nil
+	})
+	HandleFunc(srv, "prev", func(ctx context.Context, client *Client, id *UUID) (UUID, error) {
+		return UUID{id.hi, id.lo - 1}, nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	var reply UUID
+	if err := clt.Call("next", UUID{1, 2}, &reply); err != nil || reply != (UUID{1, 3}) {
+		t.Fatalf("unexpected reply: %v, %v", reply, err)
+	}
+	if err := clt.Call("prev", &UUID{1, 2}, &reply); err != nil || reply != (UUID{1, 1}) {
+		t.Fatalf("unexpected reply: %v, %v", reply, err)
+	}
+}
+
+func TestDynamicReply(t *testing.T) {
+	type Level int
+	type Item struct {
+		Name  string
+		Level Level
+		Tags  []string
+		at    time.Time
+	}
+	srv := NewServer()
+	srv.Handle("item", func(client *Client, args int, reply *Item) error {
+		*reply = Item{Name: "a", Level: Level(args), Tags: []string{"x", "y"}}
+		return nil
+	})
+	srv.Handle("items", func(client *Client, args int, reply *map[string]Item) error {
+		*reply = map[string]Item{"a": {Name: "a", Level: Level(args)}}
+		return nil
+	})
+	want := map[string]interface{}{"Name": "a", "Level": 2, "Tags": []interface{}{"x", "y"}}
+
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+	loopback := NewLoopbackClient(srv)
+	go loopback.Run()
+	defer loopback.Close()
+
+	for name, clt := range map[string]*Client{"gob": clt, "loopback": loopback} {
+		var m map[string]interface{}
+		if err := clt.Call("item", 2, &m); err != nil || !reflect.DeepEqual(m, want) {
+			t.Fatalf("%s: unexpected reply: %#v, %v", name, m, err)
+		}
+		var v interface{}
+		if err := clt.Call("items", 2, &v); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if l := v.(map[string]interface{})["a"].(map[string]interface{})["Level"]; l != 2 {
+			t.Fatalf("%s: unexpected reply: %#v", name, v)
+		}
+		// Typed replies are not affected.
+		var item Item
+		if err := clt.Call("item", 3, &item); err != nil || item.Level != 3 {
+			t.Fatalf("%s: unexpected reply: %#v, %v", name, item, err)
+		}
+	}
+}
+
+func TestIncomingCall(t *testing.T) {
+	infos := make(chan CallInfo, 2)
+	srv := NewServer()
+	srv.Handle("user.get", func(ctx context.Context, client *Client, args int, reply *int) error {
+		info, ok := IncomingCall(ctx)
+		if !ok {
+			t.Error("no call info")
+		}
+		infos <- info
+		return nil
+	})
+	srv.Alias("getUser", "user.get")
+	clt := NewLoopbackClient(srv)
+	go clt.Run()
+	defer clt.Close()
+
+	for _, method := range []string{"user.get", "getUser"} {
+		if err := clt.Call(method, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		info := <-infos
+		if info.Method != method || info.Handler != "user.get" || info.Seq == 0 {
+			t.Fatalf("unexpected call info: %+v", info)
+		}
+	}
+	if _, ok := IncomingCall(context.Background()); ok {
+		t.Fatal("call info without a call")
+	}
+}
+
+func TestHandlePattern(t *testing.T) {
+	srv := NewServer()
+	handle := func(ctx context.Context, client *Client, args int, reply *string) error {
+		info, _ := IncomingCall(ctx)
+		*reply = info.Handler + " " + strings.Join(info.Params, ",")
+		return nil
+	}
+	srv.Handle("device.0.status", handle)
+	srv.HandlePattern("device.*.status", handle)
+	srv.HandlePattern("tenant.*.**", handle)
+	clt := NewLoopbackClient(srv)
+	go clt.Run()
+	defer clt.Close()
+
+	for method, want := range map[string]string{
+		"device.0.status":    "device.0.status ",
+		"device.42.status":   "device.*.status 42",
+		"tenant.a.user.get":  "tenant.*.** a,user.get",
+		"tenant.b.list":      "tenant.*.** b,list",
+		"device.42.status.x": "",
+		"device..status":     "",
+		"tenant.a":           "",
+	} {
+		var reply string
+		err := clt.Call(method, 1, &reply)
+		if want == "" {
+			var e *Error
+			if !errors.As(err, &e) || e.Code != CodeMethodNotFound {
+				t.Fatalf("%s: unexpected error: %v", method, err)
+			}
+			continue
+		}
+		if err != nil || reply != want {
+			t.Fatalf("%s: unexpected reply: %q, %v", method, reply, err)
+		}
+	}
+}
+
+func TestDialAndServe(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	srv := NewServer()
+	srv.Handle("status", func(client *Client, args int, reply *string) error {
+		*reply = "ok"
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.DialAndServe(ctx, func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", lis.Addr().String())
+		}, 10*time.Millisecond)
+	}()
+
+	// The server dials again after the connection is closed.
+	for i := 0; i < 2; i++ {
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clt := NewClient(conn)
+		go clt.Run()
+		var reply string
+		if err := clt.Call("status", 0, &reply); err != nil || reply != "ok" {
+			t.Fatalf("unexpected reply: %q, %v", reply, err)
+		}
+		clt.Close()
+	}
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DialAndServe did not return")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	type Args struct{ A, B int }
+	type Reply int
+	srv := NewServer()
+	srv.SetDrainNotification(true)
+	srv.Handle("add", func(client *Client, args *Args, reply *Reply) error {
+		*reply = Reply(args.A + args.B)
+		return nil
+	})
+	blocked := make(chan struct{})
+	srv.Handle("block", func(ctx context.Context, client *Client, args int, reply *int) error {
+		go client.Call("hang", 0, new(int))
+		close(blocked)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// A well-behaved client disconnects when notified.
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	deadlines := make(chan time.Time, 1)
+	clt.OnDrain(func(deadline time.Time) {
+		deadlines <- deadline
+		clt.Close()
+	})
+	go clt.Run()
+	// Another one does not.
+	c3, c4 := net.Pipe()
+	go srv.ServeConn(c3)
+	stubborn := NewClient(c4)
+	hang := make(chan struct{})
+	defer close(hang)
+	stubborn.Handle("hang", func(client *Client, args int, reply *int) error {
+		<-hang
+		return nil
+	})
+	go stubborn.Run()
+
+	var reply Reply
+	for _, c := range []*Client{clt, stubborn} {
+		if err := c.Call("add", Args{1, 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	stubborn.Go("block", 0, new(int), nil)
+	<-blocked
+	type result struct {
+		report ShutdownReport
+		err    error
+	}
+	shutdown := make(chan result, 1)
+	go func() {
+		report, err := srv.Shutdown(ctx)
+		shutdown <- result{report, err}
+	}()
+
+	// The drain notification is sent after the server starts draining.
+	select {
+	case d := <-deadlines:
+		if d.IsZero() || time.Until(d) > 500*time.Millisecond {
+			t.Fatalf("unexpected deadline: %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain notification is not received")
+	}
+
+	// Calls arriving while draining are rejected, except built-in ones.
+	err := stubborn.Call("add", Args{1, 2}, &reply)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeShuttingDown {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := stubborn.Ping(context.Background()); err != nil {
+		t.Fatalf("unexpected error from ping: %v", err)
+	}
+
+	res := <-shutdown
+	if res.err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+	want := ShutdownReport{
+		InterruptedHandlers: map[string]int{"block": 1},
+		AbortedCalls:        map[string]int{"hang": 1},
+		ClosedConnections:   1,
+	}
+	if !reflect.DeepEqual(res.report, want) {
+		t.Fatalf("unexpected report: %+v", res.report)
+	}
+	select {
+	case <-stubborn.DisconnectNotify():
+	case <-time.After(time.Second):
+		t.Fatal("remaining client is not disconnected")
+	}
+
+	// New connections are not served.
+	c5, c6 := net.Pipe()
+	go srv.ServeConn(c5)
+	late := NewClient(c6)
+	go late.Run()
+	if err := late.Call("add", Args{1, 2}, &reply); err == nil {
+		t.Fatal("connection is served after shutdown")
+	}
+	if report, err := srv.Shutdown(context.Background()); err != nil || !reflect.DeepEqual(report, ShutdownReport{}) {
+		t.Fatalf("unexpected result of second shutdown: %+v, %v", report, err)
+	}
+}
+
+func TestCallHedged(t *testing.T) {
+	canceled := make(chan struct{})
+	slow := NewServer()
+	slow.Handle("get", func(ctx context.Context, client *Client, args int, reply *string) error {
+		select {
+		case <-ctx.Done():
+			close(canceled)
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			*reply = "slow"
+			return nil
+		}
+	})
+	failing := NewServer()
+	failing.Handle("get", func(client *Client, args int, reply *string) error {
+		return errors.New("failed")
+	})
+	fast := NewServer()
+	fast.Handle("get", func(client *Client, args int, reply *string) error {
+		*reply = "fast"
+		return nil
+	})
+	clients := make(map[*Server]*Client)
+	for _, srv := range []*Server{slow, failing, fast} {
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		clt := NewClient(c2)
+		go clt.Run()
+		defer clt.Close()
+		clients[srv] = clt
+	}
+
+	var reply string
+	start := time.Now()
+	err := CallHedged(context.Background(), []*Client{clients[slow], clients[failing], clients[fast]}, 50*time.Millisecond, "get", 0, &reply)
+	if err != nil || reply != "fast" {
+		t.Fatalf("unexpected reply: %q, %v", reply, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("call is not hedged")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("slow call is not canceled")
+	}
+
+	err = CallHedged(context.Background(), []*Client{clients[failing]}, time.Second, "get", 0, &reply)
+	if err == nil || err.Error() != "failed" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = CallHedged(context.Background(), nil, time.Second, "get", 0, &reply); err != ErrNoClients {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCallHedgedAfterFailure(t *testing.T) {
+	started := make(chan time.Time, 2)
+	failing := NewServer()
+	failing.Handle("get", func(client *Client, args int, reply *string) error {
+		time.Sleep(150 * time.Millisecond)
+		return errors.New("failed")
+	})
+	slow := NewServer()
+	slow.Handle("get", func(ctx context.Context, client *Client, args int, reply *string) error {
+		started <- time.Now()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	fast := NewServer()
+	fast.Handle("get", func(client *Client, args int, reply *string) error {
+		started <- time.Now()
+		*reply = "fast"
+		return nil
+	})
+	var clients []*Client
+	for _, srv := range []*Server{failing, slow, fast} {
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		clt := NewClient(c2)
+		go clt.Run()
+		defer clt.Close()
+		clients = append(clients, clt)
+	}
+
+	// The call started after the failure is hedged after the full delay.
+	var reply string
+	if err := CallHedged(context.Background(), clients, 200*time.Millisecond, "get", 0, &reply); err != nil || reply != "fast" {
+		t.Fatalf("unexpected reply: %q, %v", reply, err)
+	}
+	slowStart, fastStart := <-started, <-started
+	if d := fastStart.Sub(slowStart); d < 150*time.Millisecond {
+		t.Fatalf("call is hedged %v after the previous one", d)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		i := i
+		srv := NewServer()
+		srv.Handle("id", func(ctx context.Context, client *Client, args int, reply *int) error {
+			if i == 2 {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			*reply = i * args
+			return nil
+		})
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		clt := NewClient(c2)
+		go clt.Run()
+		defer clt.Close()
+		clients = append(clients, clt)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results := Fanout(ctx, clients, "id", 10, new(int))
+	for i, r := range results {
+		if r.Client != clients[i] {
+			t.Fatalf("result %d is of another client", i)
+		}
+		if i == 2 {
+			// The deadline expires on either side first.
+			if r.Err == nil || r.Err.Error() != context.DeadlineExceeded.Error() {
+				t.Fatalf("unexpected error: %v", r.Err)
+			}
+			continue
+		}
+		if r.Err != nil || *r.Reply.(*int) != i*10 {
+			t.Fatalf("unexpected result %d: %v, %v", i, r.Reply, r.Err)
+		}
+	}
+}
+
+func TestCallAll(t *testing.T) {
+	srv := NewServer()
+	connected := make(chan *Client, 3)
+	srv.OnConnect(func(c *Client) { connected <- c })
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		i := i
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		clt := NewClient(c2)
+		clt.Handle("load", func(client *Client, args int, reply *int) error {
+			*reply = i + args
+			return nil
+		})
+		go clt.Run()
+		defer clt.Close()
+		clients = append(clients, clt)
+	}
+	var peers []*Client
+	for i := 0; i < 3; i++ {
+		peers = append(peers, <-connected)
+	}
+	srv.Tag(peers[0], "role", "worker")
+	srv.Tag(peers[1], "role", "worker")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	results := srv.CallAll(ctx, map[string]string{"role": "worker"}, "load", 10, new(int))
+	if len(results) != 2 {
+		t.Fatalf("unexpected number of results: %d", len(results))
+	}
+	for _, p := range peers[:2] {
+		r, ok := results[p]
+		if !ok || r.Err != nil || *r.Reply.(*int) < 10 {
+			t.Fatalf("unexpected result: %+v", r)
+		}
+	}
+	if results := srv.CallAll(ctx, nil, "load", 10, new(int)); len(results) != 3 {
+		t.Fatalf("unexpected number of results: %d", len(results))
+	}
+}
+
+func TestCallAny(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("register", func(client *Client, capacity int, reply *int) error {
+		srv.SetWeight(client, capacity)
+		srv.Tag(client, "capacity", strconv.Itoa(capacity))
+		return nil
+	})
+	capacities := []int{1, 3, 0}
+	calls := make([]atomic.Int64, len(capacities))
+	for i, capacity := range capacities {
+		i := i
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		clt := NewClient(c2)
+		clt.Handle("job", func(client *Client, args int, reply *int) error {
+			calls[i].Add(1)
+			return nil
+		})
+		go clt.Run()
+		defer clt.Close()
+		if err := clt.Call("register", capacity, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 40; i++ {
+		if err := srv.CallAny(context.Background(), nil, "job", 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls[0].Load() != 10 || calls[1].Load() != 30 || calls[2].Load() != 0 {
+		t.Fatalf("unexpected distribution: %d, %d, %d", calls[0].Load(), calls[1].Load(), calls[2].Load())
+	}
+	err := srv.CallAny(context.Background(), map[string]string{"capacity": "0"}, "job", 0, nil)
+	if err != ErrNoClients {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// methodRecorder records the methods of the requests written with a codec.
+type methodRecorder struct {
+	Codec
+	mutex   sync.Mutex
+	methods []string
+}
+
+func (c *methodRecorder) WriteRequest(r *Request, body interface{}) error {
+	c.mutex.Lock()
+	c.methods = append(c.methods, r.Method)
+	c.mutex.Unlock()
+	return c.Codec.WriteRequest(r, body)
+}
+
+func TestControlLane(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("data", func(client *Client, i int, _ *struct{}) error {
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	codec := &methodRecorder{Codec: NewGobCodec(c2)}
+	clt := NewClientWithCodec(codec)
+	clt.SetHoldUntilRun(true)
+	defer clt.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := clt.Notify("data", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call := clt.Go(EchoMethod, int64(1), new(int64), nil)
+	if len(clt.writes) != 3 || len(clt.control) != 1 {
+		t.Fatalf("unexpected queues: %d, %d", len(clt.writes), len(clt.control))
+	}
+
+	go clt.Run()
+	<-call.Done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	codec.mutex.Lock()
+	defer codec.mutex.Unlock()
+	if len(codec.methods) == 0 || codec.methods[0] != EchoMethod {
+		t.Fatalf("unexpected order of requests: %v", codec.methods)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("size", func(ctx context.Context, client *Client, i int, reply *int) error {
+		r, err := OpenAttachment(ctx, i)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(r)
+		*reply = len(b)
+		return err
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	blob := bytes.Repeat([]byte{0xff}, 1000)
+	ctx := WithAttachments(context.Background(), []byte("header"), blob)
+	var size int
+	if err := clt.CallWithContext(ctx, "size", 1, &size); err != nil {
+		t.Fatal(err)
+	}
+	if size != len(blob) {
+		t.Fatalf("unexpected size: %d", size)
+	}
+	err := clt.CallWithContext(ctx, "size", 2, &size)
+	if e, ok := err.(*Error); !ok || e.Code != CodeInvalidParams {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	err = clt.Call("size", 0, &size)
+	if e, ok := err.(*Error); !ok || e.Code != CodeInvalidParams {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+// QueryV1 and QueryV2 are versions of the same args, as gob sees them.
+type QueryV1 struct {
+	Term string
+}
+
+type QueryV2 struct {
+	Term  string
+	Limit int
+}
+
+func (q *QueryV2) SetDefaults() { q.Limit = 100 }
+
+func TestSchemaEvolution(t *testing.T) {
+	srv := NewServer()
+	srv.SetSchemaVersion(2, 1)
+	srv.Handle("search", func(client *Client, q QueryV2, reply *int) error {
+		*reply = q.Limit
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	clt.SetSchemaVersion(1, 1)
+	go clt.Run()
+	defer clt.Close()
+
+	peer, err := clt.NegotiateVersion(context.Background())
+	if err != nil || peer != 2 {
+		t.Fatalf("unexpected version: %d, %v", peer, err)
+	}
+	if v, ok := clt.PeerVersion(); !ok || v != 2 {
+		t.Fatalf("unexpected peer version: %d, %v", v, ok)
+	}
+	var limit int
+	if err = clt.Call("search", QueryV1{Term: "a"}, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if limit != 100 {
+		t.Fatalf("unexpected limit: %d", limit)
+	}
+	if err = clt.Call("search", QueryV2{Term: "a", Limit: 5}, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if limit != 5 {
+		t.Fatalf("unexpected limit: %d", limit)
+	}
+
+	c3, c4 := net.Pipe()
+	go srv.ServeConn(c3)
+	old := NewClient(c4)
+	go old.Run()
+	defer old.Close()
+	_, err = old.NegotiateVersion(context.Background())
+	if e, ok := err.(*Error); !ok || e.Code != CodeIncompatible {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestCaseInsensitiveMethods(t *testing.T) {
+	srv := NewServer()
+	srv.SetCaseInsensitiveMethods(true)
+	srv.Handle("GetUser", func(ctx context.Context, client *Client, id int, reply *string) error {
+		info, _ := IncomingCall(ctx)
+		*reply = info.Method
+		return nil
+	})
+	srv.Alias("FetchUser", "GetUser")
+	HandleFunc(srv, "CountUsers", func(ctx context.Context, client *Client, args int) (int, error) {
+		return 1, nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	for _, method := range []string{"GetUser", "getUser", "GETUSER"} {
+		var name string
+		if err := clt.Call(method, 1, &name); err != nil {
+			t.Fatal(err)
+		}
+		if name != "GetUser" {
+			t.Fatalf("unexpected method name: %s", name)
+		}
+	}
+	err := clt.Call("get_user", 1, new(string))
+	if e, ok := err.(*Error); !ok || e.Code != CodeMethodNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	var name string
+	if err = clt.Call("fetchUser", 1, &name); err != nil || name != "FetchUser" {
+		t.Fatalf("unexpected reply to alias: %s, %v", name, err)
+	}
+	var n int
+	if err = clt.Call("countusers", 0, &n); err != nil || n != 1 {
+		t.Fatalf("unexpected reply: %d, %v", n, err)
+	}
+	var rtt int64
+	if err = clt.Call("RPC.Echo", int64(1), &rtt); err != nil || rtt != 1 {
+		t.Fatalf("unexpected reply: %d, %v", rtt, err)
+	}
+}
+
+func TestReservedMethods(t *testing.T) {
+	srv := NewServer()
+	for name, register := range map[string]func(){
+		"Handle": func() { srv.Handle("rpc.list", func(client *Client, reply *[]string) error { return nil }) },
+		"Alias": func() {
+			srv.Handle("list", func(client *Client, reply *[]string) error { return nil })
+			srv.Alias("rpc.list", "list")
+		},
+		"HandlePattern": func() { srv.HandlePattern("rpc.*", func(client *Client, reply *[]string) error { return nil }) },
+		"HandleFunc": func() {
+			HandleFunc(srv, "rpc.list", func(ctx context.Context, client *Client, args int) ([]string, error) { return nil, nil })
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+
+	srv.HandlePattern("**", func(client *Client, args int, reply *int) error {
+		*reply = args
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	var reply int
+	if err := clt.Call("anything", 1, &reply); err != nil || reply != 1 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	err := clt.Call("rpc.unknown", 1, &reply)
+	if e, ok := err.(*Error); !ok || e.Code != CodeMethodNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	srv := NewServer()
+	started := make(chan *Client, 1)
+	release := make(chan struct{})
+	srv.Handle("work", func(client *Client, args int, reply *int) error {
+		started <- client
+		<-release
+		return nil
+	})
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := NewClient(c2)
+	go clt.Run()
+
+	clt.Go("work", 1, new(int), nil)
+	peer := <-started
+	clt.Close()
+
+	waited := make(chan struct{}, 2)
+	go func() {
+		srv.Wait()
+		waited <- struct{}{}
+	}()
+	go func() {
+		peer.Wait()
+		waited <- struct{}{}
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while the handler is running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-waited:
+		case <-time.After(time.Second):
+			t.Fatal("Wait did not return")
+		}
+	}
+	srv.Wait()
+}
+
+func TestHealthHandlers(t *testing.T) {
+	srv := NewServer()
+	srv.Handle("fail", func(client *Client, args int, reply *int) error {
+		return errors.New("failed")
+	})
+
+	get := func(h http.Handler) (int, Health) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		var health Health
+		if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, health
+	}
+	waitListeners := func(n int64) {
+		for deadline := time.Now().Add(time.Second); srv.Health().Listeners != n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected listeners: %d", srv.Health().Listeners)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if code, health := get(srv.ReadinessHandler()); code != http.StatusServiceUnavailable || health.Ready {
+		t.Fatalf("ready before accepting: %d, %+v", code, health)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Accept(lis)
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt := NewClient(conn)
+	go clt.Run()
+	defer clt.Close()
+	clt.Call("fail", 1, new(int))
+	var echo int64
+	if err := clt.Call(EchoMethod, int64(1), &echo); err != nil {
+		t.Fatal(err)
+	}
+	waitListeners(1)
+
+	want := Health{Ready: true, Listeners: 1, ActiveConnections: 1, Calls: 2, Errors: 1, ErrorRate: 0.5}
+	for _, h := range []http.Handler{srv.LivenessHandler(), srv.ReadinessHandler()} {
+		if code, health := get(h); code != http.StatusOK || health != want {
+			t.Fatalf("unexpected response: %d, %+v", code, health)
+		}
+	}
+
+	// Not ready when the listener is closed.
+	lis.Close()
+	waitListeners(0)
+	if code, health := get(srv.ReadinessHandler()); code != http.StatusServiceUnavailable || health.Ready {
+		t.Fatalf("ready after listener is closed: %d, %+v", code, health)
+	}
+
+	// Not ready when draining, although accepting.
+	lis, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go srv.Accept(lis)
+	waitListeners(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.Shutdown(ctx)
+	if code, health := get(srv.ReadinessHandler()); code != http.StatusServiceUnavailable || health.Ready || !health.Draining {
+		t.Fatalf("unexpected response: %d, %+v", code, health)
+	}
+	if code, _ := get(srv.LivenessHandler()); code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", code)
+	}
 }
@@ -0,0 +1,108 @@
+package rpc2mock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// Clock is a fake rpc2.Clock. Time stands still until Advance is called,
+// so tests of keepalives, retries and deduplication windows run without sleeping:
+//
+//	clock := rpc2mock.NewClock(time.Now())
+//	clt.SetClock(clock)
+//	clt.SetKeepalive(time.Minute, 10*time.Second)
+//	clock.Advance(time.Minute) // sends a keepalive
+type Clock struct {
+	mutex  sync.Mutex // protects now, timers
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewClock returns a fake clock showing now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+type fakeTimer struct {
+	clock  *Clock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration // of tickers, zero for timers
+	active bool
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer firing when the clock is advanced by d.
+func (c *Clock) NewTimer(d time.Duration) rpc2.Timer {
+	return c.add(d, 0)
+}
+
+// NewTicker returns a ticker firing every time the clock is advanced by d.
+func (c *Clock) NewTicker(d time.Duration) rpc2.Ticker {
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *Clock) add(d, period time.Duration) *fakeTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), when: c.now.Add(d), period: period, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers and tickers due.
+// Like time.Ticker, tickers drop ticks if their channel is full.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			select {
+			case t.c <- c.now:
+			default:
+			}
+			if t.period > 0 {
+				for !t.when.After(c.now) {
+					t.when = t.when.Add(t.period)
+				}
+			} else {
+				t.active = false
+			}
+		}
+		if t.active {
+			active = append(active, t)
+		}
+	}
+	for i := len(active); i < len(c.timers); i++ {
+		c.timers[i] = nil
+	}
+	c.timers = active
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
@@ -0,0 +1,273 @@
+package rpc2mock
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+func TestClock(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	timer := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(time.Second)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	case <-ticker.C():
+		t.Fatal("ticker fired early")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if now := <-timer.C(); !now.Equal(time.Unix(1, 0)) {
+		t.Fatalf("unexpected time: %v", now)
+	}
+	<-ticker.C()
+	ticker.Stop()
+	clock.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("stopped ticker fired")
+	default:
+	}
+}
+
+func TestKeepaliveClock(t *testing.T) {
+	// The peer reads but never responds.
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	defer c2.Close()
+	clock := NewClock(time.Now())
+	clt := rpc2.NewClient(c1)
+	clt.SetClock(clock)
+	clt.SetKeepalive(time.Minute, 10*time.Second)
+	done := make(chan error, 1)
+	go func() { done <- clt.Run() }()
+
+	// Advance until the keepalive is sent and times out.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			if err != rpc2.ErrKeepaliveTimeout {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection is not closed")
+		}
+		clock.Advance(5 * time.Second)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRateLimitClock(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("ping", func(client *rpc2.Client, args int, reply *int) error { return nil })
+	srv.SetLimiter(rpc2.NewTokenBucket(1, 1))
+	clock := NewClock(time.Now())
+	srv.SetClock(clock)
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := rpc2.NewClient(c2)
+	go clt.Run()
+	defer clt.Close()
+
+	if err := clt.Call("ping", 0, new(int)); err != nil {
+		t.Fatal(err)
+	}
+	err := clt.Call("ping", 0, new(int))
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != rpc2.CodeRejected || e.RetryAfter != time.Second {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := clt.Call("ping", 0, new(int)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncClock(t *testing.T) {
+	now := time.Now()
+	srv := rpc2.NewServer()
+	srv.SetClock(NewClock(now.Add(time.Hour)))
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	clt := rpc2.NewClient(c2)
+	clt.SetClock(NewClock(now))
+	go clt.Run()
+	defer clt.Close()
+
+	offset, err := clt.SyncClock(context.Background())
+	if err != nil || offset != time.Hour {
+		t.Fatalf("unexpected offset: %v, %v", offset, err)
+	}
+}
+
+func TestKeepaliveUnsupported(t *testing.T) {
+	// The peer has no built-in methods and responds without error codes.
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	pings := make(chan struct{}, 10)
+	go func() {
+		codec := rpc2.NewGobCodec(c2)
+		for {
+			var req rpc2.Request
+			if err := codec.ReadHeader(&req, new(rpc2.Response)); err != nil {
+				return
+			}
+			if err := codec.ReadRequestBody(nil); err != nil {
+				return
+			}
+			pings <- struct{}{}
+			resp := &rpc2.Response{Seq: req.Seq, Error: "rpc2: can't find method " + req.Method}
+			if err := codec.WriteResponse(resp, resp); err != nil {
+				return
+			}
+		}
+	}()
+	clock := NewClock(time.Now())
+	clt := rpc2.NewClient(c1)
+	clt.SetClock(clock)
+	clt.SetKeepalive(time.Minute, 10*time.Second)
+	go clt.Run()
+	defer clt.Close()
+
+	// Keepalives stop after the first one fails.
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Minute)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(pings); n != 1 {
+		t.Fatalf("unexpected number of keepalives: %d", n)
+	}
+}
+
+func TestDeduplicationClock(t *testing.T) {
+	srv := rpc2.NewServer()
+	var count int32
+	srv.Handle("increment", func(client *rpc2.Client, args int) (int32, error) {
+		return atomic.AddInt32(&count, 1), nil
+	})
+	srv.SetDeduplication(time.Minute, nil)
+	clock := NewClock(time.Now())
+	srv.SetClock(clock)
+	clt := rpc2.NewLoopbackClient(srv)
+	go clt.Run()
+	defer clt.Close()
+
+	call := func(ctx context.Context) int32 {
+		var reply int32
+		if err := clt.CallWithContext(ctx, "increment", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	ctx := rpc2.WithIdempotencyKey(context.Background(), "a")
+	if n := call(ctx); n != 1 {
+		t.Fatalf("unexpected reply: %d", n)
+	}
+	if n := call(ctx); n != 1 {
+		t.Fatalf("unexpected reply to duplicate: %d", n)
+	}
+	if n := call(rpc2.WithIdempotencyKey(context.Background(), "b")); n != 2 {
+		t.Fatalf("unexpected reply to another key: %d", n)
+	}
+	if n := call(context.Background()); n != 3 {
+		t.Fatalf("unexpected reply without key: %d", n)
+	}
+	clock.Advance(time.Minute)
+	if n := call(ctx); n != 4 {
+		t.Fatalf("unexpected reply after window: %d", n)
+	}
+}
+
+// writeSignalConn signals on writing when Write is called.
+type writeSignalConn struct {
+	net.Conn
+	writing chan struct{}
+}
+
+func (c writeSignalConn) Write(p []byte) (int, error) {
+	select {
+	case c.writing <- struct{}{}:
+	default:
+	}
+	return c.Conn.Write(p)
+}
+
+func TestNotifyTTLClock(t *testing.T) {
+	c1, c2 := net.Pipe()
+	writing := make(chan struct{}, 1)
+	clt := rpc2.NewClient(writeSignalConn{c1, writing})
+	clock := NewClock(time.Now())
+	clt.SetClock(clock)
+	clt.SetNotifyQueue(10, rpc2.BlockOnOverflow)
+	clt.SetNotifyTTL(time.Minute)
+	go clt.Run()
+	defer clt.Close()
+
+	// Nobody reads c2 yet, so the first notification blocks the queue
+	// and the rest expire.
+	for i := 0; i < 4; i++ {
+		if err := clt.Notify("tick", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-writing
+	clock.Advance(time.Minute)
+
+	peer := rpc2.NewClient(c2)
+	received := make(chan int, 10)
+	peer.Handle("tick", func(client *rpc2.Client, i int, reply *struct{}) error {
+		received <- i
+		return nil
+	})
+	go peer.Run()
+	defer peer.Close()
+	if err := clt.Notify("tick", 4); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-received:
+			seen[n] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %d notifications", i)
+		}
+	}
+	if !seen[0] || !seen[4] {
+		t.Fatalf("unexpected notifications: %v", seen)
+	}
+	if n := clt.ExpiredNotifications(); n != 3 {
+		t.Fatalf("unexpected number of expired notifications: %d", n)
+	}
+}
+
+func TestCoalescingClock(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := rpc2.NewCoalescingConn(c1, time.Second, 1<<10)
+	clock := NewClock(time.Now())
+	conn.SetClock(clock)
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c2, buf); err != nil || string(buf) != "ab" {
+		t.Fatalf("unexpected read: %q, %v", buf, err)
+	}
+}
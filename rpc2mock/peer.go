@@ -0,0 +1,198 @@
+package rpc2mock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// Peer plays the remote side of a connection from a script, for protocol
+// level tests of code using rpc2 with any codec:
+//
+//	peer, conn := rpc2mock.NewPeer(t, jsonrpc.NewJSONCodec)
+//	peer.ExpectCall("subscribe", "prices", true).
+//		Notify("price", 42).
+//		ExpectNotify("ack", 42)
+//	peer.Start()
+//
+//	clt := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(conn))
+//	... // code under test using clt
+//	peer.Wait()
+//
+// Steps run in order. Messages are decoded into new values of the types of
+// the expected args and replies, and compared with reflect.DeepEqual.
+// Failures are reported to the test and stop the script.
+type Peer struct {
+	t     testing.TB
+	conn  net.Conn
+	codec rpc2.Codec
+	steps []step
+	seq   uint64
+	done  chan struct{}
+}
+
+type step struct {
+	desc string
+	run  func(p *Peer) error
+}
+
+// NewPeer returns a peer using the codec returned by newCodec and the end of
+// an in-memory connection to give to the code under test. The connection is
+// closed when the test ends.
+func NewPeer(t testing.TB, newCodec func(io.ReadWriteCloser) rpc2.Codec) (*Peer, io.ReadWriteCloser) {
+	c1, c2 := net.Pipe()
+	p := &Peer{t: t, conn: c1, codec: newCodec(c1), done: make(chan struct{})}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return p, c2
+}
+
+// ExpectCall adds a step reading a call of method with args and responding with reply.
+func (p *Peer) ExpectCall(method string, args, reply interface{}) *Peer {
+	return p.expectCall(method, args, &rpc2.Response{}, reply)
+}
+
+// ExpectCallError adds a step reading a call of method with args and responding
+// with err. The code of err is sent if it is an *rpc2.Error.
+func (p *Peer) ExpectCallError(method string, args interface{}, err error) *Peer {
+	resp := &rpc2.Response{Error: err.Error()}
+	var e *rpc2.Error
+	if errors.As(err, &e) {
+		resp.Code = e.Code
+	}
+	return p.expectCall(method, args, resp, resp)
+}
+
+func (p *Peer) expectCall(method string, args interface{}, resp *rpc2.Response, reply interface{}) *Peer {
+	return p.add(fmt.Sprintf("expect call of %s with %#v", method, args), func(p *Peer) error {
+		seq, err := p.readRequest(method, args)
+		if err != nil {
+			return err
+		}
+		if seq == 0 {
+			return errors.New("got a notification")
+		}
+		r := *resp
+		r.Seq = seq
+		return p.codec.WriteResponse(&r, reply)
+	})
+}
+
+// ExpectNotify adds a step reading a notification of method with args.
+func (p *Peer) ExpectNotify(method string, args interface{}) *Peer {
+	return p.add(fmt.Sprintf("expect notification of %s with %#v", method, args), func(p *Peer) error {
+		seq, err := p.readRequest(method, args)
+		if err == nil && seq != 0 {
+			err = errors.New("got a call")
+		}
+		return err
+	})
+}
+
+// Notify adds a step sending a notification of method with args.
+func (p *Peer) Notify(method string, args interface{}) *Peer {
+	return p.add("notify "+method, func(p *Peer) error {
+		return p.codec.WriteRequest(&rpc2.Request{Method: method}, args)
+	})
+}
+
+// Call adds a step calling method with args and expecting reply in response.
+func (p *Peer) Call(method string, args, reply interface{}) *Peer {
+	return p.add("call "+method, func(p *Peer) error {
+		p.seq++
+		if err := p.codec.WriteRequest(&rpc2.Request{Seq: p.seq, Method: method}, args); err != nil {
+			return err
+		}
+		var req rpc2.Request
+		var resp rpc2.Response
+		if err := p.codec.ReadHeader(&req, &resp); err != nil {
+			return err
+		}
+		if req.Method != "" {
+			return fmt.Errorf("got a request of %s", req.Method)
+		}
+		if resp.Seq != p.seq {
+			return fmt.Errorf("got a response to %d", resp.Seq)
+		}
+		if resp.Error != "" {
+			p.codec.ReadResponseBody(nil)
+			return fmt.Errorf("got error %q", resp.Error)
+		}
+		got, err := decode(p.codec.ReadResponseBody, reply)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(got, reply) {
+			return fmt.Errorf("got reply %#v", got)
+		}
+		return nil
+	})
+}
+
+func (p *Peer) add(desc string, run func(p *Peer) error) *Peer {
+	p.steps = append(p.steps, step{desc, run})
+	return p
+}
+
+// readRequest reads a request of method with args and returns its sequence number.
+func (p *Peer) readRequest(method string, args interface{}) (uint64, error) {
+	var req rpc2.Request
+	var resp rpc2.Response
+	if err := p.codec.ReadHeader(&req, &resp); err != nil {
+		return 0, err
+	}
+	if req.Method == "" {
+		p.codec.ReadResponseBody(nil)
+		return 0, fmt.Errorf("got a response to %d", resp.Seq)
+	}
+	if req.Method != method {
+		p.codec.ReadRequestBody(nil)
+		return 0, fmt.Errorf("got a request of %s", req.Method)
+	}
+	got, err := decode(p.codec.ReadRequestBody, args)
+	if err != nil {
+		return 0, err
+	}
+	if args != Any && !reflect.DeepEqual(got, args) {
+		return 0, fmt.Errorf("got args %#v", got)
+	}
+	return req.Seq, nil
+}
+
+// decode reads a body into a new value of the type of want.
+func decode(read func(interface{}) error, want interface{}) (interface{}, error) {
+	if want == nil || want == Any {
+		return want, read(nil)
+	}
+	v := reflect.New(reflect.TypeOf(want))
+	if err := read(v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// Start runs the script in a new goroutine.
+func (p *Peer) Start() {
+	go func() {
+		defer close(p.done)
+		for i, s := range p.steps {
+			if err := s.run(p); err != nil {
+				p.t.Errorf("rpc2mock: step %d (%s): %v", i+1, s.desc, err)
+				p.conn.Close()
+				return
+			}
+		}
+	}()
+}
+
+// Wait waits until the script ends.
+func (p *Peer) Wait() {
+	<-p.done
+}
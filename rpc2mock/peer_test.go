@@ -0,0 +1,42 @@
+package rpc2mock
+
+import (
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+func TestPeer(t *testing.T) {
+	type Args struct{ A, B int }
+
+	peer, conn := NewPeer(t, rpc2.NewGobCodec)
+	peer.ExpectCall("add", Args{1, 2}, 3).
+		Notify("progress", 50).
+		ExpectNotify("ack", 50).
+		Call("mult", Args{2, 3}, 6).
+		ExpectCallError("div", Any, &rpc2.Error{Code: 7, Message: "division by zero"})
+	peer.Start()
+
+	clt := rpc2.NewClient(conn)
+	clt.Handle("progress", func(client *rpc2.Client, percent int, _ *struct{}) error {
+		return client.Notify("ack", percent)
+	})
+	multiplied := make(chan struct{})
+	clt.Handle("mult", func(client *rpc2.Client, args Args) (int, error) {
+		close(multiplied)
+		return args.A * args.B, nil
+	})
+	go clt.Run()
+	defer clt.Close()
+
+	var reply int
+	if err := clt.Call("add", Args{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	<-multiplied
+	err := clt.Call("div", Args{1, 0}, &reply)
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != 7 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	peer.Wait()
+}
@@ -0,0 +1,294 @@
+// Package rpc2mock provides a mock of rpc2.Client for unit testing code that
+// calls peers and handlers that peers call, without real connections.
+//
+// Code under test takes a Conn, implemented by *rpc2.Client and *Client:
+//
+//	func Register(conn rpc2mock.Conn, name string) (int, error) {
+//		var id int
+//		err := conn.Call("register", name, &id)
+//		return id, err
+//	}
+//
+// Tests set expectations on a mock, which are verified when the test ends:
+//
+//	m := rpc2mock.New(t)
+//	m.ExpectCall("register", "alice").Reply(42)
+//	id, err := Register(m, "alice")
+package rpc2mock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// Conn is the part of *rpc2.Client used for calling peers and handling their calls.
+type Conn interface {
+	Call(method string, args interface{}, reply interface{}) error
+	CallWithContext(ctx context.Context, method string, args interface{}, reply interface{}) error
+	Notify(method string, args interface{}) error
+	Handle(method string, handlerFunc interface{})
+}
+
+var _ Conn = (*rpc2.Client)(nil)
+
+// Any matches any args in expectations.
+var Any = anyArgs{}
+
+type anyArgs struct{}
+
+// Client is a mock implementing Conn. Calls and notifications must match
+// expectations set with ExpectCall and ExpectNotify, in any order.
+// Handlers registered with Handle are called with Invoke.
+type Client struct {
+	t testing.TB
+
+	mutex        sync.Mutex // protects expectations, handlers
+	expectations []*Expectation
+	handlers     map[string]interface{}
+}
+
+var _ Conn = (*Client)(nil)
+
+// New returns a mock reporting failures to t.
+// Expectations are verified when the test ends.
+func New(t testing.TB) *Client {
+	m := &Client{t: t, handlers: make(map[string]interface{})}
+	t.Cleanup(m.AssertExpectations)
+	return m
+}
+
+// Expectation is an expected call or notification.
+type Expectation struct {
+	method string
+	args   interface{}
+	notify bool
+	reply  interface{}
+	err    error
+	times  int // zero for any number of times, at least once
+	calls  int
+}
+
+// ExpectCall expects a call of method with args, which are compared with
+// reflect.DeepEqual unless they are Any. The call succeeds without setting the reply
+// unless Reply or Return is set. It is expected once unless Times is set.
+func (m *Client) ExpectCall(method string, args interface{}) *Expectation {
+	return m.expect(&Expectation{method: method, args: args, times: 1})
+}
+
+// ExpectNotify expects a notification of method with args, like ExpectCall.
+func (m *Client) ExpectNotify(method string, args interface{}) *Expectation {
+	return m.expect(&Expectation{method: method, args: args, notify: true, times: 1})
+}
+
+func (m *Client) expect(e *Expectation) *Expectation {
+	m.mutex.Lock()
+	m.expectations = append(m.expectations, e)
+	m.mutex.Unlock()
+	return e
+}
+
+// Reply sets the value copied to the reply of the call.
+// It may be a value of the type of the reply or a pointer to one.
+func (e *Expectation) Reply(v interface{}) *Expectation {
+	e.reply = v
+	return e
+}
+
+// Return sets the error returned from the call or notification.
+func (e *Expectation) Return(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// Times sets the number of times the call is expected.
+// Zero means any number of times, at least once.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+func (e *Expectation) matches(method string, args interface{}, notify bool) bool {
+	if e.method != method || e.notify != notify {
+		return false
+	}
+	if e.times > 0 && e.calls >= e.times {
+		return false
+	}
+	return e.args == Any || reflect.DeepEqual(e.args, args)
+}
+
+func (e *Expectation) String() string {
+	kind := "call"
+	if e.notify {
+		kind = "notification"
+	}
+	return fmt.Sprintf("%s of %s with %#v", kind, e.method, e.args)
+}
+
+// find returns the first unsatisfied expectation matching the call and counts the call.
+func (m *Client) find(method string, args interface{}, notify bool) (*Expectation, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, e := range m.expectations {
+		if e.matches(method, args, notify) {
+			e.calls++
+			return e, nil
+		}
+	}
+	u := &Expectation{method: method, args: args, notify: notify}
+	m.t.Errorf("rpc2mock: unexpected %s", u)
+	return nil, errors.New("rpc2mock: unexpected " + u.String())
+}
+
+// Call calls CallWithContext with the background context.
+func (m *Client) Call(method string, args interface{}, reply interface{}) error {
+	return m.CallWithContext(context.Background(), method, args, reply)
+}
+
+// CallWithContext returns the reply and error of the expectation matching the call.
+func (m *Client) CallWithContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e, err := m.find(method, args, false)
+	if err != nil {
+		return err
+	}
+	if e.err != nil {
+		return e.err
+	}
+	if e.reply != nil && reply != nil {
+		if err := assign(reply, e.reply); err != nil {
+			m.t.Errorf("rpc2mock: reply of %s: %v", e, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Notify returns the error of the expectation matching the notification.
+func (m *Client) Notify(method string, args interface{}) error {
+	e, err := m.find(method, args, true)
+	if err != nil {
+		return err
+	}
+	return e.err
+}
+
+// Handle registers the handler function for the given method, like rpc2.Client.Handle.
+func (m *Client) Handle(method string, handlerFunc interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.handlers[method]; ok {
+		panic("rpc2mock: multiple registrations for " + method)
+	}
+	m.handlers[method] = handlerFunc
+}
+
+// Invoke calls the handler registered for method as if the peer called it,
+// and copies the reply of the handler to reply. Handlers get a nil
+// *rpc2.Client and, if they take one, the background context.
+func (m *Client) Invoke(method string, args interface{}, reply interface{}) error {
+	m.mutex.Lock()
+	h, ok := m.handlers[method]
+	m.mutex.Unlock()
+	if !ok {
+		return &rpc2.Error{Code: rpc2.CodeMethodNotFound, Message: "rpc2: can't find method " + method}
+	}
+	fn := reflect.ValueOf(h)
+	ft := fn.Type()
+	var in []reflect.Value
+	i := 0
+	if ft.NumIn() > 0 && ft.In(0) == reflect.TypeOf((*context.Context)(nil)).Elem() {
+		in = append(in, reflect.ValueOf(context.Background()))
+		i++
+	}
+	in = append(in, reflect.Zero(ft.In(i)))
+	i++
+	returned := ft.NumOut() == 2
+	takesReply := 0
+	if !returned {
+		takesReply = 1
+	}
+	if ft.NumIn() == i+1+takesReply {
+		argv := reflect.New(ft.In(i))
+		if err := assign(argv.Interface(), args); err != nil {
+			return &rpc2.Error{Code: rpc2.CodeInvalidParams, Message: "rpc2: invalid params: " + err.Error()}
+		}
+		in = append(in, argv.Elem())
+		i++
+	}
+	var replyv reflect.Value
+	if !returned {
+		replyv = reflect.New(ft.In(i).Elem())
+		in = append(in, replyv)
+	}
+	out := fn.Call(in)
+	if err, _ := out[len(out)-1].Interface().(error); err != nil {
+		return err
+	}
+	if returned {
+		replyv = out[0]
+	}
+	if reply == nil {
+		return nil
+	}
+	return assign(reply, replyv.Interface())
+}
+
+// AssertExpectations reports expectations that are not satisfied.
+// It is called when the test of the mock ends.
+func (m *Client) AssertExpectations() {
+	m.t.Helper()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, e := range m.expectations {
+		if e.calls == 0 || (e.times > 0 && e.calls < e.times) {
+			m.t.Errorf("rpc2mock: expected %s %s, got %d", e, times(e.times), e.calls)
+		}
+	}
+}
+
+func times(n int) string {
+	switch n {
+	case 0:
+		return "at least once"
+	case 1:
+		return "once"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+// assign sets the value pointed by dst to src, dereferencing src as needed.
+func assign(dst interface{}, src interface{}) error {
+	d := reflect.ValueOf(dst)
+	if d.Kind() != reflect.Ptr || d.IsNil() {
+		return fmt.Errorf("cannot assign to non-pointer %T", dst)
+	}
+	d = d.Elem()
+	s := reflect.ValueOf(src)
+	for {
+		if !s.IsValid() {
+			d.Set(reflect.Zero(d.Type()))
+			return nil
+		}
+		if s.Type().AssignableTo(d.Type()) {
+			d.Set(s)
+			return nil
+		}
+		if s.Kind() != reflect.Ptr {
+			return fmt.Errorf("cannot assign %s to %s", s.Type(), d.Type())
+		}
+		if s.IsNil() {
+			s = reflect.Value{}
+			continue
+		}
+		s = s.Elem()
+	}
+}
@@ -0,0 +1,84 @@
+package rpc2mock
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+func register(conn Conn, name string) (int, error) {
+	var id int
+	if err := conn.Call("register", name, &id); err != nil {
+		return 0, err
+	}
+	return id, conn.Notify("registered", id)
+}
+
+func TestExpectations(t *testing.T) {
+	m := New(t)
+	m.ExpectCall("register", "alice").Reply(42)
+	m.ExpectCall("register", Any).Return(errors.New("taken")).Times(2)
+	m.ExpectNotify("registered", 42)
+
+	if id, err := register(m, "alice"); err != nil || id != 42 {
+		t.Fatalf("unexpected result: %d, %v", id, err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := register(m, "bob"); err == nil || err.Error() != "taken" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+// recorder records errors instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+}
+
+func (r *recorder) Helper() {}
+
+func TestUnmetExpectations(t *testing.T) {
+	r := &recorder{TB: t}
+	m := &Client{t: r, handlers: make(map[string]interface{})}
+	m.ExpectCall("register", "alice")
+	m.ExpectNotify("registered", 1).Times(2)
+	m.Notify("registered", 1)
+	if err := m.Call("unregister", "alice", nil); err == nil {
+		t.Fatal("unexpected call succeeded")
+	}
+	m.AssertExpectations()
+	if len(r.errors) != 3 {
+		t.Fatalf("unexpected errors: %q", r.errors)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	type Args struct{ A, B int }
+
+	m := New(t)
+	m.Handle("add", func(client *rpc2.Client, args Args, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	m.Handle("mult", func(ctx context.Context, client *rpc2.Client, args *Args) (int, error) {
+		return args.A * args.B, nil
+	})
+	var reply int
+	if err := m.Invoke("add", Args{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	if err := m.Invoke("mult", &Args{2, 3}, &reply); err != nil || reply != 6 {
+		t.Fatalf("unexpected reply: %d, %v", reply, err)
+	}
+	var e *rpc2.Error
+	if err := m.Invoke("div", Args{}, &reply); !errors.As(err, &e) || e.Code != rpc2.CodeMethodNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
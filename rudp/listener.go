@@ -0,0 +1,124 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+type connKey struct {
+	addr string
+	id   uint32
+}
+
+// Listener accepts reliable connections on a packet connection.
+// It implements net.Listener.
+type Listener struct {
+	pc     net.PacketConn
+	accept chan *Conn
+	done   chan struct{}
+
+	mutex  sync.Mutex // protects conns, closed
+	conns  map[connKey]*Conn
+	closed bool
+}
+
+// Listen announces on the local address, the network must be "udp", "udp4" or "udp6".
+func Listen(network, address string) (*Listener, error) {
+	pc, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(pc), nil
+}
+
+// NewListener returns a Listener accepting connections on pc.
+// The listener owns pc; it reads all packets from it and closes it on Close.
+func NewListener(pc net.PacketConn) *Listener {
+	l := &Listener{
+		pc:     pc,
+		accept: make(chan *Conn),
+		done:   make(chan struct{}),
+		conns:  make(map[connKey]*Conn),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, headerSize+maxPayload)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		if n < headerSize {
+			continue
+		}
+		typ := buf[0]
+		key := connKey{addr.String(), binary.BigEndian.Uint32(buf[1:5])}
+		seq := binary.BigEndian.Uint32(buf[5:9])
+
+		l.mutex.Lock()
+		c, ok := l.conns[key]
+		// New connections start with the first data packet.
+		// Anything else is a leftover of a closed connection.
+		if !ok && typ == typeData && seq == 0 && !l.closed {
+			c = newConn(l.pc, addr, key.id, func() { l.remove(key) })
+			l.conns[key] = c
+			go func() {
+				select {
+				case l.accept <- c:
+				case <-l.done:
+					c.fail(net.ErrClosed)
+				}
+			}()
+		}
+		l.mutex.Unlock()
+		if c != nil {
+			c.handlePacket(typ, seq, buf[headerSize:n])
+		}
+	}
+}
+
+func (l *Listener) remove(key connKey) {
+	l.mutex.Lock()
+	delete(l.conns, key)
+	l.mutex.Unlock()
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and closes all accepted connections.
+func (l *Listener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return net.ErrClosed
+	}
+	l.closed = true
+	close(l.done)
+	conns := make([]*Conn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mutex.Unlock()
+	for _, c := range conns {
+		c.fail(net.ErrClosed)
+	}
+	return l.pc.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
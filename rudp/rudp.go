@@ -0,0 +1,324 @@
+// Package rudp implements a reliable, ordered byte stream over UDP for rpc2.
+//
+// Each connection is identified by a random ID chosen by the dialing side.
+// Written bytes are split into datagrams that are acked by the receiver and
+// retransmitted until acked. Received datagrams are reordered before they are
+// handed to the reader. This avoids TCP connection setup per device in LAN
+// discovery and control scenarios while keeping the stream semantics codecs expect.
+//
+//	lis, _ := rudp.Listen("udp", ":5000")
+//	go srv.Accept(lis)
+//
+//	conn, _ := rudp.Dial("udp", "10.0.0.2:5000")
+//	clt := rpc2.NewClient(conn)
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packet types
+const (
+	typeData = 1
+	typeAck  = 2
+	typeFin  = 3
+)
+
+const (
+	headerSize  = 9    // type(1) + conn id(4) + seq(4)
+	maxPayload  = 1200 // keeps datagrams below common MTUs
+	window      = 256  // max unacked packets before Write blocks
+	rto         = 200 * time.Millisecond
+	maxRetries  = 25
+	lingerDelay = time.Second // max time Close waits for the peer to ack
+)
+
+// ErrPeerUnreachable is returned when the peer stops acknowledging packets.
+var ErrPeerUnreachable = errors.New("rudp: peer is unreachable")
+
+// ErrDeadlineNotSupported is returned from deadline methods of Conn.
+var ErrDeadlineNotSupported = errors.New("rudp: deadlines are not supported")
+
+type packet struct {
+	typ    byte
+	seq    uint32
+	data   []byte
+	sentAt time.Time
+	tries  int
+}
+
+// Conn is a reliable connection over a packet connection.
+// It implements net.Conn.
+type Conn struct {
+	pc      net.PacketConn
+	raddr   net.Addr
+	id      uint32
+	onClose func() // called once when the connection is torn down
+
+	mutex sync.Mutex
+	cond  *sync.Cond // signaled when state protected by mutex changes
+
+	// send side
+	nextSeq uint32
+	unacked map[uint32]*packet
+
+	// receive side
+	expected   uint32
+	outOfOrder map[uint32]*packet
+	readBuf    []byte
+	finRead    bool // peer closed its side
+
+	closing bool  // Close called, no more writes
+	err     error // terminal error
+	done    chan struct{}
+}
+
+func newConn(pc net.PacketConn, raddr net.Addr, id uint32, onClose func()) *Conn {
+	c := &Conn{
+		pc:         pc,
+		raddr:      raddr,
+		id:         id,
+		onClose:    onClose,
+		unacked:    make(map[uint32]*packet),
+		outOfOrder: make(map[uint32]*packet),
+		done:       make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	go c.retransmitLoop()
+	return c
+}
+
+// Dial connects to the address on the named network, which must be "udp", "udp4" or "udp6".
+func Dial(network, address string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return DialPacketConn(pc, raddr), nil
+}
+
+// DialPacketConn returns a new connection to raddr over pc.
+// The connection owns pc; it reads all packets from it and closes it on Close.
+func DialPacketConn(pc net.PacketConn, raddr net.Addr) *Conn {
+	c := newConn(pc, raddr, rand.Uint32(), func() { pc.Close() })
+	go func() {
+		buf := make([]byte, headerSize+maxPayload)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if addr.String() != raddr.String() || n < headerSize || binary.BigEndian.Uint32(buf[1:5]) != c.id {
+				continue
+			}
+			c.handlePacket(buf[0], binary.BigEndian.Uint32(buf[5:9]), buf[headerSize:n])
+		}
+	}()
+	return c
+}
+
+func (c *Conn) writePacket(typ byte, seq uint32, data []byte) error {
+	b := make([]byte, headerSize+len(data))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], c.id)
+	binary.BigEndian.PutUint32(b[5:9], seq)
+	copy(b[headerSize:], data)
+	_, err := c.pc.WriteTo(b, c.raddr)
+	return err
+}
+
+// before reports whether sequence number a comes before b, allowing wraparound.
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (c *Conn) handlePacket(typ byte, seq uint32, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch typ {
+	case typeAck:
+		for s := range c.unacked {
+			if before(s, seq) {
+				delete(c.unacked, s)
+			}
+		}
+		c.cond.Broadcast()
+	case typeData, typeFin:
+		if !before(seq, c.expected) && before(seq, c.expected+window) {
+			if _, ok := c.outOfOrder[seq]; !ok {
+				c.outOfOrder[seq] = &packet{typ: typ, seq: seq, data: append([]byte(nil), data...)}
+			}
+			for {
+				p, ok := c.outOfOrder[c.expected]
+				if !ok {
+					break
+				}
+				delete(c.outOfOrder, c.expected)
+				c.expected++
+				if p.typ == typeFin {
+					c.finRead = true
+				} else {
+					c.readBuf = append(c.readBuf, p.data...)
+				}
+			}
+			c.cond.Broadcast()
+		}
+		// Always ack, the previous ack may be lost.
+		c.writePacket(typeAck, c.expected, nil)
+	}
+}
+
+// Read reads data in order from the connection.
+// It returns io.EOF after the peer closes the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.readBuf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.finRead {
+			return 0, io.EOF
+		}
+		c.cond.Wait()
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Write writes data to the connection.
+// It blocks while too many packets are waiting to be acked by the peer.
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		if err := c.send(typeData, b[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		b = b[size:]
+	}
+	return written, nil
+}
+
+func (c *Conn) send(typ byte, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.unacked) >= window && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if c.closing && typ == typeData {
+		return net.ErrClosed
+	}
+	p := &packet{typ: typ, seq: c.nextSeq, data: append([]byte(nil), data...), sentAt: time.Now(), tries: 1}
+	c.nextSeq++
+	c.unacked[p.seq] = p
+	return c.writePacket(p.typ, p.seq, p.data)
+}
+
+func (c *Conn) retransmitLoop() {
+	ticker := time.NewTicker(rto / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mutex.Lock()
+		now := time.Now()
+		unreachable := false
+		for _, p := range c.unacked {
+			if now.Sub(p.sentAt) < rto {
+				continue
+			}
+			if p.tries >= maxRetries {
+				unreachable = true
+				break
+			}
+			p.tries++
+			p.sentAt = now
+			c.writePacket(p.typ, p.seq, p.data)
+		}
+		c.mutex.Unlock()
+		if unreachable {
+			c.fail(ErrPeerUnreachable)
+			return
+		}
+	}
+}
+
+// fail tears down the connection with err.
+func (c *Conn) fail(err error) {
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// Close sends any pending data, tells the peer that the connection is closed
+// and waits a short time for the peer to ack before releasing resources.
+// If the peer has closed the connection first, Close does not wait.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	if c.closing || c.err != nil {
+		c.mutex.Unlock()
+		return net.ErrClosed
+	}
+	c.closing = true
+	peerClosed := c.finRead
+	c.mutex.Unlock()
+
+	if err := c.send(typeFin, nil); err == nil && !peerClosed {
+		timer := time.AfterFunc(lingerDelay, func() { c.fail(net.ErrClosed) })
+		defer timer.Stop()
+		c.mutex.Lock()
+		for len(c.unacked) > 0 && c.err == nil {
+			c.cond.Wait()
+		}
+		c.mutex.Unlock()
+	}
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.raddr }
+
+// SetDeadline is not supported.
+func (c *Conn) SetDeadline(t time.Time) error { return ErrDeadlineNotSupported }
+
+// SetReadDeadline is not supported.
+func (c *Conn) SetReadDeadline(t time.Time) error { return ErrDeadlineNotSupported }
+
+// SetWriteDeadline is not supported.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return ErrDeadlineNotSupported }
@@ -0,0 +1,98 @@
+package rudp
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// lossyConn drops every third packet written.
+type lossyConn struct {
+	net.PacketConn
+	mutex sync.Mutex
+	n     int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	c.n++
+	drop := c.n%3 == 0
+	c.mutex.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listenLossy(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyConn{PacketConn: pc}
+}
+
+func TestRPCOverLossyLink(t *testing.T) {
+	lis := NewListener(listenLossy(t))
+	defer lis.Close()
+
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+	go srv.Accept(lis)
+
+	conn := DialPacketConn(listenLossy(t), lis.Addr())
+	clt := rpc2.NewClient(conn)
+	go clt.Run()
+	defer clt.Close()
+
+	// Large enough to span many datagrams.
+	large := strings.Repeat("x", 20*maxPayload)
+	for _, s := range []string{"hello", large, "world"} {
+		var reply string
+		if err := clt.Call("echo", s, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != s {
+			t.Fatalf("unexpected reply of length %d", len(reply))
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	lis, err := Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	conn, err := Dial("udp4", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "bye" {
+		t.Fatalf("unexpected data: %q", b)
+	}
+	accepted.Close()
+}
@@ -0,0 +1,111 @@
+package rpc2
+
+import (
+	"context"
+	"fmt"
+)
+
+// Defaulter is implemented by args that set default values of their fields.
+// Args of handlers implementing it are initialized with SetDefaults before
+// they are decoded, so fields that an older peer does not know about keep
+// their defaults instead of being zero. Gob ignores fields the receiver does
+// not know about, so new fields can be added on either side:
+//
+//	type Query struct {
+//		Term  string
+//		Limit int // added in version 2
+//	}
+//
+//	func (q *Query) SetDefaults() { q.Limit = 100 }
+//
+// Gob does not send fields with zero values either, so a peer can not set
+// a field with a non-zero default to zero; use a pointer field instead.
+type Defaulter interface {
+	SetDefaults()
+}
+
+// setDefaults calls SetDefaults on args if they implement Defaulter.
+func setDefaults(args interface{}) {
+	if d, ok := args.(Defaulter); ok {
+		d.SetDefaults()
+	}
+}
+
+// VersionMethod is the name of the built-in method exchanging schema
+// versions, see NegotiateVersion. Its argument and reply are the version
+// and the minimum peer version of the caller and the peer.
+const VersionMethod = "rpc.version"
+
+// CodeIncompatible is the code of errors returned from NegotiateVersion when
+// the schema versions of the peers are not compatible.
+const CodeIncompatible = -32004
+
+func init() {
+	addHandler(builtins, builtinIndex, VersionMethod, func(client *Client, args []int, reply *[]int) error {
+		if len(args) != 2 {
+			return &Error{Code: CodeInvalidParams, Message: "rpc2: invalid version"}
+		}
+		*reply = []int{client.schemaVersion, client.minPeerVersion}
+		if err := client.checkVersion(args[0], args[1]); err != nil {
+			return err
+		}
+		client.peerVersion.Store(int64(args[0]) + 1)
+		return nil
+	})
+}
+
+// SetSchemaVersion sets the version of the args and replies that the client
+// sends and handles, and the minimum version of peers it can talk to, for
+// detecting incompatible peers with NegotiateVersion during rolling upgrades.
+// Clients have version zero and talk to peers of any version by default.
+// It must be called before Run.
+func (c *Client) SetSchemaVersion(version, minPeer int) {
+	c.schemaVersion = version
+	c.minPeerVersion = minPeer
+}
+
+// SetSchemaVersion sets the schema version of clients of the server.
+// See Client.SetSchemaVersion. It must be called before serving connections.
+func (s *Server) SetSchemaVersion(version, minPeer int) {
+	s.schemaVersion = version
+	s.minPeerVersion = minPeer
+}
+
+// NegotiateVersion sends the schema version of the client to the peer,
+// which checks that it can talk to it, and checks the version of the peer
+// in turn. Clients call it when they connect, before making other calls.
+// Incompatible versions are reported with an *Error with code
+// CodeIncompatible, from either side.
+func (c *Client) NegotiateVersion(ctx context.Context) (peer int, err error) {
+	var reply []int
+	if err = c.CallWithContext(ctx, VersionMethod, []int{c.schemaVersion, c.minPeerVersion}, &reply); err != nil {
+		return 0, err
+	}
+	if len(reply) != 2 {
+		return 0, &Error{Code: CodeInvalidParams, Message: "rpc2: invalid version"}
+	}
+	if err = c.checkVersion(reply[0], reply[1]); err != nil {
+		return reply[0], err
+	}
+	c.peerVersion.Store(int64(reply[0]) + 1)
+	return reply[0], nil
+}
+
+// PeerVersion returns the schema version of the peer and true
+// if it is negotiated, see NegotiateVersion.
+func (c *Client) PeerVersion() (int, bool) {
+	v := c.peerVersion.Load()
+	return int(v - 1), v != 0
+}
+
+// checkVersion returns an error if the client can not talk to a peer
+// of version that can talk to peers of minPeer and later versions.
+func (c *Client) checkVersion(version, minPeer int) error {
+	if version < c.minPeerVersion {
+		return &Error{Code: CodeIncompatible, Message: fmt.Sprintf("rpc2: schema version %d is older than %d", version, c.minPeerVersion)}
+	}
+	if c.schemaVersion < minPeer {
+		return &Error{Code: CodeIncompatible, Message: fmt.Sprintf("rpc2: schema version %d is older than %d", c.schemaVersion, minPeer)}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Package serialport runs rpc2 connections over serial devices (RS-232/RS-485).
+//
+// Messages are framed with the line framing mode of the jsonrpc codec,
+// so a corrupted line is skipped instead of breaking the connection.
+// When the device disappears (e.g. a USB adapter is unplugged) the client
+// read loop exits with ErrDeviceGone and the client is disconnected.
+//
+//	clt, err := serialport.Dial(serialport.Config{Device: "/dev/ttyUSB0", BaudRate: 115200})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	go clt.Run()
+package serialport
+
+import (
+	"errors"
+	"io"
+	"syscall"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"go.bug.st/serial"
+)
+
+// Parity and stop bit settings.
+const (
+	NoParity    = serial.NoParity
+	OddParity   = serial.OddParity
+	EvenParity  = serial.EvenParity
+	MarkParity  = serial.MarkParity
+	SpaceParity = serial.SpaceParity
+
+	OneStopBit           = serial.OneStopBit
+	OnePointFiveStopBits = serial.OnePointFiveStopBits
+	TwoStopBits          = serial.TwoStopBits
+)
+
+// ErrDeviceGone is returned from reads after the serial device has disappeared.
+var ErrDeviceGone = errors.New("serialport: device is gone")
+
+// Config describes a serial device and its line settings.
+type Config struct {
+	Device   string // e.g. "/dev/ttyUSB0" or "COM3"
+	BaudRate int    // defaults to 9600
+	DataBits int    // defaults to 8
+	Parity   serial.Parity
+	StopBits serial.StopBits
+
+	// OnDecodeError is called with lines that cannot be decoded. Optional.
+	OnDecodeError func(line []byte, err error)
+}
+
+// Open opens the serial device in cfg.
+func Open(cfg Config) (io.ReadWriteCloser, error) {
+	mode := &serial.Mode{
+		BaudRate: cfg.BaudRate,
+		DataBits: cfg.DataBits,
+		Parity:   cfg.Parity,
+		StopBits: cfg.StopBits,
+	}
+	if mode.BaudRate == 0 {
+		mode.BaudRate = 9600
+	}
+	if mode.DataBits == 0 {
+		mode.DataBits = 8
+	}
+	port, err := serial.Open(cfg.Device, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &device{port}, nil
+}
+
+// NewCodec returns a new rpc2.Codec suitable for serial links on port.
+func NewCodec(port io.ReadWriteCloser, onDecodeError func(line []byte, err error)) rpc2.Codec {
+	return jsonrpc.NewJSONCodec(port, jsonrpc.WithLineFraming(onDecodeError))
+}
+
+// Dial opens the serial device in cfg and returns a new client on it.
+// The caller must call Run on the returned client.
+func Dial(cfg Config) (*rpc2.Client, error) {
+	port, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return rpc2.NewClientWithCodec(NewCodec(port, cfg.OnDecodeError)), nil
+}
+
+// device translates errors caused by the device disappearing to ErrDeviceGone.
+type device struct {
+	io.ReadWriteCloser
+}
+
+func (d *device) Read(p []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Read(p)
+	return n, deviceError(err)
+}
+
+func (d *device) Write(p []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Write(p)
+	return n, deviceError(err)
+}
+
+func deviceError(err error) error {
+	var portErr *serial.PortError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &portErr) && portErr.Code() == serial.PortClosed:
+		return ErrDeviceGone
+	case errors.Is(err, syscall.EIO), errors.Is(err, syscall.ENXIO), errors.Is(err, syscall.ENODEV):
+		return ErrDeviceGone
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package serialport
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+type unpluggedPort struct{ net.Conn }
+
+func (p unpluggedPort) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	if err == io.EOF {
+		return n, syscall.EIO
+	}
+	return n, err
+}
+
+func TestDeviceGone(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clt := rpc2.NewClientWithCodec(NewCodec(&device{unpluggedPort{c1}}, nil))
+	done := make(chan error, 1)
+	go func() { done <- clt.Run() }()
+
+	c2.Close()
+	select {
+	case err := <-done:
+		if err != ErrDeviceGone {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client did not disconnect")
+	}
+}
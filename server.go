@@ -1,11 +1,16 @@
 package rpc2
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -16,6 +21,7 @@ import (
 // because Typeof takes an empty interface value.  This is annoying.
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 var typeOfClient = reflect.TypeOf((*Client)(nil))
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 const (
 	clientConnected hub.Kind = iota
@@ -25,13 +31,93 @@ const (
 // Server responds to RPC requests made by Client.
 type Server struct {
 	handlers map[string]*handler
+	index    methodIndex // of handlers, for matching methods ignoring case
+	routes   []*route    // of handlers registered with HandlePattern
 	eventHub *hub.Hub
+	stats    *stats
+	labels   bool // whether to set profiler labels in handlers
+	tracing  bool // whether to create execution trace tasks
+	slow     time.Duration
+
+	notifySize   int
+	notifyPolicy OverflowPolicy
+	notifyTTL    time.Duration
+
+	schemaVersion  int
+	minPeerVersion int
+	foldCase       bool
+
+	keepalive        time.Duration
+	keepaliveTimeout time.Duration
+	limiter          Limiter
+	maxHandlers      int
+	maxQueued        int
+	memoryBudget     uint64
+	connFilter       func(net.Conn) error
+	connectCheck     func(*Client) error
+	propagate        []string
+	coalesceDelay    time.Duration
+	coalesceSize     int
+	deps             *dependencies
+	clients          registry
+	dedup            *dedupCache
+	timeSource       Clock
+
+	drainNotification bool         // whether Shutdown notifies clients
+	draining          atomic.Bool  // set by Shutdown
+	listeners         atomic.Int64 // being accepted on by Accept
+	work              tracker      // requests being handled by clients
 }
 
 type handler struct {
 	fn        reflect.Value
-	argType   reflect.Type
-	replyType reflect.Type
+	withCtx   bool          // takes a context.Context before the client
+	argType   reflect.Type  // nil if the handler takes no arguments
+	replyType reflect.Type  // pointer to the reply, even if it is returned
+	returned  bool          // the reply is returned instead of filled through a pointer
+	aliasOf   string        // name of the method if registered as an alias
+	pattern   string        // set if registered with HandlePattern
+	limit     *methodLimit  // shared with aliases
+	typed     *typedHandler // set if registered with HandleFunc, fn is not used
+}
+
+// ExcessPolicy decides what happens to calls exceeding the concurrency limit of a method.
+type ExcessPolicy int
+
+// Excess policies
+const (
+	QueueExcess  ExcessPolicy = iota // wait until a running call returns
+	RejectExcess                     // respond with a CodeRejected error
+)
+
+// methodLimit limits concurrent executions of a method.
+type methodLimit struct {
+	sem    chan struct{} // nil for no limit
+	reject bool
+}
+
+// acquire reports whether a call may run.
+// It waits for a running call to return if the limit is reached and calls are queued.
+func (l *methodLimit) acquire() bool {
+	if l.sem == nil {
+		return true
+	}
+	if !l.reject {
+		l.sem <- struct{}{}
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *methodLimit) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
 }
 
 type connectionEvent struct {
@@ -48,29 +134,133 @@ func (disconnectionEvent) Kind() hub.Kind { return clientDisconnected }
 // NewServer returns a new Server.
 func NewServer() *Server {
 	return &Server{
-		handlers: make(map[string]*handler),
-		eventHub: &hub.Hub{},
+		handlers:   make(map[string]*handler),
+		index:      make(methodIndex),
+		eventHub:   &hub.Hub{},
+		stats:      &stats{},
+		deps:       &dependencies{},
+		timeSource: RealClock,
 	}
 }
 
-// Handle registers the handler function for the given method. If a handler already exists for method, Handle panics.
+// Handle registers the handler function for the given method. If a handler already exists for method,
+// or method starts with "rpc.", which is reserved for built-in methods, Handle panics.
+//
+// The handler function must have the form
+//
+//	func(client *rpc2.Client, args T, reply *R) error
+//
+// where args may be omitted for methods taking no arguments. It may take a
+// context.Context as the first argument, which carries the deadline of the
+// caller if the codec transmits it:
+//
+//	func(ctx context.Context, client *rpc2.Client, args T, reply *R) error
+//
+// Instead of taking a pointer to fill, it may return the reply:
+//
+//	func(client *rpc2.Client, args T) (R, error)
+//
+// The reply is not sent if the returned error is not nil.
+// See HandleFunc for registering handlers called without reflection.
 func (s *Server) Handle(method string, handlerFunc interface{}) {
-	addHandler(s.handlers, method, handlerFunc)
+	checkReserved(method)
+	addHandler(s.handlers, s.index, method, handlerFunc)
 }
 
-func addHandler(handlers map[string]*handler, mname string, handlerFunc interface{}) {
+// Alias registers alias as another name of the method registered with Handle,
+// which allows renaming a method while older peers keep calling it by the old name:
+//
+//	srv.Handle("user.get", getUser)
+//	srv.Alias("getUser", "user.get")
+//
+// Calls made by the alias are counted separately in the counters published with PublishExpvar.
+// If method is not registered, a handler already exists for alias or alias
+// starts with "rpc.", Alias panics.
+func (s *Server) Alias(alias, method string) {
+	h, ok := s.handlers[method]
+	if !ok {
+		panic("rpc2: alias of unregistered method " + method)
+	}
+	checkReserved(alias)
+	if _, ok = s.handlers[alias]; ok {
+		panic("rpc2: multiple registrations for " + alias)
+	}
+	a := *h
+	a.aliasOf = method
+	s.handlers[alias] = &a
+	s.index.add(alias)
+}
+
+// SetMethodConcurrency limits the number of concurrent executions of method
+// across all clients of the server to n, which must be positive.
+// Excess calls are handled by policy.
+// It must be called before serving connections. If method is not registered, SetMethodConcurrency panics.
+func (s *Server) SetMethodConcurrency(method string, n int, policy ExcessPolicy) {
+	h, ok := s.handlers[method]
+	if !ok {
+		panic("rpc2: concurrency limit of unregistered method " + method)
+	}
+	if n <= 0 {
+		panic("rpc2: concurrency limit must be positive")
+	}
+	h.limit.sem = make(chan struct{}, n)
+	h.limit.reject = policy == RejectExcess
+}
+
+// builtinPrefix is the prefix of the names of built-in methods, such as
+// EchoMethod. As in JSON-RPC 2.0, the namespace is reserved for protocol
+// extensions, so handlers can not be registered in it.
+const builtinPrefix = "rpc."
+
+// checkReserved panics if method is in the namespace of built-in methods.
+func checkReserved(method string) {
+	if strings.HasPrefix(method, builtinPrefix) {
+		panic("rpc2: method names starting with " + builtinPrefix + " are reserved: " + method)
+	}
+}
+
+func addHandler(handlers map[string]*handler, index methodIndex, mname string, handlerFunc interface{}) {
 	if _, ok := handlers[mname]; ok {
 		panic("rpc2: multiple registrations for " + mname)
 	}
+	handlers[mname] = newHandler(mname, handlerFunc)
+	index.add(mname)
+}
 
+// newHandler validates the signature of handlerFunc, registered for mname.
+func newHandler(mname string, handlerFunc interface{}) *handler {
 	method := reflect.ValueOf(handlerFunc)
 	mtype := method.Type()
+	// Method may take a context before other ins.
+	var ins []reflect.Type
+	for i := 0; i < mtype.NumIn(); i++ {
+		ins = append(ins, mtype.In(i))
+	}
+	takesContext := len(ins) > 0 && ins[0] == typeOfContext
+	if takesContext {
+		ins = ins[1:]
+	}
+	// Method needs one out, or two if it returns the reply.
+	if mtype.NumOut() != 1 && mtype.NumOut() != 2 {
+		log.Panicln("method", mname, "has wrong number of outs:", mtype.NumOut())
+	}
+	// The last return type of the method must be error.
+	if returnType := mtype.Out(mtype.NumOut() - 1); returnType != typeOfError {
+		log.Panicln("method", mname, "returns", returnType.String(), "not error")
+	}
+	returnsReply := mtype.NumOut() == 2
 	// Method needs three ins: *client, *args, *reply.
-	if mtype.NumIn() != 3 {
+	// Args may be omitted for methods taking no arguments.
+	// Reply is omitted if the method returns it.
+	numIns := 3
+	if returnsReply {
+		numIns = 2
+	}
+	if len(ins) != numIns && len(ins) != numIns-1 {
 		log.Panicln("method", mname, "has wrong number of ins:", mtype.NumIn())
 	}
 	// First arg must be a pointer to rpc2.Client.
-	clientType := mtype.In(0)
+	clientType := ins[0]
 	if clientType.Kind() != reflect.Ptr {
 		log.Panicln("method", mname, "client type not a pointer:", clientType)
 	}
@@ -78,31 +268,38 @@ func addHandler(handlers map[string]*handler, mname string, handlerFunc interfac
 		log.Panicln("method", mname, "first argument", clientType.String(), "not *rpc2.Client")
 	}
 	// Second arg need not be a pointer.
-	argType := mtype.In(1)
-	if !isExportedOrBuiltinType(argType) {
-		log.Panicln(mname, "argument type not exported:", argType)
+	var argType reflect.Type
+	if len(ins) == numIns {
+		argType = ins[1]
+		if !isExportedOrBuiltinType(argType) {
+			log.Panicln(mname, "argument type not exported:", argType)
+		}
 	}
-	// Third arg must be a pointer.
-	replyType := mtype.In(2)
-	if replyType.Kind() != reflect.Ptr {
-		log.Panicln("method", mname, "reply type not a pointer:", replyType)
+	var replyType reflect.Type
+	if returnsReply {
+		// Returned reply need not be a pointer.
+		replyType = mtype.Out(0)
+		if replyType.Kind() != reflect.Ptr {
+			replyType = reflect.PtrTo(replyType)
+		}
+	} else {
+		// Last arg must be a pointer.
+		replyType = ins[len(ins)-1]
+		if replyType.Kind() != reflect.Ptr {
+			log.Panicln("method", mname, "reply type not a pointer:", replyType)
+		}
 	}
 	// Reply type must be exported.
 	if !isExportedOrBuiltinType(replyType) {
 		log.Panicln("method", mname, "reply type not exported:", replyType)
 	}
-	// Method needs one out.
-	if mtype.NumOut() != 1 {
-		log.Panicln("method", mname, "has wrong number of outs:", mtype.NumOut())
-	}
-	// The return type of the method must be error.
-	if returnType := mtype.Out(0); returnType != typeOfError {
-		log.Panicln("method", mname, "returns", returnType.String(), "not error")
-	}
-	handlers[mname] = &handler{
+	return &handler{
 		fn:        method,
+		withCtx:   takesContext,
 		argType:   argType,
 		replyType: replyType,
+		returned:  returnsReply,
+		limit:     &methodLimit{},
 	}
 }
 
@@ -122,6 +319,139 @@ func isExported(name string) bool {
 	return unicode.IsUpper(rune)
 }
 
+// SetProfilerLabels makes clients of the server run handlers with pprof labels.
+// See Client.SetProfilerLabels. It must be called before serving connections.
+func (s *Server) SetProfilerLabels(enabled bool) {
+	s.labels = enabled
+}
+
+// SetTracing makes clients of the server create execution trace tasks.
+// See Client.SetTracing. It must be called before serving connections.
+func (s *Server) SetTracing(enabled bool) {
+	s.tracing = enabled
+}
+
+// SetSlowThreshold makes clients of the server log slow handlers and calls.
+// See Client.SetSlowThreshold. It must be called before serving connections.
+func (s *Server) SetSlowThreshold(d time.Duration) {
+	s.slow = d
+}
+
+// SetNotifyQueue sets the notify queue of clients of the server.
+// See Client.SetNotifyQueue. It must be called before serving connections.
+func (s *Server) SetNotifyQueue(size int, policy OverflowPolicy) {
+	s.notifySize = size
+	s.notifyPolicy = policy
+}
+
+// SetNotifyTTL sets the expiration of notifications queued by clients of the
+// server. See Client.SetNotifyTTL. It must be called before serving connections.
+func (s *Server) SetNotifyTTL(ttl time.Duration) {
+	s.notifyTTL = ttl
+}
+
+// SetKeepalive makes clients of the server ping their peers.
+// See Client.SetKeepalive. It must be called before serving connections.
+func (s *Server) SetKeepalive(interval, timeout time.Duration) {
+	s.keepalive = interval
+	s.keepaliveTimeout = timeout
+}
+
+// SetPropagatedMetadata sets the metadata keys propagated by clients of the
+// server. See Client.SetPropagatedMetadata. It must be called before serving connections.
+func (s *Server) SetPropagatedMetadata(keys ...string) {
+	s.propagate = keys
+}
+
+// SetLimiter sets the limiter admitting requests from all clients of the server.
+// See Limiter. It must be called before serving connections.
+func (s *Server) SetLimiter(l Limiter) {
+	s.limiter = l
+}
+
+// SetMaxConcurrentHandlers limits the number of handlers running concurrently
+// for each client of the server. See Client.SetMaxConcurrentHandlers.
+// It must be called before serving connections.
+func (s *Server) SetMaxConcurrentHandlers(n int) {
+	s.maxHandlers = n
+}
+
+// SetMaxQueuedRequests makes clients of the server shed requests when their
+// queues are full. See Client.SetMaxQueuedRequests.
+// It must be called before serving connections.
+func (s *Server) SetMaxQueuedRequests(n int) {
+	s.maxQueued = n
+}
+
+// SetMemoryBudget makes clients of the server shed requests while the heap is
+// larger than bytes. See Client.SetMemoryBudget.
+// It must be called before serving connections.
+func (s *Server) SetMemoryBudget(bytes uint64) {
+	s.memoryBudget = bytes
+}
+
+// SetConnFilter sets a function called with connections given to ServeConn
+// and Accept before a codec is attached. If it returns an error, the connection
+// is closed without being served, so unwanted peers can be rejected early,
+// e.g. by IP address. Rejected connections do not trigger OnConnect or
+// OnDisconnect. It must be called before serving connections.
+func (s *Server) SetConnFilter(f func(net.Conn) error) {
+	s.connFilter = f
+}
+
+// SetConnectCheck sets a function called with every client before its
+// requests are served and before OnConnect functions run. Unlike OnConnect,
+// it runs synchronously and may reject the client by returning an error, in
+// which case the connection is closed without serving any handlers. Rejected
+// clients do not trigger OnConnect or OnDisconnect.
+//
+// It runs after the handshake of connections having a Handshake method,
+// such as *tls.Conn, so the function can inspect the negotiated parameters
+// and credentials through Client.Conn and store them in Client.State:
+//
+//	srv.SetConnectCheck(func(client *rpc2.Client) error {
+//		conn, ok := client.Conn().(*tls.Conn)
+//		if !ok {
+//			return errors.New("not a TLS connection")
+//		}
+//		state := conn.ConnectionState()
+//		if len(state.PeerCertificates) == 0 {
+//			return errors.New("no client certificate")
+//		}
+//		client.State.Set("cn", state.PeerCertificates[0].Subject.CommonName)
+//		return nil
+//	})
+//
+// It must be called before serving connections.
+func (s *Server) SetConnectCheck(f func(*Client) error) {
+	s.connectCheck = f
+}
+
+// checkConnect completes the handshake of the connection of c
+// and reports whether c is admitted by the connect check.
+func (s *Server) checkConnect(c *Client) bool {
+	if s.connectCheck == nil {
+		return true
+	}
+	if err := handshake(c.Conn()); err != nil {
+		debugln("rpc2: handshake failed:", err.Error())
+		return false
+	}
+	if err := s.connectCheck(c); err != nil {
+		debugln("rpc2: client rejected:", err.Error())
+		return false
+	}
+	return true
+}
+
+// handshake completes the handshake of conn if it has a Handshake method.
+func handshake(conn io.ReadWriteCloser) error {
+	if hc, ok := conn.(interface{ Handshake() error }); ok {
+		return hc.Handshake()
+	}
+	return nil
+}
+
 // OnConnect registers a function to run when a client connects.
 func (s *Server) OnConnect(f func(*Client)) {
 	s.eventHub.Subscribe(clientConnected, func(e hub.Event) {
@@ -140,6 +470,8 @@ func (s *Server) OnDisconnect(f func(*Client)) {
 // for each incoming connection.  Accept blocks; the caller typically
 // invokes it in a go statement.
 func (s *Server) Accept(lis net.Listener) {
+	s.listeners.Add(1)
+	defer s.listeners.Add(-1)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
@@ -152,12 +484,59 @@ func (s *Server) Accept(lis net.Listener) {
 	}
 }
 
+// AcceptAll is like Accept but accepts connections on all listeners
+// concurrently, so the same handlers serve e.g. TCP, Unix socket and TLS
+// listeners. When accepting on one of the listeners fails, typically because it
+// is closed, the other listeners are closed too. AcceptAll blocks until
+// accepting stops on all listeners.
+func (s *Server) AcceptAll(listeners ...net.Listener) {
+	var wg sync.WaitGroup
+	var once sync.Once
+	closeAll := func() {
+		for _, lis := range listeners {
+			lis.Close()
+		}
+	}
+	for _, lis := range listeners {
+		wg.Add(1)
+		go func(lis net.Listener) {
+			defer wg.Done()
+			s.Accept(lis)
+			once.Do(closeAll)
+		}(lis)
+	}
+	wg.Wait()
+}
+
 // ServeConn runs the server on a single connection.
 // ServeConn blocks, serving the connection until the client hangs up.
 // The caller typically invokes ServeConn in a go statement.
 // ServeConn uses the gob wire format (see package gob) on the
 // connection.  To use an alternate codec, use ServeCodec.
 func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	if nc, ok := conn.(net.Conn); ok && s.connFilter != nil {
+		if err := s.connFilter(nc); err != nil {
+			debugln("rpc2: connection from", nc.RemoteAddr(), "rejected:", err.Error())
+			conn.Close()
+			return
+		}
+	}
+	if s.connectCheck != nil {
+		// Wrappers hide the Handshake method.
+		if err := handshake(conn); err != nil {
+			debugln("rpc2: handshake failed:", err.Error())
+			conn.Close()
+			return
+		}
+	}
+	if s.stats.countBytes.Load() {
+		conn = s.stats.countConn(conn)
+	}
+	if s.coalesceDelay > 0 {
+		cc := NewCoalescingConn(conn, s.coalesceDelay, s.coalesceSize)
+		cc.SetClock(s.timeSource)
+		conn = cc
+	}
 	s.ServeCodec(NewGobCodec(conn))
 }
 
@@ -176,9 +555,42 @@ func (s *Server) ServeCodecWithState(codec Codec, state *State) {
 	c := NewClientWithCodec(codec)
 	c.server = true
 	c.handlers = s.handlers
+	c.index = s.index
+	c.routes = s.routes
 	c.State = state
+	c.stats = s.stats
+	c.labels = s.labels
+	c.tracing = s.tracing
+	c.slow = s.slow
+	c.SetNotifyQueue(s.notifySize, s.notifyPolicy)
+	c.SetNotifyTTL(s.notifyTTL)
+	c.SetSchemaVersion(s.schemaVersion, s.minPeerVersion)
+	c.SetCaseInsensitiveMethods(s.foldCase)
+	c.SetKeepalive(s.keepalive, s.keepaliveTimeout)
+	c.limiter = s.limiter
+	c.maxHandlers = s.maxHandlers
+	c.maxQueued = s.maxQueued
+	c.memoryBudget = s.memoryBudget
+	c.propagate = s.propagate
+	c.deps = s.deps
+	c.dedup = s.dedup
+	c.timeSource = s.timeSource
+	c.created = s.timeSource.Now()
+	c.draining = &s.draining
+	c.serverWork = &s.work
 
+	if !s.checkConnect(c) {
+		return
+	}
+	if !s.clients.add(c) {
+		// The server is shutting down.
+		return
+	}
+	s.stats.connections.Add(1)
+	s.stats.activeConnections.Add(1)
 	s.eventHub.Publish(connectionEvent{c})
 	c.Run()
+	s.clients.remove(c)
+	s.stats.activeConnections.Add(-1)
 	s.eventHub.Publish(disconnectionEvent{c})
 }
@@ -0,0 +1,153 @@
+package rpc2
+
+import (
+	"context"
+	"time"
+)
+
+// CodeShuttingDown is the code of errors rejecting calls that arrive while the
+// server shuts down. Such calls are not handled, so they can be retried with
+// another server.
+const CodeShuttingDown = -32003
+
+// DrainMethod is the name of the built-in notification a server sends to its
+// clients when it shuts down, if enabled with SetDrainNotification. Its
+// argument is the number of milliseconds until the server closes the
+// remaining connections, or -1 if it waits for clients to disconnect.
+// Clients receive it with OnDrain.
+const DrainMethod = "rpc.drain"
+
+func init() {
+	addHandler(builtins, builtinIndex, DrainMethod, func(client *Client, ms int64, reply *struct{}) error {
+		client.mutex.Lock()
+		f := client.onDrain
+		client.mutex.Unlock()
+		if f == nil {
+			return nil
+		}
+		var deadline time.Time
+		if ms >= 0 {
+			deadline = client.timeSource.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		f(deadline)
+		return nil
+	})
+}
+
+// OnDrain registers a function to run when the server the client is connected
+// to starts shutting down, so the client can move to another server before the
+// connection is closed. The deadline is when the server closes the connection,
+// zero if the server waits for the client to disconnect.
+// The function runs in the goroutine handling the notification.
+func (c *Client) OnDrain(f func(deadline time.Time)) {
+	c.mutex.Lock()
+	c.onDrain = f
+	c.mutex.Unlock()
+}
+
+// SetDrainNotification makes Shutdown send DrainMethod notifications to the
+// connected clients, which well-behaved clients handle by reconnecting to
+// another server, so rolling restarts do not look like failures to them.
+// It must be called before Shutdown.
+func (s *Server) SetDrainNotification(enabled bool) {
+	s.drainNotification = enabled
+}
+
+// ShutdownReport describes the work lost when Shutdown gave up waiting.
+// It is empty if Shutdown returned nil.
+type ShutdownReport struct {
+	// InterruptedHandlers are the numbers of handlers still running when
+	// the context was done, by method. Their contexts are canceled.
+	InterruptedHandlers map[string]int
+
+	// AbortedCalls are the numbers of calls made by the server to clients,
+	// which were pending when their connections were force-closed, by method.
+	AbortedCalls map[string]int
+
+	// ClosedConnections is the number of connections force-closed.
+	ClosedConnections int
+}
+
+// Shutdown gracefully shuts down the server: it stops serving new
+// connections, notifies the connected clients if enabled with
+// SetDrainNotification and waits for them to disconnect. Calls arriving in
+// the meantime are rejected with a CodeShuttingDown error, except calls of
+// built-in methods such as EchoMethod, and notifications are discarded.
+// Calls being handled are not affected, and Shutdown waits for their
+// handlers to return as well, see Wait. When ctx is done, the remaining
+// connections are closed and ctx.Err() is returned, along with a report of
+// the handlers and calls that did not complete.
+// Listeners given to Accept are not closed by Shutdown; connections they accept
+// afterwards are closed right away.
+func (s *Server) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	var report ShutdownReport
+	s.draining.Store(true)
+	clients, idle := s.clients.drain()
+	if s.drainNotification {
+		ms := int64(-1)
+		if deadline, ok := ctx.Deadline(); ok {
+			ms = int64(deadline.Sub(s.timeSource.Now()) / time.Millisecond)
+			if ms < 0 {
+				ms = 0
+			}
+		}
+		for _, c := range clients {
+			go c.Notify(DrainMethod, ms)
+		}
+	}
+	select {
+	case <-idle:
+		select {
+		case <-s.work.wait():
+			return report, nil
+		case <-ctx.Done():
+			report.InterruptedHandlers = s.work.running()
+			return report, ctx.Err()
+		}
+	case <-ctx.Done():
+	}
+	report.InterruptedHandlers = s.work.running()
+	for _, c := range s.Clients() {
+		for _, method := range c.pendingMethods() {
+			if report.AbortedCalls == nil {
+				report.AbortedCalls = make(map[string]int)
+			}
+			report.AbortedCalls[method]++
+		}
+		c.Close()
+		report.ClosedConnections++
+	}
+	return report, ctx.Err()
+}
+
+// pendingMethods returns the methods of the calls waiting for responses.
+func (c *Client) pendingMethods() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	methods := make([]string, 0, len(c.pending))
+	for _, call := range c.pending {
+		methods = append(methods, call.Method)
+	}
+	return methods
+}
+
+// rejectDraining discards the body of req and, if it is a call, responds
+// with a shutting down error.
+func (c *Client) rejectDraining(req *Request) error {
+	if err := c.codec.ReadRequestBody(nil); err != nil {
+		return err
+	}
+	if req.Seq == 0 {
+		return nil
+	}
+	return c.writeErrorResponse(&Response{
+		Seq:   req.Seq,
+		Error: "rpc2: server shutting down, retry elsewhere",
+		Code:  CodeShuttingDown,
+	})
+}
+
+// isDraining returns true if the client is served by a server shutting down.
+func (c *Client) isDraining() bool {
+	return c.draining != nil && c.draining.Load()
+}
@@ -0,0 +1,114 @@
+package rpc2
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// stats holds counters of a server.
+type stats struct {
+	connections          atomic.Int64 // accepted since the server is created
+	activeConnections    atomic.Int64
+	calls                atomic.Int64 // incoming requests and notifications
+	errors               atomic.Int64 // failed incoming requests
+	shed                 atomic.Int64 // incoming requests rejected because of overload
+	unknownResponses     atomic.Int64 // responses matching no pending call
+	expiredNotifications atomic.Int64 // queued notifications discarded after their TTL
+	bytesRead            atomic.Int64 // counted only when countBytes is set
+	bytesWritten         atomic.Int64
+	countBytes           atomic.Bool
+
+	aliasMutex sync.Mutex
+	aliasCalls map[string]int64 // incoming requests and notifications by alias
+}
+
+// countAlias counts a call to a method by its alias.
+func (s *stats) countAlias(alias string) {
+	s.aliasMutex.Lock()
+	if s.aliasCalls == nil {
+		s.aliasCalls = make(map[string]int64)
+	}
+	s.aliasCalls[alias]++
+	s.aliasMutex.Unlock()
+}
+
+// values returns the counters by name.
+// Calls by alias are named "alias_calls.<alias>".
+func (s *stats) values() map[string]int64 {
+	v := map[string]int64{
+		"connections":           s.connections.Load(),
+		"active_connections":    s.activeConnections.Load(),
+		"calls":                 s.calls.Load(),
+		"errors":                s.errors.Load(),
+		"shed":                  s.shed.Load(),
+		"unknown_responses":     s.unknownResponses.Load(),
+		"expired_notifications": s.expiredNotifications.Load(),
+		"bytes_read":            s.bytesRead.Load(),
+		"bytes_written":         s.bytesWritten.Load(),
+	}
+	s.aliasMutex.Lock()
+	for alias, n := range s.aliasCalls {
+		v["alias_calls."+alias] = n
+	}
+	s.aliasMutex.Unlock()
+	return v
+}
+
+// PublishExpvar publishes counters of connections, calls, errors, shed calls,
+// unknown responses, expired notifications, bytes and calls made by method
+// aliases under name in the expvar package. Bytes are counted for connections
+// served with ServeConn and Accept after PublishExpvar is called; codecs given
+// to ServeCodec own their connections and are not counted.
+// Like expvar.Publish, it panics if name is already registered.
+func (s *Server) PublishExpvar(name string) {
+	s.stats.countBytes.Store(true)
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.stats.values()
+	}))
+}
+
+// countConn wraps conn to count bytes read and written in s.
+// The result implements net.Conn if conn does.
+func (s *stats) countConn(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	if nc, ok := conn.(net.Conn); ok {
+		return &countingNetConn{nc, s}
+	}
+	return &countingConn{conn, s}
+}
+
+type countingConn struct {
+	io.ReadWriteCloser
+	stats *stats
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.stats.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.stats.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+type countingNetConn struct {
+	net.Conn
+	stats *stats
+}
+
+func (c *countingNetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *countingNetConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.bytesWritten.Add(int64(n))
+	return n, err
+}
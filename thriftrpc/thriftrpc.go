@@ -0,0 +1,227 @@
+// Package thriftrpc implements a Thrift compact protocol codec for the rpc2 package.
+//
+// Messages are framed like Thrift service calls so rpc2 peers can talk to
+// existing Thrift clients and servers. Args and replies must be thrift.TStruct
+// values, typically the "<Service><Method>Args" and "<Service><Method>Result"
+// structs generated from the IDL:
+//
+//	srv.Handle("add", func(client *rpc2.Client, args *calc.CalculatorAddArgs, reply *calc.CalculatorAddResult) error {
+//		sum := args.A + args.B
+//		reply.Success = &sum
+//		return nil
+//	})
+//
+// Errors are sent as TApplicationException.
+package thriftrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/cenkalti/rpc2"
+)
+
+type thriftCodec struct {
+	in     *thrift.TCompactProtocol
+	out    *thrift.TCompactProtocol
+	rwc    io.ReadWriteCloser
+	wmutex sync.Mutex // protects out
+
+	// temporary work space
+	exception bool // last message is an exception
+
+	// Sequence IDs of incoming requests are 32-bit and chosen by the peer.
+	// We assign our own sequence numbers to incoming requests
+	// and save the original sequence ID and method name in the pending map.
+	mutex   sync.Mutex // protects seq, pending
+	pending map[uint64]pendingRequest
+	seq     uint64
+}
+
+type pendingRequest struct {
+	method string
+	seqID  int32
+}
+
+// NewThriftCodec returns a new rpc2.Codec using the Thrift compact protocol on conn.
+func NewThriftCodec(conn io.ReadWriteCloser) rpc2.Codec {
+	return &thriftCodec{
+		in:      thrift.NewTCompactProtocol(thrift.NewStreamTransportR(conn)),
+		out:     thrift.NewTCompactProtocol(thrift.NewStreamTransportW(conn)),
+		rwc:     conn,
+		pending: make(map[uint64]pendingRequest),
+	}
+}
+
+func (c *thriftCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	ctx := context.Background()
+	name, typ, seqID, err := c.in.ReadMessageBegin(ctx)
+	if err != nil {
+		return readError(err)
+	}
+	c.exception = typ == thrift.EXCEPTION
+	switch typ {
+	case thrift.CALL:
+		req.Method = name
+		c.mutex.Lock()
+		c.seq++
+		c.pending[c.seq] = pendingRequest{method: name, seqID: seqID}
+		req.Seq = c.seq
+		c.mutex.Unlock()
+	case thrift.ONEWAY:
+		req.Method = name
+	case thrift.REPLY:
+		resp.Seq = uint64(uint32(seqID))
+	case thrift.EXCEPTION:
+		resp.Seq = uint64(uint32(seqID))
+		e := thrift.NewTApplicationException(thrift.UNKNOWN_APPLICATION_EXCEPTION, "")
+		if err = e.Read(ctx, c.in); err != nil {
+			return readError(err)
+		}
+		if err = c.in.ReadMessageEnd(ctx); err != nil {
+			return readError(err)
+		}
+		resp.Error = e.Error()
+		if resp.Error == "" {
+			resp.Error = "unspecified error"
+		}
+		resp.Code = toCode(e.TypeId())
+	default:
+		return fmt.Errorf("thriftrpc: invalid message type %d", typ)
+	}
+	return nil
+}
+
+// readError returns io.EOF if err is caused by the peer closing the connection.
+func readError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+	return err
+}
+
+func (c *thriftCodec) ReadRequestBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+func (c *thriftCodec) ReadResponseBody(x interface{}) error {
+	if c.exception {
+		// Body is already read in ReadHeader.
+		return nil
+	}
+	return c.readBody(x)
+}
+
+func (c *thriftCodec) readBody(x interface{}) error {
+	ctx := context.Background()
+	if x == nil {
+		if err := c.in.Skip(ctx, thrift.STRUCT); err != nil {
+			return err
+		}
+		return c.in.ReadMessageEnd(ctx)
+	}
+	s, ok := x.(thrift.TStruct)
+	if !ok {
+		// Skip the body so the stream stays in sync.
+		c.in.Skip(ctx, thrift.STRUCT)
+		c.in.ReadMessageEnd(ctx)
+		return fmt.Errorf("thriftrpc: %T does not implement thrift.TStruct", x)
+	}
+	if err := s.Read(ctx, c.in); err != nil {
+		return err
+	}
+	return c.in.ReadMessageEnd(ctx)
+}
+
+func (c *thriftCodec) WriteRequest(r *rpc2.Request, param interface{}) error {
+	s, ok := param.(thrift.TStruct)
+	if !ok {
+		return fmt.Errorf("thriftrpc: %T does not implement thrift.TStruct", param)
+	}
+	typ := thrift.CALL
+	if r.Seq == 0 {
+		typ = thrift.ONEWAY
+	}
+	return c.write(r.Method, typ, int32(r.Seq), s)
+}
+
+func (c *thriftCodec) WriteResponse(r *rpc2.Response, x interface{}) error {
+	c.mutex.Lock()
+	p, ok := c.pending[r.Seq]
+	if !ok {
+		c.mutex.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.mutex.Unlock()
+
+	if r.Error != "" {
+		e := thrift.NewTApplicationException(toExceptionType(r.Code), r.Error)
+		return c.write(p.method, thrift.EXCEPTION, p.seqID, e)
+	}
+	s, ok := x.(thrift.TStruct)
+	if !ok {
+		e := thrift.NewTApplicationException(thrift.INTERNAL_ERROR, fmt.Sprintf("thriftrpc: %T does not implement thrift.TStruct", x))
+		c.write(p.method, thrift.EXCEPTION, p.seqID, e)
+		return e
+	}
+	return c.write(p.method, thrift.REPLY, p.seqID, s)
+}
+
+func (c *thriftCodec) write(name string, typ thrift.TMessageType, seqID int32, s thrift.TStruct) error {
+	ctx := context.Background()
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if err := c.out.WriteMessageBegin(ctx, name, typ, seqID); err != nil {
+		return err
+	}
+	if err := s.Write(ctx, c.out); err != nil {
+		return err
+	}
+	if err := c.out.WriteMessageEnd(ctx); err != nil {
+		return err
+	}
+	return c.out.Flush(ctx)
+}
+
+// toExceptionType converts an rpc2 error code to a TApplicationException type.
+func toExceptionType(code int) int32 {
+	switch code {
+	case rpc2.CodeMethodNotFound:
+		return thrift.UNKNOWN_METHOD
+	case rpc2.CodeInvalidParams, rpc2.CodeParseError:
+		return thrift.PROTOCOL_ERROR
+	case rpc2.CodeInvalidRequest:
+		return thrift.INVALID_MESSAGE_TYPE_EXCEPTION
+	case rpc2.CodeInternalError:
+		return thrift.INTERNAL_ERROR
+	}
+	return thrift.UNKNOWN_APPLICATION_EXCEPTION
+}
+
+// toCode converts a TApplicationException type to an rpc2 error code.
+func toCode(typ int32) int {
+	switch typ {
+	case thrift.UNKNOWN_METHOD:
+		return rpc2.CodeMethodNotFound
+	case thrift.PROTOCOL_ERROR:
+		return rpc2.CodeInvalidParams
+	case thrift.INVALID_MESSAGE_TYPE_EXCEPTION:
+		return rpc2.CodeInvalidRequest
+	case thrift.INTERNAL_ERROR:
+		return rpc2.CodeInternalError
+	}
+	return 0
+}
+
+func (c *thriftCodec) Conn() io.ReadWriteCloser {
+	return c.rwc
+}
+
+func (c *thriftCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,181 @@
+package thriftrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/cenkalti/rpc2"
+)
+
+// Hand written equivalents of structs generated for:
+//
+//	service Calculator {
+//		i32 add(1: i32 a, 2: i32 b)
+//	}
+type AddArgs struct {
+	A int32
+	B int32
+}
+
+func (p *AddArgs) Read(ctx context.Context, iprot thrift.TProtocol) error {
+	if _, err := iprot.ReadStructBegin(ctx); err != nil {
+		return err
+	}
+	for {
+		_, typ, id, err := iprot.ReadFieldBegin(ctx)
+		if err != nil {
+			return err
+		}
+		if typ == thrift.STOP {
+			break
+		}
+		switch {
+		case id == 1 && typ == thrift.I32:
+			p.A, err = iprot.ReadI32(ctx)
+		case id == 2 && typ == thrift.I32:
+			p.B, err = iprot.ReadI32(ctx)
+		default:
+			err = iprot.Skip(ctx, typ)
+		}
+		if err != nil {
+			return err
+		}
+		if err = iprot.ReadFieldEnd(ctx); err != nil {
+			return err
+		}
+	}
+	return iprot.ReadStructEnd(ctx)
+}
+
+func (p *AddArgs) Write(ctx context.Context, oprot thrift.TProtocol) error {
+	if err := oprot.WriteStructBegin(ctx, "add_args"); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		id int16
+		v  int32
+	}{{1, p.A}, {2, p.B}} {
+		if err := oprot.WriteFieldBegin(ctx, "", thrift.I32, f.id); err != nil {
+			return err
+		}
+		if err := oprot.WriteI32(ctx, f.v); err != nil {
+			return err
+		}
+		if err := oprot.WriteFieldEnd(ctx); err != nil {
+			return err
+		}
+	}
+	if err := oprot.WriteFieldStop(ctx); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd(ctx)
+}
+
+type AddResult struct {
+	Success *int32
+}
+
+func (p *AddResult) Read(ctx context.Context, iprot thrift.TProtocol) error {
+	if _, err := iprot.ReadStructBegin(ctx); err != nil {
+		return err
+	}
+	for {
+		_, typ, id, err := iprot.ReadFieldBegin(ctx)
+		if err != nil {
+			return err
+		}
+		if typ == thrift.STOP {
+			break
+		}
+		if id == 0 && typ == thrift.I32 {
+			v, err := iprot.ReadI32(ctx)
+			if err != nil {
+				return err
+			}
+			p.Success = &v
+		} else if err = iprot.Skip(ctx, typ); err != nil {
+			return err
+		}
+		if err = iprot.ReadFieldEnd(ctx); err != nil {
+			return err
+		}
+	}
+	return iprot.ReadStructEnd(ctx)
+}
+
+func (p *AddResult) Write(ctx context.Context, oprot thrift.TProtocol) error {
+	if err := oprot.WriteStructBegin(ctx, "add_result"); err != nil {
+		return err
+	}
+	if p.Success != nil {
+		if err := oprot.WriteFieldBegin(ctx, "success", thrift.I32, 0); err != nil {
+			return err
+		}
+		if err := oprot.WriteI32(ctx, *p.Success); err != nil {
+			return err
+		}
+		if err := oprot.WriteFieldEnd(ctx); err != nil {
+			return err
+		}
+	}
+	if err := oprot.WriteFieldStop(ctx); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd(ctx)
+}
+
+func TestThriftRPC(t *testing.T) {
+	srv := rpc2.NewServer()
+	srv.Handle("add", func(client *rpc2.Client, args *AddArgs, reply *AddResult) error {
+		sum := args.A + args.B
+		reply.Success = &sum
+		return nil
+	})
+	number := make(chan int32, 1)
+	srv.Handle("set", func(client *rpc2.Client, args *AddArgs, _ *AddResult) error {
+		number <- args.A
+		return nil
+	})
+
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewThriftCodec(c1))
+
+	clt := rpc2.NewClientWithCodec(NewThriftCodec(c2))
+	go clt.Run()
+	defer clt.Close()
+
+	var reply AddResult
+	err := clt.Call("add", &AddArgs{1, 2}, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Success == nil || *reply.Success != 3 {
+		t.Fatalf("unexpected reply: %v", reply.Success)
+	}
+
+	// Test oneway call.
+	if err = clt.Notify("set", &AddArgs{A: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if i := <-number; i != 6 {
+		t.Fatalf("unexpected number: %d", i)
+	}
+
+	// Test undefined method.
+	err = clt.Call("foo", &AddArgs{}, &reply)
+	if e, ok := err.(*rpc2.Error); !ok || e.Code != rpc2.CodeMethodNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	// Connection must be usable after errors.
+	reply = AddResult{}
+	err = clt.Call("add", &AddArgs{3, 4}, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Success == nil || *reply.Success != 7 {
+		t.Fatalf("unexpected reply: %v", reply.Success)
+	}
+}
@@ -0,0 +1,58 @@
+package rpc2
+
+import "time"
+
+// Clock is the source of time of clients and servers, used for keepalives,
+// retry backoff, slow call logging, activity tracking, deduplication windows,
+// rate limiting, clock synchronization, time budgets of calls and write
+// coalescing. Tests may replace the real clock with a fake one advanced
+// synthetically. Deadlines of contexts are compared with the clock, but
+// contexts still expire by the real clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer created by a Clock, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is a ticker created by a Clock, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock of the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                   { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer   { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// SetClock sets the source of time of the client. It must be called before Run.
+func (c *Client) SetClock(clock Clock) {
+	c.timeSource = clock
+	c.created = clock.Now()
+}
+
+// SetClock sets the source of time of clients of the server.
+// It must be called before serving connections.
+func (s *Server) SetClock(clock Clock) {
+	s.timeSource = clock
+}
@@ -0,0 +1,96 @@
+package rpc2
+
+import "sync"
+
+// tracker counts the requests being handled, including queued ones.
+type tracker struct {
+	mutex   sync.Mutex
+	n       int
+	methods map[string]int // number of requests by method
+	idle    chan struct{}  // closed when n drops to zero, nil if nobody waits
+}
+
+func (t *tracker) add(method string) {
+	t.mutex.Lock()
+	t.n++
+	if t.methods == nil {
+		t.methods = make(map[string]int)
+	}
+	t.methods[method]++
+	t.mutex.Unlock()
+}
+
+func (t *tracker) done(method string) {
+	t.mutex.Lock()
+	t.n--
+	if t.methods[method]--; t.methods[method] == 0 {
+		delete(t.methods, method)
+	}
+	if t.n == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+	t.mutex.Unlock()
+}
+
+// wait returns a channel closed when no requests are being handled.
+func (t *tracker) wait() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.n == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	return t.idle
+}
+
+// running returns the number of requests being handled by method,
+// nil if there are none.
+func (t *tracker) running() map[string]int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.n == 0 {
+		return nil
+	}
+	m := make(map[string]int, len(t.methods))
+	for k, v := range t.methods {
+		m[k] = v
+	}
+	return m
+}
+
+// Wait waits until the handlers of the requests received by the client have
+// returned, including requests queued because of SetMaxConcurrentHandlers, and their
+// responses are written or have failed. Handlers keep running after the
+// connection is closed until they return, so tests and embedders can call
+// Wait after Close to make sure no handler is left behind. Requests received
+// while Wait is waiting are waited for as well.
+func (c *Client) Wait() {
+	<-c.work.wait()
+}
+
+// Wait waits until the handlers of the requests received by all clients of
+// the server have returned, like Client.Wait.
+func (s *Server) Wait() {
+	<-s.work.wait()
+}
+
+// trackRequest counts a request of method as being handled until
+// untrackRequest is called.
+func (c *Client) trackRequest(method string) {
+	c.work.add(method)
+	if c.serverWork != nil {
+		c.serverWork.add(method)
+	}
+}
+
+func (c *Client) untrackRequest(method string) {
+	c.work.done(method)
+	if c.serverWork != nil {
+		c.serverWork.done(method)
+	}
+}
@@ -0,0 +1,76 @@
+// Package webtransport runs rpc2 connections over WebTransport (HTTP/3) sessions,
+// so browser and native clients behind HTTP/3-only infrastructure can keep
+// bidirectional rpc2 connections.
+//
+// The package does not depend on a WebTransport implementation. Sessions of
+// github.com/quic-go/webtransport-go satisfy the interfaces below; pass the
+// stream type of the version in use as the type argument:
+//
+//	http.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+//		sess, err := wtServer.Upgrade(w, r)
+//		if err != nil {
+//			return
+//		}
+//		webtransport.Serve[*wt.Stream](r.Context(), srv, sess, newJSONCodec)
+//	})
+//
+//	func newJSONCodec(conn io.ReadWriteCloser) rpc2.Codec {
+//		return jsonrpc.NewJSONCodec(conn)
+//	}
+//
+// The rpc2 connection runs on the first bidirectional stream of the session.
+package webtransport
+
+import (
+	"context"
+	"io"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// Stream is a bidirectional WebTransport stream.
+type Stream interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// StreamAcceptor is the server side of a session.
+type StreamAcceptor[S Stream] interface {
+	AcceptStream(ctx context.Context) (S, error)
+}
+
+// StreamOpener is the client side of a session.
+type StreamOpener[S Stream] interface {
+	OpenStreamSync(ctx context.Context) (S, error)
+}
+
+// Serve accepts the first bidirectional stream of sess and serves srv on it.
+// It blocks until the stream is closed.
+// If newCodec is nil, the gob codec is used. Browser peers typically need the jsonrpc codec.
+func Serve[S Stream](ctx context.Context, srv *rpc2.Server, sess StreamAcceptor[S], newCodec func(io.ReadWriteCloser) rpc2.Codec) error {
+	stream, err := sess.AcceptStream(ctx)
+	if err != nil {
+		return err
+	}
+	srv.ServeCodec(codec(stream, newCodec))
+	return nil
+}
+
+// NewClient opens a bidirectional stream on sess and returns a new client on it.
+// The caller must call Run on the returned client.
+// If newCodec is nil, the gob codec is used.
+func NewClient[S Stream](ctx context.Context, sess StreamOpener[S], newCodec func(io.ReadWriteCloser) rpc2.Codec) (*rpc2.Client, error) {
+	stream, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rpc2.NewClientWithCodec(codec(stream, newCodec)), nil
+}
+
+func codec(stream io.ReadWriteCloser, newCodec func(io.ReadWriteCloser) rpc2.Codec) rpc2.Codec {
+	if newCodec == nil {
+		return rpc2.NewGobCodec(stream)
+	}
+	return newCodec(stream)
+}
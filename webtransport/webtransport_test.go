@@ -0,0 +1,50 @@
+package webtransport
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+)
+
+// fakeSession hands out one end of a pipe as its only stream.
+type fakeSession struct {
+	stream net.Conn
+}
+
+func (s *fakeSession) AcceptStream(ctx context.Context) (net.Conn, error)   { return s.stream, nil }
+func (s *fakeSession) OpenStreamSync(ctx context.Context) (net.Conn, error) { return s.stream, nil }
+
+func newJSONCodec(conn io.ReadWriteCloser) rpc2.Codec {
+	return jsonrpc.NewJSONCodec(conn)
+}
+
+func TestWebTransport(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	srv := rpc2.NewServer()
+	srv.Handle("echo", func(client *rpc2.Client, s string, reply *string) error {
+		*reply = s
+		return nil
+	})
+	ctx := context.Background()
+	go Serve[net.Conn](ctx, srv, &fakeSession{c1}, newJSONCodec)
+
+	clt, err := NewClient[net.Conn](ctx, &fakeSession{c2}, newJSONCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go clt.Run()
+	defer clt.Close()
+
+	var reply string
+	if err = clt.Call("echo", "hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hello" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+}
@@ -0,0 +1,157 @@
+package rpc2
+
+// writeQueueSize is the number of messages waiting for the writer goroutine
+// before senders block.
+const writeQueueSize = 128
+
+// controlQueueSize is the number of control messages waiting for the writer
+// goroutine before senders block.
+const controlQueueSize = 16
+
+// outgoing is a message waiting to be written by the writer goroutine.
+// Either req or resp is set.
+type outgoing struct {
+	req  *Request
+	resp *Response
+	body interface{}
+	call *Call      // completed with the error if the request can not be written
+	err  chan error // receives the result of the write if not nil
+
+	control bool // written ahead of other queued messages
+}
+
+// isControl returns true if requests of method, and responses to them, are
+// control messages: cancels and built-in methods such as EchoMethod.
+// Control messages are written ahead of queued calls, notifications and
+// responses, so keepalives do not time out while a large backlog is written.
+func isControl(method string) bool {
+	if method == CancelMethod {
+		return true
+	}
+	_, ok := builtins[method]
+	return ok
+}
+
+// write queues msg to be written to the codec by the writer goroutine,
+// which is started on the first write, or by Run if writes are held.
+// All requests and responses go through a single goroutine, so senders
+// do not contend for the codec. Control messages have a separate queue
+// which the writer empties first.
+func (c *Client) write(msg outgoing) error {
+	queue := c.writes
+	if msg.control || msg.req != nil && isControl(msg.req.Method) {
+		queue = c.control
+	}
+	if !c.writesHeld() {
+		c.startWriter()
+	}
+	select {
+	case <-c.disconnect:
+		return ErrShutdown
+	default:
+	}
+	select {
+	case queue <- msg:
+	case <-c.disconnect:
+		return ErrShutdown
+	}
+	if msg.err == nil {
+		return nil
+	}
+	select {
+	case err := <-msg.err:
+		return err
+	case <-c.disconnect:
+		return ErrShutdown
+	}
+}
+
+func (c *Client) startWriter() {
+	c.writerOnce.Do(func() {
+		go c.writeLoop()
+	})
+}
+
+// SetHoldUntilRun makes the client queue calls and notifications made before
+// Run is called and send them in order once Run has started, and for clients
+// created with NewLazyClient, the connection is established. Notify returns
+// nil for queued notifications. Up to 128 messages are queued; later calls
+// block until Run is called. Control messages such as pings are sent before
+// the queued messages. It must be called before making calls.
+func (c *Client) SetHoldUntilRun(enabled bool) {
+	c.holdWrites = enabled
+}
+
+// writesHeld reports whether writes are queued until Run is called.
+func (c *Client) writesHeld() bool {
+	return c.holdWrites && !c.runCalled.Load()
+}
+
+func (c *Client) writeLoop() {
+	for {
+		// Write queued control messages before anything else.
+		select {
+		case msg := <-c.control:
+			c.writeMessage(msg)
+			continue
+		default:
+		}
+		select {
+		case msg := <-c.control:
+			c.writeMessage(msg)
+		case msg := <-c.writes:
+			c.writeMessage(msg)
+		case <-c.disconnect:
+			return
+		}
+	}
+}
+
+func (c *Client) writeMessage(msg outgoing) {
+	if msg.call != nil && msg.call.cancel && c.abandoned(msg.call) {
+		// The cancel may have been written already, the peer would not see it.
+		putRequest(msg.req)
+		return
+	}
+	var err error
+	if msg.req != nil {
+		err = c.codec.WriteRequest(msg.req, msg.body)
+		putRequest(msg.req)
+	} else {
+		err = c.codec.WriteResponse(msg.resp, msg.body)
+		putResponse(msg.resp)
+	}
+	if msg.err != nil {
+		msg.err <- err
+	}
+	if err == nil {
+		return
+	}
+	if msg.call != nil {
+		c.failCall(msg.call, err)
+	} else if msg.err == nil {
+		debugln("rpc2: error writing response:", err.Error())
+	}
+}
+
+// abandoned returns true if call is no longer pending before its request is written.
+func (c *Client) abandoned(call *Call) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pending[call.seq] != call
+}
+
+// failCall completes a pending call with err.
+func (c *Client) failCall(call *Call, err error) {
+	c.mutex.Lock()
+	pending := c.pending[call.seq] == call
+	if pending {
+		delete(c.pending, call.seq)
+	}
+	c.mutex.Unlock()
+	if pending {
+		c.forget(call.seq)
+		call.Error = err
+		call.done()
+	}
+}